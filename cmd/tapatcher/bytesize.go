@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A byteSize is a command line argument for a number of bytes, allowing suffixes like "MiB" or "GB".
+type byteSize int64
+
+var byteSizeSuffixes = []struct {
+	suffix string
+	factor int64
+}{
+	// Longest suffixes first, otherwise "B" would match "KiB".
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"TB", 1000 * 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// UnmarshalText implements (encoding.TextUnmarshaler).UnmarshalText
+func (b *byteSize) UnmarshalText(text []byte) error {
+	str := strings.TrimSpace(string(text))
+	factor := int64(1)
+	for _, s := range byteSizeSuffixes {
+		if strings.HasSuffix(strings.ToUpper(str), strings.ToUpper(s.suffix)) {
+			str = strings.TrimSpace(str[:len(str)-len(s.suffix)])
+			factor = s.factor
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q, expected something like 500MiB", string(text))
+	}
+	*b = byteSize(n * float64(factor))
+	return nil
+}
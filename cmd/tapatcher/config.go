@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"gopkg.in/yaml.v3"
+)
+
+// A configResolver provides flag values from a --config file. Keys are flag names, as on the command line
+// without the dashes ("download-workers"), with underscores ("download_workers") or in camelCase
+// ("downloadWorkers").
+type configResolver struct {
+	values map[string]interface{}
+}
+
+// loadConfig reads a --config file. As JSON is (close enough to) a subset of YAML this handles both.
+func loadConfig(r io.Reader) (kong.Resolver, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("couldn't decode config file: %w", err)
+	}
+	normalized := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		normalized[normalizeConfigKey(key)] = value
+	}
+	return &configResolver{values: normalized}, nil
+}
+
+// normalizeConfigKey turns the different ways of writing a flag name into the name of the flag.
+func normalizeConfigKey(key string) string {
+	var b strings.Builder
+	for i, c := range key {
+		switch {
+		case c == '_':
+			b.WriteRune('-')
+		case c >= 'A' && c <= 'Z':
+			if i > 0 {
+				b.WriteRune('-')
+			}
+			b.WriteRune(c - 'A' + 'a')
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// Validate implements (kong.Resolver).Validate, it rejects keys that aren't flags so typos don't go
+// unnoticed.
+func (r *configResolver) Validate(app *kong.Application) error {
+	flags := make(map[string]struct{})
+	var addFlags func(node *kong.Node)
+	addFlags = func(node *kong.Node) {
+		for _, flag := range node.Flags {
+			flags[flag.Name] = struct{}{}
+		}
+		for _, child := range node.Children {
+			addFlags(child)
+		}
+	}
+	addFlags(app.Node)
+
+	unknown := make([]string, 0)
+	for key := range r.values {
+		if _, found := flags[key]; !found || key == "config" {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("config file contains unknown options: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// Resolve implements (kong.Resolver).Resolve
+func (r *configResolver) Resolve(context *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+	value, found := r.values[flag.Name]
+	if !found {
+		return nil, nil
+	}
+	// Numbers are passed as text, the flag types (e.g. byteSize) parse that like a command line argument.
+	// So are times, YAML turns unquoted ones (e.g. 2024-01-31) into a time.Time.
+	switch v := value.(type) {
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case time.Time:
+		return v.Format(time.RFC3339), nil
+	}
+	return value, nil
+}
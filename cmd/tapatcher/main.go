@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -11,6 +13,8 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/alecthomas/kong"
@@ -21,33 +25,257 @@ import (
 var Version string = "<unknown version>"
 
 type CommonUpdateOpts struct {
-	VerifyWorkers   int    `name:"verify-workers" default:"4" help:"Number of concurrent file verifications."`
-	DownloadWorkers int    `name:"download-workers" default:"4" help:"Number of concurrent patch downloads."`
-	ApplyWorkers    int    `name:"apply-workers" default:"4" help:"Number of concurrent patching processes."`
-	XDeltaPath      string `name:"xdelta" short:"X" default:"xdelta3" help:"Path to xdelta3 binary. If no directory name will also look for this in PATH."`
-
-	DownloadMaxAttempts     int           `name:"download-max-attempts" default:"5" help:"How many times to try to download a file."`
-	DownloadBaseDelay       time.Duration `name:"download-base-delay" default:"1s" help:"How many seconds to wait between download retries at first."`
-	DownloadDelayFactor     float64       `name:"download-delay-factor" default:"1.5" help:"How much to multiply delay between download retries after each retry."`
+	VerifyWorkers   int     `name:"verify-workers" default:"4" help:"Number of concurrent file verifications."`
+	DownloadWorkers int     `name:"download-workers" default:"4" help:"Number of concurrent patch downloads."`
+	ApplyWorkers    int     `name:"apply-workers" default:"4" help:"Number of concurrent patching processes."`
+	XDeltaPath      string  `name:"xdelta" short:"X" default:"xdelta3" help:"Path to xdelta3 binary. If no directory name will also look for this in PATH."`
+	XDeltaImpl      string  `name:"xdelta-impl" enum:"binary,go" default:"binary" help:"Apply xdelta patches with the xdelta binary or the built-in decoder (go), which falls back to the binary for unsupported patches."`
+	XDeltaMemory    string  `name:"xdelta-memory" enum:"default,low,minimal" default:"default" help:"Memory the xdelta binary may use to cache the old file when applying delta patches: default (512MiB), low (64MiB) or minimal (16MiB) per patch. Less is slower for large files."`
+	PatchTool       string  `name:"patch-tool" enum:"xdelta,bsdiff" default:"xdelta" help:"Which tool to apply patches with (xdelta or bsdiff)."`
+	BsPatchPath     string  `name:"bspatch" default:"bspatch" help:"Path to bspatch binary, used with --patch-tool bsdiff. If no directory name will also look for this in PATH."`
+	VerifyPatches   bool    `name:"verify-patches" help:"Verify checksums of patch files left over from a previous run before applying them."`
+	VerifyAfterMove bool    `name:"verify-after-move" help:"Compute the checksum of every patched file again after moving it into place, to catch corruption by faulty hardware. Slow."`
+	VerifyAfter     bool    `name:"verify-after" help:"Compute the checksum of every game file again after the update, ignoring the manifest, and fail if any doesn't match the instructions. Slow."`
+	Repair          bool    `name:"repair" help:"Compute the checksum of every game file instead of trusting the manifest, for when files may have been changed while keeping their last change time. Slow."`
+	StreamFull      bool    `name:"stream-full-patches" help:"Apply full patches while downloading them instead of storing them first. Saves disk I/O, but interrupted downloads start over."`
+	KeepTemp        bool    `name:"keep-temp" help:"Keep partial output of failed patch applications, for debugging."`
+	AtomicApply     bool    `name:"atomic-apply" help:"Keep the files replaced during the apply phase until it's done, so if it fails partway they're restored instead of leaving a partly updated game. Needs extra disk space."`
+	Sequential      bool    `name:"sequential-phases" help:"Wait for the verify phase to finish before downloading, instead of downloading patches as soon as they're known to be needed. For debugging."`
+	KeepPatches     bool    `name:"keep-patches" help:"Keep the directory with downloaded patches after a successful update."`
+	SharedInstall   bool    `name:"shared-install-dir" help:"Allow other products to be installed in the same directory (e.g. a mod pack on top of a game)."`
+	NoCreate        bool    `name:"no-create" help:"Fail if the install dir doesn't exist instead of creating it."`
+	PathCase        string  `name:"path-case" enum:"auto,sensitive,insensitive" default:"auto" help:"Whether paths differing only in case are the same file (auto detects this from the filesystem)."`
+	ManifestFormat  string  `name:"manifest-format" enum:"json,bolt" default:"json" help:"How to store the manifest (json, or bolt for a database that's faster for installs with a huge number of files)."`
+	IgnoreManifest  bool    `name:"ignore-manifest-version" help:"Use a manifest written by a newer version of the patcher anyway, at your own risk."`
+	BaseDir         string  `name:"base-dir" help:"Directory to resolve a relative install-dir against, instead of the current directory."`
+	MaxScanRatio    float64 `name:"max-scan-ratio" default:"20" help:"Warn if the install dir contains this many times more files than the game, 0 to disable."`
+	ManyFilesAction string  `name:"many-files-action" enum:"warn,confirm,abort" default:"confirm" help:"What to do when --max-scan-ratio is exceeded (confirm asks if interactive with plain progress, otherwise warns)."`
+	MaxDeleteRatio  float64 `name:"max-delete-ratio" default:"0.5" help:"Refuse to update if the instructions would delete more than this fraction of the game files in the install dir (a sign of broken or malicious instructions), 0 to disable."`
+	AllowMassDelete bool    `name:"allow-mass-delete" help:"Update anyway when --max-delete-ratio is exceeded."`
+	DryRun          bool    `name:"dry-run" help:"Only verify the install dir and show what would be downloaded, patched and deleted, without changing anything but the manifest."`
+	Proxy           string  `name:"proxy" help:"URL of the proxy to send requests through (e.g. http://proxy:3128), by default HTTP_PROXY and HTTPS_PROXY are used."`
+	SkipScanErrors  bool    `name:"skip-scan-errors" help:"Skip files and directories in the install dir that can't be read (e.g. protected by the OS) instead of failing."`
+	SkipSpaceCheck  bool    `name:"skip-space-check" help:"Don't check whether there's enough free disk space for the update before downloading."`
+
+	ApplyTimeout            time.Duration `name:"apply-timeout" default:"0s" help:"How long to allow applying a single patch before failing it, 0 for no limit."`
+	ParallelHashThreshold   byteSize      `name:"parallel-hash-threshold" default:"0" help:"Experimental: hash files at least this large (e.g. 4GiB) in parallel regions to quickly recognize unchanged files, 0 to disable."`
+	ChangedSince            timestamp     `name:"changed-since" help:"Only verify files changed after this time (e.g. 2024-01-31 18:00), trusting the manifest for older files."`
+	MaxHashMemory           byteSize      `name:"max-hash-memory" default:"256MiB" help:"Maximum memory for the buffers of concurrent checksum computations (see --copy-buffer-size), 0 for no limit."`
+	CopyBufferSize          byteSize      `name:"copy-buffer-size" default:"1MiB" help:"Size of the buffers for computing checksums and writing files, larger can help on hard disks and network shares."`
+	XDeltaSourceWindow      byteSize      `name:"xdelta-source-window" default:"0" help:"Size of the xdelta binary's source window (e.g. 32MiB, at least 1MiB) instead of the --xdelta-memory preset, 0 to use the preset."`
 	DownloadSpeedWindow     int           `name:"download-speed-window" default:"5" help:"How many seconds to average download speed over."`
 	DownloadRequestTimemout time.Duration `name:"download-request-timeout" default:"30s" help:"How many seconds to allow before receiving the start of a download response."`
 	DownloadStallTimeout    time.Duration `name:"download-stall-timeout" default:"30s" help:"How many seconds to allow between receiving any data in a download."`
+	MinDownloadSpeed        byteSize      `name:"min-download-speed" default:"0" help:"Treat a download that's slower than this per second (e.g. 10KiB) over the stall timeout as stalled, 0 to disable."`
+	DownloadConnections     int           `name:"download-connections" default:"1" help:"How many connections to use per downloaded file (for large files on servers that throttle each connection)."`
+	DownloadChunkSize       byteSize      `name:"download-chunk-size" default:"0" help:"With --download-connections, split files into ranges of this size (at least 1MiB) the connections take turns fetching, 0 for one range per connection."`
+	RampUp                  bool          `name:"ramp-up" help:"Start with a few download workers and add one every --ramp-up-interval until --download-workers, to go easy on mirrors and slow links."`
+	RampUpInterval          time.Duration `name:"ramp-up-interval" default:"1s" help:"How long to wait before adding another download worker with --ramp-up."`
+	OpenEndedRanges         bool          `name:"open-ended-ranges" help:"Resume downloads with open-ended ranges (bytes=<offset>-), some caching proxies handle those better."`
+	QuarantineBad           bool          `name:"quarantine-bad" help:"Keep downloads with a checksum mismatch in patch/quarantine for inspection, instead of only discarding them."`
+	Header                  []string      `name:"header" sep:"none" help:"Extra HTTP header to send to the mirrors and when fetching metadata, as 'Name: value' (e.g. 'Authorization: Bearer <token>'). Can be repeated."`
+	MaxDownloadSize         byteSize      `name:"max-download-size" default:"0" help:"Refuse to download patch files larger than this (e.g. 20GiB), 0 for no limit."`
+	MaxTotalDownloadSize    byteSize      `name:"max-total-download-size" default:"0" help:"Refuse to download more than this in total (e.g. 100GiB), 0 for no limit."`
+	MaxDownloadRate         byteSize      `name:"max-download-rate" default:"0" help:"Maximum combined download speed per second (e.g. 10MiB), 0 for no limit."`
+	RateDaytime             byteSize      `name:"rate-daytime" default:"0" help:"Maximum combined download speed per second during the day, 0 to use --max-download-rate."`
+	RateNighttime           byteSize      `name:"rate-nighttime" default:"0" help:"Maximum combined download speed per second during the night, 0 to use --max-download-rate."`
+	DaytimeStart            int           `name:"daytime-start" default:"8" help:"Hour (0-23, local time) the day starts for --rate-daytime and --rate-nighttime."`
+	DaytimeEnd              int           `name:"daytime-end" default:"18" help:"Hour (0-23, local time) the day ends for --rate-daytime and --rate-nighttime."`
+
+	RetryMaxAttempts    int            `name:"retry-max-attempts" default:"5" help:"How many times to retry a failed download (or metadata fetch, with --retry-all)."`
+	RetryBaseDelay      time.Duration  `name:"retry-base-delay" default:"1s" help:"How long to wait before the first retry."`
+	RetryDelayFactor    float64        `name:"retry-delay-factor" default:"1.5" help:"How much to multiply the delay between retries by after each retry."`
+	RetryJitter         float64        `name:"retry-jitter" default:"0" help:"Randomly make each delay between retries up to this fraction (e.g. 0.2) longer or shorter, so patchers that failed together don't retry together."`
+	RetryAll            bool           `name:"retry-all" help:"Also retry failed fetches of products.json, release.json and instructions.json, not just downloads."`
+	LockedFileRetries   int            `name:"locked-file-retries" default:"3" help:"How many times to retry using a file that another process (e.g. antivirus) briefly has locked (Windows only)."`
+	DownloadMaxAttempts *int           `name:"download-max-attempts" help:"How many times to retry a failed download, overrides --retry-max-attempts."`
+	DownloadBaseDelay   *time.Duration `name:"download-base-delay" help:"How long to wait before the first download retry, overrides --retry-base-delay."`
+	DownloadDelayFactor *float64       `name:"download-delay-factor" help:"How much to multiply the delay between download retries by after each retry, overrides --retry-delay-factor."`
 
 	ProgressInterval int    `name:"progress-interval" default:"1" help:"How often to report progress."`
 	ProgressMode     string `name:"progress-mode" enum:"plain,fancy,json" default:"fancy" help:"How to report progress (plain, fancy or json)."`
+	StatusAddr       string `name:"status-addr" help:"Serve the progress as JSON at /status on this address (e.g. :8080, which only listens on localhost; 0.0.0.0:8080 listens on all interfaces). POST to /throttle, /pause or /resume from localhost to throttle or pause."`
+
+	CheckPatcherUpdate bool   `name:"check-patcher-update" help:"Check whether a newer version of the patcher is available."`
+	PatcherUpdateUrl   string `name:"patcher-update-url" default:"${patcherUpdateUrl}" help:"Where to check for a newer version of the patcher."`
+
+	Config kong.ConfigFlag `name:"config" help:"Read options from a JSON or YAML file, options on the command line take precedence."`
 
 	Verbose       bool   `name:"verbose" short:"v" help:"Use verbose logging."`
+	RunID         string `name:"run-id" help:"Identifier to prefix verbose log messages with, to correlate them with logs of a launcher."`
 	OmitTimestamp bool   `name:"omit-timestamp" help:"Disable timestamps in logs."`
 	LogFile       string `name:"log-file" short:"L" type:"path" help:"Where to store logs. Particularly useful with fancy progress mode as that hides logs, use '-' for stderr."`
 }
 
+// Validate is called by kong after parsing, it rejects worker counts that would make the patcher hang and
+// progress intervals that would make it crash.
+func (o CommonUpdateOpts) Validate() error {
+	workers := []struct {
+		flag  string
+		value int
+	}{
+		{"--verify-workers", o.VerifyWorkers},
+		{"--download-workers", o.DownloadWorkers},
+		{"--apply-workers", o.ApplyWorkers},
+	}
+	for _, w := range workers {
+		if w.value < 1 {
+			return fmt.Errorf("%s must be at least 1, got %d", w.flag, w.value)
+		}
+	}
+	if o.RetryMaxAttempts < 0 || (o.DownloadMaxAttempts != nil && *o.DownloadMaxAttempts < 0) {
+		return fmt.Errorf("--retry-max-attempts and --download-max-attempts can't be negative")
+	}
+	if o.LockedFileRetries < 0 {
+		return fmt.Errorf("--locked-file-retries can't be negative, got %d", o.LockedFileRetries)
+	}
+	if o.MaxDeleteRatio < 0 || o.MaxDeleteRatio > 1 {
+		return fmt.Errorf("--max-delete-ratio must be between 0 and 1, got %g", o.MaxDeleteRatio)
+	}
+	if o.RetryJitter < 0 || o.RetryJitter > 1 {
+		return fmt.Errorf("--retry-jitter must be between 0 and 1, got %g", o.RetryJitter)
+	}
+	if o.Repair && !time.Time(o.ChangedSince).IsZero() {
+		return fmt.Errorf("--repair and --changed-since can't be used together")
+	}
+	if o.RampUp && o.RampUpInterval <= 0 {
+		return fmt.Errorf("--ramp-up-interval must be positive with --ramp-up, got %s", o.RampUpInterval)
+	}
+	if o.ProgressInterval < 1 {
+		return fmt.Errorf("--progress-interval must be at least 1, got %d", o.ProgressInterval)
+	}
+	if o.XDeltaSourceWindow != 0 && o.XDeltaSourceWindow < 1024*1024 {
+		return fmt.Errorf("--xdelta-source-window must be 0 or at least 1MiB, got %d bytes", o.XDeltaSourceWindow)
+	}
+	if _, err := parseProxy(o.Proxy); err != nil {
+		return err
+	}
+	if _, err := parseHeaders(o.Header); err != nil {
+		return err
+	}
+	if o.StatusAddr != "" {
+		if _, err := statusListenAddr(o.StatusAddr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseProxy parses the --proxy flag, returning nil if it's empty.
+func parseProxy(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	proxyUrl, err := url.Parse(proxy)
+	if err != nil || proxyUrl.Scheme == "" || proxyUrl.Host == "" {
+		return nil, fmt.Errorf("--proxy must be a URL like http://proxy:3128, got '%s'", proxy)
+	}
+	return proxyUrl, nil
+}
+
+// withProxy makes requests for metadata made with the context go through the --proxy, if set.
+func withProxy(ctx context.Context, commonOpts *CommonUpdateOpts) context.Context {
+	// Validated already.
+	proxyUrl, _ := parseProxy(commonOpts.Proxy)
+	return patcher.WithHTTPClient(ctx, patcher.NewHTTPClient(proxyUrl))
+}
+
+// parseHeaders parses the --header flags, returning nil if there are none.
+func parseHeaders(headers []string) (map[string]string, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	parsed := make(map[string]string, len(headers))
+	for _, header := range headers {
+		name, value, found := strings.Cut(header, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("--header must look like 'Name: value', got '%s'", redactHeader(header))
+		}
+		parsed[name] = strings.TrimSpace(value)
+	}
+	return parsed, nil
+}
+
+// redactHeader hides the value of a --header, which is likely a secret, for messages.
+func redactHeader(header string) string {
+	if name, _, found := strings.Cut(header, ":"); found {
+		return name + ": <redacted>"
+	}
+	return "<redacted>"
+}
+
+// withHeaders makes requests for metadata made with the context include the --header flags. Not used for
+// checking for patcher updates, the headers are meant for the mirrors.
+func withHeaders(ctx context.Context, commonOpts *CommonUpdateOpts) context.Context {
+	// Validated already.
+	headers, _ := parseHeaders(commonOpts.Header)
+	if headers == nil {
+		return ctx
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	patcher.LogVerbose(ctx, "Sending extra headers (values redacted): %s.", strings.Join(names, ", "))
+	return patcher.WithRequestHeaders(ctx, headers)
+}
+
+// retryPolicy returns the retry policy of the --retry-* flags.
+func retryPolicy(commonOpts *CommonUpdateOpts) patcher.RetryPolicy {
+	return patcher.RetryPolicy{
+		MaxAttempts: commonOpts.RetryMaxAttempts,
+		BaseDelay:   commonOpts.RetryBaseDelay,
+		DelayFactor: commonOpts.RetryDelayFactor,
+		Jitter:      commonOpts.RetryJitter,
+	}
+}
+
+// downloadRetryPolicy returns the retry policy for downloads: the --retry-* flags, overridden by the
+// --download-* flags that are set.
+func downloadRetryPolicy(commonOpts *CommonUpdateOpts) patcher.RetryPolicy {
+	policy := retryPolicy(commonOpts)
+	if commonOpts.DownloadMaxAttempts != nil {
+		policy.MaxAttempts = *commonOpts.DownloadMaxAttempts
+	}
+	if commonOpts.DownloadBaseDelay != nil {
+		policy.BaseDelay = *commonOpts.DownloadBaseDelay
+	}
+	if commonOpts.DownloadDelayFactor != nil {
+		policy.DelayFactor = *commonOpts.DownloadDelayFactor
+	}
+	return policy
+}
+
+// withRetries makes failed requests for metadata made with the context be retried, if --retry-all is set.
+func withRetries(ctx context.Context, commonOpts *CommonUpdateOpts) context.Context {
+	if !commonOpts.RetryAll {
+		return ctx
+	}
+	return patcher.WithRetryPolicy(ctx, retryPolicy(commonOpts))
+}
+
+// Values of --path-case.
+var pathCaseModes = map[string]patcher.PathCaseMode{
+	"auto":        patcher.PathCaseAuto,
+	"sensitive":   patcher.PathCaseSensitive,
+	"insensitive": patcher.PathCaseInsensitive,
+}
+
 var CLI struct {
 	Update struct {
-		Product    string `arg:"" name:"product" help:"Code of the game."`
-		InstallDir string `arg:"" name:"install-dir" help:"Directory where the game should be."`
+		Product    string   `arg:"" name:"product" help:"Code of the game."`
+		InstallDir string   `arg:"" name:"install-dir" help:"Directory where the game should be."`
+		More       []string `arg:"" optional:"" name:"more" help:"More product and install-dir pairs, updated one after the other with the same options."`
 
 		ProductsUrl string `name:"products-url" short:"U" default:"https://launcher.totemarts.services/products.json" help:"Location of the products.json file."`
 
+		CacheMetadata    bool   `name:"cache-metadata" help:"Cache products.json, release.json and instructions.json and only download them again if they changed."`
+		MetadataCacheDir string `name:"metadata-cache-dir" type:"path" help:"Where to cache metadata with --cache-metadata (default: tapatcher directory in the user cache dir)."`
+
+		StopOnError bool `name:"stop-on-error" help:"When updating several games, stop at the first game that fails instead of continuing with the others."`
+
 		CommonUpdateOpts
 	} `cmd:"" help:"Install or update a game."`
 	UpdateFromInstructions struct {
@@ -59,15 +287,103 @@ var CLI struct {
 
 		CommonUpdateOpts
 	} `cmd:"" help:"Install or update a game using an already downloaded instructions.json file."`
+	SelfCheck struct {
+		InstallDir string `arg:"" name:"install-dir" help:"Directory where the game is installed."`
+
+		VerifyWorkers int    `name:"verify-workers" default:"4" help:"Number of concurrent file verifications."`
+		BaseDir       string `name:"base-dir" help:"Directory to resolve a relative install-dir against, instead of the current directory."`
+		WarnOnly      bool   `name:"warn-only" help:"Only report files that don't match or can't be read, exit with 0 anyway."`
+
+		Verbose       bool   `name:"verbose" short:"v" help:"Use verbose logging."`
+		OmitTimestamp bool   `name:"omit-timestamp" help:"Disable timestamps in logs."`
+		LogFile       string `name:"log-file" short:"L" type:"path" help:"Where to store logs, use '-' for stderr."`
+	} `cmd:"" help:"Check installed files against the checksums in the manifest, without using the network."`
+	Verify struct {
+		Product    string `arg:"" name:"product" help:"Code of the game."`
+		InstallDir string `arg:"" name:"install-dir" help:"Directory where the game is installed."`
+
+		ProductsUrl    string   `name:"products-url" short:"U" default:"https://launcher.totemarts.services/products.json" help:"Location of the products.json file."`
+		Instructions   string   `name:"instructions" short:"I" type:"existingfile" help:"Path of an already downloaded instructions.json file to check against, use '-' for reading from stdin."`
+		VerifyWorkers  int      `name:"verify-workers" default:"4" help:"Number of concurrent file verifications."`
+		IgnoreManifest bool     `name:"ignore-manifest" help:"Compute the checksums of all files, instead of trusting the manifest for files that didn't change."`
+		BaseDir        string   `name:"base-dir" help:"Directory to resolve a relative install-dir against, instead of the current directory."`
+		ProgressMode   string   `name:"progress-mode" enum:"plain,json" default:"plain" help:"How to write the report (plain, or json for a single JSON object)."`
+		Header         []string `name:"header" sep:"none" help:"Extra HTTP header to send when fetching metadata, as 'Name: value'. Can be repeated."`
+		Proxy          string   `name:"proxy" help:"URL of the proxy to send requests through (e.g. http://proxy:3128), by default HTTP_PROXY and HTTPS_PROXY are used."`
+
+		Verbose       bool   `name:"verbose" short:"v" help:"Use verbose logging."`
+		OmitTimestamp bool   `name:"omit-timestamp" help:"Disable timestamps in logs."`
+		LogFile       string `name:"log-file" short:"L" type:"path" help:"Where to store logs, use '-' for stderr."`
+	} `cmd:"" help:"Check which files of a game are up to date, without downloading or changing anything."`
+	VerifyPatches struct {
+		InstallDir string `arg:"" name:"install-dir" help:"Directory where the game is installed."`
+
+		Instructions  string `name:"instructions" short:"I" default:"-" type:"existingfile" help:"Path of the instructions.json file the patches were downloaded for, use '-' for reading from stdin."`
+		VerifyWorkers int    `name:"verify-workers" default:"4" help:"Number of concurrent patch file verifications."`
+		BaseDir       string `name:"base-dir" help:"Directory to resolve a relative install-dir against, instead of the current directory."`
+
+		Verbose       bool   `name:"verbose" short:"v" help:"Use verbose logging."`
+		OmitTimestamp bool   `name:"omit-timestamp" help:"Disable timestamps in logs."`
+		LogFile       string `name:"log-file" short:"L" type:"path" help:"Where to store logs, use '-' for stderr."`
+	} `cmd:"" help:"Check patch files staged in the install dir against instructions.json, before applying them."`
+	Warm struct {
+		Product string `arg:"" name:"product" help:"Code of the game."`
+
+		ProductsUrl    string        `name:"products-url" short:"U" default:"https://launcher.totemarts.services/products.json" help:"Location of the products.json file."`
+		InstallDir     string        `name:"install-dir" type:"path" help:"Warm the patches needed to update the game in this directory, instead of those for a fresh install."`
+		VerifyWorkers  int           `name:"verify-workers" default:"4" help:"Number of concurrent file verifications, with --install-dir."`
+		WarmWorkers    int           `name:"warm-workers" default:"8" help:"Number of concurrent requests."`
+		Method         string        `name:"method" enum:"head,range" default:"head" help:"Send HEAD requests (head) or GET requests for the first byte (range), for caches that don't fetch files on HEAD."`
+		RequestTimeout time.Duration `name:"request-timeout" default:"30s" help:"How long to wait for a response to a single request."`
+		Header         []string      `name:"header" sep:"none" help:"Extra HTTP header to send to the mirrors and when fetching metadata, as 'Name: value' (e.g. 'Authorization: Bearer <token>'). Can be repeated."`
+		Proxy          string        `name:"proxy" help:"URL of the proxy to send requests through (e.g. http://proxy:3128), by default HTTP_PROXY and HTTPS_PROXY are used."`
+		CheckRemote    bool          `name:"check-remote" help:"Report the status of every patch file, failing if any is missing or has the wrong size."`
+
+		Verbose       bool   `name:"verbose" short:"v" help:"Use verbose logging."`
+		OmitTimestamp bool   `name:"omit-timestamp" help:"Disable timestamps in logs."`
+		LogFile       string `name:"log-file" short:"L" type:"path" help:"Where to store logs, use '-' for stderr."`
+	} `cmd:"" help:"Request every patch file of the latest version without downloading it, to fill caches (e.g. a CDN)."`
+	Benchmark struct {
+		InstallDir string `arg:"" name:"install-dir" help:"Directory where the game is installed."`
+
+		Workers    []int    `name:"workers" default:"1,2,4,8,16" help:"Worker counts to measure, comma separated."`
+		SampleSize byteSize `name:"sample-size" default:"1GiB" help:"How much data to hash per worker count, larger gives more reliable results."`
+		BaseDir    string   `name:"base-dir" help:"Directory to resolve a relative install-dir against, instead of the current directory."`
+
+		Verbose       bool   `name:"verbose" short:"v" help:"Use verbose logging."`
+		OmitTimestamp bool   `name:"omit-timestamp" help:"Disable timestamps in logs."`
+		LogFile       string `name:"log-file" short:"L" type:"path" help:"Where to store logs, use '-' for stderr."`
+	} `cmd:"" help:"Diagnostic: measure checksum speed of an install with several worker counts, to pick --verify-workers."`
+	ManifestExport struct {
+		InstallDir string `arg:"" name:"install-dir" help:"Directory where the game is installed."`
+
+		Format  string `name:"format" enum:"sha256sum,json" default:"sha256sum" help:"Output format (sha256sum for a list that works with 'sha256sum -c', or json)."`
+		Product string `name:"product" help:"Only export the files of this game, by default all games in the manifest are exported."`
+		BaseDir string `name:"base-dir" help:"Directory to resolve a relative install-dir against, instead of the current directory."`
+	} `cmd:"" help:"Print the checksums in the manifest, e.g. to compare installs or check one with standard tools."`
+	ManifestImport struct {
+		InstallDir string `arg:"" name:"install-dir" help:"Directory where the game is installed."`
+		List       string `arg:"" name:"list" type:"path" help:"Checksum list of a known-good install of the same version, use '-' for reading from stdin."`
+
+		Product        string `name:"product" required:"" help:"Code of the game the files belong to."`
+		Format         string `name:"format" enum:"sha256sum,json" default:"sha256sum" help:"Format of the list (as written by manifest-export)."`
+		SharedInstall  bool   `name:"shared-install-dir" help:"Allow other products to be installed in the same directory (e.g. a mod pack on top of a game)."`
+		ManifestFormat string `name:"manifest-format" enum:"json,bolt" default:"json" help:"How to store the manifest (json, or bolt for a database that's faster for installs with a huge number of files)."`
+		BaseDir        string `name:"base-dir" help:"Directory to resolve a relative install-dir against, instead of the current directory."`
+	} `cmd:"" help:"Add the files in a trusted checksum list to the manifest without computing their checksums, to speed up the first update."`
 	About struct {
 	} `cmd:"" help:"Show license info."`
 	Version struct {
 	} `cmd:"" help:"Show version of patcher."`
 }
 
+// An updateTarget is a game to update with the update command.
+type updateTarget struct {
+	product    string
+	installDir string
+}
+
 func update() {
-	product := CLI.Update.Product
-	installDir := CLI.Update.InstallDir
 	productsUrlStr := CLI.Update.ProductsUrl
 
 	// Yes, this looks silly. It's the least ugly approach I've found for sharing arguments between
@@ -77,35 +393,196 @@ func update() {
 		DownloadWorkers: CLI.Update.DownloadWorkers,
 		ApplyWorkers:    CLI.Update.ApplyWorkers,
 		XDeltaPath:      CLI.Update.XDeltaPath,
+		XDeltaImpl:      CLI.Update.XDeltaImpl,
+		XDeltaMemory:    CLI.Update.XDeltaMemory,
+		PatchTool:       CLI.Update.PatchTool,
+		BsPatchPath:     CLI.Update.BsPatchPath,
+		VerifyPatches:   CLI.Update.VerifyPatches,
+		VerifyAfterMove: CLI.Update.VerifyAfterMove,
+		VerifyAfter:     CLI.Update.VerifyAfter,
+		Repair:          CLI.Update.Repair,
+		StreamFull:      CLI.Update.StreamFull,
+		KeepTemp:        CLI.Update.KeepTemp,
+		KeepPatches:     CLI.Update.KeepPatches,
+		AtomicApply:     CLI.Update.AtomicApply,
+		Sequential:      CLI.Update.Sequential,
+		ApplyTimeout:    CLI.Update.ApplyTimeout,
+		SharedInstall:   CLI.Update.SharedInstall,
+		NoCreate:        CLI.Update.NoCreate,
+		PathCase:        CLI.Update.PathCase,
+		ManifestFormat:  CLI.Update.ManifestFormat,
+		IgnoreManifest:  CLI.Update.IgnoreManifest,
+		BaseDir:         CLI.Update.BaseDir,
+		MaxScanRatio:    CLI.Update.MaxScanRatio,
+		ManyFilesAction: CLI.Update.ManyFilesAction,
+		MaxDeleteRatio:  CLI.Update.MaxDeleteRatio,
+		AllowMassDelete: CLI.Update.AllowMassDelete,
+		DryRun:          CLI.Update.DryRun,
+		Proxy:           CLI.Update.Proxy,
+		SkipScanErrors:  CLI.Update.SkipScanErrors,
+		SkipSpaceCheck:  CLI.Update.SkipSpaceCheck,
 
-		DownloadMaxAttempts:     CLI.Update.DownloadMaxAttempts,
-		DownloadBaseDelay:       CLI.Update.DownloadBaseDelay,
-		DownloadDelayFactor:     CLI.Update.DownloadDelayFactor,
+		ParallelHashThreshold:   CLI.Update.ParallelHashThreshold,
+		ChangedSince:            CLI.Update.ChangedSince,
+		MaxHashMemory:           CLI.Update.MaxHashMemory,
+		CopyBufferSize:          CLI.Update.CopyBufferSize,
+		XDeltaSourceWindow:      CLI.Update.XDeltaSourceWindow,
 		DownloadSpeedWindow:     CLI.Update.DownloadSpeedWindow,
 		DownloadRequestTimemout: CLI.Update.DownloadRequestTimemout,
 		DownloadStallTimeout:    CLI.Update.DownloadStallTimeout,
+		MinDownloadSpeed:        CLI.Update.MinDownloadSpeed,
+		DownloadConnections:     CLI.Update.DownloadConnections,
+		DownloadChunkSize:       CLI.Update.DownloadChunkSize,
+		RampUp:                  CLI.Update.RampUp,
+		RampUpInterval:          CLI.Update.RampUpInterval,
+		OpenEndedRanges:         CLI.Update.OpenEndedRanges,
+		QuarantineBad:           CLI.Update.QuarantineBad,
+		Header:                  CLI.Update.Header,
+		MaxDownloadSize:         CLI.Update.MaxDownloadSize,
+		MaxTotalDownloadSize:    CLI.Update.MaxTotalDownloadSize,
+		MaxDownloadRate:         CLI.Update.MaxDownloadRate,
+		RateDaytime:             CLI.Update.RateDaytime,
+		RateNighttime:           CLI.Update.RateNighttime,
+		DaytimeStart:            CLI.Update.DaytimeStart,
+		DaytimeEnd:              CLI.Update.DaytimeEnd,
+
+		RetryMaxAttempts:    CLI.Update.RetryMaxAttempts,
+		RetryBaseDelay:      CLI.Update.RetryBaseDelay,
+		RetryDelayFactor:    CLI.Update.RetryDelayFactor,
+		RetryJitter:         CLI.Update.RetryJitter,
+		RetryAll:            CLI.Update.RetryAll,
+		LockedFileRetries:   CLI.Update.LockedFileRetries,
+		DownloadMaxAttempts: CLI.Update.DownloadMaxAttempts,
+		DownloadBaseDelay:   CLI.Update.DownloadBaseDelay,
+		DownloadDelayFactor: CLI.Update.DownloadDelayFactor,
 
 		ProgressInterval: CLI.Update.ProgressInterval,
 		ProgressMode:     CLI.Update.ProgressMode,
+		StatusAddr:       CLI.Update.StatusAddr,
+
+		CheckPatcherUpdate: CLI.Update.CheckPatcherUpdate,
+		PatcherUpdateUrl:   CLI.Update.PatcherUpdateUrl,
 
 		Verbose:       CLI.Update.Verbose,
+		RunID:         CLI.Update.RunID,
 		OmitTimestamp: CLI.Update.OmitTimestamp,
 		LogFile:       CLI.Update.LogFile,
 	}
 
 	setupLogging(&commonOpts)
 
+	targets := []updateTarget{{CLI.Update.Product, CLI.Update.InstallDir}}
+	if len(CLI.Update.More)%2 != 0 {
+		fatal(&commonOpts, "Expected product and install-dir pairs",
+			fmt.Errorf("product '%s' has no install-dir", CLI.Update.More[len(CLI.Update.More)-1]))
+	}
+	for i := 0; i < len(CLI.Update.More); i += 2 {
+		targets = append(targets, updateTarget{CLI.Update.More[i], CLI.Update.More[i+1]})
+	}
+
 	productsUrl, err := url.Parse(productsUrlStr)
 	if err != nil {
-		log.Fatalf("products-url is not a valid URL: %s", err)
+		fatal(&commonOpts, "products-url is not a valid URL", err)
+	}
+
+	var cache *patcher.MetadataCache
+	if CLI.Update.CacheMetadata {
+		cacheDir := CLI.Update.MetadataCacheDir
+		if cacheDir == "" {
+			userCacheDir, err := os.UserCacheDir()
+			if err != nil {
+				fatal(&commonOpts, "Couldn't determine metadata cache dir, use --metadata-cache-dir", err)
+			}
+			cacheDir = filepath.Join(userCacheDir, "tapatcher")
+		}
+		cache = patcher.NewMetadataCache(cacheDir)
+	}
+
+	if commonOpts.CheckPatcherUpdate {
+		checkPatcherUpdate(&commonOpts)
+	}
+	// Shared by all games, so e.g. the xdelta binary is only looked up once.
+	backend := makePatchBackend(&commonOpts)
+
+	if len(targets) == 1 {
+		what, err := updateGame(&commonOpts, productsUrl, cache, backend, targets[0])
+		if err != nil && !errors.Is(err, context.Canceled) {
+			fatal(&commonOpts, what, err)
+		}
+		return
+	}
+
+	failed := make([]string, 0)
+	for i, target := range targets {
+		log.Printf("Updating game %d of %d: '%s' in '%s'.", i+1, len(targets), target.product, target.installDir)
+		what, err := updateGame(&commonOpts, productsUrl, cache, backend, target)
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		if err != nil {
+			reportGameFailure(&commonOpts, target, what, err)
+			failed = append(failed, target.product)
+			if CLI.Update.StopOnError {
+				break
+			}
+		}
+	}
+	if len(failed) > 0 {
+		if commonOpts.ProgressMode != "json" {
+			fmt.Printf("Updating %d of %d games failed: %s\n", len(failed), len(targets), strings.Join(failed, ", "))
+		}
+		os.Exit(1)
+	}
+	if commonOpts.ProgressMode != "json" {
+		fmt.Printf("Updated all %d games.\n", len(targets))
 	}
+}
 
-	resolved, err := patcher.ResolveInstructions(productsUrl, product)
+// updateGame resolves the instructions for a game and updates it. Returns what failed along with the error.
+func updateGame(
+	commonOpts *CommonUpdateOpts,
+	productsUrl *url.URL,
+	cache *patcher.MetadataCache,
+	backend patcher.PatchBackend,
+	target updateTarget,
+) (string, error) {
+	// Interrupting is handled by doUpdate once patching starts.
+	ctx := patcher.SetVerbose(withProxy(context.Background(), commonOpts), commonOpts.Verbose)
+	ctx = patcher.WithMetadataCache(withRetries(withHeaders(ctx, commonOpts), commonOpts), cache)
+	ctx, stopNotify := signal.NotifyContext(ctx, os.Interrupt)
+	resolved, err := patcher.ResolveInstructionsContext(ctx, productsUrl, target.product,
+		func(step patcher.ResolveStep) {
+			log.Printf("Resolving instructions: %s.", step)
+		})
+	stopNotify()
 	if err != nil {
-		log.Fatalf("failed to resolve instructions.json: %s", err)
+		return "failed to resolve instructions.json", err
 	}
 
-	doUpdate(&commonOpts, product, installDir, resolved.BaseUrl, resolved.Instructions, &resolved.VersionName)
+	err = doUpdate(commonOpts, target.product, target.installDir, resolved.BaseUrl, resolved.FallbackBaseUrls,
+		resolved.Instructions, &resolved.VersionName, backend)
+	return "Patcher process failed", err
+}
+
+// reportGameFailure reports that updating one of several games failed, like fatal but without exiting.
+func reportGameFailure(commonOpts *CommonUpdateOpts, target updateTarget, what string, err error) {
+	if commonOpts.ProgressMode == "json" {
+		jerr := jsonError{Error: fmt.Sprintf("%s: %s", what, err), Product: target.product}
+		var phaseErr *patcher.PhaseError
+		if errors.As(err, &phaseErr) {
+			jerr.Phase = phaseErr.Phase.String()
+		}
+		var fileErr *patcher.FileError
+		if errors.As(err, &fileErr) {
+			jerr.File = fileErr.Path
+		}
+		if data, err := json.Marshal(jerr); err == nil {
+			fmt.Printf("%s\n", data)
+		}
+	} else {
+		fmt.Printf("FAILED %s (%s): %s: %s\n", target.product, target.installDir, what, err)
+	}
+	log.Printf("Updating '%s' failed: %s: %s", target.product, what, err)
 }
 
 func updateFromInstructions() {
@@ -120,18 +597,78 @@ func updateFromInstructions() {
 		DownloadWorkers: CLI.UpdateFromInstructions.DownloadWorkers,
 		ApplyWorkers:    CLI.UpdateFromInstructions.ApplyWorkers,
 		XDeltaPath:      CLI.UpdateFromInstructions.XDeltaPath,
+		XDeltaImpl:      CLI.UpdateFromInstructions.XDeltaImpl,
+		XDeltaMemory:    CLI.UpdateFromInstructions.XDeltaMemory,
+		PatchTool:       CLI.UpdateFromInstructions.PatchTool,
+		BsPatchPath:     CLI.UpdateFromInstructions.BsPatchPath,
+		VerifyPatches:   CLI.UpdateFromInstructions.VerifyPatches,
+		VerifyAfterMove: CLI.UpdateFromInstructions.VerifyAfterMove,
+		VerifyAfter:     CLI.UpdateFromInstructions.VerifyAfter,
+		Repair:          CLI.UpdateFromInstructions.Repair,
+		StreamFull:      CLI.UpdateFromInstructions.StreamFull,
+		KeepTemp:        CLI.UpdateFromInstructions.KeepTemp,
+		KeepPatches:     CLI.UpdateFromInstructions.KeepPatches,
+		AtomicApply:     CLI.UpdateFromInstructions.AtomicApply,
+		Sequential:      CLI.UpdateFromInstructions.Sequential,
+		ApplyTimeout:    CLI.UpdateFromInstructions.ApplyTimeout,
+		SharedInstall:   CLI.UpdateFromInstructions.SharedInstall,
+		NoCreate:        CLI.UpdateFromInstructions.NoCreate,
+		PathCase:        CLI.UpdateFromInstructions.PathCase,
+		ManifestFormat:  CLI.UpdateFromInstructions.ManifestFormat,
+		IgnoreManifest:  CLI.UpdateFromInstructions.IgnoreManifest,
+		BaseDir:         CLI.UpdateFromInstructions.BaseDir,
+		MaxScanRatio:    CLI.UpdateFromInstructions.MaxScanRatio,
+		ManyFilesAction: CLI.UpdateFromInstructions.ManyFilesAction,
+		MaxDeleteRatio:  CLI.UpdateFromInstructions.MaxDeleteRatio,
+		AllowMassDelete: CLI.UpdateFromInstructions.AllowMassDelete,
+		DryRun:          CLI.UpdateFromInstructions.DryRun,
+		Proxy:           CLI.UpdateFromInstructions.Proxy,
+		SkipScanErrors:  CLI.UpdateFromInstructions.SkipScanErrors,
+		SkipSpaceCheck:  CLI.UpdateFromInstructions.SkipSpaceCheck,
 
-		DownloadMaxAttempts:     CLI.UpdateFromInstructions.DownloadMaxAttempts,
-		DownloadBaseDelay:       CLI.UpdateFromInstructions.DownloadBaseDelay,
-		DownloadDelayFactor:     CLI.UpdateFromInstructions.DownloadDelayFactor,
+		ParallelHashThreshold:   CLI.UpdateFromInstructions.ParallelHashThreshold,
+		ChangedSince:            CLI.UpdateFromInstructions.ChangedSince,
+		MaxHashMemory:           CLI.UpdateFromInstructions.MaxHashMemory,
+		CopyBufferSize:          CLI.UpdateFromInstructions.CopyBufferSize,
+		XDeltaSourceWindow:      CLI.UpdateFromInstructions.XDeltaSourceWindow,
 		DownloadSpeedWindow:     CLI.UpdateFromInstructions.DownloadSpeedWindow,
 		DownloadRequestTimemout: CLI.UpdateFromInstructions.DownloadRequestTimemout,
 		DownloadStallTimeout:    CLI.UpdateFromInstructions.DownloadStallTimeout,
+		MinDownloadSpeed:        CLI.UpdateFromInstructions.MinDownloadSpeed,
+		DownloadConnections:     CLI.UpdateFromInstructions.DownloadConnections,
+		DownloadChunkSize:       CLI.UpdateFromInstructions.DownloadChunkSize,
+		RampUp:                  CLI.UpdateFromInstructions.RampUp,
+		RampUpInterval:          CLI.UpdateFromInstructions.RampUpInterval,
+		OpenEndedRanges:         CLI.UpdateFromInstructions.OpenEndedRanges,
+		QuarantineBad:           CLI.UpdateFromInstructions.QuarantineBad,
+		Header:                  CLI.UpdateFromInstructions.Header,
+		MaxDownloadSize:         CLI.UpdateFromInstructions.MaxDownloadSize,
+		MaxTotalDownloadSize:    CLI.UpdateFromInstructions.MaxTotalDownloadSize,
+		MaxDownloadRate:         CLI.UpdateFromInstructions.MaxDownloadRate,
+		RateDaytime:             CLI.UpdateFromInstructions.RateDaytime,
+		RateNighttime:           CLI.UpdateFromInstructions.RateNighttime,
+		DaytimeStart:            CLI.UpdateFromInstructions.DaytimeStart,
+		DaytimeEnd:              CLI.UpdateFromInstructions.DaytimeEnd,
+
+		RetryMaxAttempts:    CLI.UpdateFromInstructions.RetryMaxAttempts,
+		RetryBaseDelay:      CLI.UpdateFromInstructions.RetryBaseDelay,
+		RetryDelayFactor:    CLI.UpdateFromInstructions.RetryDelayFactor,
+		RetryJitter:         CLI.UpdateFromInstructions.RetryJitter,
+		RetryAll:            CLI.UpdateFromInstructions.RetryAll,
+		LockedFileRetries:   CLI.UpdateFromInstructions.LockedFileRetries,
+		DownloadMaxAttempts: CLI.UpdateFromInstructions.DownloadMaxAttempts,
+		DownloadBaseDelay:   CLI.UpdateFromInstructions.DownloadBaseDelay,
+		DownloadDelayFactor: CLI.UpdateFromInstructions.DownloadDelayFactor,
 
 		ProgressInterval: CLI.UpdateFromInstructions.ProgressInterval,
 		ProgressMode:     CLI.UpdateFromInstructions.ProgressMode,
+		StatusAddr:       CLI.UpdateFromInstructions.StatusAddr,
+
+		CheckPatcherUpdate: CLI.UpdateFromInstructions.CheckPatcherUpdate,
+		PatcherUpdateUrl:   CLI.UpdateFromInstructions.PatcherUpdateUrl,
 
 		Verbose:       CLI.UpdateFromInstructions.Verbose,
+		RunID:         CLI.UpdateFromInstructions.RunID,
 		OmitTimestamp: CLI.UpdateFromInstructions.OmitTimestamp,
 		LogFile:       CLI.UpdateFromInstructions.LogFile,
 	}
@@ -140,28 +677,524 @@ func updateFromInstructions() {
 
 	baseUrl, err := url.Parse(baseUrlStr)
 	if err != nil {
-		log.Fatalf("base-url is not a valid URL: %s", err)
+		fatal(&commonOpts, "base-url is not a valid URL", err)
+	}
+
+	instructionsData, what, err := readInstructionsData(instructionsPath)
+	if err != nil {
+		fatal(&commonOpts, what, err)
+	}
+	instructions, err := patcher.DecodeInstructions(instructionsData)
+	if err != nil {
+		fatal(&commonOpts, fmt.Sprintf("Couldn't decode instructions.json file '%s'", instructionsPath), err)
+	}
+
+	if commonOpts.CheckPatcherUpdate {
+		checkPatcherUpdate(&commonOpts)
+	}
+	backend := makePatchBackend(&commonOpts)
+	err = doUpdate(&commonOpts, product, installDir, baseUrl, nil, instructions, gameVersion, backend)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		fatal(&commonOpts, "Patcher process failed", err)
 	}
+}
 
-	var instructionsData []byte
+// readInstructionsData reads an instructions.json file, '-' means stdin. Returns what failed along with the error.
+func readInstructionsData(instructionsPath string) ([]byte, string, error) {
 	if instructionsPath == "-" {
-		// Instructions from stdin.
-		instructionsData, err = io.ReadAll(os.Stdin)
+		instructionsData, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, "Couldn't read instructions.json from stdin", err
+		}
+		return instructionsData, "", nil
+	}
+	instructionsData, err := os.ReadFile(instructionsPath)
+	if err != nil {
+		return nil, fmt.Sprintf("Couldn't read instructions.json file '%s'", instructionsPath), err
+	}
+	return instructionsData, "", nil
+}
+
+func selfCheck() {
+	installDir := CLI.SelfCheck.InstallDir
+
+	// Only the logging options are relevant. Plain progress mode so logs aren't discarded.
+	commonOpts := CommonUpdateOpts{
+		ProgressMode:  "plain",
+		Verbose:       CLI.SelfCheck.Verbose,
+		OmitTimestamp: CLI.SelfCheck.OmitTimestamp,
+		LogFile:       CLI.SelfCheck.LogFile,
+	}
+
+	setupLogging(&commonOpts)
+
+	if CLI.SelfCheck.BaseDir != "" && !filepath.IsAbs(installDir) {
+		installDir = filepath.Join(CLI.SelfCheck.BaseDir, installDir)
+	}
+	absInstallDir, err := filepath.Abs(installDir)
+	if err != nil {
+		log.Fatalf("install-dir is not a valid directory name: %s", err)
+	}
+
+	ctx := patcher.SetVerbose(context.Background(), commonOpts.Verbose)
+	ctx, stopNotify := signal.NotifyContext(ctx, os.Interrupt)
+	defer stopNotify()
+
+	mismatches, err := patcher.SelfCheck(ctx, absInstallDir, CLI.SelfCheck.VerifyWorkers)
+	if err != nil {
+		log.Fatalf("Self-check failed: %s", err)
+	}
+	unreadable := 0
+	for _, m := range mismatches {
+		if m.Unreadable() {
+			unreadable++
+			fmt.Printf("UNREADABLE %s (%s): %s\n", m.Filename, m.Product, m.Err)
+		} else if m.Actual == "" {
+			fmt.Printf("MISSING %s (%s)\n", m.Filename, m.Product)
+		} else {
+			fmt.Printf("CORRUPT %s (%s): expected %s, got %s\n", m.Filename, m.Product,
+				strings.ToUpper(m.Expected), strings.ToUpper(m.Actual))
+		}
+	}
+	// Exit code 1 means files don't match, 2 means files couldn't be read, 3 means both.
+	exitCode := 0
+	if mismatched := len(mismatches) - unreadable; mismatched > 0 {
+		fmt.Printf("%d files don't match the manifest, run an update to repair them.\n", mismatched)
+		exitCode |= 1
+	}
+	if unreadable > 0 {
+		fmt.Printf("%d files couldn't be read, so it's unknown whether they match.\n", unreadable)
+		exitCode |= 2
+	}
+	if exitCode == 0 {
+		fmt.Printf("All files match the manifest.\n")
+	} else if !CLI.SelfCheck.WarnOnly {
+		os.Exit(exitCode)
+	}
+}
+
+// jsonVerifyReport is written to stdout by the verify subcommand in JSON progress mode.
+type jsonVerifyReport struct {
+	Product     string   `json:"product"`
+	InstallDir  string   `json:"installDir"`
+	OutOfDate   bool     `json:"outOfDate"`
+	UpToDate    []string `json:"upToDate"`
+	Mismatched  []string `json:"mismatched"`
+	Missing     []string `json:"missing"`
+	Obsolete    []string `json:"obsolete"`
+	VersionName string   `json:"versionName,omitempty"`
+}
+
+func verify() {
+	product := CLI.Verify.Product
+	installDir := CLI.Verify.InstallDir
+
+	// Only the logging options are relevant, and the progress mode for the format of the report.
+	commonOpts := CommonUpdateOpts{
+		ProgressMode:  CLI.Verify.ProgressMode,
+		Verbose:       CLI.Verify.Verbose,
+		OmitTimestamp: CLI.Verify.OmitTimestamp,
+		LogFile:       CLI.Verify.LogFile,
+		Proxy:         CLI.Verify.Proxy,
+		Header:        CLI.Verify.Header,
+	}
+
+	setupLogging(&commonOpts)
+
+	if CLI.Verify.BaseDir != "" && !filepath.IsAbs(installDir) {
+		installDir = filepath.Join(CLI.Verify.BaseDir, installDir)
+	}
+	absInstallDir, err := filepath.Abs(installDir)
+	if err != nil {
+		log.Fatalf("install-dir is not a valid directory name: %s", err)
+	}
+	if _, err := parseProxy(commonOpts.Proxy); err != nil {
+		log.Fatalf("%s", err)
+	}
+	if _, err := parseHeaders(commonOpts.Header); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	ctx := patcher.SetVerbose(withProxy(context.Background(), &commonOpts), commonOpts.Verbose)
+	ctx = withHeaders(ctx, &commonOpts)
+	ctx, stopNotify := signal.NotifyContext(ctx, os.Interrupt)
+	defer stopNotify()
+
+	var instructions []patcher.Instruction
+	versionName := ""
+	if CLI.Verify.Instructions != "" {
+		instructionsData, what, err := readInstructionsData(CLI.Verify.Instructions)
+		if err != nil {
+			fatal(&commonOpts, what, err)
+		}
+		instructions, err = patcher.DecodeInstructions(instructionsData)
 		if err != nil {
-			log.Fatalf("Couldn't read instructions.json from stdin: %s", err)
+			fatal(&commonOpts, fmt.Sprintf("Couldn't decode instructions.json file '%s'", CLI.Verify.Instructions), err)
 		}
 	} else {
-		instructionsData, err = os.ReadFile(instructionsPath)
+		productsUrl, err := url.Parse(CLI.Verify.ProductsUrl)
+		if err != nil {
+			log.Fatalf("products-url is not a valid URL: %s", err)
+		}
+		resolved, err := patcher.ResolveInstructionsContext(ctx, productsUrl, product, nil)
+		if err != nil {
+			fatal(&commonOpts, "Failed to resolve instructions.json", err)
+		}
+		instructions = resolved.Instructions
+		versionName = resolved.VersionName
+	}
+
+	manifest := patcher.NewManifest(product)
+	if !CLI.Verify.IgnoreManifest {
+		manifest, err = patcher.ReadManifest(absInstallDir, product)
 		if err != nil {
-			log.Fatalf("Couldn't read instructions.json file '%s': %s", instructionsPath, err)
+			fatal(&commonOpts, "Couldn't read manifest", err)
+		}
+	}
+	config := patcher.PatcherConfig{
+		InstallDir:    absInstallDir,
+		Product:       product,
+		VerifyWorkers: CLI.Verify.VerifyWorkers,
+	}
+	report, err := patcher.VerifyInstall(ctx, instructions, manifest, config, nil)
+	if err != nil {
+		fatal(&commonOpts, "Verifying install dir failed", err)
+	}
+
+	if commonOpts.ProgressMode == "json" {
+		data, err := json.Marshal(jsonVerifyReport{
+			Product:     product,
+			InstallDir:  absInstallDir,
+			OutOfDate:   report.OutOfDate(),
+			UpToDate:    report.UpToDate,
+			Mismatched:  report.Mismatched,
+			Missing:     report.Missing,
+			Obsolete:    report.Obsolete,
+			VersionName: versionName,
+		})
+		if err != nil {
+			log.Fatalf("Couldn't encode report: %s", err)
+		}
+		fmt.Printf("%s\n", data)
+	} else {
+		for _, p := range report.Mismatched {
+			fmt.Printf("MISMATCHED %s\n", p)
+		}
+		for _, p := range report.Missing {
+			fmt.Printf("MISSING %s\n", p)
 		}
+		for _, p := range report.Obsolete {
+			fmt.Printf("OBSOLETE %s\n", p)
+		}
+		if report.OutOfDate() {
+			fmt.Printf("%d files are up to date, %d don't match, %d are missing and %d should be deleted, "+
+				"run an update to repair them.\n", len(report.UpToDate), len(report.Mismatched), len(report.Missing),
+				len(report.Obsolete))
+		} else {
+			fmt.Printf("All %d files are up to date.\n", len(report.UpToDate))
+		}
+	}
+	if report.OutOfDate() {
+		os.Exit(1)
+	}
+}
+
+func verifyPatches() {
+	installDir := CLI.VerifyPatches.InstallDir
+	instructionsPath := CLI.VerifyPatches.Instructions
+
+	// Only the logging options are relevant. Plain progress mode so logs aren't discarded.
+	commonOpts := CommonUpdateOpts{
+		ProgressMode:  "plain",
+		Verbose:       CLI.VerifyPatches.Verbose,
+		OmitTimestamp: CLI.VerifyPatches.OmitTimestamp,
+		LogFile:       CLI.VerifyPatches.LogFile,
+	}
+
+	setupLogging(&commonOpts)
+
+	if CLI.VerifyPatches.BaseDir != "" && !filepath.IsAbs(installDir) {
+		installDir = filepath.Join(CLI.VerifyPatches.BaseDir, installDir)
+	}
+	absInstallDir, err := filepath.Abs(installDir)
+	if err != nil {
+		log.Fatalf("install-dir is not a valid directory name: %s", err)
+	}
+
+	instructionsData, what, err := readInstructionsData(instructionsPath)
+	if err != nil {
+		log.Fatalf("%s: %s", what, err)
 	}
 	instructions, err := patcher.DecodeInstructions(instructionsData)
 	if err != nil {
 		log.Fatalf("Couldn't decode instructions.json file '%s': %s", instructionsPath, err)
 	}
 
-	doUpdate(&commonOpts, product, installDir, baseUrl, instructions, gameVersion)
+	ctx := patcher.SetVerbose(context.Background(), commonOpts.Verbose)
+	ctx, stopNotify := signal.NotifyContext(ctx, os.Interrupt)
+	defer stopNotify()
+
+	mismatches, checked, err := patcher.VerifyStagedPatches(ctx, absInstallDir, instructions,
+		CLI.VerifyPatches.VerifyWorkers)
+	if err != nil {
+		log.Fatalf("Verifying patches failed: %s", err)
+	}
+	for _, m := range mismatches {
+		if m.Incomplete {
+			fmt.Printf("INCOMPLETE %s\n", m.Path)
+		} else {
+			fmt.Printf("CORRUPT %s: expected %s, got %s\n", m.Path, strings.ToUpper(m.Expected),
+				strings.ToUpper(m.Actual))
+		}
+	}
+	if len(mismatches) > 0 {
+		fmt.Printf("%d of %d patch files don't match the instructions, run the download again to repair them.\n",
+			len(mismatches), checked)
+		os.Exit(1)
+	}
+	fmt.Printf("All %d patch files match the instructions.\n", checked)
+}
+
+func warm() {
+	product := CLI.Warm.Product
+
+	// Only the logging options are relevant. Plain progress mode so logs aren't discarded.
+	commonOpts := CommonUpdateOpts{
+		ProgressMode:  "plain",
+		Verbose:       CLI.Warm.Verbose,
+		OmitTimestamp: CLI.Warm.OmitTimestamp,
+		LogFile:       CLI.Warm.LogFile,
+		Proxy:         CLI.Warm.Proxy,
+		Header:        CLI.Warm.Header,
+	}
+
+	setupLogging(&commonOpts)
+
+	productsUrl, err := url.Parse(CLI.Warm.ProductsUrl)
+	if err != nil {
+		log.Fatalf("products-url is not a valid URL: %s", err)
+	}
+
+	if _, err := parseProxy(commonOpts.Proxy); err != nil {
+		log.Fatalf("%s", err)
+	}
+	if _, err := parseHeaders(commonOpts.Header); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	ctx := patcher.SetVerbose(withProxy(context.Background(), &commonOpts), commonOpts.Verbose)
+	ctx = withHeaders(ctx, &commonOpts)
+	ctx, stopNotify := signal.NotifyContext(ctx, os.Interrupt)
+	defer stopNotify()
+
+	resolved, err := patcher.ResolveInstructionsContext(ctx, productsUrl, product, nil)
+	if err != nil {
+		log.Fatalf("Failed to resolve instructions.json: %s", err)
+	}
+
+	var actions patcher.DeterminedActions
+	if CLI.Warm.InstallDir == "" {
+		actions = patcher.DetermineActions(resolved.Instructions, patcher.NewManifest(product),
+			map[string]patcher.BasicFileInfo{}, map[string]string{})
+	} else {
+		manifest, err := patcher.ReadManifest(CLI.Warm.InstallDir, product)
+		if err != nil {
+			log.Fatalf("Couldn't read manifest: %s", err)
+		}
+		config := patcher.PatcherConfig{
+			InstallDir:    CLI.Warm.InstallDir,
+			Product:       product,
+			VerifyWorkers: CLI.Warm.VerifyWorkers,
+		}
+		verified, err := patcher.RunVerify(ctx, resolved.Instructions, manifest, config, nil)
+		if err != nil {
+			log.Fatalf("Verifying install dir failed: %s", err)
+		}
+		actions = *verified
+	}
+
+	results, err := patcher.WarmPatchUrls(ctx, resolved.BaseUrl, actions.ToDownload, patcher.WarmConfig{
+		Workers:        CLI.Warm.WarmWorkers,
+		RequestTimeout: CLI.Warm.RequestTimeout,
+		RangeGet:       CLI.Warm.Method == "range",
+	})
+	if err != nil {
+		log.Fatalf("Warming failed: %s", err)
+	}
+	if CLI.Warm.CheckRemote {
+		reportRemoteCheck(results, resolved.VersionName)
+		return
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Ok() {
+			continue
+		}
+		failed++
+		if r.Err != nil {
+			fmt.Printf("FAILED %s: %s\n", r.Url, r.Err)
+		} else {
+			fmt.Printf("%d %s\n", r.StatusCode, r.Url)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d patch files couldn't be requested.\n", failed, len(results))
+		os.Exit(1)
+	}
+	fmt.Printf("Requested all %d patch files of version %s.\n", len(results), resolved.VersionName)
+}
+
+func benchmark() {
+	installDir := CLI.Benchmark.InstallDir
+
+	// Only the logging options are relevant. Plain progress mode so logs aren't discarded.
+	commonOpts := CommonUpdateOpts{
+		ProgressMode:  "plain",
+		Verbose:       CLI.Benchmark.Verbose,
+		OmitTimestamp: CLI.Benchmark.OmitTimestamp,
+		LogFile:       CLI.Benchmark.LogFile,
+	}
+
+	setupLogging(&commonOpts)
+
+	if CLI.Benchmark.BaseDir != "" && !filepath.IsAbs(installDir) {
+		installDir = filepath.Join(CLI.Benchmark.BaseDir, installDir)
+	}
+	absInstallDir, err := filepath.Abs(installDir)
+	if err != nil {
+		log.Fatalf("install-dir is not a valid directory name: %s", err)
+	}
+
+	ctx := patcher.SetVerbose(context.Background(), commonOpts.Verbose)
+	ctx, stopNotify := signal.NotifyContext(ctx, os.Interrupt)
+	defer stopNotify()
+
+	fmt.Printf("Diagnostic: measuring checksum speed in '%s', nothing is changed.\n", absInstallDir)
+	results, err := patcher.BenchmarkHashing(ctx, absInstallDir, CLI.Benchmark.Workers, int64(CLI.Benchmark.SampleSize))
+	if err != nil {
+		log.Fatalf("Benchmark failed: %s", err)
+	}
+	fmt.Printf("%7s  %10s  %s\n", "Workers", "MiB/s", "Data")
+	cached := false
+	for _, r := range results {
+		note := ""
+		if r.Reused {
+			note = " (cached)"
+			cached = true
+		}
+		fmt.Printf("%7d  %10.1f  %d files, %s%s\n", r.Workers, r.MiBPerSecond(), r.Files,
+			byteStr(r.Bytes), note)
+	}
+	if cached {
+		fmt.Printf("Some runs hashed files again that were probably cached, use a smaller --sample-size for " +
+			"reliable results.\n")
+	}
+	fmt.Printf("Recommended: --verify-workers %d\n", patcher.RecommendWorkers(results))
+}
+
+func manifestExport() {
+	installDir := CLI.ManifestExport.InstallDir
+	if CLI.ManifestExport.BaseDir != "" && !filepath.IsAbs(installDir) {
+		installDir = filepath.Join(CLI.ManifestExport.BaseDir, installDir)
+	}
+
+	exported, err := patcher.ExportManifest(installDir, CLI.ManifestExport.Product)
+	if err != nil {
+		log.Fatalf("Couldn't export manifest: %s", err)
+	}
+	if CLI.ManifestExport.Format == "json" {
+		data, err := json.MarshalIndent(exported, "", "  ")
+		if err != nil {
+			log.Fatalf("Couldn't encode manifest: %s", err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	out := bufio.NewWriter(os.Stdout)
+	if err := patcher.WriteSha256sumList(out, exported); err != nil {
+		log.Fatalf("Couldn't write checksum list: %s", err)
+	}
+	if err := out.Flush(); err != nil {
+		log.Fatalf("Couldn't write checksum list: %s", err)
+	}
+}
+
+func manifestImport() {
+	installDir := CLI.ManifestImport.InstallDir
+	product := CLI.ManifestImport.Product
+	if CLI.ManifestImport.BaseDir != "" && !filepath.IsAbs(installDir) {
+		installDir = filepath.Join(CLI.ManifestImport.BaseDir, installDir)
+	}
+
+	var listData []byte
+	var err error
+	if CLI.ManifestImport.List == "-" {
+		listData, err = io.ReadAll(os.Stdin)
+	} else {
+		listData, err = os.ReadFile(CLI.ManifestImport.List)
+	}
+	if err != nil {
+		log.Fatalf("Couldn't read checksum list: %s", err)
+	}
+	var entries []patcher.ManifestExportEntry
+	if CLI.ManifestImport.Format == "json" {
+		err = json.Unmarshal(listData, &entries)
+	} else {
+		entries, err = patcher.ReadSha256sumList(bytes.NewReader(listData))
+	}
+	if err != nil {
+		log.Fatalf("Couldn't decode checksum list: %s", err)
+	}
+
+	var store patcher.ManifestStore = patcher.JSONManifestStore{}
+	if CLI.ManifestImport.ManifestFormat == "bolt" {
+		store = patcher.BoltManifestStore{}
+	}
+	// Reading the existing manifest checks it's for the same product.
+	manifest, err := store.Read(installDir, product, CLI.ManifestImport.SharedInstall, false)
+	if err != nil {
+		log.Fatalf("Couldn't read manifest: %s", err)
+	}
+	imported, missing, err := patcher.ImportChecksums(installDir, manifest, entries)
+	if err != nil {
+		log.Fatalf("Couldn't import checksum list: %s", err)
+	}
+	for _, m := range missing {
+		log.Printf("Warning: '%s' is in the checksum list but not in the install dir.", m)
+	}
+	if err := store.Write(installDir, manifest); err != nil {
+		log.Fatalf("Couldn't write manifest: %s", err)
+	}
+	fmt.Printf("Added %d files to the manifest of '%s'", imported, product)
+	if len(missing) > 0 {
+		fmt.Printf(", %d listed files are missing", len(missing))
+	}
+	fmt.Printf(".\n")
+}
+
+// reportRemoteCheck prints the status of every patch file for warm --check-remote and exits with 1 if any
+// patch file is missing or has the wrong size.
+func reportRemoteCheck(results []patcher.WarmResult, versionName string) {
+	bad := 0
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			fmt.Printf("FAILED %s: %s\n", r.Url, r.Err)
+		case !r.Ok():
+			fmt.Printf("MISSING %s: status %d\n", r.Url, r.StatusCode)
+		case r.WrongSize():
+			fmt.Printf("WRONG SIZE %s: %d bytes, expected %d\n", r.Url, r.Size, r.ExpectedSize)
+		default:
+			fmt.Printf("OK %s\n", r.Url)
+			continue
+		}
+		bad++
+	}
+	if bad > 0 {
+		fmt.Printf("FAIL: %d of %d patch files of version %s are missing or wrong.\n", bad, len(results), versionName)
+		os.Exit(1)
+	}
+	fmt.Printf("PASS: all %d patch files of version %s are available.\n", len(results), versionName)
 }
 
 func setupLogging(commonOpts *CommonUpdateOpts) {
@@ -182,27 +1215,163 @@ func setupLogging(commonOpts *CommonUpdateOpts) {
 
 }
 
+// jsonError is written as the final object on stdout in JSON progress mode if the patcher fails.
+type jsonError struct {
+	Error string `json:"error"`
+	Phase string `json:"phase,omitempty"`
+	// The file that failed, if the error is about one file.
+	File string `json:"file,omitempty"`
+	// Only set when updating several games.
+	Product string `json:"product,omitempty"`
+}
+
+// fatal logs an error and exits. In JSON progress mode the error is also written to stdout,
+// so a program reading the progress knows why the patcher stopped.
+func fatal(commonOpts *CommonUpdateOpts, what string, err error) {
+	if commonOpts.ProgressMode == "json" {
+		jerr := jsonError{Error: fmt.Sprintf("%s: %s", what, err)}
+		var phaseErr *patcher.PhaseError
+		if errors.As(err, &phaseErr) {
+			jerr.Phase = phaseErr.Phase.String()
+		}
+		var fileErr *patcher.FileError
+		if errors.As(err, &fileErr) {
+			jerr.File = fileErr.Path
+		}
+		if data, err := json.Marshal(jerr); err == nil {
+			fmt.Printf("%s\n", data)
+		}
+	}
+	log.Fatalf("%s: %s", what, err)
+}
+
+// checkPatcherUpdate tells the user if there's a newer version of the patcher. Failures are only logged,
+// checking for a new patcher should never stop the game from being updated.
+func checkPatcherUpdate(commonOpts *CommonUpdateOpts) {
+	updateUrl, err := url.Parse(commonOpts.PatcherUpdateUrl)
+	if err != nil {
+		log.Printf("patcher-update-url is not a valid URL: %s", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(withProxy(context.Background(), commonOpts), 5*time.Second)
+	defer cancel()
+	info, err := patcher.CheckSelfUpdate(ctx, updateUrl, Version)
+	if err != nil {
+		log.Printf("Couldn't check for a newer version of the patcher: %s", err)
+		return
+	}
+	if info.Newer {
+		fmt.Fprintf(os.Stderr, "A newer version of the patcher is available: %s (running %s). %s\n",
+			info.Version, Version, info.Url)
+	}
+}
+
+// makeConfirmManyFiles returns the function deciding whether to continue when the install dir contains
+// suspiciously many files, depending on --many-files-action.
+func makeConfirmManyFiles(commonOpts *CommonUpdateOpts) func(found int, expected int) bool {
+	// Logs are hidden in fancy progress mode, so always tell the user directly.
+	warn := func(found int, expected int) bool {
+		fmt.Fprintf(os.Stderr, "WARNING: the install dir contains %d files but the game only has %d files, "+
+			"is this really the right directory?\n", found, expected)
+		return true
+	}
+	switch commonOpts.ManyFilesAction {
+	case "abort":
+		return func(int, int) bool { return false }
+	case "confirm":
+		// The fancy progress bars keep redrawing the terminal, they'd hide the question.
+		if commonOpts.ProgressMode != "plain" || !isInteractive() {
+			return warn
+		}
+		return func(found int, expected int) bool {
+			fmt.Fprintf(os.Stderr, "\nThe install dir contains %d files but the game only has %d files. "+
+				"Is this really the right directory? Continue? [y/N] ", found, expected)
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			answer = strings.ToLower(strings.TrimSpace(answer))
+			return answer == "y" || answer == "yes"
+		}
+	default:
+		return warn
+	}
+}
+
+// makeRateSchedule returns the download rate schedule for --max-download-rate, --rate-daytime and
+// --rate-nighttime.
+func makeRateSchedule(commonOpts *CommonUpdateOpts) (patcher.RateSchedule, error) {
+	schedule := patcher.RateSchedule{Default: int64(commonOpts.MaxDownloadRate)}
+	if commonOpts.RateDaytime == 0 && commonOpts.RateNighttime == 0 {
+		return schedule, nil
+	}
+	start, end := commonOpts.DaytimeStart, commonOpts.DaytimeEnd
+	if start < 0 || start > 23 || end < 0 || end > 23 {
+		return schedule, fmt.Errorf("--daytime-start and --daytime-end must be hours from 0 to 23, got %d and %d",
+			start, end)
+	}
+	if start == end {
+		return schedule, fmt.Errorf("--daytime-start and --daytime-end can't both be %d", start)
+	}
+	if commonOpts.RateDaytime != 0 {
+		schedule.Windows = append(schedule.Windows,
+			patcher.RateWindow{StartHour: start, EndHour: end, Rate: int64(commonOpts.RateDaytime)})
+	}
+	if commonOpts.RateNighttime != 0 {
+		schedule.Windows = append(schedule.Windows,
+			patcher.RateWindow{StartHour: end, EndHour: start, Rate: int64(commonOpts.RateNighttime)})
+	}
+	return schedule, nil
+}
+
+// isInteractive returns whether stdin is a terminal.
+func isInteractive() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
 func doUpdate(
 	commonOpts *CommonUpdateOpts,
 	product string,
 	installDir string,
 	baseUrl *url.URL,
+	fallbackBaseUrls []*url.URL,
 	instructions []patcher.Instruction,
 	gameVersion *string,
-) {
+	backend patcher.PatchBackend,
+) error {
 	ctx := patcher.SetVerbose(context.Background(), commonOpts.Verbose)
+	if commonOpts.RunID != "" {
+		ctx = patcher.WithRunID(ctx, commonOpts.RunID)
+	}
+	ctx = patcher.WithLockedFileRetries(ctx, commonOpts.LockedFileRetries)
 
+	if commonOpts.BaseDir != "" && !filepath.IsAbs(installDir) {
+		installDir = filepath.Join(commonOpts.BaseDir, installDir)
+	}
 	absInstallDir, err := filepath.Abs(installDir)
 	if err != nil {
-		log.Fatalf("install-dir is not a valid directory name: %s", err)
+		fatal(commonOpts, "install-dir is not a valid directory name", err)
 	}
 
+	// Summary of the time spent per phase, printed after the progress bars are stopped. RunPatcher reports
+	// progress one last time before returning, so the last progress has the final durations.
+	var lastProgress patcher.Progress
+	printSummary := false
+	// Likewise the report of a dry run.
+	var dryRunReport bytes.Buffer
+	defer func() {
+		if dryRunReport.Len() > 0 {
+			fmt.Printf("Dry run, nothing was downloaded, patched or deleted. A real run would:\n%s", &dryRunReport)
+		}
+		if printSummary {
+			fmt.Printf("Time spent per phase: %s\n", lastProgress.PhaseDurationSummary())
+		}
+	}()
+
 	var progressFunc func(patcher.Progress)
 	if commonOpts.ProgressMode == "json" {
 		progressFunc = func(p patcher.Progress) {
 			data, err := json.Marshal(p)
 			if err != nil {
-				log.Fatalf("Failed to serialize progress structure: %s", err)
+				fatal(commonOpts, "Failed to serialize progress structure", err)
 			}
 			fmt.Printf("%s\n", data)
 		}
@@ -213,34 +1382,125 @@ func doUpdate(
 	} else {
 		progressFunc = plainProgress
 	}
+	throttle := patcher.NewThrottle()
+	if commonOpts.StatusAddr != "" {
+		status, err := startStatusServer(commonOpts.StatusAddr, product, throttle)
+		if err != nil {
+			fatal(commonOpts, "Couldn't start status server", err)
+		}
+		defer status.stop()
+		reportToTerminal := progressFunc
+		progressFunc = func(p patcher.Progress) {
+			status.update(p)
+			reportToTerminal(p)
+		}
+	}
+	reportProgress := progressFunc
+	progressFunc = func(p patcher.Progress) {
+		lastProgress = p
+		reportProgress(p)
+	}
+
+	rateSchedule, err := makeRateSchedule(commonOpts)
+	if err != nil {
+		fatal(commonOpts, "Invalid download rate schedule", err)
+	}
+	// Validated already.
+	proxyUrl, _ := parseProxy(commonOpts.Proxy)
+	headers, _ := parseHeaders(commonOpts.Header)
+	downloadRetry := downloadRetryPolicy(commonOpts)
+	quarantineDir := ""
+	if commonOpts.QuarantineBad {
+		quarantineDir = filepath.Join(absInstallDir, patcher.QuarantineDirname)
+	}
+	rampUp := time.Duration(0)
+	if commonOpts.RampUp {
+		rampUp = commonOpts.RampUpInterval
+	}
 
 	config := patcher.PatcherConfig{
-		BaseUrl:         baseUrl,
-		InstallDir:      absInstallDir,
-		Product:         product,
-		VerifyWorkers:   commonOpts.VerifyWorkers,
-		DownloadWorkers: commonOpts.DownloadWorkers,
-		ApplyWorkers:    commonOpts.ApplyWorkers,
-		XDeltaBinPath:   commonOpts.XDeltaPath,
+		BaseUrl:               baseUrl,
+		FallbackBaseUrls:      fallbackBaseUrls,
+		InstallDir:            absInstallDir,
+		Product:               product,
+		SharedInstallDir:      commonOpts.SharedInstall,
+		NoCreateInstallDir:    commonOpts.NoCreate,
+		PathCase:              pathCaseModes[commonOpts.PathCase],
+		IgnoreManifestVersion: commonOpts.IgnoreManifest,
+		MaxScanRatio:          commonOpts.MaxScanRatio,
+		ConfirmManyFiles:      makeConfirmManyFiles(commonOpts),
+		MaxDeleteRatio:        commonOpts.MaxDeleteRatio,
+		AllowMassDelete:       commonOpts.AllowMassDelete,
+		DryRun:                commonOpts.DryRun,
+		SkipScanErrors:        commonOpts.SkipScanErrors,
+		VerifyWorkers:         commonOpts.VerifyWorkers,
+		ChangedSince:          time.Time(commonOpts.ChangedSince),
+		ForceRehash:           commonOpts.Repair,
+		DownloadWorkers:       commonOpts.DownloadWorkers,
+		DownloadRampUp:        rampUp,
+		ApplyWorkers:          commonOpts.ApplyWorkers,
+		XDeltaBinPath:         commonOpts.XDeltaPath,
+		VerifyPatches:         commonOpts.VerifyPatches,
+		VerifyAfterMove:       commonOpts.VerifyAfterMove,
+		VerifyAfter:           commonOpts.VerifyAfter,
+		StreamFullPatches:     commonOpts.StreamFull,
+		KeepTemp:              commonOpts.KeepTemp,
+		KeepPatches:           commonOpts.KeepPatches,
+		AtomicApply:           commonOpts.AtomicApply,
+		SequentialPhases:      commonOpts.Sequential,
+		ApplyTimeout:          commonOpts.ApplyTimeout,
+		ParallelHashThreshold: int64(commonOpts.ParallelHashThreshold),
+		MaxHashMemory:         int64(commonOpts.MaxHashMemory),
+		CopyBufferSize:        int(commonOpts.CopyBufferSize),
 		DownloadConfig: patcher.DownloadConfig{
-			MaxAttempts:              commonOpts.DownloadMaxAttempts,
-			RetryBaseDelay:           commonOpts.DownloadBaseDelay,
-			RetryWaitIncrementFactor: commonOpts.DownloadDelayFactor,
+			MaxAttempts:              downloadRetry.MaxAttempts,
+			RetryBaseDelay:           downloadRetry.BaseDelay,
+			RetryWaitIncrementFactor: downloadRetry.DelayFactor,
+			RetryJitter:              downloadRetry.Jitter,
 			DownloadSpeedWindow:      commonOpts.DownloadSpeedWindow,
 			DownloadRequestTimeout:   commonOpts.DownloadRequestTimemout,
 			DownloadStallTimeout:     commonOpts.DownloadStallTimeout,
+			MinDownloadSpeed:         int64(commonOpts.MinDownloadSpeed),
+			MaxFileSize:              int64(commonOpts.MaxDownloadSize),
+			ConnectionsPerFile:       commonOpts.DownloadConnections,
+			ChunkSize:                int64(commonOpts.DownloadChunkSize),
+			OpenEndedRanges:          commonOpts.OpenEndedRanges,
+			RateSchedule:             rateSchedule,
+			QuarantineDir:            quarantineDir,
+			ProxyUrl:                 proxyUrl,
+			Headers:                  headers,
 		},
-		ProgressInterval: time.Duration(commonOpts.ProgressInterval) * time.Second,
-		ProgressFunc:     progressFunc,
+		MaxTotalDownloadSize: int64(commonOpts.MaxTotalDownloadSize),
+		SkipSpaceCheck:       commonOpts.SkipSpaceCheck,
+		ProgressInterval:     time.Duration(commonOpts.ProgressInterval) * time.Second,
+		ProgressFunc:         progressFunc,
+		Throttle:             throttle,
+		PatchBackend:         backend,
+	}
+
+	if commonOpts.ManifestFormat == "bolt" {
+		config.ManifestStore = patcher.BoltManifestStore{}
+	}
+	// In JSON mode stdout is for progress, the report goes to the log instead.
+	if commonOpts.DryRun && commonOpts.ProgressMode != "json" {
+		config.DryRunOutput = &dryRunReport
 	}
 
 	ctx, stopNotify := signal.NotifyContext(ctx, os.Interrupt)
 	defer stopNotify()
+	watchThrottleSignals(ctx, config.Throttle)
 
 	err = patcher.RunPatcher(ctx, instructions, config)
-	if err != nil && !errors.Is(err, context.Canceled) {
-		log.Fatalf("Patcher process failed: %s", err)
+	var spaceErr *patcher.NotEnoughSpaceError
+	if errors.As(err, &spaceErr) {
+		err = fmt.Errorf("%w (use --skip-space-check to update anyway)", err)
+	}
+	var massDeleteErr *patcher.MassDeleteError
+	if errors.As(err, &massDeleteErr) {
+		err = fmt.Errorf("%w (use --allow-mass-delete to update anyway)", err)
 	}
+	// In JSON mode the final progress has longestPhase and the durations.
+	printSummary = err == nil && commonOpts.ProgressMode != "json"
 
 	if commonOpts.ProgressMode == "fancy" {
 		// Bit of a hack. The progress bar lib updates on a timer and if we exit straight after the final
@@ -250,15 +1510,79 @@ func doUpdate(
 		case <-ctx.Done():
 		}
 	}
+	return err
+}
+
+// makePatchBackend returns the patch backend for the options.
+func makePatchBackend(commonOpts *CommonUpdateOpts) patcher.PatchBackend {
+	if commonOpts.PatchTool == "bsdiff" {
+		bsdiff, err := patcher.NewBsDiff(commonOpts.BsPatchPath)
+		if err != nil {
+			fatal(commonOpts, "Couldn't find bspatch", err)
+		}
+		bsdiff.KeepTemp = commonOpts.KeepTemp
+		return bsdiff
+	} else if commonOpts.XDeltaImpl == "go" {
+		goXDelta := &patcher.GoXDelta{KeepTemp: commonOpts.KeepTemp}
+		// The binary is optional, it's only needed for patches the built-in decoder can't handle.
+		if xdelta, err := patcher.NewXDelta(commonOpts.XDeltaPath); err == nil {
+			xdelta.KeepTemp = commonOpts.KeepTemp
+			xdelta.SourceWindow = xdeltaSourceWindow(commonOpts)
+			goXDelta.Fallback = xdelta
+		} else {
+			log.Printf("No xdelta binary to fall back on, patches using unsupported features will fail: %s", err)
+		}
+		return goXDelta
+	}
+	xdelta, err := patcher.NewXDelta(commonOpts.XDeltaPath)
+	if err != nil {
+		fatal(commonOpts, "Couldn't find xdelta", err)
+	}
+	xdelta.KeepTemp = commonOpts.KeepTemp
+	xdelta.SourceWindow = xdeltaSourceWindow(commonOpts)
+	return xdelta
+}
+
+// xdeltaSourceWindow returns the source window for the xdelta binary, --xdelta-source-window if set and
+// otherwise the --xdelta-memory preset.
+func xdeltaSourceWindow(commonOpts *CommonUpdateOpts) int64 {
+	if commonOpts.XDeltaSourceWindow != 0 {
+		return int64(commonOpts.XDeltaSourceWindow)
+	}
+	switch commonOpts.XDeltaMemory {
+	case "low":
+		return patcher.LowMemoryXDeltaSourceWindow
+	case "minimal":
+		return patcher.MinimalXDeltaSourceWindow
+	default:
+		return patcher.DefaultXDeltaSourceWindow
+	}
 }
 
 func main() {
-	kongCtx := kong.Parse(&CLI)
+	kongCtx := kong.Parse(&CLI,
+		kong.Vars{"patcherUpdateUrl": patcher.DefaultSelfUpdateUrl},
+		kong.Configuration(loadConfig),
+	)
 	switch kongCtx.Command() {
-	case "update <product> <install-dir>":
+	case "update <product> <install-dir>", "update <product> <install-dir> <more>":
 		update()
 	case "update-from-instructions <product> <install-dir> <base-url>":
 		updateFromInstructions()
+	case "self-check <install-dir>":
+		selfCheck()
+	case "verify <product> <install-dir>":
+		verify()
+	case "verify-patches <install-dir>":
+		verifyPatches()
+	case "warm <product>":
+		warm()
+	case "benchmark <install-dir>":
+		benchmark()
+	case "manifest-export <install-dir>":
+		manifestExport()
+	case "manifest-import <install-dir> <list>":
+		manifestImport()
 	case "about":
 		printAbout()
 	case "version":
@@ -123,6 +123,15 @@ func makeFancyProgressFunc(product string, installDir string, gameVersion *strin
 			phb.SetTotal(int64(ph.Needed))
 			phb.Set("duration", time.Duration(ph.Duration)*time.Second)
 			phb.Set("total_known", ph.NeededKnown)
+			if pbi.ph == patcher.PhaseVerify {
+				if p.Scanning {
+					// Until the scan is done there's no needed count, show how many files were found.
+					phb.Set("prefix", "Scanning: ")
+					phb.SetCurrent(int64(p.ScannedFiles))
+				} else {
+					phb.Set("prefix", pbi.t)
+				}
+			}
 			if ph.Done {
 				if ph.Needed == 0 {
 					// Fake the amounts to get 100% bar.
@@ -133,6 +142,11 @@ func makeFancyProgressFunc(product string, installDir string, gameVersion *strin
 				phb.Finish() // Safe to call multiple times.
 			}
 		}
+		if p.Paused {
+			statsBar.Set("prefix", "Paused, download speed: ")
+		} else {
+			statsBar.Set("prefix", "Download speed: ")
+		}
 		statsBar.Set("speed", p.DownloadSpeed)
 		statsBar.Set("bytesTotal", p.DownloadTotalBytes)
 	}
@@ -173,7 +187,15 @@ func plainProgress(p patcher.Progress) {
 			return fmt.Sprintf("%d/%s (%.1f%%, %s)", ph.Completed, neededStr, perc, phaseTime(ph))
 		}
 	}
-	fmt.Printf("Verify: %s, Download: %s, Apply: %s, DL: %s/s, %s total\n",
-		phaseProgress(p.Verify), phaseProgress(p.Download), phaseProgress(p.Apply),
+	pausedStr := ""
+	if p.Paused {
+		pausedStr = "[paused] "
+	}
+	verifyStr := phaseProgress(p.Verify)
+	if p.Scanning {
+		verifyStr = fmt.Sprintf("scanning, %d files found (%s)", p.ScannedFiles, phaseTime(p.Verify))
+	}
+	fmt.Printf("%sVerify: %s, Download: %s, Apply: %s, DL: %s/s, %s total\n",
+		pausedStr, verifyStr, phaseProgress(p.Download), phaseProgress(p.Apply),
 		byteStr(p.DownloadSpeed), byteStr(p.DownloadTotalBytes))
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pminten/totemarts-patcher-cli/lib/patcher"
+)
+
+// How long stopping the status server may wait for requests in progress.
+const statusShutdownTimeout = 5 * time.Second
+
+// A statusServer serves the latest progress as JSON over HTTP, see --status-addr. It also lets local programs
+// throttle and pause the patcher, which is the only way to do that on Windows (there are no SIGUSR1 and SIGUSR2).
+type statusServer struct {
+	mu       sync.Mutex
+	product  string
+	progress patcher.Progress
+	throttle *patcher.Throttle
+	server   *http.Server
+}
+
+// statusResponse is what the status server sends: the progress, plus some fields derived from it.
+type statusResponse struct {
+	patcher.Progress
+
+	// Code of the game being updated.
+	Product string `json:"product"`
+
+	// Estimated seconds until the downloads are done, -1 if unknown.
+	DownloadEta int64 `json:"downloadEta"`
+}
+
+// controlResponse is what the control endpoints send: the state of the throttle after the change.
+type controlResponse struct {
+	ThrottleLevel string `json:"throttleLevel"`
+	Paused        bool   `json:"paused"`
+}
+
+// statusListenAddr returns the address to listen on for --status-addr. Without a host (e.g. ":8080") only
+// localhost is listened on, to listen on all interfaces use something like "0.0.0.0:8080".
+func statusListenAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("--status-addr must be like localhost:8080 or :8080, got '%s'", addr)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// startStatusServer starts serving the progress on /status and the throttle controls on /throttle, /pause and
+// /resume.
+func startStatusServer(addr string, product string, throttle *patcher.Throttle) (*statusServer, error) {
+	listenAddr, err := statusListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	// Listening here rather than in the goroutine, so a port that's in use is reported.
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on '%s': %w", listenAddr, err)
+	}
+	s := &statusServer{product: product, throttle: throttle}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.serveStatus)
+	mux.HandleFunc("/throttle", s.control(func() {
+		log.Printf("Throttle level changed through status server, now %s.", s.throttle.Cycle())
+	}))
+	mux.HandleFunc("/pause", s.control(func() {
+		log.Printf("Pausing (requested through status server).")
+		s.throttle.Pause()
+	}))
+	mux.HandleFunc("/resume", s.control(func() {
+		log.Printf("Resuming (requested through status server).")
+		s.throttle.Resume()
+	}))
+	s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Status server stopped: %s", err)
+		}
+	}()
+	log.Printf("Serving progress on http://%s/status", listener.Addr())
+	return s, nil
+}
+
+// update sets the progress to serve.
+func (s *statusServer) update(p patcher.Progress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.progress = p
+}
+
+// serveStatus serves the latest progress.
+func (s *statusServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	resp := statusResponse{Progress: s.progress, Product: s.product, DownloadEta: -1}
+	s.mu.Unlock()
+	if eta, known := resp.Progress.DownloadEta(); known {
+		resp.DownloadEta = int64(eta / time.Second)
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(data)
+}
+
+// control returns a handler for a control endpoint, which calls change on a POST request and responds with the
+// new state of the throttle. Only requests from the machine itself are accepted, even if the server listens on
+// all interfaces to let other machines see the status.
+func (s *statusServer) control(change func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isLoopback(r.RemoteAddr) {
+			http.Error(w, "only allowed from localhost", http.StatusForbidden)
+			return
+		}
+		change()
+		data, err := json.Marshal(controlResponse{
+			ThrottleLevel: s.throttle.Level().String(),
+			Paused:        s.throttle.Paused(),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write(data)
+	}
+}
+
+// isLoopback returns whether a remote address (host:port) is on the machine itself.
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// stop stops the status server, waiting a bit for requests in progress.
+func (s *statusServer) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), statusShutdownTimeout)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Printf("Couldn't stop status server cleanly: %s", err)
+	}
+}
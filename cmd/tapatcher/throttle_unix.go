@@ -0,0 +1,40 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pminten/totemarts-patcher-cli/lib/patcher"
+)
+
+// watchThrottleSignals cycles the throttle level every time SIGUSR1 is received and
+// pauses or resumes on SIGUSR2, until the context is canceled.
+func watchThrottleSignals(ctx context.Context, throttle *patcher.Throttle) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(sigChan)
+		for {
+			select {
+			case sig := <-sigChan:
+				if sig == syscall.SIGUSR2 {
+					if throttle.TogglePause() {
+						log.Printf("Received SIGUSR2, pausing.")
+					} else {
+						log.Printf("Received SIGUSR2, resuming.")
+					}
+					continue
+				}
+				level := throttle.Cycle()
+				log.Printf("Received SIGUSR1, throttle level is now %s.", level)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
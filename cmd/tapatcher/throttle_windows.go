@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+
+	"github.com/pminten/totemarts-patcher-cli/lib/patcher"
+)
+
+// watchThrottleSignals does nothing on Windows, there's no SIGUSR1 or SIGUSR2 there. The control endpoints of
+// the status server (see --status-addr) are used instead.
+func watchThrottleSignals(ctx context.Context, throttle *patcher.Throttle) {
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A timestamp is a command line argument for a point in time, either RFC 3339 (e.g. "2024-01-31T18:00:00Z")
+// or a local date with an optional time (e.g. "2024-01-31" or "2024-01-31 18:00").
+type timestamp time.Time
+
+// Formats accepted in local time, besides RFC 3339.
+var localTimestampFormats = []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// UnmarshalText implements (encoding.TextUnmarshaler).UnmarshalText
+func (t *timestamp) UnmarshalText(text []byte) error {
+	str := strings.TrimSpace(string(text))
+	if parsed, err := time.Parse(time.RFC3339, str); err == nil {
+		*t = timestamp(parsed)
+		return nil
+	}
+	for _, format := range localTimestampFormats {
+		if parsed, err := time.ParseInLocation(format, str, time.Local); err == nil {
+			*t = timestamp(parsed)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid time %q, expected something like 2024-01-31, 2024-01-31 18:00 or "+
+		"2024-01-31T18:00:00Z", string(text))
+}
@@ -5,9 +5,12 @@ go 1.21
 require (
 	github.com/alecthomas/kong v0.8.1
 	github.com/cheggaaa/pb/v3 v3.1.4
+	github.com/klauspost/compress v1.17.4
 	github.com/stretchr/testify v1.8.4
+	go.etcd.io/bbolt v1.3.8
 	golang.org/x/sync v0.5.0
 	golang.org/x/sys v0.15.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -22,5 +25,4 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
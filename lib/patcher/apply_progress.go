@@ -0,0 +1,165 @@
+package patcher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Filename (relative to the install dir) of the file recording which patches have been applied, so a run
+// that's interrupted during the apply phase doesn't need to compute the checksums of the patched files again.
+const ApplyProgressFilename = "patch/.taprogress"
+
+// An applyProgressRecord is a line in the apply progress file: a patch that was applied to get a temporary
+// file with the checksum the file should have.
+type applyProgressRecord struct {
+	FilePath     string    `json:"filePath"`
+	Checksum     string    `json:"checksum"`
+	TempFilename string    `json:"tempFilename"`
+	Size         int64     `json:"size"`
+	LastChange   time.Time `json:"lastChange"`
+}
+
+// An applyProgress keeps track of the applied patches in the apply progress file. Safe for concurrent use.
+type applyProgress struct {
+	mu       sync.Mutex
+	filename string
+	// Opened when the first patch is recorded.
+	file    *os.File
+	applied map[string]applyProgressRecord
+}
+
+// readApplyProgress reads the apply progress file left by an earlier run, if any. A file that can't be read
+// or decoded is ignored, at worst the checksums of the patched files are computed again.
+func readApplyProgress(installDir string) *applyProgress {
+	ap := &applyProgress{
+		filename: filepath.Join(installDir, ApplyProgressFilename),
+		applied:  make(map[string]applyProgressRecord),
+	}
+	data, err := os.ReadFile(ap.filename)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Ignoring apply progress file '%s', couldn't read it: %s", ap.filename, err)
+		}
+		return ap
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var record applyProgressRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// An incomplete last line from an interrupted write is expected, anything else means the file
+			// can't be trusted.
+			if scanner.Scan() || bytes.HasSuffix(data, []byte("\n")) {
+				log.Printf("Ignoring apply progress file '%s', it's corrupt: %s", ap.filename, err)
+				ap.applied = make(map[string]applyProgressRecord)
+			}
+			break
+		}
+		ap.applied[record.FilePath] = record
+	}
+	// The file is rewritten from scratch once something is recorded, so stale or corrupt data doesn't stick.
+	return ap
+}
+
+// isApplied returns whether an earlier run applied the patch of an update and the resulting temporary file
+// is still there, unchanged. Only the size and the time of the last change are checked, not the checksum.
+func (ap *applyProgress) isApplied(installDir string, ui UpdateInstr) bool {
+	ap.mu.Lock()
+	record, found := ap.applied[ui.FilePath]
+	ap.mu.Unlock()
+	if !found || !HashEqual(record.Checksum, ui.Checksum) || record.TempFilename != ui.TempFilename {
+		return false
+	}
+	fileInfo, err := os.Stat(filepath.Join(installDir, ui.TempFilename))
+	if err != nil {
+		return false
+	}
+	return fileInfo.Size() == record.Size && fileInfo.ModTime().Equal(record.LastChange)
+}
+
+// record records that the patch of an update has been applied, the temporary file must exist.
+func (ap *applyProgress) record(installDir string, ui UpdateInstr) error {
+	tempPath := filepath.Join(installDir, ui.TempFilename)
+	fileInfo, err := os.Stat(tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to get basic metadata of '%s': %w", tempPath, err)
+	}
+	record := applyProgressRecord{
+		FilePath:     ui.FilePath,
+		Checksum:     ui.Checksum,
+		TempFilename: ui.TempFilename,
+		Size:         fileInfo.Size(),
+		LastChange:   fileInfo.ModTime(),
+	}
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("couldn't encode apply progress record for '%s': %w", ui.FilePath, err)
+	}
+	encoded = append(encoded, '\n')
+
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	if ap.file == nil {
+		if err := ap.openLocked(); err != nil {
+			return err
+		}
+	}
+	// A single write, so a crash at worst leaves an incomplete last line.
+	if _, err := ap.file.Write(encoded); err != nil {
+		return fmt.Errorf("couldn't write to apply progress file '%s': %w", ap.filename, err)
+	}
+	if err := ap.file.Sync(); err != nil {
+		return fmt.Errorf("couldn't sync apply progress file '%s': %w", ap.filename, err)
+	}
+	ap.applied[ui.FilePath] = record
+	return nil
+}
+
+// openLocked creates the apply progress file, writing the records of the earlier run that are still valid.
+func (ap *applyProgress) openLocked() error {
+	var buf bytes.Buffer
+	for _, record := range ap.applied {
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("couldn't encode apply progress record for '%s': %w", record.FilePath, err)
+		}
+		buf.Write(encoded)
+		buf.WriteByte('\n')
+	}
+	if err := writeFileAtomic(ap.filename, buf.Bytes()); err != nil {
+		return fmt.Errorf("couldn't write apply progress file '%s': %w", ap.filename, err)
+	}
+	file, err := os.OpenFile(ap.filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't open apply progress file '%s': %w", ap.filename, err)
+	}
+	ap.file = file
+	return nil
+}
+
+// close closes the apply progress file, it's kept on disk for the next run.
+func (ap *applyProgress) close() {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	if ap.file != nil {
+		ap.file.Close()
+		ap.file = nil
+	}
+}
+
+// removeApplyProgress removes the apply progress file, once everything is done it's no longer needed.
+func removeApplyProgress(installDir string) error {
+	filename := filepath.Join(installDir, ApplyProgressFilename)
+	if err := os.Remove(filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("couldn't remove apply progress file '%s': %w", filename, err)
+	}
+	return nil
+}
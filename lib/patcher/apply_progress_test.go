@@ -0,0 +1,104 @@
+package patcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// copyingBackend applies a patch by copying the patch file.
+type copyingBackend struct{}
+
+func (copyingBackend) ApplyPatch(
+	_ context.Context, _ *string, patchPath string, newPath string, _ string, _ int64,
+) error {
+	data, err := os.ReadFile(patchPath)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(newPath, data, 0644)
+}
+
+func TestApplyProgress(t *testing.T) {
+	installDir := t.TempDir()
+	require.NoError(t, createPatchDirs(installDir))
+	ui := UpdateInstr{FilePath: "file", TempFilename: "patch/apply/00000_new", Checksum: "abc"}
+	tempPath := filepath.Join(installDir, ui.TempFilename)
+	require.NoError(t, os.WriteFile(tempPath, []byte("new"), 0644))
+
+	ap := readApplyProgress(installDir)
+	require.False(t, ap.isApplied(installDir, ui))
+	require.NoError(t, ap.record(installDir, ui))
+	require.True(t, ap.isApplied(installDir, ui))
+	ap.close()
+
+	// The next run sees it, unless the instruction or the file changed.
+	ap = readApplyProgress(installDir)
+	require.True(t, ap.isApplied(installDir, ui))
+	require.False(t, ap.isApplied(installDir, UpdateInstr{FilePath: "file", TempFilename: ui.TempFilename,
+		Checksum: "def"}))
+	require.NoError(t, os.WriteFile(tempPath, []byte("newer"), 0644))
+	require.False(t, ap.isApplied(installDir, ui))
+
+	// An incomplete last line is ignored, the rest is kept.
+	require.NoError(t, ap.record(installDir, ui))
+	ap.close()
+	progressPath := filepath.Join(installDir, ApplyProgressFilename)
+	file, err := os.OpenFile(progressPath, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"filePath":"oth`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.True(t, readApplyProgress(installDir).isApplied(installDir, ui))
+
+	// A corrupt file is ignored entirely.
+	require.NoError(t, os.WriteFile(progressPath, []byte("garbage\n"), 0644))
+	require.False(t, readApplyProgress(installDir).isApplied(installDir, ui))
+
+	require.NoError(t, removeApplyProgress(installDir))
+	require.NoFileExists(t, progressPath)
+	require.NoError(t, removeApplyProgress(installDir))
+}
+
+func TestRunPatchPhaseUsesApplyProgress(t *testing.T) {
+	installDir := t.TempDir()
+	require.NoError(t, createPatchDirs(installDir))
+	data := []byte("new data")
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "patch", "new"), data, 0644))
+	toUpdate := []UpdateInstr{
+		{PatchPath: "patch/new", FilePath: "file", TempFilename: "patch/apply/00000_new",
+			Checksum: HashBytes(data), Size: int64(len(data))},
+	}
+	tempPath := filepath.Join(installDir, toUpdate[0].TempFilename)
+	// An earlier run applied the patch but was interrupted before moving the file into place.
+	ap := readApplyProgress(installDir)
+	require.NoError(t, copyingBackend{}.ApplyPatch(context.Background(), nil,
+		filepath.Join(installDir, "patch", "new"), tempPath, "", 0))
+	require.NoError(t, ap.record(installDir, toUpdate[0]))
+	ap.close()
+
+	// Change the contents without changing size and time, if the checksum were computed the file wouldn't
+	// match and the failing backend would be used.
+	info, err := os.Stat(tempPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tempPath, []byte("NEW DATA"), 0644))
+	require.NoError(t, os.Chtimes(tempPath, info.ModTime(), info.ModTime()))
+
+	progress := NewProgress()
+	err = runPatchPhase(context.Background(), toUpdate, nil, NewManifest("foo"), installDir, failingBackend{},
+		progress, 1, nil, false, false, newVerifiedPatches(), 0, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, progress.Current().Apply.Completed)
+	require.FileExists(t, filepath.Join(installDir, "file"))
+
+	// A successful run removes the file.
+	config := PatcherConfig{InstallDir: installDir, ApplyWorkers: 1, KeepPatches: true}
+	require.FileExists(t, filepath.Join(installDir, ApplyProgressFilename))
+	err = runApply(context.Background(), &DeterminedActions{}, NewManifest("foo"), config, copyingBackend{},
+		NewProgress(), newVerifiedPatches())
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(installDir, ApplyProgressFilename))
+}
@@ -0,0 +1,140 @@
+package patcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Directory in the patch dir where the apply phase keeps the files it replaces or deletes, see
+// PatcherConfig.AtomicApply.
+const backupDirname = "patch/backup"
+
+// An applyRollback records the changes the apply phase makes to the install dir, so they can be undone if it
+// fails partway, see PatcherConfig.AtomicApply. The original files are moved to the backup dir instead of
+// being overwritten or deleted. A nil applyRollback doesn't record anything, so files are replaced directly.
+type applyRollback struct {
+	installDir string
+	manifest   *Manifest
+	// In the order they were made.
+	changes []applyChange
+}
+
+// An applyChange is a file in the install dir that was replaced or deleted by the apply phase.
+type applyChange struct {
+	// Path of the file relative to the install dir.
+	filePath string
+	// Whether the patched file was moved into place yet.
+	moved bool
+	// Whether there was an original file, which is in the backup dir.
+	backedUp bool
+	// The manifest entry of the original file, nil if there was none.
+	entry *ManifestEntry
+}
+
+// newApplyRollback returns an applyRollback if atomic is set, otherwise nil.
+func newApplyRollback(installDir string, manifest *Manifest, atomic bool) *applyRollback {
+	if !atomic {
+		return nil
+	}
+	return &applyRollback{installDir: installDir, manifest: manifest}
+}
+
+// backup moves a file in the install dir to the backup dir before it's replaced (by a patched file, which
+// should then be moved into place and passed to moved) or deleted. It's fine if the file doesn't exist.
+func (r *applyRollback) backup(ctx context.Context, filePath string) error {
+	if r == nil {
+		return nil
+	}
+	realPath := filepath.Join(r.installDir, filePath)
+	backupPath := filepath.Join(r.installDir, backupDirname, filePath)
+	change := applyChange{filePath: filePath}
+	if entry, found := r.manifest.Entries[filePath]; found {
+		change.entry = &entry
+	}
+	if _, err := os.Lstat(realPath); errors.Is(err, fs.ErrNotExist) {
+		r.changes = append(r.changes, change)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(backupPath), 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory for '%s': %w", realPath, err)
+	}
+	LogVerbose(ctx, "Moving '%s' to '%s' in case the update has to be rolled back.", realPath, backupPath)
+	if err := retryLockedFile(ctx, realPath, func() error { return os.Rename(realPath, backupPath) }); err != nil {
+		return fmt.Errorf("failed to back up '%s' to '%s': %w", realPath, backupPath, err)
+	}
+	change.backedUp = true
+	r.changes = append(r.changes, change)
+	return nil
+}
+
+// moved records that the patched file for the last backup was moved into place.
+func (r *applyRollback) moved() {
+	if r == nil {
+		return
+	}
+	r.changes[len(r.changes)-1].moved = true
+}
+
+// rollback undoes the recorded changes, newest first. Patched files are removed, as one of them may be the
+// reason the phase failed (e.g. corrupted after moving it into place). What can't be undone is logged and kept
+// in the backup dir, it's not an error as the next run repairs the install dir.
+func (r *applyRollback) rollback() {
+	if r == nil || len(r.changes) == 0 {
+		return
+	}
+	log.Printf("Rolling back %d changed files.", len(r.changes))
+	failed := 0
+	for i := len(r.changes) - 1; i >= 0; i-- {
+		if err := r.undo(r.changes[i]); err != nil {
+			log.Printf("WARNING: %s.", err)
+			failed++
+		}
+	}
+	r.changes = nil
+	if failed > 0 {
+		log.Printf("WARNING: %d files couldn't be rolled back, the install dir is partly updated. "+
+			"Run the update again to finish it.", failed)
+		return
+	}
+	if err := r.discard(); err != nil {
+		log.Printf("Warning: %s.", err)
+	}
+}
+
+// undo restores the original file of a change.
+func (r *applyRollback) undo(change applyChange) error {
+	realPath := filepath.Join(r.installDir, change.filePath)
+	if change.moved {
+		if err := os.Remove(realPath); err != nil {
+			return fmt.Errorf("failed to remove patched file '%s': %w", realPath, err)
+		}
+	}
+	if change.backedUp {
+		backupPath := filepath.Join(r.installDir, backupDirname, change.filePath)
+		if err := os.Rename(backupPath, realPath); err != nil {
+			return fmt.Errorf("failed to restore '%s' from '%s': %w", realPath, backupPath, err)
+		}
+	}
+	if change.entry != nil {
+		r.manifest.Add(change.filePath, change.entry.LastChange, change.entry.LastChecksum)
+	}
+	return nil
+}
+
+// discard removes the backups once the apply phase succeeded.
+func (r *applyRollback) discard() error {
+	if r == nil {
+		return nil
+	}
+	backupDir := filepath.Join(r.installDir, backupDirname)
+	if err := os.RemoveAll(backupDir); err != nil {
+		return fmt.Errorf("failed to remove backup dir '%s': %w", backupDir, err)
+	}
+	r.changes = nil
+	return nil
+}
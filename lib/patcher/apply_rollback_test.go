@@ -0,0 +1,122 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// setUpRollbackTest creates an install dir with files f0 to f3 (except f1, which is new) and patches for them,
+// of which the one for f2 is corrupt. With VerifyAfterMove moving the third file into place fails.
+func setUpRollbackTest(t *testing.T) (string, []UpdateInstr, *Manifest) {
+	installDir := t.TempDir()
+	require.NoError(t, createPatchDirs(installDir))
+	manifest := NewManifest("foo")
+	toUpdate := make([]UpdateInstr, 0)
+	for i := 0; i < 4; i++ {
+		filePath := fmt.Sprintf("f%d", i)
+		if i != 1 {
+			old := []byte(fmt.Sprintf("old%d", i))
+			require.NoError(t, os.WriteFile(filepath.Join(installDir, filePath), old, 0644))
+			info, err := os.Stat(filepath.Join(installDir, filePath))
+			require.NoError(t, err)
+			manifest.Add(filePath, info.ModTime(), HashBytes(old))
+		}
+		patched := []byte(fmt.Sprintf("new%d", i))
+		patchPath := fmt.Sprintf("patch/new%d", i)
+		patchData := patched
+		if i == 2 {
+			patchData = []byte("corrupt")
+		}
+		require.NoError(t, os.WriteFile(filepath.Join(installDir, patchPath), patchData, 0644))
+		toUpdate = append(toUpdate, UpdateInstr{PatchPath: patchPath, FilePath: filePath,
+			TempFilename: fmt.Sprintf("patch/apply/%05d_new%d", i, i), Checksum: HashBytes(patched)})
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "obsolete"), []byte("obsolete"), 0644))
+	return installDir, toUpdate, manifest
+}
+
+func TestRunPatchPhaseAtomicRollsBack(t *testing.T) {
+	installDir, toUpdate, manifest := setUpRollbackTest(t)
+	before := make(map[string]ManifestEntry)
+	for k, v := range manifest.Entries {
+		before[k] = v
+	}
+
+	err := runPatchPhase(context.Background(), toUpdate, []string{"obsolete"}, manifest, installDir,
+		copyingBackend{}, NewProgress(), 2, nil, false, true, newVerifiedPatches(), 0, true)
+	require.ErrorContains(t, err, "no longer has checksum")
+
+	// The files before the failing one are restored, the new file is gone again.
+	for _, filePath := range []string{"f0", "f2", "f3"} {
+		data, err := os.ReadFile(filepath.Join(installDir, filePath))
+		require.NoError(t, err)
+		require.Equal(t, "old"+filePath[1:], string(data))
+	}
+	require.NoFileExists(t, filepath.Join(installDir, "f1"))
+	require.FileExists(t, filepath.Join(installDir, "obsolete"))
+	require.NoDirExists(t, filepath.Join(installDir, backupDirname))
+	// The manifest describes the restored files, so they don't have to be verified again.
+	for filePath, entry := range before {
+		info, err := os.Stat(filepath.Join(installDir, filePath))
+		require.NoError(t, err)
+		require.True(t, manifest.Check(filePath, info.ModTime(), entry.LastChecksum), filePath)
+	}
+}
+
+func TestRunPatchPhaseAtomicSucceeds(t *testing.T) {
+	installDir, toUpdate, manifest := setUpRollbackTest(t)
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "patch", "new2"), []byte("new2"), 0644))
+
+	err := runPatchPhase(context.Background(), toUpdate, []string{"obsolete"}, manifest, installDir,
+		copyingBackend{}, NewProgress(), 2, nil, false, true, newVerifiedPatches(), 0, true)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		data, err := os.ReadFile(filepath.Join(installDir, fmt.Sprintf("f%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("new%d", i), string(data))
+	}
+	require.NoFileExists(t, filepath.Join(installDir, "obsolete"))
+	require.NoDirExists(t, filepath.Join(installDir, backupDirname))
+}
+
+func TestRunPatchPhaseNotAtomic(t *testing.T) {
+	installDir, toUpdate, manifest := setUpRollbackTest(t)
+
+	err := runPatchPhase(context.Background(), toUpdate, nil, manifest, installDir, copyingBackend{},
+		NewProgress(), 2, nil, false, true, newVerifiedPatches(), 0, false)
+	require.ErrorContains(t, err, "no longer has checksum")
+	// Without AtomicApply the files moved into place stay there.
+	data, err := os.ReadFile(filepath.Join(installDir, "f0"))
+	require.NoError(t, err)
+	require.Equal(t, "new0", string(data))
+	require.FileExists(t, filepath.Join(installDir, "f1"))
+	require.NoDirExists(t, filepath.Join(installDir, backupDirname))
+}
+
+func TestApplyRollbackDeletedFile(t *testing.T) {
+	installDir := t.TempDir()
+	old := filepath.Join(installDir, "dir", "old")
+	require.NoError(t, os.MkdirAll(filepath.Dir(old), 0755))
+	require.NoError(t, os.WriteFile(old, []byte("old"), 0644))
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(old, modTime, modTime))
+	manifest := NewManifest("foo")
+	manifest.Add("dir/old", modTime, HashBytes([]byte("old")))
+
+	rollback := newApplyRollback(installDir, manifest, true)
+	require.NoError(t, rollback.backup(context.Background(), "dir/old"))
+	require.NoFileExists(t, old)
+	rollback.rollback()
+	data, err := os.ReadFile(old)
+	require.NoError(t, err)
+	require.Equal(t, "old", string(data))
+	info, err := os.Stat(old)
+	require.NoError(t, err)
+	require.True(t, manifest.Check("dir/old", info.ModTime(), HashBytes([]byte("old"))))
+}
@@ -0,0 +1,110 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+type typeTokenProvider string
+
+const keyTokenProvider typeTokenProvider = "tokenProvider"
+
+// A tokenCache holds the bearer token from a token provider until the server refuses it.
+type tokenCache struct {
+	provider func(ctx context.Context) (string, error)
+
+	mu    sync.Mutex
+	token string
+	valid bool
+}
+
+// newTokenCache creates a cache for the tokens of a provider, nil if there is no provider.
+func newTokenCache(provider func(ctx context.Context) (string, error)) *tokenCache {
+	if provider == nil {
+		return nil
+	}
+	return &tokenCache{provider: provider}
+}
+
+// WithTokenProvider sets a function that returns a bearer token for fetching metadata and warming caches,
+// like DownloadConfig.TokenProvider does for downloads. It's sent in the Authorization header (replacing one
+// set with WithRequestHeaders). Like those headers it's not sent when checking for patcher updates.
+func WithTokenProvider(ctx context.Context, provider func(ctx context.Context) (string, error)) context.Context {
+	return context.WithValue(ctx, keyTokenProvider, newTokenCache(provider))
+}
+
+// requestTokens returns the tokens of the provider set with WithTokenProvider, nil if there is none.
+func requestTokens(ctx context.Context) *tokenCache {
+	tokens, _ := ctx.Value(keyTokenProvider).(*tokenCache)
+	return tokens
+}
+
+// get returns the token to send, asking the provider for one if there is none. Only one request asks at a
+// time, the others wait for its token.
+func (tc *tokenCache) get(ctx context.Context) (string, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.valid {
+		return tc.token, nil
+	}
+	token, err := tc.provider(ctx)
+	if err != nil {
+		return "", err
+	}
+	tc.token = token
+	tc.valid = true
+	return token, nil
+}
+
+// invalidate drops a token the server refused, so get asks for a new one. If the token was already replaced
+// (because another request got refused too) the replacement is kept.
+func (tc *tokenCache) invalidate(token string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.valid && tc.token == token {
+		tc.valid = false
+	}
+}
+
+// accessDenied returns whether a response means the server refused the credentials, e.g. because a token or
+// signed URL expired. Trying again with the same credentials won't help.
+func accessDenied(resp *http.Response) bool {
+	return resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden)
+}
+
+// sendWithToken sends a request with send, passing it the token to put in the Authorization header. If access
+// is denied the token is replaced and the request sent once more, the response to that is returned whatever
+// it is. Without tokens the request is sent once, with an empty token. What is for error messages.
+func sendWithToken(
+	ctx context.Context,
+	tokens *tokenCache,
+	what string,
+	send func(token string) (*http.Response, error),
+) (*http.Response, error) {
+	if tokens == nil {
+		return send("")
+	}
+	for refreshed := false; ; refreshed = true {
+		token, err := tokens.get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get token for %s: %w", what, err)
+		}
+		resp, err := send(token)
+		if err != nil || !accessDenied(resp) || refreshed {
+			return resp, err
+		}
+		resp.Body.Close()
+		log.Printf("Access denied for %s (status %d), getting a new token.", what, resp.StatusCode)
+		tokens.invalidate(token)
+	}
+}
+
+// setAuthorization puts a bearer token in the Authorization header of a request, unless it's empty.
+func setAuthorization(req *http.Request, token string) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
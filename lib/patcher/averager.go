@@ -33,3 +33,8 @@ func (a *Averager) Average() float64 {
 	}
 	return sum / float64(count)
 }
+
+// Full returns whether there are at least as many measurements as the window.
+func (a *Averager) Full() bool {
+	return a.totalMeasurements >= len(a.measurements)
+}
@@ -32,3 +32,14 @@ func TestAveragerOutsideWindow(t *testing.T) {
 	actual := a.Average()
 	require.InEpsilon(t, expected, actual, 0.01, "expected %f got %f", expected, actual)
 }
+
+func TestAveragerFull(t *testing.T) {
+	a := NewAverager(2)
+	require.False(t, a.Full())
+	a.Add(1)
+	require.False(t, a.Full())
+	a.Add(2)
+	require.True(t, a.Full())
+	a.Add(3)
+	require.True(t, a.Full())
+}
@@ -0,0 +1,169 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// A worker count reaching this fraction of the best throughput is good enough, more workers mostly cost
+// memory and make the machine less responsive.
+const recommendedThroughputFraction = 0.9
+
+// A HashBenchmarkResult is the checksum throughput measured with a number of workers, see BenchmarkHashing.
+type HashBenchmarkResult struct {
+	// Number of files hashed at the same time.
+	Workers int
+	// Number of files hashed.
+	Files int
+	// Total size of the files hashed.
+	Bytes int64
+	// How long hashing took.
+	Duration time.Duration
+	// Whether some of the files were already hashed with a lower worker count, so they were probably read from
+	// the OS cache and the throughput is too optimistic. Happens when the install dir is smaller than the
+	// sample size times the number of worker counts.
+	Reused bool
+}
+
+// MiBPerSecond returns the throughput in MiB per second.
+func (r HashBenchmarkResult) MiBPerSecond() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / (1024 * 1024) / r.Duration.Seconds()
+}
+
+// BenchmarkHashing measures how fast checksums of the files in the install dir are computed (like in the verify
+// phase) with each of the worker counts, in order. Each run hashes files until at least sampleSize bytes are
+// done, taking files no earlier run hashed where possible so the OS cache doesn't skew the results. Nothing is
+// written and the network isn't used. Files that can't be read are skipped with a warning.
+func BenchmarkHashing(
+	ctx context.Context,
+	installDir string,
+	workerCounts []int,
+	sampleSize int64,
+) ([]HashBenchmarkResult, error) {
+	for _, workers := range workerCounts {
+		if err := checkNumWorkers("number of workers", workers); err != nil {
+			return nil, err
+		}
+	}
+	if sampleSize <= 0 {
+		return nil, fmt.Errorf("sample size must be positive, got %d", sampleSize)
+	}
+	log.Printf("Scanning files in '%s'.", installDir)
+	infos, err := ScanFiles(installDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("no files found in '%s' to benchmark with", installDir)
+	}
+	paths := make([]string, 0, len(infos))
+	for path := range infos {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	sampler := benchmarkSampler{installDir: installDir, paths: paths, sizes: make([]int64, len(paths)),
+		hashed: make([]bool, len(paths))}
+	results := make([]HashBenchmarkResult, 0, len(workerCounts))
+	for _, workers := range workerCounts {
+		sample, reused := sampler.next(sampleSize)
+		log.Printf("Hashing %d files with %d workers.", len(sample), workers)
+		start := time.Now()
+		sizes, err := DoInParallelWithResult[string, int64](
+			ctx,
+			func(ctx context.Context, filename string) (int64, error) {
+				return benchmarkHashFile(ctx, filename)
+			},
+			sample,
+			workers,
+		)
+		if err != nil {
+			return nil, err
+		}
+		result := HashBenchmarkResult{Workers: workers, Files: len(sample), Duration: time.Since(start),
+			Reused: reused}
+		for _, size := range sizes {
+			result.Bytes += size
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// RecommendWorkers returns the lowest worker count that reached nearly the best throughput in the results,
+// 0 if there are no results.
+func RecommendWorkers(results []HashBenchmarkResult) int {
+	best := 0.0
+	for _, r := range results {
+		best = max(best, r.MiBPerSecond())
+	}
+	recommended := 0
+	for _, r := range results {
+		if r.MiBPerSecond() >= recommendedThroughputFraction*best && (recommended == 0 || r.Workers < recommended) {
+			recommended = r.Workers
+		}
+	}
+	return recommended
+}
+
+// benchmarkSampler picks the files for each run of BenchmarkHashing, going round the files in order.
+type benchmarkSampler struct {
+	installDir string
+	paths      []string
+	// Size of each file, -1 if it couldn't be determined and 0 if not looked up yet.
+	sizes []int64
+	// Whether each file was picked before.
+	hashed []bool
+	// Index of the next file to pick.
+	pos int
+}
+
+// next returns the real filenames of files with at least sampleSize bytes in total, or all files if there
+// aren't enough. Returns whether any of them was picked before.
+func (s *benchmarkSampler) next(sampleSize int64) ([]string, bool) {
+	sample := make([]string, 0)
+	reused := false
+	total := int64(0)
+	for i := 0; i < len(s.paths) && total < sampleSize; i++ {
+		idx := s.pos
+		s.pos = (s.pos + 1) % len(s.paths)
+		filename := filepath.Join(s.installDir, s.paths[idx])
+		if s.sizes[idx] == 0 {
+			s.sizes[idx] = -1
+			if info, err := os.Stat(filename); err == nil {
+				s.sizes[idx] = info.Size()
+			}
+		}
+		if s.sizes[idx] <= 0 {
+			// Empty files say nothing about throughput.
+			continue
+		}
+		reused = reused || s.hashed[idx]
+		s.hashed[idx] = true
+		sample = append(sample, filename)
+		total += s.sizes[idx]
+	}
+	return sample, reused
+}
+
+// benchmarkHashFile computes the checksum of a file and returns its size, 0 if it can't be read.
+func benchmarkHashFile(ctx context.Context, filename string) (int64, error) {
+	size := int64(0)
+	_, err := hasher(ctx).HashFile(ctx, filename, func(hashed int64) { size = hashed })
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		log.Printf("Warning: skipping '%s' in benchmark: %s", filename, err)
+		return 0, nil
+	}
+	return size, nil
+}
@@ -0,0 +1,57 @@
+package patcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBenchmarkHashing(t *testing.T) {
+	installDir := t.TempDir()
+	for i := 0; i < 6; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 1000)
+		require.NoError(t, os.WriteFile(filepath.Join(installDir, fmt.Sprintf("file%d", i)), data, 0644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "empty"), nil, 0644))
+
+	results, err := BenchmarkHashing(context.Background(), installDir, []int{1, 2, 4}, 2000)
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	for i, workers := range []int{1, 2, 4} {
+		require.Equal(t, workers, results[i].Workers)
+		require.Equal(t, 2, results[i].Files)
+		require.Equal(t, int64(2000), results[i].Bytes)
+		// Each run got files of its own.
+		require.False(t, results[i].Reused)
+	}
+
+	// Not enough files for separate runs.
+	results, err = BenchmarkHashing(context.Background(), installDir, []int{1, 2}, 5000)
+	require.NoError(t, err)
+	require.Equal(t, 5, results[0].Files)
+	require.False(t, results[0].Reused)
+	require.True(t, results[1].Reused)
+
+	_, err = BenchmarkHashing(context.Background(), installDir, []int{0}, 5000)
+	require.Error(t, err)
+	_, err = BenchmarkHashing(context.Background(), t.TempDir(), []int{1}, 5000)
+	require.ErrorContains(t, err, "no files found")
+}
+
+func TestRecommendWorkers(t *testing.T) {
+	result := func(workers int, mibPerSecond int64) HashBenchmarkResult {
+		return HashBenchmarkResult{Workers: workers, Bytes: mibPerSecond * 1024 * 1024, Duration: time.Second}
+	}
+	require.Equal(t, 0, RecommendWorkers(nil))
+	// 4 workers are within 10% of the best, so 8 aren't worth it.
+	require.Equal(t, 4, RecommendWorkers([]HashBenchmarkResult{
+		result(1, 100), result(2, 180), result(4, 300), result(8, 320), result(16, 310),
+	}))
+	require.Equal(t, 1, RecommendWorkers([]HashBenchmarkResult{result(1, 100), result(2, 95)}))
+}
@@ -0,0 +1,74 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// A BsDiff instance provides helpers for invoking the bspatch program, for patches made with bsdiff.
+type BsDiff struct {
+	// Path to the binary.
+	binPath string
+
+	// If true ApplyPatch leaves the (partial) output file in place when it fails. Useful for debugging.
+	KeepTemp bool
+}
+
+// Create a BsDiff instance.
+//
+// If the binPath is just a basename without directory it will be looked up in PATH.
+// To use binary in the current directory use something like './bspatch'.
+func NewBsDiff(binPath string) (*BsDiff, error) {
+	realPath, err := findBinary(binPath)
+	if err != nil {
+		return nil, err
+	}
+	return &BsDiff{binPath: realPath}, nil
+}
+
+// ApplyPatch runs the bspatch binary, outputting to newPath, and validates the checksum of the result.
+// If oldPath is not nil it's a delta patch, otherwise it's a full patch, i.e. a delta against an empty file.
+//
+// On failure the output file is removed (unless KeepTemp is set).
+func (b BsDiff) ApplyPatch(
+	ctx context.Context,
+	oldPath *string,
+	patchPath string,
+	newPath string,
+	expectedChecksum string,
+	expectedSize int64,
+) (retErr error) {
+	var what string
+	var sourcePath string
+	if oldPath == nil {
+		what = fmt.Sprintf("applying full patch '%s' to get '%s'", patchPath, newPath)
+		// bspatch always needs a source file.
+		emptyFile, err := os.CreateTemp(filepath.Dir(newPath), "empty-")
+		if err != nil {
+			return fmt.Errorf("%s failed (create empty source file): %w", what, err)
+		}
+		emptyFile.Close()
+		defer os.Remove(emptyFile.Name())
+		sourcePath = emptyFile.Name()
+	} else {
+		what = fmt.Sprintf("applying delta patch '%s' to '%s' to get '%s'", patchPath, *oldPath, newPath)
+		sourcePath = *oldPath
+	}
+
+	defer func() {
+		if retErr != nil && !b.KeepTemp {
+			removePartialOutput(newPath)
+		}
+	}()
+
+	cmd := exec.CommandContext(ctx, b.binPath, sourcePath, newPath, patchPath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %w; bspatch said: %s", what, err, strings.TrimSpace(string(output)))
+	}
+
+	return checkOutputChecksum(ctx, what, newPath, expectedChecksum)
+}
@@ -0,0 +1,56 @@
+package patcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The fake bspatch "applies" a patch by appending it to the old file: bspatch old new patch.
+const fakeBsPatchScript = "cat \"$1\" \"$3\" > \"$2\"\n"
+
+func TestBsDiffApplyDeltaPatch(t *testing.T) {
+	bsdiff, err := NewBsDiff(fakeBinary(t, "bspatch", fakeBsPatchScript))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old")
+	patchPath := filepath.Join(dir, "patch")
+	newPath := filepath.Join(dir, "new")
+	require.NoError(t, os.WriteFile(oldPath, []byte("old "), 0644))
+	require.NoError(t, os.WriteFile(patchPath, []byte("patch"), 0644))
+	err = bsdiff.ApplyPatch(context.Background(), &oldPath, patchPath, newPath, HashBytes([]byte("old patch")), 9)
+	require.NoError(t, err)
+	data, err := os.ReadFile(newPath)
+	require.NoError(t, err)
+	require.Equal(t, "old patch", string(data))
+}
+
+func TestBsDiffApplyFullPatch(t *testing.T) {
+	bsdiff, err := NewBsDiff(fakeBinary(t, "bspatch", fakeBsPatchScript))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	patchPath := filepath.Join(dir, "patch")
+	newPath := filepath.Join(dir, "new")
+	require.NoError(t, os.WriteFile(patchPath, []byte("patch"), 0644))
+	err = bsdiff.ApplyPatch(context.Background(), nil, patchPath, newPath, HashBytes([]byte("patch")), 5)
+	require.NoError(t, err)
+	// The temporary empty source file is cleaned up.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
+
+func TestBsDiffChecksumMismatchRemovesOutput(t *testing.T) {
+	bsdiff, err := NewBsDiff(fakeBinary(t, "bspatch", fakeBsPatchScript))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	patchPath := filepath.Join(dir, "patch")
+	newPath := filepath.Join(dir, "new")
+	require.NoError(t, os.WriteFile(patchPath, []byte("patch"), 0644))
+	err = bsdiff.ApplyPatch(context.Background(), nil, patchPath, newPath, "abc", 5)
+	require.ErrorContains(t, err, "expected it to produce file with checksum")
+	require.NoFileExists(t, newPath)
+}
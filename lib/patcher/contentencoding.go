@@ -0,0 +1,47 @@
+package patcher
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The response has a content encoding the patcher can't decompress, asking the same server again won't help.
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// contentEncoding returns the Content-Encoding of a response in lower case, "" if the body isn't encoded.
+//
+// Go's HTTP client asks for gzip itself on requests without a range and then decompresses the body and drops
+// the header, those responses aren't encoded as far as the patcher can tell.
+func contentEncoding(resp *http.Response) string {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "identity" {
+		return ""
+	}
+	return encoding
+}
+
+// decodeBody wraps a response body in a decompressor for its content encoding (gzip or zstd), so what's hashed
+// and stored is the file itself rather than the compressed stream. Closing the returned reader releases the
+// decompressor, not the body.
+func decodeBody(body io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "":
+		return io.NopCloser(body), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "zstd":
+		decoder, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encoding)
+	}
+}
@@ -0,0 +1,137 @@
+package patcher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+// compressBytes compresses data with gzip or zstd.
+func compressBytes(t *testing.T, encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zstd":
+		w, err = zstd.NewWriter(&buf)
+		require.NoError(t, err)
+	default:
+		// Pretend, it's only for checking that unknown encodings are rejected.
+		return data
+	}
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// serveEncoded returns a test server that always sends data compressed with the encoding, like a mirror that
+// compresses patch files whether asked or not. Range requests get a range of the compressed data. The Range
+// header of every request is appended to ranges.
+func serveEncoded(t *testing.T, encoding string, data []byte, ranges *[]string) *url.URL {
+	compressed := compressBytes(t, encoding, data)
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*ranges = append(*ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Encoding", encoding)
+		if r.Header.Get("Range") != "" {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 5-%d/%d", len(compressed)-1, len(compressed)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(compressed[5:])
+			return
+		}
+		_, _ = w.Write(compressed)
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+	return location
+}
+
+func TestDownloadFileContentEncoding(t *testing.T) {
+	data := bytes.Repeat([]byte("some compressible patch data "), 1000)
+	for _, encoding := range []string{"gzip", "zstd"} {
+		var ranges []string
+		location := serveEncoded(t, encoding, data, &ranges)
+		config := testDownloadConfig()
+		// Otherwise Go's HTTP client asks for gzip itself and decompresses it before the patcher sees it.
+		config.Headers = map[string]string{"Accept-Encoding": encoding}
+		config.MaxAttempts = 0
+		d := newTestDownloader(t, config)
+
+		filename := filepath.Join(t.TempDir(), "patch")
+		err := d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+		require.NoError(t, err, encoding)
+		actual, err := os.ReadFile(filename)
+		require.NoError(t, err)
+		require.Equal(t, data, actual, encoding)
+		require.Equal(t, []string{""}, ranges, encoding)
+
+		// The rest of a partial download can't be taken from compressed data, it starts over.
+		ranges = nil
+		filename = filepath.Join(t.TempDir(), "patch")
+		require.NoError(t, os.WriteFile(partFilename(filename), data[:100], 0644))
+		err = d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+		require.NoError(t, err, encoding)
+		actual, err = os.ReadFile(filename)
+		require.NoError(t, err)
+		require.Equal(t, data, actual, encoding)
+		require.Equal(t, []string{fmt.Sprintf("bytes=100-%d", len(data)-1), ""}, ranges, encoding)
+
+		// Same for streaming.
+		var streamed []byte
+		err = d.StreamFile(context.Background(), location, "stream-"+encoding, HashBytes(data), int64(len(data)),
+			func(r io.Reader) error {
+				streamed, err = io.ReadAll(r)
+				return err
+			})
+		require.NoError(t, err, encoding)
+		require.Equal(t, data, streamed, encoding)
+	}
+
+	// Encodings the patcher doesn't know fail right away.
+	var ranges []string
+	location := serveEncoded(t, "br", data, &ranges)
+	d := newTestDownloader(t, testDownloadConfig())
+	err := d.DownloadFile(context.Background(), location, filepath.Join(t.TempDir(), "patch"),
+		HashBytes(data), int64(len(data)))
+	require.ErrorIs(t, err, errUnsupportedEncoding)
+	require.Len(t, ranges, 1)
+}
+
+func TestDownloadFileContentEncodingMultiConnection(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 3*minSegmentSize/10)
+	var ranges []string
+	location := serveEncoded(t, "gzip", data, &ranges)
+	config := testDownloadConfig()
+	config.Headers = map[string]string{"Accept-Encoding": "gzip"}
+	config.ConnectionsPerFile = 2
+	config.MaxAttempts = 0
+	d := newTestDownloader(t, config)
+
+	// Ranges of compressed data are useless, so it falls back to a single connection.
+	filename := filepath.Join(t.TempDir(), "patch")
+	err := d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	actual, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, data, actual)
+	require.Equal(t, "", ranges[len(ranges)-1])
+}
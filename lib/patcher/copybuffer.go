@@ -0,0 +1,40 @@
+package patcher
+
+import (
+	"context"
+	"io"
+)
+
+// Size of the buffers used for computing checksums and copying data to files if none is configured.
+const DefaultCopyBufferSize = 1 << 20
+
+type typeCopyBufferSize string
+
+const keyCopyBufferSize typeCopyBufferSize = "copyBufferSize"
+
+// withCopyBufferSize makes checksum computations and copies under ctx use buffers of size bytes. 0 means
+// DefaultCopyBufferSize.
+func withCopyBufferSize(ctx context.Context, size int) context.Context {
+	if size <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, keyCopyBufferSize, size)
+}
+
+// copyBufferSize returns the buffer size set with withCopyBufferSize, DefaultCopyBufferSize if there is none.
+func copyBufferSize(ctx context.Context) int {
+	if size, ok := ctx.Value(keyCopyBufferSize).(int); ok {
+		return size
+	}
+	return DefaultCopyBufferSize
+}
+
+// copyBuffered is io.Copy with a buffer of bufferSize bytes (DefaultCopyBufferSize if 0). Unlike io.CopyBuffer
+// it always uses that buffer, a file would otherwise read with its own 32 KiB one.
+func copyBuffered(dst io.Writer, src io.Reader, bufferSize int) (int64, error) {
+	if bufferSize <= 0 {
+		bufferSize = DefaultCopyBufferSize
+	}
+	// Hide ReadFrom and WriteTo, io.CopyBuffer prefers those.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, bufferSize))
+}
@@ -0,0 +1,66 @@
+package patcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyBufferSizeChecksums(t *testing.T) {
+	data := make([]byte, 10000)
+	_, err := io.ReadAtLeast(rand.Reader, data, len(data))
+	require.NoError(t, err)
+	ctx := withCopyBufferSize(context.Background(), 7)
+	require.Equal(t, 7, copyBufferSize(ctx))
+	checksum, err := HashReader(ctx, bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, HashBytes(data), checksum)
+	checksum, err = HashReader(withHashBudget(ctx, 1000), bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, HashBytes(data), checksum)
+
+	location := serveBytes(t, data)
+	config := testDownloadConfig()
+	config.CopyBufferSize = 7
+	filename := filepath.Join(t.TempDir(), "patch")
+	// A partial download, read again with the small buffer when resuming.
+	require.NoError(t, os.WriteFile(partFilename(filename), data[:1234], 0644))
+	d := newTestDownloader(t, config)
+	require.NoError(t, d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data))))
+	actual, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, data, actual)
+}
+
+// writeSizes records the size of every write.
+type writeSizes struct {
+	sizes []int
+}
+
+func (w *writeSizes) Write(b []byte) (int, error) {
+	w.sizes = append(w.sizes, len(b))
+	return len(b), nil
+}
+
+func TestCopyBuffered(t *testing.T) {
+	w := &writeSizes{}
+	n, err := copyBuffered(w, bytes.NewReader(make([]byte, 25)), 10)
+	require.NoError(t, err)
+	require.EqualValues(t, 25, n)
+	require.Equal(t, []int{10, 10, 5}, w.sizes)
+
+	// A file doesn't get to use its own buffer.
+	filename := filepath.Join(t.TempDir(), "file")
+	file, err := os.Create(filename)
+	require.NoError(t, err)
+	defer file.Close()
+	n, err = copyBuffered(file, bytes.NewReader(make([]byte, 25)), 0)
+	require.NoError(t, err)
+	require.EqualValues(t, 25, n)
+}
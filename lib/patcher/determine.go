@@ -2,9 +2,11 @@ package patcher
 
 import (
 	"fmt"
+	"io"
 	"path"
 	"sort"
 	"strings"
+	"time"
 )
 
 // The patching process consists of four phases of I/O mixed with two phases of thinking.
@@ -18,6 +20,9 @@ import (
 // For historical reasons scanning and verifying is considered to be part of a single phase.
 // The user probably won't notice, the scanning part is pretty quick given that there are only
 // in the order of 1000 files.
+//
+// Unless PatcherConfig.SequentialPhases is set b is done per file as soon as it's verified, and 3 starts
+// right away for the patch files found to be needed. 4 waits for both 2 and 3 to finish.
 
 // A DownloadInstr indicates how to download a patch file.
 type DownloadInstr struct {
@@ -39,6 +44,9 @@ type UpdateInstr struct {
 	// Filename for the patch file on disk.
 	PatchPath string
 
+	// Checksum the patch file should have.
+	PatchChecksum string
+
 	// Filename for the file to patch.
 	FilePath string
 
@@ -48,6 +56,9 @@ type UpdateInstr struct {
 	// Whether the patch should be applied as a delta patch.
 	IsDelta bool
 
+	// For a delta patch the checksum the file to patch should have. Empty for full patches.
+	OldHash string
+
 	// The final hash the file should have.
 	Checksum string
 
@@ -63,6 +74,47 @@ type DeterminedActions struct {
 	ToUpdate []UpdateInstr
 	// Which game files to delete.
 	ToDelete []string
+	// Total size in bytes of the patch files in ToDownload.
+	DownloadSize int64
+	// Total size in bytes of the patch files that would be needed without delta patches,
+	// i.e. if every file in ToUpdate got a full patch.
+	FullDownloadSize int64
+	// Paths in the install dir that couldn't be read while scanning and were skipped,
+	// see PatcherConfig.SkipScanErrors.
+	SkippedScanPaths []string
+}
+
+// DeltaSavings returns the percentage of FullDownloadSize that's saved by using delta patches.
+func (da *DeterminedActions) DeltaSavings() float64 {
+	if da.FullDownloadSize == 0 {
+		return 0
+	}
+	return float64(da.FullDownloadSize-da.DownloadSize) / float64(da.FullDownloadSize) * 100
+}
+
+// WriteReport writes a readable list of the actions to w: the patch files to download with their sizes, the
+// files to update and the files to delete.
+func (da *DeterminedActions) WriteReport(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Download %d patch files, %d bytes (%d bytes without delta patches):\n",
+		len(da.ToDownload), da.DownloadSize, da.FullDownloadSize)
+	for _, di := range da.ToDownload {
+		fmt.Fprintf(&b, "  %s (%d bytes)\n", di.RemotePath, di.Size)
+	}
+	fmt.Fprintf(&b, "Update %d files:\n", len(da.ToUpdate))
+	for _, ui := range da.ToUpdate {
+		kind := "full"
+		if ui.IsDelta {
+			kind = "delta"
+		}
+		fmt.Fprintf(&b, "  %s (%s patch)\n", ui.FilePath, kind)
+	}
+	fmt.Fprintf(&b, "Delete %d files:\n", len(da.ToDelete))
+	for _, path := range da.ToDelete {
+		fmt.Fprintf(&b, "  %s\n", path)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
 }
 
 // DetermineFilesToVerify given the raw instructions, a manifest (empty if it doesn't exist yet) and
@@ -94,6 +146,30 @@ func DetermineFilesToMeasure(
 	return toVerify, checksums
 }
 
+// filterChangedSince splits the files to measure (as returned by DetermineFilesToMeasure) into the files that
+// were changed after since, which still have to be measured, and the older files whose checksum the manifest
+// knows (even though the last change time doesn't match), which are trusted. Older files the manifest doesn't
+// know are measured as well.
+func filterChangedSince(
+	toMeasure []string,
+	manifest *Manifest,
+	existingFiles map[string]BasicFileInfo,
+	since time.Time,
+) ([]string, map[string]string) {
+	changed := make([]string, 0, len(toMeasure))
+	trusted := make(map[string]string)
+	for _, filename := range toMeasure {
+		if !existingFiles[filename].ModTime.After(since) {
+			if cs, found := manifest.GetAnyChange(filename); found {
+				trusted[filename] = cs
+				continue
+			}
+		}
+		changed = append(changed, filename)
+	}
+	return changed, trusted
+}
+
 // DetermineActions determines what should be downloaded and what should be patched/deleted.
 // It receives the same data as DetermineFilesToMeasure and additionally the combined results
 // of result of file measurement and looking up files in the manifest.
@@ -103,75 +179,154 @@ func DetermineActions(
 	existingFiles map[string]BasicFileInfo,
 	fileChecksums map[string]string,
 ) DeterminedActions {
-	toDownloadMap := make(map[string]DownloadInstr) // Keyed by CompressedHash or DeltaHash.
-	toUpdateMap := make(map[string]UpdateInstr)     // Keyed by Path
-	toDelete := make([]string, 0)
-
+	builder := newActionsBuilder()
 	for instrIdx, instr := range instructions {
 		_, found := existingFiles[instr.Path]
-		// If NewHash is nil CompressedHash should be nil as well and vice versa.
-		// The extra check for CompressedHash is mainly here to guard against corrupted files causing panics.
-		if instr.NewHash == nil || instr.CompressedHash == nil {
-			if found {
-				toDelete = append(toDelete, instr.Path)
-			}
-			continue
+		builder.add(instrIdx, instr, found, fileChecksums[instr.Path])
+	}
+	return builder.actions()
+}
+
+// An actionsBuilder determines the actions for one instruction at a time, so downloads can start while other
+// files are still being measured. Adding every instruction gives the same actions as DetermineActions, in
+// whatever order they're added. It's not safe for concurrent use.
+type actionsBuilder struct {
+	toDownload map[downloadKey]DownloadInstr
+	toUpdate   map[string]UpdateInstr // Keyed by Path
+	fullSizes  map[downloadKey]int64  // Only for files to update.
+	toDelete   []string
+}
+
+func newActionsBuilder() *actionsBuilder {
+	return &actionsBuilder{
+		toDownload: make(map[downloadKey]DownloadInstr),
+		toUpdate:   make(map[string]UpdateInstr),
+		fullSizes:  make(map[downloadKey]int64),
+		toDelete:   make([]string, 0),
+	}
+}
+
+// add determines the actions for the instruction at instrIdx in instructions.json, given whether its file
+// exists and if so the checksum of that file. Returns the patch file to download for it, false if there's
+// none or another file already needed the same patch file.
+func (b *actionsBuilder) add(instrIdx int, instr Instruction, found bool, checksum string) (DownloadInstr, bool) {
+	// If NewHash is nil CompressedHash should be nil as well and vice versa.
+	// The extra check for CompressedHash is mainly here to guard against corrupted files causing panics.
+	if instr.NewHash == nil || instr.CompressedHash == nil {
+		if found {
+			b.toDelete = append(b.toDelete, instr.Path)
 		}
+		return DownloadInstr{}, false
+	}
 
-		// Note: path, not filepath, so the slashes don't get replaced by backslashes.
-		fullPatchRemotePath := path.Join("full", *instr.NewHash)
-		fullPatchLocalPath := path.Join("patch", *instr.NewHash)
-
-		// The temp files get moved into place, which causes problems if a single applied
-		// file is used for multiple final files. So use a naming scheme that avoid such
-		// complications. The index refers to the index in the instructions.json file.
-		tempPath := path.Join("patch", "apply", fmt.Sprintf("%05d_%s", instrIdx, *instr.NewHash))
-
-		if found && HashEqual(fileChecksums[instr.Path], *instr.NewHash) {
-			continue // Already up to date.
-		} else if found && instr.DeltaHash != nil && HashEqual(fileChecksums[instr.Path], instr.OldHash) {
-			// Can use (hopefully much smaller) delta file to upgrade.
-			deltaFilename := fmt.Sprintf("%s_from_%s", *instr.NewHash, instr.OldHash)
-			deltaPatchRemotePath := path.Join("delta", deltaFilename)
-			deltaPatchLocalPath := path.Join("patch", deltaFilename)
-			toDownloadMap[*instr.DeltaHash] = DownloadInstr{
-				RemotePath: deltaPatchRemotePath,
-				LocalPath:  deltaPatchLocalPath,
-				Checksum:   *instr.DeltaHash,
-				Size:       instr.DeltaSize,
-			}
-			toUpdateMap[instr.Path] = UpdateInstr{
-				FilePath:     instr.Path,
-				PatchPath:    deltaPatchLocalPath,
-				TempFilename: tempPath,
-				IsDelta:      true,
-				Checksum:     *instr.NewHash,
-				Size:         instr.FileSize,
-			}
-		} else {
-			// File doesn't match checksum or doesn't exist yet.
-			toDownloadMap[*instr.CompressedHash] = DownloadInstr{
-				RemotePath: fullPatchRemotePath,
-				LocalPath:  fullPatchLocalPath,
-				Checksum:   *instr.CompressedHash,
-				Size:       instr.FullReplaceSize,
-			}
-			toUpdateMap[instr.Path] = UpdateInstr{
-				FilePath:     instr.Path,
-				PatchPath:    fullPatchLocalPath,
-				TempFilename: tempPath,
-				IsDelta:      false,
-				Checksum:     *instr.NewHash,
-				Size:         instr.FileSize,
-			}
+	// Note: path, not filepath, so the slashes don't get replaced by backslashes.
+	fullPatchRemotePath := path.Join("full", *instr.NewHash)
+	fullPatchLocalPath := path.Join("patch", *instr.NewHash)
+
+	// The temp files get moved into place, which causes problems if a single applied
+	// file is used for multiple final files. So use a naming scheme that avoid such
+	// complications. The index refers to the index in the instructions.json file.
+	tempPath := path.Join("patch", "apply", fmt.Sprintf("%05d_%s", instrIdx, *instr.NewHash))
+
+	if found && HashEqual(checksum, *instr.NewHash) {
+		return DownloadInstr{}, false // Already up to date.
+	}
+	fullKey := downloadKey{isDelta: false, checksum: *instr.CompressedHash, remotePath: fullPatchRemotePath}
+	b.fullSizes[fullKey] = instr.FullReplaceSize
+	var key downloadKey
+	var di DownloadInstr
+	if found && instr.DeltaHash != nil && HashEqual(checksum, instr.OldHash) {
+		// Can use (hopefully much smaller) delta file to upgrade.
+		deltaFilename := fmt.Sprintf("%s_from_%s", *instr.NewHash, instr.OldHash)
+		deltaPatchRemotePath := path.Join("delta", deltaFilename)
+		deltaPatchLocalPath := path.Join("patch", deltaFilename)
+		key = downloadKey{isDelta: true, checksum: *instr.DeltaHash, remotePath: deltaPatchRemotePath}
+		di = DownloadInstr{
+			RemotePath: deltaPatchRemotePath,
+			LocalPath:  deltaPatchLocalPath,
+			Checksum:   *instr.DeltaHash,
+			Size:       instr.DeltaSize,
+		}
+		b.toUpdate[instr.Path] = UpdateInstr{
+			FilePath:      instr.Path,
+			PatchPath:     deltaPatchLocalPath,
+			PatchChecksum: *instr.DeltaHash,
+			TempFilename:  tempPath,
+			IsDelta:       true,
+			OldHash:       instr.OldHash,
+			Checksum:      *instr.NewHash,
+			Size:          instr.FileSize,
+		}
+	} else {
+		// File doesn't match checksum or doesn't exist yet.
+		key = fullKey
+		di = DownloadInstr{
+			RemotePath: fullPatchRemotePath,
+			LocalPath:  fullPatchLocalPath,
+			Checksum:   *instr.CompressedHash,
+			Size:       instr.FullReplaceSize,
+		}
+		b.toUpdate[instr.Path] = UpdateInstr{
+			FilePath:      instr.Path,
+			PatchPath:     fullPatchLocalPath,
+			PatchChecksum: *instr.CompressedHash,
+			TempFilename:  tempPath,
+			IsDelta:       false,
+			Checksum:      *instr.NewHash,
+			Size:          instr.FileSize,
 		}
 	}
+	_, known := b.toDownload[key]
+	b.toDownload[key] = di
+	return di, !known
+}
+
+// actions returns the actions for the instructions added so far.
+func (b *actionsBuilder) actions() DeterminedActions {
+	toDelete := append([]string{}, b.toDelete...)
 	sort.Slice(toDelete, func(i, j int) bool { return strings.Compare(toDelete[i], toDelete[j]) < 0 })
+	var downloadSize, fullDownloadSize int64
+	for _, di := range b.toDownload {
+		downloadSize += di.Size
+	}
+	for _, size := range b.fullSizes {
+		fullDownloadSize += size
+	}
 	return DeterminedActions{
-		ToDownload: mapToSortedSlice(toDownloadMap),
-		ToUpdate:   mapToSortedSlice(toUpdateMap),
-		ToDelete:   toDelete,
+		ToDownload:       sortedDownloads(b.toDownload),
+		ToUpdate:         mapToSortedSlice(b.toUpdate),
+		ToDelete:         toDelete,
+		DownloadSize:     downloadSize,
+		FullDownloadSize: fullDownloadSize,
+	}
+}
+
+// A downloadKey identifies a patch file in DetermineActions. Files with the same patch share a download, but a
+// delta and a full patch (or patches at different locations) are never the same download, even if their
+// checksums happen to be equal.
+type downloadKey struct {
+	isDelta    bool
+	checksum   string
+	remotePath string
+}
+
+// sortedDownloads returns the downloads sorted by checksum, then by remote path.
+func sortedDownloads(m map[downloadKey]DownloadInstr) []DownloadInstr {
+	keys := make([]downloadKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].checksum != keys[j].checksum {
+			return keys[i].checksum < keys[j].checksum
+		}
+		return keys[i].remotePath < keys[j].remotePath
+	})
+	slice := make([]DownloadInstr, 0, len(m))
+	for _, k := range keys {
+		slice = append(slice, m[k])
+	}
+	return slice
 }
 
 func mapToSortedSlice[V any](m map[string]V) []V {
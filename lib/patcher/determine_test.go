@@ -203,11 +203,12 @@ func TestDetermineActionsFileNotExists(t *testing.T) {
 	}, actions.ToDownload)
 	require.EqualValues(t, []UpdateInstr{
 		{
-			FilePath:     filename1,
-			PatchPath:    "patch/def",
-			TempFilename: "patch/apply/00000_def",
-			IsDelta:      false,
-			Checksum:     "def",
+			FilePath:      filename1,
+			PatchPath:     "patch/def",
+			PatchChecksum: "ghi",
+			TempFilename:  "patch/apply/00000_def",
+			IsDelta:       false,
+			Checksum:      "def",
 		},
 	}, actions.ToUpdate)
 	require.Empty(t, actions.ToDelete)
@@ -284,21 +285,26 @@ func TestDetermineActionsDownloadFullPatchForMismatch(t *testing.T) {
 	}, actions.ToDownload)
 	require.EqualValues(t, []UpdateInstr{
 		{
-			FilePath:     filename1,
-			PatchPath:    "patch/def",
-			TempFilename: "patch/apply/00000_def",
-			IsDelta:      false,
-			Checksum:     "def",
+			FilePath:      filename1,
+			PatchPath:     "patch/def",
+			PatchChecksum: "ghi",
+			TempFilename:  "patch/apply/00000_def",
+			IsDelta:       false,
+			Checksum:      "def",
 		},
 		{
-			FilePath:     filename2,
-			PatchPath:    "patch/wvu",
-			TempFilename: "patch/apply/00001_wvu",
-			IsDelta:      false,
-			Checksum:     "wvu",
+			FilePath:      filename2,
+			PatchPath:     "patch/wvu",
+			PatchChecksum: "tsr",
+			TempFilename:  "patch/apply/00001_wvu",
+			IsDelta:       false,
+			Checksum:      "wvu",
 		},
 	}, actions.ToUpdate)
 	require.Empty(t, actions.ToDelete)
+	require.EqualValues(t, 37, actions.DownloadSize)
+	require.EqualValues(t, 37, actions.FullDownloadSize)
+	require.Zero(t, actions.DeltaSavings())
 }
 
 func TestDetermineActionsDownloadDeltaPatch(t *testing.T) {
@@ -331,12 +337,120 @@ func TestDetermineActionsDownloadDeltaPatch(t *testing.T) {
 	}, actions.ToDownload)
 	require.EqualValues(t, []UpdateInstr{
 		{
-			FilePath:     filename1,
-			PatchPath:    "patch/def_from_abc",
-			TempFilename: "patch/apply/00000_def",
-			IsDelta:      true,
-			Checksum:     "def",
+			FilePath:      filename1,
+			PatchPath:     "patch/def_from_abc",
+			PatchChecksum: "jkl",
+			TempFilename:  "patch/apply/00000_def",
+			IsDelta:       true,
+			OldHash:       "abc",
+			Checksum:      "def",
 		},
 	}, actions.ToUpdate)
 	require.Empty(t, actions.ToDelete)
+	require.EqualValues(t, 4, actions.DownloadSize)
+	require.EqualValues(t, 12, actions.FullDownloadSize)
+	require.InDelta(t, 66.7, actions.DeltaSavings(), 0.1)
+}
+
+func TestDetermineActionsFullPatchForDeltaSourceMismatch(t *testing.T) {
+	instructions := []Instruction{
+		{
+			Path:            filename1,
+			OldHash:         "abc",
+			NewHash:         someStr("def"),
+			CompressedHash:  someStr("ghi"),
+			DeltaHash:       someStr("jkl"),
+			FullReplaceSize: 12,
+			DeltaSize:       4,
+		},
+	}
+	infos := map[string]BasicFileInfo{
+		filename1: {ModTime: date2},
+	}
+	// Neither the old nor the new version, so the delta patch can't be used.
+	checksums := map[string]string{filename1: "abd"}
+	actions := DetermineActions(instructions, NewManifest("foo"), infos, checksums)
+	require.EqualValues(t, []DownloadInstr{
+		{
+			RemotePath: "full/def",
+			LocalPath:  "patch/def",
+			Checksum:   "ghi",
+			Size:       12,
+		},
+	}, actions.ToDownload)
+	// A full patch doesn't need a particular source, so OldHash isn't set.
+	require.EqualValues(t, []UpdateInstr{
+		{
+			FilePath:      filename1,
+			PatchPath:     "patch/def",
+			PatchChecksum: "ghi",
+			TempFilename:  "patch/apply/00000_def",
+			IsDelta:       false,
+			Checksum:      "def",
+		},
+	}, actions.ToUpdate)
+	require.Empty(t, actions.ToDelete)
+}
+
+func TestDetermineActionsDeltaAndFullPatchWithSameChecksum(t *testing.T) {
+	instructions := []Instruction{
+		{
+			Path:            filename1,
+			OldHash:         "abc",
+			NewHash:         someStr("def"),
+			CompressedHash:  someStr("ghi"),
+			DeltaHash:       someStr("jkl"),
+			FullReplaceSize: 12,
+			DeltaSize:       4,
+		},
+		{
+			// The full patch of this file has the same checksum as the delta patch of the other one.
+			Path:            filename2,
+			NewHash:         someStr("mno"),
+			CompressedHash:  someStr("jkl"),
+			FullReplaceSize: 7,
+		},
+	}
+	infos := map[string]BasicFileInfo{
+		filename1: {ModTime: date2},
+	}
+	checksums := map[string]string{filename1: "abc"}
+	actions := DetermineActions(instructions, NewManifest("foo"), infos, checksums)
+	// Both are downloaded, rather than one overwriting the other.
+	require.EqualValues(t, []DownloadInstr{
+		{
+			RemotePath: "delta/def_from_abc",
+			LocalPath:  "patch/def_from_abc",
+			Checksum:   "jkl",
+			Size:       4,
+		},
+		{
+			RemotePath: "full/mno",
+			LocalPath:  "patch/mno",
+			Checksum:   "jkl",
+			Size:       7,
+		},
+	}, actions.ToDownload)
+	require.Len(t, actions.ToUpdate, 2)
+	require.EqualValues(t, 11, actions.DownloadSize)
+	require.EqualValues(t, 19, actions.FullDownloadSize)
+}
+
+func TestDetermineActionsSharedFullPatch(t *testing.T) {
+	instructions := []Instruction{
+		{Path: filename1, NewHash: someStr("def"), CompressedHash: someStr("ghi"), FullReplaceSize: 12},
+		{Path: filename2, NewHash: someStr("def"), CompressedHash: someStr("ghi"), FullReplaceSize: 12},
+	}
+	actions := DetermineActions(instructions, NewManifest("foo"), map[string]BasicFileInfo{}, map[string]string{})
+	// Files with the same content still share the download.
+	require.EqualValues(t, []DownloadInstr{
+		{
+			RemotePath: "full/def",
+			LocalPath:  "patch/def",
+			Checksum:   "ghi",
+			Size:       12,
+		},
+	}, actions.ToDownload)
+	require.Len(t, actions.ToUpdate, 2)
+	require.EqualValues(t, 12, actions.DownloadSize)
 }
@@ -0,0 +1,64 @@
+package patcher
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+)
+
+// A NotEnoughSpaceError is returned when the volume of the install dir doesn't have enough free space for the
+// update, see PatcherConfig.SkipSpaceCheck.
+type NotEnoughSpaceError struct {
+	// The install dir.
+	Dir string
+	// Bytes needed for the update.
+	Needed int64
+	// Bytes available on the volume.
+	Available int64
+}
+
+// Error implements (error).Error
+func (e *NotEnoughSpaceError) Error() string {
+	return fmt.Sprintf("not enough free disk space for the update in '%s': need %.1f MiB, only %.1f MiB available",
+		e.Dir, float64(e.Needed)/(1<<20), float64(e.Available)/(1<<20))
+}
+
+// spaceNeeded returns how many bytes the download and apply phases write at most: the patch files that aren't
+// (completely) downloaded yet plus the files the patches produce. Replaced files free their space along the
+// way, that's ignored to be on the safe side.
+func spaceNeeded(installDir string, actions *DeterminedActions) int64 {
+	var needed int64
+	for _, di := range actions.ToDownload {
+		needed += di.Size
+		// A partial download from an earlier run is resumed.
+		if size, found := existingDownloadSize(filepath.Join(installDir, di.LocalPath)); found {
+			needed -= min(max(size, 0), di.Size)
+		}
+	}
+	for _, ui := range actions.ToUpdate {
+		needed += ui.Size
+	}
+	return needed
+}
+
+// checkDiskSpace returns a NotEnoughSpaceError if the volume of the install dir doesn't have the space the
+// actions need, unless SkipSpaceCheck is set. If the free space can't be determined that's logged and the
+// update goes ahead.
+func (c PatcherConfig) checkDiskSpace(actions *DeterminedActions) error {
+	if c.SkipSpaceCheck {
+		return nil
+	}
+	needed := spaceNeeded(c.InstallDir, actions)
+	if needed == 0 {
+		return nil
+	}
+	available, err := AvailableDiskSpace(c.InstallDir)
+	if err != nil {
+		log.Printf("Couldn't determine free disk space, not checking whether there's enough: %s", err)
+		return nil
+	}
+	if available < needed {
+		return &NotEnoughSpaceError{Dir: c.InstallDir, Needed: needed, Available: available}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows && !linux
+
+package patcher
+
+import "errors"
+
+// AvailableDiskSpace returns how many bytes can still be written to the volume containing dir. This default
+// implementation doesn't know, it always returns errors.ErrUnsupported.
+func AvailableDiskSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,18 @@
+//go:build !windows && linux
+
+package patcher
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// AvailableDiskSpace returns how many bytes can still be written to the volume containing dir by the
+// current user.
+func AvailableDiskSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("statfs failed for '%s': %w", dir, err)
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,50 @@
+package patcher
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpaceNeeded(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "patch"), 0755))
+	// Half downloaded in an earlier run.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "patch", "partial"), make([]byte, 50), 0644))
+	actions := &DeterminedActions{
+		ToDownload: []DownloadInstr{
+			{LocalPath: filepath.Join("patch", "partial"), Size: 100},
+			{LocalPath: filepath.Join("patch", "new"), Size: 200},
+		},
+		ToUpdate: []UpdateInstr{{Size: 1000}, {Size: 2000}},
+	}
+	require.Equal(t, int64(50+200+1000+2000), spaceNeeded(dir, actions))
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "windows" {
+		t.Skip("free disk space is only known on Linux and Windows")
+	}
+	dir := t.TempDir()
+	available, err := AvailableDiskSpace(dir)
+	require.NoError(t, err)
+	require.Positive(t, available)
+
+	config := PatcherConfig{InstallDir: dir}
+	small := &DeterminedActions{ToUpdate: []UpdateInstr{{Size: 1}}}
+	require.NoError(t, config.checkDiskSpace(small))
+
+	huge := &DeterminedActions{ToUpdate: []UpdateInstr{{Size: 1 << 62}}}
+	err = config.checkDiskSpace(huge)
+	var spaceErr *NotEnoughSpaceError
+	require.True(t, errors.As(err, &spaceErr))
+	require.Equal(t, int64(1<<62), spaceErr.Needed)
+	require.ErrorContains(t, err, "not enough free disk space")
+
+	config.SkipSpaceCheck = true
+	require.NoError(t, config.checkDiskSpace(huge))
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package patcher
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// AvailableDiskSpace returns how many bytes can still be written to the volume containing dir by the
+// current user (taking quotas into account).
+func AvailableDiskSpace(dir string) (int64, error) {
+	dir16, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, fmt.Errorf("invalid directory name '%s': %w", dir, err)
+	}
+	var available uint64
+	if err := windows.GetDiskFreeSpaceEx(dir16, &available, nil, nil); err != nil {
+		return 0, fmt.Errorf("GetDiskFreeSpaceEx failed for '%s': %w", dir, err)
+	}
+	return int64(available), nil
+}
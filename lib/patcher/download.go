@@ -2,22 +2,27 @@ package patcher
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
 var errOurTimeout = errors.New("[TA] timeout")
 var errOurStall = errors.New("[TA] stalled")
+var errOurTooSlow = errors.New("[TA] too slow")
+
+// The response is for a file of a different size than expected, asking the same server again won't help.
+var errWrongSize = errors.New("response size doesn't match the expected size")
 
 // A Downloader manages downloads. Mainly it keeps track of progress and download speed.
 type Downloader struct {
@@ -40,6 +45,21 @@ type Downloader struct {
 
 	// How many files have been downloaded.
 	downloadCount int64
+
+	// Optional throttle, used to suspend downloads while paused. Not covered by mu.
+	throttle *Throttle
+
+	// Limits the combined download speed according to config.RateSchedule. Not covered by mu.
+	limiter *rateLimiter
+
+	// Client for all requests, see config.ProxyUrl. Not covered by mu.
+	client *http.Client
+
+	// Tokens from config.TokenProvider, nil if there is none. Not covered by mu.
+	tokens *tokenCache
+
+	// Computes the checksums of downloads, see config.NewHash. Not covered by mu.
+	hasher *Hasher
 }
 
 // A DownloadConfig is the configuration for a Downloader.
@@ -53,6 +73,9 @@ type DownloadConfig struct {
 	// How much to increment the delay between retries (factor, so 2 = double every retry).
 	RetryWaitIncrementFactor float64
 
+	// Fraction of the delay between retries to randomly add or subtract, see RetryPolicy.Jitter.
+	RetryJitter float64
+
 	// How many seconds to average the download speed over.
 	DownloadSpeedWindow int
 
@@ -61,6 +84,99 @@ type DownloadConfig struct {
 
 	// How much time to allow between receiving any data in a download.
 	DownloadStallTimeout time.Duration
+
+	// Minimum download speed in bytes per second, averaged over DownloadStallTimeout. A connection that's
+	// slower than this is treated as stalled. 0 disables the check, so only receiving no data at all counts
+	// as a stall.
+	MinDownloadSpeed int64
+
+	// Maximum size in bytes of a single downloaded file, 0 for no limit. Guards against
+	// corrupted instructions with absurd sizes.
+	MaxFileSize int64
+
+	// How many connections to use for downloading a single file, each fetching a different range.
+	// Values below 2 download over a single connection. Helps when a server throttles per connection.
+	ConnectionsPerFile int
+
+	// If set, a file downloaded over multiple connections (see ConnectionsPerFile) is split into ranges of
+	// this many bytes (at least 1 MiB) that the connections take turns fetching, instead of into one range
+	// per connection. Then a slow connection only holds up its current range instead of a large part of the
+	// file.
+	ChunkSize int64
+
+	// If true resumed downloads request an open-ended range ("bytes=<offset>-") instead of one ending at the
+	// expected size. Some caching proxies handle those better. Only the expected size is written either way.
+	// Doesn't affect multi-connection downloads, those need closed ranges.
+	OpenEndedRanges bool
+
+	// Optional function that decides whether a failed download attempt is retried (as long as attempts are
+	// left), e.g. to give up on a CDN that returns an error page with status 200. resp is the response if one
+	// was received, nil otherwise; its body is closed already. err is the failure. Returning false makes the
+	// failure terminal, DownloadFile then returns err. Isn't called for cancellation or denied access (status
+	// 401 or 403, see TokenProvider), those are never retried. If nil every other failure is retried.
+	ShouldRetry func(resp *http.Response, err error) bool
+
+	// Maximum combined download speed of all downloads over the course of the day. Looked up every second,
+	// so a change of window takes effect during a run. The zero value means no limit.
+	RateSchedule RateSchedule
+
+	// If set, a downloaded file with a checksum mismatch is copied to this directory before it's
+	// redownloaded, with a ".mismatch" file next to it noting the URL and the expected and actual checksums.
+	// For finding out what a bad mirror sends.
+	QuarantineDir string
+
+	// Proxy to send download requests through. If nil the proxy is taken from the environment (HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY). The download timeouts apply either way.
+	ProxyUrl *url.URL
+
+	// How many idle connections to keep open per host, so later downloads from the same host don't need a new
+	// connection (and TLS handshake). 0 means Go's default of 2, except in RunPatcher and RunDownload where it
+	// is enough for every download worker and connection.
+	MaxIdleConnsPerHost int
+
+	// How long an idle connection is kept open. 0 means Go's default of 90 seconds.
+	IdleConnTimeout time.Duration
+
+	// Extra headers to send with every request, e.g. for authenticating with a mirror.
+	Headers map[string]string
+
+	// Optional function that returns a bearer token to send in the Authorization header of every request
+	// (replacing one in Headers), for servers with short-lived tokens. It's called for the first request and
+	// again when the server denies access (status 401 or 403), so it should return a new token each time; the
+	// request is then sent once more with the new token. If access is denied again the download fails. With a
+	// static token set the header in Headers instead.
+	TokenProvider func(ctx context.Context) (string, error)
+
+	// Size in bytes of the buffer downloads are written to disk with, DefaultCopyBufferSize if 0. Larger buffers
+	// mean fewer, bigger writes, which helps on hard disks and network shares. Also used to read the data of an
+	// existing file when resuming. In RunPatcher and RunDownload it's PatcherConfig.CopyBufferSize if 0.
+	CopyBufferSize int
+
+	// Function creating the hash that downloads are checked with, e.g. for instructions using a different
+	// digest. The checksums passed to the download functions are hex strings of such hashes. If nil SHA256 is
+	// used, except in RunPatcher and RunDownload where it's PatcherConfig.NewHash.
+	NewHash func() hash.Hash
+
+	// Optional function that receives the progress of each file being downloaded (with DownloadFile,
+	// DownloadFileMirrors or StreamFile), at most about once per second per file while data arrives and once
+	// more when the file is done. It's called from the goroutines doing the downloads, so it should return
+	// quickly and it can be called for different files at the same time.
+	FileProgressFunc func(FileDownloadProgress)
+}
+
+// retryPolicy returns the policy for retrying failed downloads.
+func (c DownloadConfig) retryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: c.MaxAttempts,
+		BaseDelay:   c.RetryBaseDelay,
+		DelayFactor: c.RetryWaitIncrementFactor,
+		Jitter:      c.RetryJitter,
+	}
+}
+
+// shouldRetry returns whether a failed download attempt should be retried, see ShouldRetry.
+func (c DownloadConfig) shouldRetry(resp *http.Response, err error) bool {
+	return c.ShouldRetry == nil || c.ShouldRetry(resp, err)
 }
 
 // DownloadStats are current information about the download activity.
@@ -68,7 +184,10 @@ type DownloadStats struct {
 	// Running average of download speed in bytes/second.
 	Speed int64
 
-	// Total number of bytes downloaded.
+	// Total number of bytes received from the network. This includes bytes that were thrown away
+	// (e.g. received before a retry or for a file with a checksum mismatch), so it's a measure of network
+	// usage rather than of useful data. Data of partial downloads that was already on disk isn't counted.
+	// Never decreases.
 	TotalBytes int64
 }
 
@@ -78,9 +197,23 @@ type DownloadStats struct {
 type downloadRecord struct {
 	d           *Downloader
 	downloadUrl *url.URL
+	filename    string
 
 	// Used in some error detection code.
 	downloadIdx int64
+
+	// Progress of the file, see FileDownloadProgress.
+	size     int64
+	received int64
+	resumed  bool
+
+	// When the progress was last reported.
+	lastProgress time.Time
+
+	// Validator (see responseValidator) of the last response for the file and the URL it came from, sent
+	// in If-Range when resuming from that URL so a file that changed on the server is sent whole.
+	validator    string
+	validatorUrl *url.URL
 }
 
 // A downloadObserver is used to track download measurements.
@@ -92,13 +225,17 @@ type downloadObserver struct {
 	// Mutex covering all fields below this.
 	mu sync.Mutex
 
-	// Hash in progress.
+	// Hash in progress. Nil if the observer is only used for measurements.
 	hash hash.Hash
 
 	// How many seconds have passed without progress being made.
 	secondsWithoutData int
 
-	// If true the observer is being used to catch up to the data of an existing file.
+	// How many new bytes were received since the stall watchdog last looked.
+	bytesSinceTick int64
+
+	// If true the observer is being used to catch up to the data of an existing file, so the data
+	// isn't counted as downloaded.
 	catchUpMode bool
 }
 
@@ -118,6 +255,10 @@ func NewDownloader(
 		bytesDownloadedThisSecond: 0,
 		bytesDownloadedTotal:      0,
 		downloadCount:             0,
+		limiter:                   newRateLimiter(config.RateSchedule.RateAt(time.Now())),
+		client:                    newDownloadClient(config),
+		tokens:                    newTokenCache(config.TokenProvider),
+		hasher:                    NewHasher(config.NewHash),
 	}
 	go func() {
 		ticker := time.NewTicker(time.Second)
@@ -143,7 +284,13 @@ func NewDownloader(
 	return d
 }
 
-// DownloadFile downloads a file to disk. It also verifies a SHA256 hash.
+// DownloadFile downloads a file to disk. It also verifies a SHA256 hash. The data is written to a file named
+// like filename with ".part" appended, which is renamed to filename once the hash is verified. So a file named
+// filename is always complete, an interrupted download leaves a .part file that's resumed next time.
+//
+// An expectedSize of 0 means the size is unknown (e.g. missing from the instructions). The whole file is then
+// downloaded and only checked by its checksum: there's no resuming, and existing data is only kept if it's
+// complete.
 //
 // The caller must guarantee that DownloadFile is never called twice for the same filename
 // (this can happen if two output files in the instruction list have the same content).
@@ -154,49 +301,169 @@ func (d *Downloader) DownloadFile(
 	expectedChecksum string,
 	expectedSize int64,
 ) error {
+	return d.DownloadFileMirrors(ctx, []*url.URL{downloadUrl}, filename, expectedChecksum, expectedSize)
+}
+
+// DownloadFileMirrors is DownloadFile with fallback mirrors. The file is downloaded from the first URL; if
+// that still fails after MaxAttempts attempts, or right away if the mirror says the file doesn't exist or is
+// forbidden (status 404 or 403), the download continues from the next URL and so on. The data received so
+// far is kept, the next mirror is only asked for the rest.
+func (d *Downloader) DownloadFileMirrors(
+	ctx context.Context,
+	downloadUrls []*url.URL,
+	filename string,
+	expectedChecksum string,
+	expectedSize int64,
+) error {
+	if len(downloadUrls) == 0 {
+		return fmt.Errorf("no URL to download '%s' from", filename)
+	}
+	downloadUrl := downloadUrls[0]
+
 	d.mu.Lock()
 	downloadIdx := d.downloadCount
 	d.downloadCount++
 	// Copy variables under mutex.
-	config := d.config // It's a struct of value types, so this is a copy.
+	config := d.config // It's a struct of value types (and a function), so this is a copy.
 	d.mu.Unlock()      // Not with a defer but just getting and incrementing vars can't panic.
 
-	observer, err := d.register(downloadUrl, filename, downloadIdx)
+	if config.MaxFileSize > 0 && expectedSize > config.MaxFileSize {
+		return fmt.Errorf("refusing to download '%s', size %d is larger than the maximum of %d bytes",
+			downloadUrl, expectedSize, config.MaxFileSize)
+	}
+
+	observer, err := d.register(downloadUrl, filename, downloadIdx, expectedSize)
 	if err != nil {
 		return err
 	}
 
-	// If the output file already exists try to reuse it, it may be an incomplete download.
+	partName := partFilename(filename)
+	// A file with the final name was completed by an earlier run, or it's from a version of the patcher that
+	// didn't use .part files and may be incomplete. Either way it's checked like a partial download.
+	if _, err := os.Stat(filename); err == nil {
+		if err := retryLockedFile(ctx, filename, func() error { return os.Rename(filename, partName) }); err != nil {
+			return fmt.Errorf("failed to rename '%s' to '%s': %w", filename, partName, err)
+		}
+	}
+
+	// If the part file already exists try to reuse it, it may be an incomplete download.
 	// O_RDWD: Both read and write.
 	// O_CREATE: If it doesn't exist yet create it.
 	// No O_APPEND: it would interfere with partially reading the file (which is necessary for hashing).
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0755)
+	var file *os.File
+	err = retryLockedFile(ctx, partName, func() (err error) {
+		file, err = os.OpenFile(partName, os.O_RDWR|os.O_CREATE, 0755)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to open '%s' for downloading '%s' into: %w", filename, downloadUrl, err)
+		return fmt.Errorf("failed to open '%s' for downloading '%s' into: %w", partName, downloadUrl, err)
 	}
 	defer file.Close()
 
+	if err := d.downloadInto(ctx, file, observer, downloadUrls, filename, expectedChecksum, expectedSize, config,
+		downloadIdx); err != nil {
+		return err
+	}
+	// Windows can't rename an open file.
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close '%s': %w", partName, err)
+	}
+	if err := retryLockedFile(ctx, filename, func() error { return os.Rename(partName, filename) }); err != nil {
+		return fmt.Errorf("failed to rename '%s' to '%s': %w", partName, filename, err)
+	}
+	d.reportFileDone(observer.dip)
+	return nil
+}
+
+// partFilename returns the name of the file a download is written to until its checksum is verified.
+func partFilename(filename string) string {
+	return filename + ".part"
+}
+
+// existingDownloadSize returns how many bytes of a download there are on disk, in the completed file or in its
+// part file. Returns false if there are neither.
+func existingDownloadSize(filename string) (int64, bool) {
+	for _, name := range []string{filename, partFilename(filename)} {
+		if info, err := os.Stat(name); err == nil {
+			return info.Size(), true
+		}
+	}
+	return 0, false
+}
+
+// downloadInto downloads a file into the (part) file opened for it, continuing a partial download if there's
+// data in it already.
+func (d *Downloader) downloadInto(
+	ctx context.Context,
+	file *os.File,
+	observer *downloadObserver,
+	downloadUrls []*url.URL,
+	filename string,
+	expectedChecksum string,
+	expectedSize int64,
+	config DownloadConfig,
+	downloadIdx int64,
+) error {
+	downloadUrl := downloadUrls[0]
+	multi := useMultiConnection(config, expectedSize)
+	if multi {
+		// An interrupted multi-connection download can have holes, so it's resumed from its segments file.
+		if segments := readSegments(filename, expectedSize); segments != nil {
+			log.Printf("Found partial multi-connection download of '%s' (from '%s'), resuming download.",
+				filename, downloadUrl)
+			d.startFileProgress(observer.dip, segmentsDone(segments))
+			return d.downloadFromMirrors(ctx, file, observer, downloadUrls, filename, expectedChecksum,
+				expectedSize, segments, 0, config, downloadIdx)
+		}
+	} else if err := removeLockedFile(ctx, segmentsFilename(filename)); err == nil {
+		// Left over from a run with more connections, the file could have holes.
+		log.Printf("Found partial multi-connection download of '%s' (from '%s'), restarting download.",
+			filename, downloadUrl)
+		if err := truncateFile(file); err != nil {
+			return fmt.Errorf("failed to truncate '%s': %w", filename, err)
+		}
+	}
+
 	// Read all the bytes from the file. As a side effect this sets the file position at the end
 	// so writes go to the correct place.
-	offset, err := io.Copy(observer, file)
+	offset, err := copyBuffered(observer, file, config.CopyBufferSize)
 	if err != nil {
 		return fmt.Errorf("failed to read current data from '%s': %w", filename, err)
 	}
-	if offset == expectedSize {
+	if expectedSize <= 0 && offset > 0 {
+		// Without a size there's no telling whether the data is complete, other than by the checksum.
+		if HashEqual(expectedChecksum, observer.getChecksum()) {
+			log.Printf("Found previous completed download of '%s' (from '%s'), skipping download.",
+				filename, downloadUrl)
+			d.startFileProgress(observer.dip, offset)
+			return nil
+		}
+		log.Printf("Found partial download of '%s' (from '%s') of unknown size, redownloading.",
+			filename, downloadUrl)
+		observer.resetChecksum()
+		if err := truncateFile(file); err != nil {
+			return fmt.Errorf("failed to truncate '%s': %w", filename, err)
+		}
+		offset = 0
+	} else if expectedSize > 0 && offset == expectedSize {
 		actualChecksum := observer.getChecksum()
 		if HashEqual(expectedChecksum, actualChecksum) {
 			log.Printf("Found previous completed download of '%s' (from '%s'), skipping download.",
 				filename, downloadUrl)
+			d.startFileProgress(observer.dip, offset)
 			return nil
 		} else {
 			log.Printf(
 				`Previous completed download of '%s' (from '%s') has invalid checksum (expected %s, got %s), `+
 					`redownloading.`,
 				filename, downloadUrl, expectedChecksum, actualChecksum)
+			quarantineDownload(config.QuarantineDir, file, filename, downloadUrl,
+				expectedChecksum, actualChecksum)
 			observer.resetChecksum()
-			if err := file.Truncate(0); err != nil {
+			if err := truncateFile(file); err != nil {
 				return fmt.Errorf("failed to truncate '%s': %w", filename, err)
 			}
+			offset = 0
 		}
 	} else if offset > expectedSize {
 		log.Printf(
@@ -204,20 +471,141 @@ func (d *Downloader) DownloadFile(
 				`redownloading.`,
 			filename, downloadUrl, expectedSize, offset)
 		observer.resetChecksum()
-		if err := file.Truncate(0); err != nil {
+		if err := truncateFile(file); err != nil {
 			return fmt.Errorf("failed to truncate '%s': %w", filename, err)
 		}
+		offset = 0
 	} else if offset > 0 {
 		log.Printf("Found partial (%d/%d bytes) download of '%s' (from '%s'), resuming download.",
 			offset, expectedSize, filename, downloadUrl)
 	}
 
 	observer.setCatchUpMode(false)
+	d.startFileProgress(observer.dip, offset)
+
+	var segments []downloadSegment
+	if multi && offset == 0 {
+		segments = planSegments(config, expectedSize)
+	}
+	return d.downloadFromMirrors(ctx, file, observer, downloadUrls, filename, expectedChecksum, expectedSize,
+		segments, offset, config, downloadIdx)
+}
+
+// downloadFromMirrors continues a download from each mirror in turn, until one succeeds. With segments it's a
+// multi-connection download, otherwise a normal download from offset. When switching mirrors the download is
+// picked up where the previous mirror left off.
+func (d *Downloader) downloadFromMirrors(
+	ctx context.Context,
+	file *os.File,
+	observer *downloadObserver,
+	downloadUrls []*url.URL,
+	filename string,
+	expectedChecksum string,
+	expectedSize int64,
+	segments []downloadSegment,
+	offset int64,
+	config DownloadConfig,
+	downloadIdx int64,
+) error {
+	var err error
+	for i, downloadUrl := range downloadUrls {
+		if i > 0 {
+			log.Printf("Downloading '%s' from '%s' failed, trying the next mirror '%s': %s",
+				filename, downloadUrls[i-1], downloadUrl, err)
+			// A failed multi-connection download leaves a segments file, unless it switched to a normal
+			// download. The file position is where a normal download stopped.
+			segments = nil
+			if useMultiConnection(config, expectedSize) {
+				segments = readSegments(filename, expectedSize)
+			}
+			if offset, err = file.Seek(0, io.SeekCurrent); err != nil {
+				return fmt.Errorf("failed to seek in '%s': %w", filename, err)
+			}
+			if segments == nil && offset == 0 && useMultiConnection(config, expectedSize) {
+				segments = planSegments(config, expectedSize)
+			}
+			d.setFileUrl(observer.dip, downloadUrl)
+		}
+		// The last mirror gets every attempt, whatever it answers.
+		skipMissing := i < len(downloadUrls)-1
+		if segments != nil {
+			err = d.downloadMultiOrFallback(ctx, file, observer, downloadUrl, filename, expectedChecksum,
+				expectedSize, segments, config, downloadIdx, skipMissing)
+		} else {
+			err = d.downloadSingle(ctx, file, observer, downloadUrl, filename, expectedChecksum, expectedSize,
+				offset, config, downloadIdx, skipMissing)
+		}
+		if err == nil {
+			if i > 0 {
+				log.Printf("Downloaded '%s' from mirror '%s'.", filename, downloadUrl)
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// mirrorLacksFile returns whether a response means the mirror doesn't have the file or won't serve it, so
+// there's no point in retrying it if there are other mirrors.
+func mirrorLacksFile(resp *http.Response) bool {
+	return resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden)
+}
+
+// downloadMultiOrFallback does a multi-connection download, falling back to a normal download if the
+// server doesn't support ranges.
+func (d *Downloader) downloadMultiOrFallback(
+	ctx context.Context,
+	file *os.File,
+	observer *downloadObserver,
+	downloadUrl *url.URL,
+	filename string,
+	expectedChecksum string,
+	expectedSize int64,
+	segments []downloadSegment,
+	config DownloadConfig,
+	downloadIdx int64,
+	skipMissing bool,
+) error {
+	err := d.downloadMulti(ctx, file, observer, downloadUrl, filename, expectedChecksum, expectedSize,
+		segments, config, skipMissing)
+	if !errors.Is(err, errRangeNotSupported) {
+		return err
+	}
+	log.Printf("Server for '%s' doesn't support range requests, downloading over a single connection.",
+		downloadUrl)
+	if err := removeLockedFile(ctx, segmentsFilename(filename)); err != nil {
+		return fmt.Errorf("failed to remove segments file of '%s': %w", filename, err)
+	}
+	if err := truncateFile(file); err != nil {
+		return fmt.Errorf("failed to truncate '%s': %w", filename, err)
+	}
+	d.setFileReceived(observer.dip, 0)
+	// When resuming from a segments file the existing data was never read, so this can still be set.
+	observer.setCatchUpMode(false)
+	return d.downloadSingle(ctx, file, observer, downloadUrl, filename, expectedChecksum, expectedSize,
+		0, config, downloadIdx, skipMissing)
+}
 
-	waitTime := config.RetryBaseDelay
-	attempt := 1
-	for {
-		if newOffset, err := d.doDownloadFile(
+// downloadSingle downloads (the rest of) a file over a single connection, retrying on errors. With
+// skipMissing it gives up right away if the mirror doesn't have the file.
+func (d *Downloader) downloadSingle(
+	ctx context.Context,
+	file *os.File,
+	observer *downloadObserver,
+	downloadUrl *url.URL,
+	filename string,
+	expectedChecksum string,
+	expectedSize int64,
+	offset int64,
+	config DownloadConfig,
+	downloadIdx int64,
+	skipMissing bool,
+) error {
+	return retry(ctx, config.retryPolicy(), "Download", func() error {
+		newOffset, resp, err := d.doDownloadFile(
 			ctx,
 			file,
 			observer,
@@ -227,36 +615,19 @@ func (d *Downloader) DownloadFile(
 			expectedSize,
 			offset,
 			downloadIdx,
-		); err != nil {
-			offset = newOffset
-			if attempt > config.MaxAttempts {
-				return err
-			}
-			if errors.Is(err, context.Canceled) {
-				// Don't log cancelations, those likely aren't errors.
-				return err
-			}
-			// URL is already in the error message, probably twice, no need to add it here.
-			log.Printf("Download failed [attempt %d/%d, waiting %s until next attempt]: %s",
-				attempt, config.MaxAttempts, waitTime, err)
-
-			// This mainly works because the durations are going to be fairly small so overflows are unlikely.
-			attempt++
-			waitTime = time.Duration(float64(waitTime) * config.RetryWaitIncrementFactor)
-			select {
-			case <-time.After(waitTime):
-				continue
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		} else {
-			return nil
+		)
+		offset = newOffset
+		if err != nil && !errors.Is(err, context.Canceled) && (errors.Is(err, errWrongSize) ||
+			errors.Is(err, errUnsupportedEncoding) || accessDenied(resp) || !config.shouldRetry(resp, err) ||
+			(skipMissing && mirrorLacksFile(resp))) {
+			return permanent(err)
 		}
-	}
+		return err
+	})
 }
 
-// doDownloadFile contains the retryable for DownloadFile. It returns the checksum of the downloaded file.
-// Returns how many bytes have been written to the file in total, even if an error is returned.
+// doDownloadFile contains the retryable for DownloadFile. Returns how many bytes have been written to the file
+// in total and the response (nil if none was received), even if an error is returned.
 func (d *Downloader) doDownloadFile(
 	ctx context.Context,
 	file *os.File,
@@ -267,17 +638,197 @@ func (d *Downloader) doDownloadFile(
 	expectedSize int64,
 	offset int64, // Starting point for downloading new data.
 	downloadIdx int64,
-) (int64, error) {
+) (int64, *http.Response, error) {
+	if expectedSize <= 0 && offset > 0 {
+		// The size is unknown, so there's no range to ask for. Start over.
+		if err := truncateFile(file); err != nil {
+			return offset, nil, fmt.Errorf("failed to truncate '%s' (because of unknown size): %w", filename, err)
+		}
+		observer.resetChecksum()
+		d.setFileReceived(observer.dip, 0)
+		offset = 0
+	}
 	possComplete := ""
 	if offset > 0 {
 		possComplete = " complete"
 	}
-	if offset >= expectedSize { // Sanity check.
-		return offset, fmt.Errorf(
+	if expectedSize > 0 && offset >= expectedSize { // Sanity check.
+		return offset, nil, fmt.Errorf(
 			"invalid offset %d for '%s', would end up requesting more than size (%d)",
 			offset, downloadUrl, expectedSize)
 	}
 
+	rangeHeader := ""
+	ifRange := ""
+	if offset > 0 {
+		ifRange = d.validatorFor(observer.dip, downloadUrl)
+		if d.config.OpenEndedRanges {
+			rangeHeader = fmt.Sprintf("bytes=%d-", offset)
+		} else {
+			// Endpoint of range is inclusive.
+			rangeHeader = fmt.Sprintf("bytes=%d-%d", offset, expectedSize-1)
+		}
+	}
+	resp, requestCtx, cancelRequestCtx, err := d.sendRequest(ctx, downloadUrl, rangeHeader, ifRange, possComplete)
+	if err != nil {
+		return offset, nil, err
+	}
+	if offset > 0 && resp.StatusCode == http.StatusPartialContent && contentEncoding(resp) != "" {
+		// A range of a compressed stream doesn't continue the decompressed data on disk, so resuming is
+		// impossible. Ask for the whole file instead.
+		resp.Body.Close()
+		cancelRequestCtx(nil)
+		log.Printf("Server sent the rest of '%s' compressed, starting over on '%s'.", downloadUrl, filename)
+		if err := truncateFile(file); err != nil {
+			return offset, resp, fmt.Errorf("failed to truncate '%s' (because of compressed response): %w",
+				filename, err)
+		}
+		observer.resetChecksum()
+		d.setFileReceived(observer.dip, 0)
+		return d.doDownloadFile(ctx, file, observer, downloadUrl, filename, expectedChecksum, expectedSize, 0,
+			downloadIdx)
+	}
+	defer cancelRequestCtx(nil)
+	defer resp.Body.Close()
+
+	if offset > 0 && resp.StatusCode == http.StatusOK {
+		// Either the file changed since the data so far was received (the If-Range didn't match) or the
+		// server doesn't support ranges. What it sends is the whole file either way.
+		log.Printf("Server sent all of '%s' instead of the rest, starting over on '%s'.", downloadUrl, filename)
+		if err := truncateFile(file); err != nil {
+			return offset, resp, fmt.Errorf("failed to truncate '%s' (because of full response): %w", filename, err)
+		}
+		observer.resetChecksum()
+		d.setFileReceived(observer.dip, 0)
+		offset = 0
+		possComplete = ""
+	}
+	if offset > 0 {
+		if resp.StatusCode != http.StatusPartialContent {
+			return offset, resp, fmt.Errorf("failed to resume download '%s' (status %d)",
+				downloadUrl, resp.StatusCode)
+		}
+	} else {
+		if resp.StatusCode != http.StatusOK {
+			return offset, resp, fmt.Errorf("failed to download '%s' (status %d)",
+				downloadUrl, resp.StatusCode)
+		}
+	}
+	d.rememberValidator(observer.dip, downloadUrl, resp)
+
+	if err := checkContentType(resp, downloadUrl, possComplete); err != nil {
+		return offset, resp, err
+	}
+	if err := checkResponseSize(resp, downloadUrl, possComplete, offset, expectedSize); err != nil {
+		return offset, resp, err
+	}
+
+	stopWatchdog := d.watchStalls(ctx, observer, cancelRequestCtx)
+	defer stopWatchdog()
+
+	body, err := decodeBody(pausingReader{ctx: ctx, r: resp.Body, throttle: d.throttle, limiter: d.limiter},
+		contentEncoding(resp))
+	if err != nil {
+		return offset, resp, fmt.Errorf("failed to%s download '%s': %w", possComplete, downloadUrl, err)
+	}
+	defer body.Close()
+
+	// Never write more than expected, a misbehaving server could otherwise fill up the disk.
+	remaining := downloadSizeLimit(expectedSize, d.config.MaxFileSize) - offset
+	reader := io.TeeReader(io.LimitReader(body, remaining), observer)
+	written, err := copyBuffered(file, reader, d.config.CopyBufferSize)
+	offset += written
+	if err != nil {
+		// Depending on where the read was the error is context.Canceled or the cause.
+		if stallErr := d.stallError(requestCtx); stallErr != nil {
+			err = stallErr
+		}
+		return offset, resp, fmt.Errorf("failed to%s download '%s' to '%s': %w", possComplete, downloadUrl, filename, err)
+	}
+
+	if written == remaining {
+		// Check whether the server had even more data.
+		var extra [1]byte
+		if n, _ := body.Read(extra[:]); n > 0 {
+			d.countReceived(nil, int64(n))
+			if err := truncateFile(file); err != nil {
+				return 0, resp, fmt.Errorf("failed to truncate '%s' (because of too much data): %w", filename, err)
+			}
+			observer.resetChecksum()
+			d.setFileReceived(observer.dip, 0)
+			return 0, resp, fmt.Errorf(
+				"failed to%s download '%s' to '%s': server sent more than the expected %d bytes, "+
+					"redownloading on the next attempt",
+				possComplete, downloadUrl, filename, offset)
+		}
+	}
+
+	if offset < expectedSize {
+		return offset, resp, fmt.Errorf(
+			`failed to%s download '%s' to '%s': download stopped before file was fully received `+
+				`(got %d, need %d bytes)`, possComplete, downloadUrl, filename, offset, expectedSize)
+	}
+
+	actualChecksum := observer.getChecksum()
+	if !HashEqual(expectedChecksum, actualChecksum) {
+		quarantineDownload(d.config.QuarantineDir, file, filename, downloadUrl,
+			expectedChecksum, actualChecksum)
+		if err := truncateFile(file); err != nil {
+			return 0, resp, fmt.Errorf("failed to truncate '%s' (because of checksum mismatch): %w", filename, err)
+		}
+		observer.resetChecksum()
+		d.setFileReceived(observer.dip, 0)
+		return 0, resp,
+			fmt.Errorf(
+				"downloaded file has invalid checksum for '%s' downloaded to '%s', expected %s, got %s, "+
+					"redownloading on the next attempt",
+				downloadUrl, filename, expectedChecksum, actualChecksum)
+	}
+	return offset, resp, nil
+}
+
+// sendRequest sends a GET request for a download, with optional Range and If-Range headers. Sending the request
+// and receiving the response headers is subject to the request timeout. The returned context is the
+// context of the whole request, the returned cancel function (which must be called when done) cancels it.
+// On success the caller must close the response body.
+//
+// With a TokenProvider a request that's denied access is sent once more with a new token.
+func (d *Downloader) sendRequest(
+	ctx context.Context,
+	downloadUrl *url.URL,
+	rangeHeader string,
+	ifRange string,
+	possComplete string, // For error messages.
+) (*http.Response, context.Context, context.CancelCauseFunc, error) {
+	var requestCtx context.Context
+	var cancelRequestCtx context.CancelCauseFunc
+	what := fmt.Sprintf("download of '%s'", downloadUrl)
+	resp, err := sendWithToken(ctx, d.tokens, what, func(token string) (*http.Response, error) {
+		if cancelRequestCtx != nil {
+			// The previous attempt was denied.
+			cancelRequestCtx(nil)
+		}
+		var resp *http.Response
+		var err error
+		resp, requestCtx, cancelRequestCtx, err = d.doSendRequest(ctx, downloadUrl, rangeHeader, ifRange, possComplete, token)
+		return resp, err
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return resp, requestCtx, cancelRequestCtx, nil
+}
+
+// doSendRequest sends a single request for sendRequest, with the token in the Authorization header unless
+// it's empty.
+func (d *Downloader) doSendRequest(
+	ctx context.Context,
+	downloadUrl *url.URL,
+	rangeHeader string,
+	ifRange string,
+	possComplete string,
+	token string,
+) (*http.Response, context.Context, context.CancelCauseFunc, error) {
 	requestCtx, cancelRequestCtx := context.WithCancelCause(ctx)
 
 	// This is for canceling the Do part, i.e. sending the request and reading the response headers
@@ -294,14 +845,21 @@ func (d *Downloader) doDownloadFile(
 	}()
 	req, err := http.NewRequestWithContext(doCtx, http.MethodGet, downloadUrl.String(), nil)
 	if err != nil {
-		return offset, fmt.Errorf("failed to create request to download '%s': %w", downloadUrl, err)
+		close(doDoneChan)
+		cancelRequestCtx(nil)
+		return nil, nil, nil, fmt.Errorf("failed to create request to download '%s': %w", downloadUrl, err)
 	}
-	if offset > 0 {
-		// Endpoint of range is inclusive.
-		req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", offset, expectedSize-1))
+	setRequestHeaders(req, d.config.Headers)
+	setAuthorization(req, token)
+	if rangeHeader != "" {
+		req.Header.Add("Range", rangeHeader)
+	}
+	if ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := d.client.Do(req)
+	close(doDoneChan)
 	if err != nil {
 		// Higher levels of the code treat a cancellation error as normal, figuring someone might
 		// have pressed interrupt or something. By detecting this and explicitly setting the error
@@ -310,37 +868,74 @@ func (d *Downloader) doDownloadFile(
 			err = fmt.Errorf("failed to request%s download of '%s': request timeout (%s) exceeded",
 				possComplete, downloadUrl, d.config.DownloadRequestTimeout)
 		}
-		return offset, fmt.Errorf("failed to request%s download of '%s': %w", possComplete, downloadUrl, err)
-	}
-	close(doDoneChan)
-	defer resp.Body.Close()
-
-	if offset > 0 {
-		if resp.StatusCode == http.StatusOK {
-			return offset, fmt.Errorf(
-				"failed to resume download '%s' to '%s', server doesn't understand range header (status 200)",
-				downloadUrl, filename)
-		}
-		if resp.StatusCode != http.StatusPartialContent {
-			return offset, fmt.Errorf("failed to resume download '%s' (status %d)",
-				downloadUrl, resp.StatusCode)
-		}
-	} else {
-		if resp.StatusCode != http.StatusOK {
-			return offset, fmt.Errorf("failed to download '%s' (status %d)",
-				downloadUrl, resp.StatusCode)
-		}
+		cancelRequestCtx(nil)
+		return nil, nil, nil, fmt.Errorf("failed to request%s download of '%s': %w", possComplete, downloadUrl, err)
 	}
+	return resp, requestCtx, cancelRequestCtx, nil
+}
 
+// checkContentType checks that a download response has the content type of patch files.
+func checkContentType(resp *http.Response, downloadUrl *url.URL, possComplete string) error {
 	contentType := resp.Header.Get("Content-Type")
 	if contentType != "application/octet-stream" {
 		// Hopefully this will protect against crazy MitM ISPs injecting weird errors.
-		return offset, fmt.Errorf("failed to%s download '%s': unexpected content type %q, expected %s",
+		return fmt.Errorf("failed to%s download '%s': unexpected content type %q, expected %s",
 			possComplete, downloadUrl, contentType, "application/octet-stream")
 	}
+	return nil
+}
 
+// checkResponseSize checks the size a download response announces against the expected size, before the body
+// is read. For a full response that's the content length, for a partial response the total in Content-Range,
+// and it may not be longer than the remaining bytes from offset. A shorter partial response is fine, the rest
+// is requested on the next attempt. Responses that don't announce a size (e.g. with chunked transfer encoding)
+// are checked while reading instead, as are compressed responses (their sizes are those of the compressed data).
+func checkResponseSize(
+	resp *http.Response,
+	downloadUrl *url.URL,
+	possComplete string,
+	offset int64,
+	expectedSize int64,
+) error {
+	if contentEncoding(resp) != "" || expectedSize <= 0 {
+		return nil
+	}
+	if fileSize := responseFileSize(resp); fileSize >= 0 && fileSize != expectedSize {
+		return fmt.Errorf("failed to%s download '%s': %w (server says the file has %d bytes, expected %d)",
+			possComplete, downloadUrl, errWrongSize, fileSize, expectedSize)
+	}
+	if remaining := expectedSize - offset; resp.ContentLength > remaining {
+		return fmt.Errorf("failed to%s download '%s': %w (server is sending %d bytes, expected at most %d)",
+			possComplete, downloadUrl, errWrongSize, resp.ContentLength, remaining)
+	}
+	return nil
+}
+
+// downloadSizeLimit returns how many bytes a download of expectedSize bytes may have. If the size is unknown (0)
+// that's maxFileSize, unless that's 0 too.
+func downloadSizeLimit(expectedSize int64, maxFileSize int64) int64 {
+	switch {
+	case expectedSize > 0:
+		return expectedSize
+	case maxFileSize > 0:
+		return maxFileSize
+	default:
+		return math.MaxInt64
+	}
+}
+
+// watchStalls cancels a request (with errOurStall as cause) if the observer doesn't see any data for longer
+// than the stall timeout. With a minimum download speed configured it also cancels the request (with
+// errOurTooSlow as cause) if the average speed over the stall timeout is lower than that.
+// Call the returned function to stop watching.
+func (d *Downloader) watchStalls(
+	ctx context.Context,
+	observer *downloadObserver,
+	cancelRequestCtx context.CancelCauseFunc,
+) func() {
 	watchdogCtx, cancelWatchdog := context.WithCancel(ctx)
-	defer cancelWatchdog()
+	speedWindow := max(int(d.config.DownloadStallTimeout/time.Second), 1)
+	speed := NewAverager(speedWindow)
 	go func() {
 		ticker := time.NewTicker(time.Second)
 		defer ticker.Stop()
@@ -349,51 +944,96 @@ func (d *Downloader) doDownloadFile(
 			case <-ticker.C:
 				// Can avoid defer Unlock because all actions are simple and can't fail.
 				observer.mu.Lock()
+				paused := d.throttle.Paused()
+				if paused {
+					// Not receiving data is expected while paused.
+					observer.secondsWithoutData = 0
+				}
 				secsWithoutData := observer.secondsWithoutData
 				observer.secondsWithoutData++
+				received := observer.bytesSinceTick
+				observer.bytesSinceTick = 0
 				observer.mu.Unlock()
 				if time.Duration(secsWithoutData)*time.Second > d.config.DownloadStallTimeout {
 					cancelRequestCtx(errOurStall)
 				}
+				if d.config.MinDownloadSpeed > 0 {
+					if paused {
+						// Start measuring again after resuming.
+						speed = NewAverager(speedWindow)
+						continue
+					}
+					speed.Add(float64(received))
+					if speed.Full() && speed.Average() < float64(d.config.MinDownloadSpeed) {
+						cancelRequestCtx(errOurTooSlow)
+					}
+				}
 			case <-watchdogCtx.Done():
 				return
 			}
 		}
 	}()
+	return cancelWatchdog
+}
 
-	reader := io.TeeReader(resp.Body, observer)
-	written, err := io.Copy(file, reader)
-	offset += written
-	if err != nil {
-		if errors.Is(err, context.Canceled) && errors.Is(context.Cause(doCtx), errOurStall) {
-			err = fmt.Errorf("failed to%s download '%s' to '%s': download stalled for at least %s",
-				possComplete, downloadUrl, filename, d.config.DownloadStallTimeout)
-		}
-		return offset, fmt.Errorf("failed to%s download '%s' to '%s': %w", possComplete, downloadUrl, filename, err)
+// stallError returns a descriptive error if the request context was canceled by the stall watchdog,
+// nil otherwise.
+func (d *Downloader) stallError(requestCtx context.Context) error {
+	cause := context.Cause(requestCtx)
+	if errors.Is(cause, errOurStall) {
+		return fmt.Errorf("download stalled for at least %s", d.config.DownloadStallTimeout)
+	}
+	if errors.Is(cause, errOurTooSlow) {
+		return fmt.Errorf("download was slower than %d bytes/s for %s", d.config.MinDownloadSpeed,
+			d.config.DownloadStallTimeout)
 	}
+	return nil
+}
 
-	if offset < expectedSize {
-		return offset, fmt.Errorf(
-			`failed to%s download '%s' to '%s': download stopped before file was fully received `+
-				`(got %d, need %d bytes)`, possComplete, downloadUrl, filename, offset, expectedSize)
+// truncateFile empties a file and moves the file position back to the start,
+// so that new writes don't leave a gap.
+// responseValidator returns what to send in If-Range to continue the file of a response: its ETag if that's a
+// strong one (weak ones aren't allowed in If-Range), otherwise its Last-Modified date. Empty if it has neither.
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
 	}
+	return resp.Header.Get("Last-Modified")
+}
 
-	actualChecksum := observer.getChecksum()
-	if !HashEqual(expectedChecksum, actualChecksum) {
-		if err := file.Truncate(0); err != nil {
-			return 0, fmt.Errorf("failed to truncate '%s' (because of checksum mismatch): %w", filename, err)
-		}
-		observer.resetChecksum()
-		return 0,
-			fmt.Errorf(
-				"downloaded file has invalid checksum for '%s' downloaded to '%s', expected %s, got %s, "+
-					"redownloading on the next attempt",
-				downloadUrl, filename, expectedChecksum, actualChecksum)
+// rememberValidator stores the validator of a response for a file, see validatorFor.
+func (d *Downloader) rememberValidator(dip *downloadRecord, downloadUrl *url.URL, resp *http.Response) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dip.validator = responseValidator(resp)
+	dip.validatorUrl = downloadUrl
+}
+
+// validatorFor returns the validator of the last response for a file, if it came from downloadUrl. Empty
+// otherwise, another mirror has its own.
+func (d *Downloader) validatorFor(dip *downloadRecord, downloadUrl *url.URL) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if dip.validatorUrl == nil || dip.validatorUrl.String() != downloadUrl.String() {
+		return ""
 	}
-	return offset, nil
+	return dip.validator
 }
 
-func (d *Downloader) register(downloadUrl *url.URL, filename string, downloadIdx int64) (*downloadObserver, error) {
+func truncateFile(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := file.Seek(0, io.SeekStart)
+	return err
+}
+
+func (d *Downloader) register(
+	downloadUrl *url.URL,
+	filename string,
+	downloadIdx int64,
+	expectedSize int64,
+) (*downloadObserver, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	existing, found := d.downloads[filename]
@@ -405,12 +1045,16 @@ func (d *Downloader) register(downloadUrl *url.URL, filename string, downloadIdx
 	dip := &downloadRecord{
 		d:           d,
 		downloadUrl: downloadUrl,
+		filename:    filename,
 		downloadIdx: downloadIdx,
+		size:        expectedSize,
 	}
 	d.downloads[filename] = dip
 	observer := &downloadObserver{
 		dip:  dip,
-		hash: sha256.New(),
+		hash: d.hasher.New(),
+		// The first thing DownloadFile does is read the existing data.
+		catchUpMode: true,
 	}
 	return observer, nil
 }
@@ -421,34 +1065,84 @@ func (d *Downloader) tick() DownloadStats {
 	defer d.mu.Unlock()
 	d.downloadSpeed.Add(float64(d.bytesDownloadedThisSecond))
 	d.bytesDownloadedThisSecond = 0
+	d.limiter.setRate(d.config.RateSchedule.RateAt(time.Now()))
 	return DownloadStats{
 		Speed:      int64(d.downloadSpeed.Average()),
 		TotalBytes: d.bytesDownloadedTotal,
 	}
 }
 
+// A pausingReader blocks reads while a throttle is paused, and after reads while the rate limiter says
+// the download is going too fast.
+type pausingReader struct {
+	ctx      context.Context
+	r        io.Reader
+	throttle *Throttle
+	limiter  *rateLimiter
+}
+
+// Read implements (io.Reader).Read
+func (p pausingReader) Read(b []byte) (int, error) {
+	if err := p.throttle.waitWhilePaused(p.ctx); err != nil {
+		return 0, err
+	}
+	n, err := p.r.Read(b)
+	if n > 0 && p.limiter != nil {
+		if limitErr := p.limiter.take(p.ctx, n); limitErr != nil {
+			return n, limitErr
+		}
+	}
+	return n, err
+}
+
 // Write implements (io.Writer).Write
 func (o *downloadObserver) Write(p []byte) (n int, err error) {
 	// Not using defer here to avoid the two mutexes being locked at the same time.
 	// While it shouldn't deadlock keeping lock regions small and non-overlapping simplifies
 	// reasoning about them.
 	o.mu.Lock()
-	o.hash.Write(p)
+	if o.hash != nil {
+		o.hash.Write(p)
+	}
 	o.secondsWithoutData = 0
+	catchUpMode := o.catchUpMode
+	if !catchUpMode {
+		o.bytesSinceTick += int64(len(p))
+	}
 	o.mu.Unlock()
 
-	if !o.catchUpMode {
-		o.dip.d.mu.Lock()
-		defer o.dip.d.mu.Unlock()
-
-		count := int64(len(p))
-		o.dip.d.bytesDownloadedThisSecond += count
-		o.dip.d.bytesDownloadedTotal += count
+	if !catchUpMode {
+		o.dip.d.countReceived(o.dip, int64(len(p)))
 	}
 
 	return len(p), nil
 }
 
+// countReceived adds bytes received from the network to the download stats and, unless dip is nil, to the
+// progress of the file, which is reported if it's time for that.
+func (d *Downloader) countReceived(dip *downloadRecord, count int64) {
+	// Not using defer here, the progress func is called without holding the mutex.
+	d.mu.Lock()
+	d.bytesDownloadedThisSecond += count
+	d.bytesDownloadedTotal += count
+	progressFunc := d.config.FileProgressFunc
+	var progress FileDownloadProgress
+	report := false
+	if dip != nil {
+		dip.received += count
+		if progressFunc != nil && time.Since(dip.lastProgress) >= fileProgressInterval {
+			dip.lastProgress = time.Now()
+			progress = dip.progress(false)
+			report = true
+		}
+	}
+	d.mu.Unlock()
+
+	if report {
+		progressFunc(progress)
+	}
+}
+
 // setCatchUpMode enables or disables catch up mode (which makes the observer only add new data to the hash).
 func (o *downloadObserver) setCatchUpMode(catchUpMode bool) {
 	o.mu.Lock()
@@ -467,5 +1161,5 @@ func (o *downloadObserver) getChecksum() string {
 func (o *downloadObserver) resetChecksum() {
 	o.mu.Lock()
 	defer o.mu.Unlock()
-	o.hash = sha256.New()
+	o.hash = o.dip.d.hasher.New()
 }
@@ -0,0 +1,301 @@
+package patcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// Minimum size of each range in a multi-connection download. Files too small to give every connection
+// at least this much are downloaded over a single connection, the overhead isn't worth it.
+const minSegmentSize = 1 << 20
+
+var errRangeNotSupported = errors.New("server doesn't support range requests")
+
+var errChecksumMismatch = errors.New("downloaded file has invalid checksum")
+
+// A downloadSegment is a range of a file downloaded over its own connection.
+type downloadSegment struct {
+	// First byte of the range.
+	Start int64 `json:"start"`
+	// One past the last byte of the range.
+	End int64 `json:"end"`
+	// How many bytes (from Start) have been written.
+	Done int64 `json:"done"`
+}
+
+// segmentsFilename returns the name of the file storing the segments of a multi-connection download.
+// Its presence means the download was interrupted, the file itself can have holes so it can't be
+// resumed like a normal download.
+func segmentsFilename(filename string) string {
+	return filename + ".segments"
+}
+
+// useMultiConnection returns whether a file of the given size should be downloaded over multiple connections.
+func useMultiConnection(config DownloadConfig, size int64) bool {
+	return config.ConnectionsPerFile > 1 && size >= int64(config.ConnectionsPerFile)*minSegmentSize
+}
+
+// splitSegments divides size bytes into count ranges of about equal size.
+func splitSegments(size int64, count int) []downloadSegment {
+	segments := make([]downloadSegment, count)
+	for i := range segments {
+		segments[i] = downloadSegment{
+			Start: size * int64(i) / int64(count),
+			End:   size * int64(i+1) / int64(count),
+		}
+	}
+	return segments
+}
+
+// planSegments divides a file of size bytes for a multi-connection download: into ranges of ChunkSize
+// (at least minSegmentSize) if that's set, otherwise into one range per connection.
+func planSegments(config DownloadConfig, size int64) []downloadSegment {
+	if config.ChunkSize <= 0 {
+		return splitSegments(size, config.ConnectionsPerFile)
+	}
+	chunkSize := max(config.ChunkSize, minSegmentSize)
+	segments := make([]downloadSegment, (size+chunkSize-1)/chunkSize)
+	for i := range segments {
+		segments[i] = downloadSegment{
+			Start: int64(i) * chunkSize,
+			End:   min(int64(i+1)*chunkSize, size),
+		}
+	}
+	return segments
+}
+
+// readSegments reads the segments of an interrupted multi-connection download. Returns nil if there is
+// no (usable) segments file.
+func readSegments(filename string, expectedSize int64) []downloadSegment {
+	data, err := os.ReadFile(segmentsFilename(filename))
+	if err != nil {
+		return nil
+	}
+	var segments []downloadSegment
+	if err := json.Unmarshal(data, &segments); err != nil {
+		log.Printf("Ignoring invalid segments file for '%s': %s", filename, err)
+		return nil
+	}
+	// Segments must be consecutive and cover the whole file.
+	pos := int64(0)
+	for _, s := range segments {
+		if s.Start != pos || s.End < s.Start || s.Done < 0 || s.Done > s.End-s.Start {
+			log.Printf("Ignoring segments file for '%s' which doesn't match the expected size", filename)
+			return nil
+		}
+		pos = s.End
+	}
+	if pos != expectedSize || len(segments) == 0 {
+		log.Printf("Ignoring segments file for '%s' which doesn't match the expected size", filename)
+		return nil
+	}
+	return segments
+}
+
+// segmentsDone returns how many bytes of the segments have been written.
+func segmentsDone(segments []downloadSegment) int64 {
+	done := int64(0)
+	for _, s := range segments {
+		done += s.Done
+	}
+	return done
+}
+
+// writeSegments stores the progress of a multi-connection download.
+func writeSegments(filename string, segments []downloadSegment) error {
+	data, err := json.Marshal(segments)
+	if err != nil {
+		return fmt.Errorf("failed to encode segments of '%s': %w", filename, err)
+	}
+	if err := os.WriteFile(segmentsFilename(filename), data, 0644); err != nil {
+		return fmt.Errorf("failed to write segments of '%s': %w", filename, err)
+	}
+	return nil
+}
+
+// downloadMulti downloads a file over several connections (at most ConnectionsPerFile), each fetching a
+// different range.
+// Progress is stored in a segments file so an interrupted download can be resumed. The file is hashed
+// after all segments are done, if it doesn't match the download starts over with fresh segments on the
+// next attempt, like a normal download. Returns errRangeNotSupported if the server ignores range requests,
+// in which case the caller should start over with a normal download. With skipMissing it gives up right
+// away if the mirror doesn't have the file.
+func (d *Downloader) downloadMulti(
+	ctx context.Context,
+	file *os.File,
+	observer *downloadObserver,
+	downloadUrl *url.URL,
+	filename string,
+	expectedChecksum string,
+	expectedSize int64,
+	segments []downloadSegment,
+	config DownloadConfig,
+	skipMissing bool,
+) error {
+	return retry(ctx, config.retryPolicy(), "Download", func() error {
+		err := d.downloadSegments(ctx, file, observer, downloadUrl, filename, expectedChecksum, segments,
+			config, skipMissing)
+		if errors.Is(err, errChecksumMismatch) {
+			// The file has been truncated, the segments are no longer valid.
+			segments = planSegments(config, expectedSize)
+			return err
+		}
+		if err != nil {
+			// The segments have been retried already.
+			return permanent(err)
+		}
+		return nil
+	})
+}
+
+// downloadSegments does a single pass of a multi-connection download, see downloadMulti. Each segment is
+// retried on its own. Returns an error wrapping errChecksumMismatch (after truncating the file) if the
+// result doesn't match the checksum.
+func (d *Downloader) downloadSegments(
+	ctx context.Context,
+	file *os.File,
+	observer *downloadObserver,
+	downloadUrl *url.URL,
+	filename string,
+	expectedChecksum string,
+	segments []downloadSegment,
+	config DownloadConfig,
+	skipMissing bool,
+) error {
+	if err := writeSegments(filename, segments); err != nil {
+		return err
+	}
+	d.setFileReceived(observer.dip, segmentsDone(segments))
+
+	// Segments are updated by the workers, the segments file is written under the same mutex.
+	var segmentsMu sync.Mutex
+	indices := make([]int, len(segments))
+	for i := range indices {
+		indices[i] = i
+	}
+	err := DoInParallel(ctx, func(ctx context.Context, i int) error {
+		segmentsMu.Lock()
+		segment := segments[i]
+		segmentsMu.Unlock()
+		if segment.Start+segment.Done >= segment.End {
+			return nil
+		}
+		// Each connection has its own stall watchdog, but they share the download record so the
+		// download speed is combined. Hashing is done afterwards, the data doesn't arrive in order.
+		segmentObserver := &downloadObserver{dip: observer.dip}
+		what := fmt.Sprintf("Download of range %d-%d", segment.Start, segment.End-1)
+		return retry(ctx, config.retryPolicy(), what, func() error {
+			done, resp, err := d.doDownloadSegment(ctx, file, segmentObserver, downloadUrl, filename, segment)
+			segmentsMu.Lock()
+			segments[i].Done = done
+			writeErr := writeSegments(filename, segments)
+			segmentsMu.Unlock()
+			if writeErr != nil {
+				return permanent(writeErr)
+			}
+			if err == nil {
+				return nil
+			}
+			segment.Done = done
+			if errors.Is(err, errRangeNotSupported) || accessDenied(resp) || (!errors.Is(err, context.Canceled) &&
+				(!config.shouldRetry(resp, err) || (skipMissing && mirrorLacksFile(resp)))) {
+				return permanent(err)
+			}
+			return err
+		})
+	}, indices, min(len(segments), config.ConnectionsPerFile))
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek in '%s': %w", filename, err)
+	}
+	actualChecksum, err := d.hasher.HashReader(ctx, file)
+	if err != nil {
+		return fmt.Errorf("failed to hash '%s': %w", filename, err)
+	}
+	// Whether it's good or not, the segments are done.
+	if err := removeLockedFile(ctx, segmentsFilename(filename)); err != nil {
+		return fmt.Errorf("failed to remove segments file of '%s': %w", filename, err)
+	}
+	if !HashEqual(expectedChecksum, actualChecksum) {
+		quarantineDownload(config.QuarantineDir, file, filename, downloadUrl,
+			expectedChecksum, actualChecksum)
+		if err := truncateFile(file); err != nil {
+			return fmt.Errorf("failed to truncate '%s' (because of checksum mismatch): %w", filename, err)
+		}
+		d.setFileReceived(observer.dip, 0)
+		return fmt.Errorf(
+			"%w for '%s' downloaded to '%s', expected %s, got %s, redownloading on the next attempt",
+			errChecksumMismatch, downloadUrl, filename, expectedChecksum, actualChecksum)
+	}
+	return nil
+}
+
+// doDownloadSegment downloads the rest of a single segment. Returns how many bytes of the segment have
+// been written in total and the response (nil if none was received), even if an error is returned.
+func (d *Downloader) doDownloadSegment(
+	ctx context.Context,
+	file *os.File,
+	observer *downloadObserver,
+	downloadUrl *url.URL,
+	filename string,
+	segment downloadSegment,
+) (int64, *http.Response, error) {
+	start := segment.Start + segment.Done
+	// Endpoint of range is inclusive.
+	rangeHeader := fmt.Sprintf("bytes=%d-%d", start, segment.End-1)
+	resp, requestCtx, cancelRequestCtx, err := d.sendRequest(ctx, downloadUrl, rangeHeader, "", " range")
+	if err != nil {
+		return segment.Done, nil, err
+	}
+	defer cancelRequestCtx(nil)
+	defer resp.Body.Close()
+
+	// A range of a compressed stream can't be written at its place in the file, only a normal download can
+	// handle those.
+	if resp.StatusCode == http.StatusOK || contentEncoding(resp) != "" {
+		return segment.Done, resp, errRangeNotSupported
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return segment.Done, resp, fmt.Errorf("failed to download range %d-%d of '%s' (status %d)",
+			start, segment.End-1, downloadUrl, resp.StatusCode)
+	}
+	if err := checkContentType(resp, downloadUrl, " range"); err != nil {
+		return segment.Done, resp, err
+	}
+
+	stopWatchdog := d.watchStalls(ctx, observer, cancelRequestCtx)
+	defer stopWatchdog()
+
+	// Never write outside the segment.
+	reader := io.TeeReader(
+		io.LimitReader(pausingReader{ctx: ctx, r: resp.Body, throttle: d.throttle, limiter: d.limiter}, segment.End-start),
+		observer,
+	)
+	written, err := copyBuffered(io.NewOffsetWriter(file, start), reader, d.config.CopyBufferSize)
+	done := segment.Done + written
+	if err != nil {
+		// Depending on where the read was the error is context.Canceled or the cause.
+		if stallErr := d.stallError(requestCtx); stallErr != nil {
+			err = stallErr
+		}
+		return done, resp, fmt.Errorf("failed to download range %d-%d of '%s' to '%s': %w",
+			start, segment.End-1, downloadUrl, filename, err)
+	}
+	if segment.Start+done < segment.End {
+		return done, resp, fmt.Errorf(
+			"failed to download range %d-%d of '%s' to '%s': download stopped before range was fully received",
+			start, segment.End-1, downloadUrl, filename)
+	}
+	return done, resp, nil
+}
@@ -0,0 +1,78 @@
+package patcher
+
+import (
+	"net/url"
+	"time"
+)
+
+// How often DownloadConfig.FileProgressFunc is called at most for each file.
+const fileProgressInterval = time.Second
+
+// FileDownloadProgress is the progress of a single download, see DownloadConfig.FileProgressFunc.
+type FileDownloadProgress struct {
+	// Where the file is being downloaded from. Changes when switching to another mirror.
+	DownloadUrl *url.URL
+
+	// Where the file is being downloaded to, for StreamFile the name passed to it.
+	Filename string
+
+	// How many bytes of the file there are now, including data of a partial download that was already on
+	// disk. Goes back to 0 when a download is started over, e.g. after a checksum mismatch.
+	Received int64
+
+	// Expected size of the file in bytes.
+	Size int64
+
+	// Whether the download continues a partial download from an earlier run.
+	Resumed bool
+
+	// Whether the file is completely downloaded and verified. This is the last report for the file.
+	Done bool
+}
+
+// progress returns the progress of a download. Must be called with the downloader mutex held.
+func (dip *downloadRecord) progress(done bool) FileDownloadProgress {
+	return FileDownloadProgress{
+		DownloadUrl: dip.downloadUrl,
+		Filename:    dip.filename,
+		Received:    dip.received,
+		Size:        dip.size,
+		Resumed:     dip.resumed,
+		Done:        done,
+	}
+}
+
+// startFileProgress sets how much of a file there is when its download starts, received > 0 means it's
+// resumed.
+func (d *Downloader) startFileProgress(dip *downloadRecord, received int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dip.received = received
+	dip.resumed = received > 0
+}
+
+// setFileReceived sets how much of a file there is, e.g. to 0 after it's been truncated.
+func (d *Downloader) setFileReceived(dip *downloadRecord, received int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dip.received = received
+}
+
+// setFileUrl sets where a file is being downloaded from, after switching mirrors.
+func (d *Downloader) setFileUrl(dip *downloadRecord, downloadUrl *url.URL) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dip.downloadUrl = downloadUrl
+}
+
+// reportFileDone sends the final progress report for a file that's completely downloaded.
+func (d *Downloader) reportFileDone(dip *downloadRecord) {
+	d.mu.Lock()
+	progressFunc := d.config.FileProgressFunc
+	dip.received = dip.size
+	progress := dip.progress(true)
+	d.mu.Unlock()
+	if progressFunc != nil {
+		progressFunc(progress)
+	}
+}
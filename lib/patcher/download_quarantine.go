@@ -0,0 +1,67 @@
+package patcher
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Directory (relative to the install dir) the patcher CLI quarantines downloads with a checksum mismatch in,
+// see DownloadConfig.QuarantineDir. It's kept when the patch dir is removed after a successful run.
+const QuarantineDirname = "patch/quarantine"
+
+// quarantineDownload copies a downloaded file with a checksum mismatch to the quarantine dir (see
+// DownloadConfig.QuarantineDir), along with a ".mismatch" file noting where it came from and the expected
+// and actual checksums. Does nothing if no quarantine dir is configured. Failing to quarantine is logged
+// but otherwise ignored, it's only a debugging aid.
+func quarantineDownload(
+	quarantineDir string,
+	file *os.File,
+	filename string,
+	downloadUrl *url.URL,
+	expectedChecksum string,
+	actualChecksum string,
+) {
+	if quarantineDir == "" {
+		return
+	}
+	// Named after the actual checksum, so a mirror serving the same bad file on every attempt doesn't
+	// fill up the disk.
+	quarantineFilename := filepath.Join(quarantineDir,
+		fmt.Sprintf("%s_%s", filepath.Base(filename), actualChecksum))
+	if err := copyToQuarantine(quarantineFilename, file); err != nil {
+		log.Printf("Couldn't quarantine '%s' with invalid checksum to '%s': %s", filename, quarantineFilename, err)
+		return
+	}
+	info := fmt.Sprintf("url: %s\nexpected: %s\nactual: %s\ntime: %s\n", downloadUrl,
+		expectedChecksum, actualChecksum, time.Now().Format(time.RFC3339))
+	if err := os.WriteFile(quarantineFilename+".mismatch", []byte(info), 0644); err != nil {
+		log.Printf("Couldn't write details of quarantined '%s': %s", quarantineFilename, err)
+		return
+	}
+	log.Printf("Quarantined '%s' with invalid checksum to '%s'.", filename, quarantineFilename)
+}
+
+// copyToQuarantine copies the contents of a file, without changing its file position.
+func copyToQuarantine(quarantineFilename string, file *os.File) error {
+	if err := os.MkdirAll(filepath.Dir(quarantineFilename), 0755); err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(quarantineFilename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(file, 0, info.Size()))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// StreamFile downloads a file without storing it, passing the data to consume while it arrives. Consume
+// should read until EOF. The size and checksum can only be checked once consume returns, so if StreamFile
+// returns an error whatever consume produced must be discarded.
+//
+// Unlike DownloadFile there are no retries, a stream can't be resumed. The name identifies the download
+// like the filename does for DownloadFile, it must not be used for any other download.
+func (d *Downloader) StreamFile(
+	ctx context.Context,
+	downloadUrl *url.URL,
+	name string,
+	expectedChecksum string,
+	expectedSize int64,
+	consume func(io.Reader) error,
+) error {
+	d.mu.Lock()
+	downloadIdx := d.downloadCount
+	d.downloadCount++
+	maxFileSize := d.config.MaxFileSize
+	d.mu.Unlock()
+
+	if maxFileSize > 0 && expectedSize > maxFileSize {
+		return fmt.Errorf("refusing to download '%s', size %d is larger than the maximum of %d bytes",
+			downloadUrl, expectedSize, maxFileSize)
+	}
+
+	observer, err := d.register(downloadUrl, name, downloadIdx, expectedSize)
+	if err != nil {
+		return err
+	}
+	// There's no existing data to catch up with.
+	observer.setCatchUpMode(false)
+
+	resp, requestCtx, cancelRequestCtx, err := d.sendRequest(ctx, downloadUrl, "", "", "")
+	if err != nil {
+		return err
+	}
+	defer cancelRequestCtx(nil)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download '%s' (status %d)", downloadUrl, resp.StatusCode)
+	}
+	if err := checkContentType(resp, downloadUrl, ""); err != nil {
+		return err
+	}
+	if err := checkResponseSize(resp, downloadUrl, "", 0, expectedSize); err != nil {
+		return err
+	}
+
+	stopWatchdog := d.watchStalls(ctx, observer, cancelRequestCtx)
+	defer stopWatchdog()
+
+	body, err := decodeBody(pausingReader{ctx: ctx, r: resp.Body, throttle: d.throttle, limiter: d.limiter},
+		contentEncoding(resp))
+	if err != nil {
+		return fmt.Errorf("failed to stream '%s': %w", downloadUrl, err)
+	}
+	defer body.Close()
+
+	// Never pass on more than expected, like DownloadFile.
+	limit := downloadSizeLimit(expectedSize, maxFileSize)
+	reader := &countingReader{r: io.TeeReader(io.LimitReader(body, limit), observer)}
+	if err := consume(reader); err != nil {
+		if stallErr := d.stallError(requestCtx); stallErr != nil {
+			err = fmt.Errorf("%w (%s)", err, stallErr)
+		}
+		return fmt.Errorf("failed to stream '%s': %w", downloadUrl, err)
+	}
+	if reader.n < expectedSize {
+		return fmt.Errorf("failed to stream '%s': stream stopped before file was fully received "+
+			"(got %d, need %d bytes)", downloadUrl, reader.n, expectedSize)
+	}
+	actualChecksum := observer.getChecksum()
+	if !HashEqual(expectedChecksum, actualChecksum) {
+		return fmt.Errorf("streamed file '%s' has invalid checksum, expected %s, got %s",
+			downloadUrl, expectedChecksum, actualChecksum)
+	}
+	d.reportFileDone(observer.dip)
+	return nil
+}
+
+// A countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements (io.Reader).Read
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
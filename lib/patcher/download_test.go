@@ -0,0 +1,850 @@
+package patcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testDownloadConfig returns a download config suitable for tests (no waiting).
+func testDownloadConfig() DownloadConfig {
+	return DownloadConfig{
+		MaxAttempts:              2,
+		RetryBaseDelay:           time.Millisecond,
+		RetryWaitIncrementFactor: 1,
+		DownloadSpeedWindow:      5,
+		DownloadRequestTimeout:   5 * time.Second,
+		DownloadStallTimeout:     5 * time.Second,
+	}
+}
+
+// serveBytes returns a test server that serves data as a patch file, supporting simple ranges.
+func serveBytes(t *testing.T, data []byte) *url.URL {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+	return location
+}
+
+func newTestDownloader(t *testing.T, config DownloadConfig) *Downloader {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewDownloader(config, func(DownloadStats) {}, ctx)
+}
+
+func TestDownloadFileOk(t *testing.T) {
+	data := []byte("some patch data")
+	location := serveBytes(t, data)
+	filename := filepath.Join(t.TempDir(), "patch")
+	d := newTestDownloader(t, testDownloadConfig())
+	err := d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	require.FileExists(t, filename)
+}
+
+func TestDownloadFileNewHash(t *testing.T) {
+	data := bytes.Repeat([]byte("some patch data"), 200000)
+	location := serveBytes(t, data)
+	sum := sha1.Sum(data)
+	config := testDownloadConfig()
+	config.NewHash = sha1.New
+	dir := t.TempDir()
+	d := newTestDownloader(t, config)
+	err := d.DownloadFile(context.Background(), location, filepath.Join(dir, "single"), hex.EncodeToString(sum[:]),
+		int64(len(data)))
+	require.NoError(t, err)
+
+	// Multi-connection downloads are hashed afterwards, with the same hash.
+	config.ConnectionsPerFile = 2
+	config.MaxAttempts = 0
+	d = newTestDownloader(t, config)
+	err = d.DownloadFile(context.Background(), location, filepath.Join(dir, "multi"), hex.EncodeToString(sum[:]),
+		int64(len(data)))
+	require.NoError(t, err)
+}
+
+func TestDownloadFileMaxFileSize(t *testing.T) {
+	data := []byte("some patch data")
+	location := serveBytes(t, data)
+	config := testDownloadConfig()
+	config.MaxFileSize = 4
+	d := newTestDownloader(t, config)
+	filename := filepath.Join(t.TempDir(), "patch")
+	err := d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.ErrorContains(t, err, "larger than the maximum")
+	require.NoFileExists(t, filename)
+}
+
+func TestDownloadFileOversizedBody(t *testing.T) {
+	data := []byte("some patch data")
+	// The server sends a lot more than expected, without saying so up front (chunked).
+	body := append(append([]byte{}, data...), make([]byte, 1<<20)...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.(http.Flusher).Flush()
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+	filename := filepath.Join(t.TempDir(), "patch")
+	d := newTestDownloader(t, testDownloadConfig())
+	err = d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.ErrorContains(t, err, "more than the expected")
+	require.NoFileExists(t, filename)
+	info, err := os.Stat(partFilename(filename))
+	require.NoError(t, err)
+	require.LessOrEqual(t, info.Size(), int64(len(data)))
+}
+
+func TestDownloadFileWrongSize(t *testing.T) {
+	data := []byte("some patch data")
+	// The server has a different version of the file.
+	otherData := append(append([]byte{}, data...), "and more"...)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(otherData))
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+	d := newTestDownloader(t, testDownloadConfig())
+
+	// Noticed before the body is read, and not retried.
+	filename := filepath.Join(t.TempDir(), "patch")
+	err = d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.ErrorContains(t, err, "server says the file has 23 bytes, expected 15")
+	require.EqualValues(t, 1, requests.Load())
+	info, err := os.Stat(partFilename(filename))
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+
+	// Also when resuming, then the total is in Content-Range.
+	filename = filepath.Join(t.TempDir(), "patch")
+	require.NoError(t, os.WriteFile(filename, data[:5], 0644))
+	err = d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.ErrorContains(t, err, "server says the file has 23 bytes, expected 15")
+
+	// A range response that's shorter than asked for is resumed.
+	var rangeHeaders []string
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHeaders = append(rangeHeaders, r.Header.Get("Range"))
+		// Always a range from the test below, like "bytes=1-14".
+		start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-14"))
+		end := min(start+5, len(data))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(data[start:end])
+	}))
+	t.Cleanup(server.Close)
+	shortLocation, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+	filename = filepath.Join(t.TempDir(), "patch")
+	require.NoError(t, os.WriteFile(filename, data[:1], 0644))
+	err = d.DownloadFile(context.Background(), shortLocation, filename, HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, []string{"bytes=1-14", "bytes=6-14", "bytes=11-14"}, rangeHeaders)
+}
+
+func TestDownloadFilePart(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if requests == 1 {
+			// Promise the whole file but break off after 5 bytes.
+			w.Header().Set("Content-Length", "20")
+			_, _ = w.Write(data[:5])
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+	config := testDownloadConfig()
+	config.MaxAttempts = 0
+	d := newTestDownloader(t, config)
+	filename := filepath.Join(t.TempDir(), "patch")
+
+	// An interrupted download only leaves the part file.
+	err = d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.Error(t, err)
+	require.NoFileExists(t, filename)
+	actual, err := os.ReadFile(partFilename(filename))
+	require.NoError(t, err)
+	require.Equal(t, data[:5], actual)
+
+	// Which is resumed, and renamed once complete.
+	d = newTestDownloader(t, config)
+	err = d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	require.NoFileExists(t, partFilename(filename))
+	actual, err = os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, data, actual)
+
+	// A completed download is recognized.
+	d = newTestDownloader(t, config)
+	err = d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, 2, requests)
+	require.FileExists(t, filename)
+	require.NoFileExists(t, partFilename(filename))
+}
+
+func TestDownloadFileUnknownSize(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+	config := testDownloadConfig()
+	config.ConnectionsPerFile = 4
+
+	for _, tc := range []struct {
+		name     string
+		partData []byte
+		requests int
+	}{
+		{"empty", nil, 1},
+		// There's no telling where the data ends, so it's downloaded again in full.
+		{"partial", data[:5], 1},
+		{"wrong", []byte("abcdefghij0123456789"), 1},
+		// Found to be complete by its checksum.
+		{"complete", data, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ranges = nil
+			filename := filepath.Join(t.TempDir(), "patch")
+			if tc.partData != nil {
+				require.NoError(t, os.WriteFile(partFilename(filename), tc.partData, 0644))
+			}
+			d := newTestDownloader(t, config)
+			err := d.DownloadFile(context.Background(), location, filename, HashBytes(data), 0)
+			require.NoError(t, err)
+			require.Len(t, ranges, tc.requests)
+			for _, r := range ranges {
+				require.Empty(t, r)
+			}
+			require.NoFileExists(t, partFilename(filename))
+			actual, err := os.ReadFile(filename)
+			require.NoError(t, err)
+			require.Equal(t, data, actual)
+		})
+	}
+}
+
+func TestDownloadFileUnknownSizeMaxFileSize(t *testing.T) {
+	data := []byte("some patch data")
+	location := serveBytes(t, data)
+	config := testDownloadConfig()
+	config.MaxFileSize = 4
+	config.MaxAttempts = 0
+	d := newTestDownloader(t, config)
+	filename := filepath.Join(t.TempDir(), "patch")
+	err := d.DownloadFile(context.Background(), location, filename, HashBytes(data), 0)
+	require.ErrorContains(t, err, "more than the expected")
+	require.NoFileExists(t, filename)
+}
+
+func TestDownloadFileIfRange(t *testing.T) {
+	oldData := []byte("0123456789abcdefghij")
+	newData := []byte("ABCDEFGHIJ0123456789")
+	var ifRanges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifRanges = append(ifRanges, r.Header.Get("If-Range"))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if len(ifRanges) == 1 {
+			// Break off the old version after 5 bytes.
+			w.Header().Set("ETag", `"old"`)
+			w.Header().Set("Content-Length", "20")
+			_, _ = w.Write(oldData[:5])
+			return
+		}
+		// Then the file changes, the If-Range doesn't match so the whole file is sent.
+		w.Header().Set("ETag", `"new"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(newData))
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+	config := testDownloadConfig()
+	config.MaxAttempts = 1
+	d := newTestDownloader(t, config)
+	filename := filepath.Join(t.TempDir(), "patch")
+	err = d.DownloadFile(context.Background(), location, filename, HashBytes(newData), int64(len(newData)))
+	require.NoError(t, err)
+	require.Equal(t, []string{"", `"old"`}, ifRanges)
+	actual, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, newData, actual)
+
+	// A server that doesn't support ranges sends the whole file too, that's not an error either.
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(newData)
+	}))
+	t.Cleanup(server.Close)
+	location, err = url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+	filename = filepath.Join(t.TempDir(), "patch")
+	require.NoError(t, os.WriteFile(partFilename(filename), newData[:5], 0644))
+	config.MaxAttempts = 0
+	d = newTestDownloader(t, config)
+	err = d.DownloadFile(context.Background(), location, filename, HashBytes(newData), int64(len(newData)))
+	require.NoError(t, err)
+	actual, err = os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, newData, actual)
+}
+
+func TestDownloadFileResumeRangeForms(t *testing.T) {
+	data := []byte("some patch data")
+	for _, tc := range []struct {
+		openEnded bool
+		expected  string
+	}{
+		{false, "bytes=5-14"},
+		{true, "bytes=5-"},
+	} {
+		var rangeHeaders []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rangeHeaders = append(rangeHeaders, r.Header.Get("Range"))
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		}))
+		t.Cleanup(server.Close)
+		location, err := url.Parse(server.URL + "/patch")
+		require.NoError(t, err)
+		config := testDownloadConfig()
+		config.OpenEndedRanges = tc.openEnded
+		d := newTestDownloader(t, config)
+		filename := filepath.Join(t.TempDir(), "patch")
+		require.NoError(t, os.WriteFile(filename, data[:5], 0644))
+
+		err = d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+		require.NoError(t, err)
+		require.Equal(t, []string{tc.expected}, rangeHeaders)
+		actual, err := os.ReadFile(filename)
+		require.NoError(t, err)
+		require.Equal(t, data, actual)
+	}
+}
+
+func TestDownloadFileTotalBytes(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if requests == 1 {
+			// Promise the rest of the file but break off after 5 bytes, forcing a retry.
+			w.Header().Set("Content-Length", "16")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(data[4:9])
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+	d := newTestDownloader(t, testDownloadConfig())
+	filename := filepath.Join(t.TempDir(), "patch")
+	// Already on disk, not downloaded in this run.
+	require.NoError(t, os.WriteFile(filename, data[:4], 0644))
+
+	err = d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, 2, requests)
+	// 5 bytes in the failed attempt, the remaining 11 in the second.
+	require.Equal(t, int64(16), d.tick().TotalBytes)
+}
+
+func TestDownloadFileProgress(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	reported := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 5-%d/%d", len(data)-1, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(data[5:10])
+		w.(http.Flusher).Flush()
+		// The rest arrives well within a second of the first report, so it isn't reported.
+		<-reported
+		_, _ = w.Write(data[10:15])
+		w.(http.Flusher).Flush()
+		_, _ = w.Write(data[15:])
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+	var reports []FileDownloadProgress
+	config := testDownloadConfig()
+	config.FileProgressFunc = func(p FileDownloadProgress) {
+		reports = append(reports, p)
+		if len(reports) == 1 {
+			reported <- struct{}{}
+		}
+	}
+	d := newTestDownloader(t, config)
+	filename := filepath.Join(t.TempDir(), "patch")
+	require.NoError(t, os.WriteFile(filename, data[:5], 0644))
+
+	err = d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+	first := reports[0]
+	// The data that was already on disk counts too.
+	require.Equal(t, int64(10), first.Received)
+	require.Equal(t, int64(len(data)), first.Size)
+	require.True(t, first.Resumed)
+	require.False(t, first.Done)
+	require.Equal(t, filename, first.Filename)
+	require.Equal(t, location, first.DownloadUrl)
+	require.Equal(t, FileDownloadProgress{
+		DownloadUrl: location,
+		Filename:    filename,
+		Received:    int64(len(data)),
+		Size:        int64(len(data)),
+		Resumed:     true,
+		Done:        true,
+	}, reports[1])
+}
+
+func TestDownloadFileMultiConnection(t *testing.T) {
+	data := make([]byte, 3*minSegmentSize+17)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	location := serveBytes(t, data)
+	config := testDownloadConfig()
+	config.ConnectionsPerFile = 3
+	d := newTestDownloader(t, config)
+	filename := filepath.Join(t.TempDir(), "patch")
+	err := d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	actual, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, data, actual)
+	require.NoFileExists(t, segmentsFilename(filename))
+}
+
+func TestDownloadFileChunks(t *testing.T) {
+	data := make([]byte, 3*minSegmentSize+17)
+	for i := range data {
+		data[i] = byte(i * 5)
+	}
+	var active, maxActive, requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			m := maxActive.Load()
+			if n <= m || maxActive.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+
+	config := testDownloadConfig()
+	config.ConnectionsPerFile = 2
+	config.ChunkSize = minSegmentSize
+	require.Len(t, planSegments(config, int64(len(data))), 4)
+	d := newTestDownloader(t, config)
+	filename := filepath.Join(t.TempDir(), "patch")
+	err = d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	actual, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, data, actual)
+	require.Equal(t, int32(4), requests.Load())
+	require.LessOrEqual(t, maxActive.Load(), int32(2))
+
+	// Chunks smaller than the minimum segment size are made bigger.
+	config.ChunkSize = 10
+	require.Len(t, planSegments(config, int64(len(data))), 4)
+}
+
+func TestDownloadFileMultiConnectionResume(t *testing.T) {
+	data := make([]byte, 2*minSegmentSize)
+	for i := range data {
+		data[i] = byte(i * 3)
+	}
+	location := serveBytes(t, data)
+	config := testDownloadConfig()
+	config.ConnectionsPerFile = 2
+	d := newTestDownloader(t, config)
+	filename := filepath.Join(t.TempDir(), "patch")
+	// First segment partially done, second segment not started (leaving a hole).
+	partial := make([]byte, len(data))
+	copy(partial, data[:100])
+	require.NoError(t, os.WriteFile(filename, partial, 0644))
+	segments := splitSegments(int64(len(data)), 2)
+	segments[0].Done = 100
+	require.NoError(t, writeSegments(filename, segments))
+
+	err := d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	actual, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, data, actual)
+	require.NoFileExists(t, segmentsFilename(filename))
+}
+
+func TestDownloadFileMultiConnectionChecksumMismatch(t *testing.T) {
+	data := make([]byte, 2*minSegmentSize)
+	for i := range data {
+		data[i] = byte(i * 3)
+	}
+	corrupt := make([]byte, len(data))
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first pass (one request per segment) gets corrupt data.
+		body := data
+		if requests.Add(1) <= 2 {
+			body = corrupt
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+
+	config := testDownloadConfig()
+	config.ConnectionsPerFile = 2
+	d := newTestDownloader(t, config)
+	filename := filepath.Join(t.TempDir(), "patch")
+	err = d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	actual, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, data, actual)
+	require.NoFileExists(t, segmentsFilename(filename))
+	require.Equal(t, int32(4), requests.Load())
+}
+
+func TestDownloadFileMultiConnectionFallback(t *testing.T) {
+	data := make([]byte, 2*minSegmentSize)
+	// This server ignores Range headers.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+	config := testDownloadConfig()
+	config.ConnectionsPerFile = 2
+	d := newTestDownloader(t, config)
+	filename := filepath.Join(t.TempDir(), "patch")
+	err = d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), info.Size())
+	require.NoFileExists(t, segmentsFilename(filename))
+}
+
+func TestDownloadFileMirrorsMissing(t *testing.T) {
+	data := []byte("some patch data")
+	var missingRequests atomic.Int32
+	missing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		missingRequests.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(missing.Close)
+	missingLocation, err := url.Parse(missing.URL + "/patch")
+	require.NoError(t, err)
+	d := newTestDownloader(t, testDownloadConfig())
+	filename := filepath.Join(t.TempDir(), "patch")
+
+	// A mirror without the file isn't retried if there's another.
+	err = d.DownloadFileMirrors(context.Background(), []*url.URL{missingLocation, serveBytes(t, data)},
+		filename, HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, missingRequests.Load())
+	actual, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, data, actual)
+
+	// The last mirror is.
+	missingRequests.Store(0)
+	err = d.DownloadFileMirrors(context.Background(), []*url.URL{missingLocation},
+		filepath.Join(t.TempDir(), "patch"), HashBytes(data), int64(len(data)))
+	require.ErrorContains(t, err, "status 404")
+	require.EqualValues(t, 3, missingRequests.Load())
+}
+
+func TestDownloadFileMirrorsResume(t *testing.T) {
+	data := []byte("some patch data")
+	// This server always stops halfway.
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, _ = w.Write(data[:5])
+	}))
+	t.Cleanup(broken.Close)
+	brokenLocation, err := url.Parse(broken.URL + "/patch")
+	require.NoError(t, err)
+	var rangeHeaders []string
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHeaders = append(rangeHeaders, r.Header.Get("Range"))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(good.Close)
+	goodLocation, err := url.Parse(good.URL + "/patch")
+	require.NoError(t, err)
+	d := newTestDownloader(t, testDownloadConfig())
+	filename := filepath.Join(t.TempDir(), "patch")
+
+	err = d.DownloadFileMirrors(context.Background(), []*url.URL{brokenLocation, goodLocation},
+		filename, HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	// The next mirror is only asked for what's missing.
+	require.Equal(t, []string{"bytes=5-14"}, rangeHeaders)
+	actual, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, data, actual)
+}
+
+func TestDownloadFileMinDownloadSpeed(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", "1000")
+		// Trickle: data keeps coming, so it's never a stall without a minimum speed.
+		for i := range data {
+			if _, err := w.Write(data[i : i+1]); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+	config := testDownloadConfig()
+	config.MaxAttempts = 0
+	config.DownloadStallTimeout = 2 * time.Second
+	config.MinDownloadSpeed = 100
+	d := newTestDownloader(t, config)
+	filename := filepath.Join(t.TempDir(), "patch")
+	err = d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.ErrorContains(t, err, "slower than 100 bytes/s")
+}
+
+func TestDownloadFileShouldRetry(t *testing.T) {
+	var requests atomic.Int32
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+	data := []byte("some patch data")
+
+	// By default every failure is retried.
+	config := testDownloadConfig()
+	d := newTestDownloader(t, config)
+	err = d.DownloadFile(context.Background(), location, filepath.Join(t.TempDir(), "patch"),
+		HashBytes(data), int64(len(data)))
+	require.ErrorContains(t, err, "status 503")
+	require.EqualValues(t, 3, requests.Load())
+
+	// Except denied access.
+	requests.Store(0)
+	status.Store(http.StatusForbidden)
+	err = d.DownloadFile(context.Background(), location, filepath.Join(t.TempDir(), "patch"),
+		HashBytes(data), int64(len(data)))
+	require.ErrorContains(t, err, "status 403")
+	require.EqualValues(t, 1, requests.Load())
+
+	requests.Store(0)
+	status.Store(http.StatusServiceUnavailable)
+	var gotStatus int
+	config.ShouldRetry = func(resp *http.Response, err error) bool {
+		gotStatus = resp.StatusCode
+		return resp.StatusCode != http.StatusServiceUnavailable
+	}
+	d = newTestDownloader(t, config)
+	err = d.DownloadFile(context.Background(), location, filepath.Join(t.TempDir(), "patch"),
+		HashBytes(data), int64(len(data)))
+	require.ErrorContains(t, err, "status 503")
+	require.EqualValues(t, 1, requests.Load())
+	require.Equal(t, http.StatusServiceUnavailable, gotStatus)
+}
+
+func TestDownloadFileTokenProvider(t *testing.T) {
+	data := []byte("some patch data")
+	var validToken atomic.Value
+	validToken.Store("token-1")
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Authorization") != "Bearer "+validToken.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/patch")
+	require.NoError(t, err)
+
+	var provided atomic.Int32
+	config := testDownloadConfig()
+	config.Headers = map[string]string{"Authorization": "Bearer static"}
+	config.TokenProvider = func(ctx context.Context) (string, error) {
+		return fmt.Sprintf("token-%d", provided.Add(1)), nil
+	}
+	d := newTestDownloader(t, config)
+	dir := t.TempDir()
+	require.NoError(t, d.DownloadFile(context.Background(), location, filepath.Join(dir, "patch1"),
+		HashBytes(data), int64(len(data))))
+	require.EqualValues(t, 1, provided.Load())
+	require.EqualValues(t, 1, requests.Load())
+
+	// The token expires, a new one is fetched and the request sent again.
+	validToken.Store("token-2")
+	require.NoError(t, d.DownloadFile(context.Background(), location, filepath.Join(dir, "patch2"),
+		HashBytes(data), int64(len(data))))
+	require.EqualValues(t, 2, provided.Load())
+	require.EqualValues(t, 3, requests.Load())
+
+	// A new token that's refused as well isn't retried.
+	validToken.Store("never")
+	err = d.DownloadFile(context.Background(), location, filepath.Join(dir, "patch3"),
+		HashBytes(data), int64(len(data)))
+	require.ErrorContains(t, err, "status 401")
+	require.EqualValues(t, 3, provided.Load())
+	require.EqualValues(t, 5, requests.Load())
+}
+
+func TestDownloadFileQuarantine(t *testing.T) {
+	data := []byte("bad patch data")
+	location := serveBytes(t, data)
+	expected := HashBytes([]byte("good patch data"))
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "patch")
+	d := newTestDownloader(t, testDownloadConfig())
+	err := d.DownloadFile(context.Background(), location, filename, expected, int64(len(data)))
+	require.ErrorContains(t, err, "invalid checksum")
+	require.NoDirExists(t, filepath.Join(dir, "quarantine"))
+
+	config := testDownloadConfig()
+	config.QuarantineDir = filepath.Join(dir, "quarantine")
+	d = newTestDownloader(t, config)
+	err = d.DownloadFile(context.Background(), location, filename, expected, int64(len(data)))
+	require.ErrorContains(t, err, "invalid checksum")
+	// Every attempt got the same bad data, so there's one quarantined file.
+	quarantined := filepath.Join(dir, "quarantine", "patch_"+HashBytes(data))
+	actual, err := os.ReadFile(quarantined)
+	require.NoError(t, err)
+	require.Equal(t, data, actual)
+	info, err := os.ReadFile(quarantined + ".mismatch")
+	require.NoError(t, err)
+	require.Contains(t, string(info), "expected: "+expected)
+	require.Contains(t, string(info), "actual: "+HashBytes(data))
+	entries, err := os.ReadDir(filepath.Join(dir, "quarantine"))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
+
+func TestDownloadFileRateLimitShared(t *testing.T) {
+	data := bytes.Repeat([]byte("r"), 50000)
+	location := serveBytes(t, data)
+	config := testDownloadConfig()
+	config.RateSchedule = RateSchedule{Default: 50000}
+	d := newTestDownloader(t, config)
+	dir := t.TempDir()
+
+	// Each download on its own would fit in the initial burst, together they have to wait.
+	start := time.Now()
+	err := DoInParallel(context.Background(), func(ctx context.Context, name string) error {
+		return d.DownloadFile(ctx, location, filepath.Join(dir, name), HashBytes(data), int64(len(data)))
+	}, []string{"a", "b"}, 2)
+	require.NoError(t, err)
+	require.Greater(t, time.Since(start), 800*time.Millisecond)
+
+	// Waiting for the limit doesn't delay cancellation.
+	config.RateSchedule = RateSchedule{Default: 1000}
+	d = newTestDownloader(t, config)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	err = d.DownloadFile(ctx, location, filepath.Join(dir, "c"), HashBytes(data), int64(len(data)))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestStreamFile(t *testing.T) {
+	data := []byte("some patch data")
+	location := serveBytes(t, data)
+	d := newTestDownloader(t, testDownloadConfig())
+	var received []byte
+	consume := func(r io.Reader) error {
+		var err error
+		received, err = io.ReadAll(r)
+		return err
+	}
+	err := d.StreamFile(context.Background(), location, "a", HashBytes(data), int64(len(data)), consume)
+	require.NoError(t, err)
+	require.Equal(t, data, received)
+
+	err = d.StreamFile(context.Background(), location, "b", HashBytes([]byte("other")), int64(len(data)), consume)
+	require.ErrorContains(t, err, "invalid checksum")
+
+	// Stopping early is an error, even if the consumer doesn't report one.
+	err = d.StreamFile(context.Background(), location, "c", HashBytes(data), int64(len(data)), func(r io.Reader) error {
+		_, err := r.Read(make([]byte, 4))
+		return err
+	})
+	require.ErrorContains(t, err, "stream stopped before file was fully received")
+}
@@ -0,0 +1,159 @@
+package patcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// A FileEventKind is what happened to a file, see FileEvent.
+type FileEventKind int
+
+const (
+	FileVerifyStarted   FileEventKind = 0
+	FileVerified        FileEventKind = 1
+	FileDownloadStarted FileEventKind = 2
+	FileDownloaded      FileEventKind = 3
+	FileApplyStarted    FileEventKind = 4
+	FileApplied         FileEventKind = 5
+	FileDeleted         FileEventKind = 6
+	FileFailed          FileEventKind = 7
+)
+
+// String implements (fmt.Stringer).String
+func (k FileEventKind) String() string {
+	switch k {
+	case FileVerifyStarted:
+		return "verify-started"
+	case FileVerified:
+		return "verified"
+	case FileDownloadStarted:
+		return "download-started"
+	case FileDownloaded:
+		return "downloaded"
+	case FileApplyStarted:
+		return "apply-started"
+	case FileApplied:
+		return "applied"
+	case FileDeleted:
+		return "deleted"
+	case FileFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("FileEventKind(%d)", int(k))
+	}
+}
+
+// A FileEvent reports a state transition of a single file, see PatcherConfig.OnFileEvent.
+type FileEvent struct {
+	// What happened.
+	Kind FileEventKind
+
+	// Phase in which it happened.
+	Phase Phase
+
+	// Path relative to the install dir. In the download phase this is the patch file (e.g. "patch/<hash>"),
+	// otherwise the installed file.
+	Path string
+
+	// Why the file failed, only set for FileFailed.
+	Err error
+}
+
+// Number of file events that can be waiting for the event handler before new events are dropped.
+const fileEventBufferSize = 4096
+
+// fileEventDispatcher passes file events to a handler on a separate goroutine, so a slow handler doesn't
+// slow down the patcher. Events are dropped if the handler can't keep up.
+type fileEventDispatcher struct {
+	events  chan FileEvent
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// newFileEventDispatcher starts passing events to the handler. Call close when done emitting events.
+func newFileEventDispatcher(handler func(FileEvent)) *fileEventDispatcher {
+	d := &fileEventDispatcher{
+		events: make(chan FileEvent, fileEventBufferSize),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(d.done)
+		for ev := range d.events {
+			handler(ev)
+		}
+	}()
+	return d
+}
+
+// emit queues an event for the handler, or drops it if the queue is full. Safe to call on nil.
+func (d *fileEventDispatcher) emit(ev FileEvent) {
+	if d == nil {
+		return
+	}
+	select {
+	case d.events <- ev:
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+// close waits until the handler has received all queued events. Safe to call on nil.
+func (d *fileEventDispatcher) close() {
+	if d == nil {
+		return
+	}
+	close(d.events)
+	<-d.done
+	if dropped := d.dropped.Load(); dropped > 0 {
+		log.Printf("Dropped %d file events because the event handler couldn't keep up.", dropped)
+	}
+}
+
+// startFileEvents makes the tracker pass file events to the handler until the returned function is called.
+// If the handler is nil file events aren't reported.
+func (p *ProgressTracker) startFileEvents(handler func(FileEvent)) func() {
+	if handler == nil {
+		return func() {}
+	}
+	d := newFileEventDispatcher(handler)
+	p.mu.Lock()
+	p.events = d
+	p.mu.Unlock()
+	return func() {
+		p.mu.Lock()
+		p.events = nil
+		p.mu.Unlock()
+		d.close()
+	}
+}
+
+// fileEvent reports a file event, if file events are being reported.
+func (p *ProgressTracker) fileEvent(kind FileEventKind, phase Phase, path string) {
+	p.mu.Lock()
+	d := p.events
+	p.mu.Unlock()
+	d.emit(FileEvent{Kind: kind, Phase: phase, Path: path})
+}
+
+// fileDone reports that a file is done in a phase: the done event if err is nil, otherwise a FileFailed event.
+func (p *ProgressTracker) fileDone(done FileEventKind, phase Phase, path string, err error) {
+	if err == nil {
+		p.fileEvent(done, phase, path)
+	} else {
+		p.fileFailed(phase, path, err)
+	}
+}
+
+// fileFailed reports a FileFailed event. Like with PhaseItemDone cancellation isn't reported.
+func (p *ProgressTracker) fileFailed(phase Phase, path string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	p.mu.Lock()
+	d := p.events
+	p.mu.Unlock()
+	d.emit(FileEvent{Kind: FileFailed, Phase: phase, Path: path, Err: err})
+}
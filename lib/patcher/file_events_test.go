@@ -0,0 +1,66 @@
+package patcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileEventDispatcherDrops(t *testing.T) {
+	block := make(chan struct{})
+	received := make([]FileEvent, 0)
+	d := newFileEventDispatcher(func(ev FileEvent) {
+		<-block
+		received = append(received, ev)
+	})
+	// The handler takes one event and blocks, the rest fill up the buffer.
+	for i := 0; i < fileEventBufferSize+10; i++ {
+		d.emit(FileEvent{Kind: FileVerified, Path: "a"})
+	}
+	require.GreaterOrEqual(t, d.dropped.Load(), int64(9))
+	close(block)
+	d.close()
+	require.EqualValues(t, fileEventBufferSize+10-d.dropped.Load(), len(received))
+}
+
+func TestFileEvents(t *testing.T) {
+	installDir := t.TempDir()
+	data := []byte("file data")
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "measured"), data, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "obsolete"), data, 0644))
+	instructions := []Instruction{
+		{Path: "measured", NewHash: someStr("def"), CompressedHash: someStr("ghi"), FullReplaceSize: 3},
+		{Path: "obsolete"},
+	}
+	var events []FileEvent
+	config := PatcherConfig{InstallDir: installDir, VerifyWorkers: 1, ApplyWorkers: 1,
+		OnFileEvent: func(ev FileEvent) { events = append(events, ev) }}
+	manifest := NewManifest("foo")
+	actions, err := RunVerify(context.Background(), instructions, manifest, config, nil)
+	require.NoError(t, err)
+	require.Equal(t, []FileEvent{
+		{Kind: FileVerifyStarted, Phase: PhaseVerify, Path: "measured"},
+		{Kind: FileVerified, Phase: PhaseVerify, Path: "measured"},
+	}, events)
+
+	// The patch fails, so nothing gets deleted.
+	events = nil
+	config.PatchBackend = failingBackend{}
+	require.NoError(t, createPatchDirs(installDir))
+	err = RunApply(context.Background(), actions, manifest, config, nil)
+	require.ErrorContains(t, err, "patch applied")
+	require.Len(t, events, 2)
+	require.Equal(t, FileEvent{Kind: FileApplyStarted, Phase: PhaseApply, Path: "measured"}, events[0])
+	require.Equal(t, FileFailed, events[1].Kind)
+	require.Equal(t, "measured", events[1].Path)
+	require.ErrorContains(t, events[1].Err, "patch applied")
+
+	// Without anything to update the obsolete file is deleted.
+	events = nil
+	err = RunApply(context.Background(), &DeterminedActions{ToDelete: actions.ToDelete}, manifest, config, nil)
+	require.NoError(t, err)
+	require.Equal(t, []FileEvent{{Kind: FileDeleted, Phase: PhaseApply, Path: "obsolete"}}, events)
+}
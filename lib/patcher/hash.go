@@ -4,38 +4,216 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
+	"hash"
 	"io"
+	"os"
 	"strings"
+
+	"golang.org/x/sync/semaphore"
 )
 
-// HashBytes generates a SHA256 hash of a byte slice.
-func HashBytes(data []byte) string {
-	hash := sha256.New()
+// Size of the regions HashFileRegions splits a file into.
+const hashRegionSize = 64 << 20
+
+type typeHashBudget string
+
+const keyHashBudget typeHashBudget = "hashBudget"
+
+type typeHasher string
+
+const keyHasher typeHasher = "hasher"
+
+// A hashBudget limits how much memory the buffers of concurrent checksum computations use together.
+type hashBudget struct {
+	sem *semaphore.Weighted
+	// Smaller than the copy buffer size if the whole budget is smaller than that.
+	bufferSize int64
+}
+
+// withHashBudget makes checksum computations under ctx use at most maxBytes for their buffers together, by
+// waiting for other computations to finish when the budget is used up. 0 means no limit.
+func withHashBudget(ctx context.Context, maxBytes int64) context.Context {
+	if maxBytes <= 0 {
+		return ctx
+	}
+	bufferSize := min(maxBytes, int64(copyBufferSize(ctx)))
+	budget := &hashBudget{sem: semaphore.NewWeighted(maxBytes), bufferSize: bufferSize}
+	return context.WithValue(ctx, keyHashBudget, budget)
+}
+
+// A Hasher computes checksums with a single hash function, so the checksums of game files, patch files,
+// downloads and instructions.json are all computed the same way. A nil *Hasher uses SHA256.
+type Hasher struct {
+	newHash func() hash.Hash
+}
+
+// The hasher used when none is configured.
+var defaultHasher = NewHasher(nil)
+
+// NewHasher creates a hasher using the hash newHash creates (e.g. sha256.New), SHA256 if newHash is nil.
+func NewHasher(newHash func() hash.Hash) *Hasher {
+	if newHash == nil {
+		newHash = sha256.New
+	}
+	return &Hasher{newHash: newHash}
+}
+
+// New creates a hash for computing a checksum incrementally.
+func (h *Hasher) New() hash.Hash {
+	if h == nil {
+		return defaultHasher.New()
+	}
+	return h.newHash()
+}
+
+// HashBytes computes the checksum of a byte slice.
+func (h *Hasher) HashBytes(data []byte) string {
+	hash := h.New()
 	hash.Write(data)
 	return hex.EncodeToString(hash.Sum(nil))
 }
 
-// HashReader reads data via a reader and computes a SHA256 hash of it.
+// HashReader reads data via a reader and computes the checksum of it.
+func (h *Hasher) HashReader(ctx context.Context, s io.Reader) (string, error) {
+	sum, err := h.hashReaderSum(ctx, s, nil)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// HashFile computes the checksum of a file. If progress isn't nil it's called with the number of bytes
+// hashed so far every time a buffer (see copy buffer size) has been hashed.
+func (h *Hasher) HashFile(ctx context.Context, filename string, progress func(hashed int64)) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to open '%s' to compute checksum: %w", filename, err)
+	}
+	defer file.Close()
+	sum, err := h.hashReaderSum(ctx, file, progress)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute checksum of '%s': %w", filename, err)
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// WithHasher makes checksum computations under ctx (HashReader, HashFileRegions, checking patched files and
+// the checksum of instructions.json) use the hasher. Downloads use DownloadConfig.NewHash instead.
+func WithHasher(ctx context.Context, h *Hasher) context.Context {
+	return context.WithValue(ctx, keyHasher, h)
+}
+
+// hasher returns the hasher set with WithHasher, a SHA256 one if there is none.
+func hasher(ctx context.Context) *Hasher {
+	if h, ok := ctx.Value(keyHasher).(*Hasher); ok && h != nil {
+		return h
+	}
+	return defaultHasher
+}
+
+// WithHashFunc makes checksum computations under ctx use the hash newHash creates instead of SHA256, e.g. for
+// instructions using a different digest. Nil means SHA256. Same as WithHasher(ctx, NewHasher(newHash)).
+func WithHashFunc(ctx context.Context, newHash func() hash.Hash) context.Context {
+	if newHash == nil {
+		return ctx
+	}
+	return WithHasher(ctx, NewHasher(newHash))
+}
+
+// HashBytes generates a SHA256 hash of a byte slice.
+func HashBytes(data []byte) string {
+	return defaultHasher.HashBytes(data)
+}
+
+// HashReader reads data via a reader and computes a hash of it, SHA256 unless set otherwise with
+// WithHasher or WithHashFunc.
 func HashReader(ctx context.Context, s io.Reader) (string, error) {
-	hash := sha256.New()
-	// Reading up to 1 meg to try to avoid unnecessary syscalls. There's no guarantee that this
-	// much data is returned of course, it just allows for it.
-	buf := make([]byte, 1<<20)
+	return hasher(ctx).HashReader(ctx, s)
+}
+
+// hashReaderSum is HashReader returning the raw hash, reporting progress like HashFile.
+func (h *Hasher) hashReaderSum(ctx context.Context, s io.Reader, progress func(hashed int64)) ([]byte, error) {
+	hash := h.New()
+	// Reading up to a whole buffer (1 meg by default) to try to avoid unnecessary syscalls. There's no
+	// guarantee that this much data is returned of course, it just allows for it.
+	bufferSize := int64(copyBufferSize(ctx))
+	if budget, ok := ctx.Value(keyHashBudget).(*hashBudget); ok {
+		if err := budget.sem.Acquire(ctx, budget.bufferSize); err != nil {
+			return nil, err
+		}
+		defer budget.sem.Release(budget.bufferSize)
+		bufferSize = budget.bufferSize
+	}
+	buf := make([]byte, bufferSize)
+	hashed := int64(0)
 	for ctx.Err() == nil {
 		read, err := s.Read(buf)
 		// Per docs for (io.Reader).Read the number of bytes read should be processed
 		// before the error.
 		if read > 0 {
 			hash.Write(buf[:read])
+			hashed += int64(read)
+			if progress != nil {
+				progress(hashed)
+			}
 		}
 		if err != nil {
 			if err == io.EOF {
-				return hex.EncodeToString(hash.Sum(nil)), nil
+				return hash.Sum(nil), nil
 			}
-			return "", err
+			return nil, err
 		}
 	}
-	return "", ctx.Err()
+	return nil, ctx.Err()
+}
+
+// HashFileRegions computes a region checksum of the first size bytes of a file, with the hasher set with
+// WithHasher (SHA256 if there is none). See (*Hasher).HashFileRegions.
+func HashFileRegions(ctx context.Context, file *os.File, size int64, numWorkers int) (string, error) {
+	return hasher(ctx).HashFileRegions(ctx, file, size, numWorkers)
+}
+
+// HashFileRegions computes a region checksum of the first size bytes of a file: the hash of the hashes of
+// consecutive regions of the file. Regions are hashed by up to numWorkers workers at the same time, which uses
+// more cores than HashReader for a very large file. A region checksum is not the hash of the file, it can only
+// be compared with other region checksums.
+func (h *Hasher) HashFileRegions(ctx context.Context, file *os.File, size int64, numWorkers int) (string, error) {
+	if err := checkNumWorkers("number of workers", numWorkers); err != nil {
+		return "", err
+	}
+	return h.hashFileRegions(ctx, file, size, hashRegionSize, numWorkers)
+}
+
+// hashFileRegions is HashFileRegions with a configurable region size.
+func (h *Hasher) hashFileRegions(
+	ctx context.Context,
+	file io.ReaderAt,
+	size int64,
+	regionSize int64,
+	numWorkers int,
+) (string, error) {
+	offsets := []int64{0}
+	for offset := regionSize; offset < size; offset += regionSize {
+		offsets = append(offsets, offset)
+	}
+	regionHashes, err := DoInParallelWithResult[int64, []byte](
+		ctx,
+		func(ctx context.Context, offset int64) ([]byte, error) {
+			length := min(size-offset, regionSize)
+			return h.hashReaderSum(ctx, io.NewSectionReader(file, offset, length), nil)
+		},
+		offsets,
+		numWorkers,
+	)
+	if err != nil {
+		return "", err
+	}
+	hash := h.New()
+	for _, regionHash := range regionHashes {
+		hash.Write(regionHash)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 // HashEqual compares two hashes for equality.
@@ -4,8 +4,15 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
 	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -21,9 +28,119 @@ func TestHashReaderAndHashBytes(t *testing.T) {
 	require.EqualValues(t, expected, actual)
 }
 
+func TestWithHashFunc(t *testing.T) {
+	data := []byte("some data")
+	sum := sha1.Sum(data)
+	ctx := WithHashFunc(context.Background(), sha1.New)
+	actual, err := HashReader(ctx, bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(sum[:]), actual)
+	require.Equal(t, actual, hasher(ctx).HashBytes(data))
+
+	// HashBytes has no context, it's always SHA256.
+	require.Len(t, HashBytes(data), 64)
+	require.Equal(t, context.Background(), WithHashFunc(context.Background(), nil))
+}
+
+func TestHasher(t *testing.T) {
+	data := bytes.Repeat([]byte("some data"), 1000)
+	sum := sha1.Sum(data)
+	h := NewHasher(sha1.New)
+	require.Equal(t, hex.EncodeToString(sum[:]), h.HashBytes(data))
+	actual, err := h.HashReader(context.Background(), bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(sum[:]), actual)
+
+	filename := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(filename, data, 0644))
+	var hashed []int64
+	ctx := withCopyBufferSize(context.Background(), 4096)
+	actual, err = h.HashFile(ctx, filename, func(n int64) { hashed = append(hashed, n) })
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(sum[:]), actual)
+	require.Equal(t, []int64{4096, 8192, 9000}, hashed)
+	_, err = h.HashFile(ctx, filepath.Join(t.TempDir(), "missing"), nil)
+	require.ErrorContains(t, err, "failed to open")
+
+	// The hasher set in the context is used by the package functions, the default is SHA256.
+	actual, err = HashReader(WithHasher(context.Background(), h), bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(sum[:]), actual)
+	require.Equal(t, HashBytes(data), NewHasher(nil).HashBytes(data))
+	var nilHasher *Hasher
+	require.Equal(t, HashBytes(data), nilHasher.HashBytes(data))
+}
+
 func TestHashEqual(t *testing.T) {
 	// Just case insensitive compare.
 	require.True(t, HashEqual("a", "a"))
 	require.True(t, HashEqual("a", "A"))
 	require.False(t, HashEqual("a", "b"))
 }
+
+func TestHashFileRegions(t *testing.T) {
+	data := make([]byte, 10000)
+	_, err := io.ReadAtLeast(rand.Reader, data, len(data))
+	require.NoError(t, err)
+	sequential, err := defaultHasher.hashFileRegions(context.Background(), bytes.NewReader(data), int64(len(data)), 1000, 1)
+	require.NoError(t, err)
+	parallel, err := defaultHasher.hashFileRegions(context.Background(), bytes.NewReader(data), int64(len(data)), 1000, 4)
+	require.NoError(t, err)
+	require.Equal(t, sequential, parallel)
+	require.NotEqual(t, HashBytes(data), parallel)
+
+	data[5500] ^= 1
+	changed, err := defaultHasher.hashFileRegions(context.Background(), bytes.NewReader(data), int64(len(data)), 1000, 4)
+	require.NoError(t, err)
+	require.NotEqual(t, parallel, changed)
+}
+
+// concurrencyReader records how many readers are being read at the same time.
+type concurrencyReader struct {
+	active    *atomic.Int32
+	maxActive *atomic.Int32
+	done      bool
+}
+
+func (r *concurrencyReader) Read(b []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	r.done = true
+	active := r.active.Add(1)
+	defer r.active.Add(-1)
+	for {
+		max := r.maxActive.Load()
+		if active <= max || r.maxActive.CompareAndSwap(max, active) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	b[0] = 'x'
+	return 1, nil
+}
+
+func TestHashReaderBudget(t *testing.T) {
+	ctx := withHashBudget(context.Background(), 2*DefaultCopyBufferSize)
+	var active, maxActive atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checksum, err := HashReader(ctx, &concurrencyReader{active: &active, maxActive: &maxActive})
+			require.NoError(t, err)
+			require.Equal(t, HashBytes([]byte("x")), checksum)
+		}()
+	}
+	wg.Wait()
+	require.EqualValues(t, 2, maxActive.Load())
+
+	// A budget smaller than a buffer uses a smaller buffer.
+	data := make([]byte, 10000)
+	_, err := io.ReadAtLeast(rand.Reader, data, len(data))
+	require.NoError(t, err)
+	checksum, err := HashReader(withHashBudget(context.Background(), 1000), bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, HashBytes(data), checksum)
+}
@@ -0,0 +1,77 @@
+package patcher
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+type typeHTTPClient string
+
+const keyHTTPClient typeHTTPClient = "httpClient"
+
+type typeRequestHeaders string
+
+const keyRequestHeaders typeRequestHeaders = "requestHeaders"
+
+// NewHTTPClient creates an HTTP client that sends requests through a proxy. If proxyUrl is nil the proxy
+// is taken from the environment (HTTP_PROXY, HTTPS_PROXY and NO_PROXY), like http.DefaultClient does.
+// The client has no timeout of its own, the patcher applies its timeouts per request.
+func NewHTTPClient(proxyUrl *url.URL) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxyUrl != nil {
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	} else {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	return &http.Client{Transport: transport}
+}
+
+// newDownloadClient creates the HTTP client a Downloader uses for all its requests, so connections are
+// reused between downloads.
+func newDownloadClient(config DownloadConfig) *http.Client {
+	client := NewHTTPClient(config.ProxyUrl)
+	transport := client.Transport.(*http.Transport)
+	if config.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+		transport.MaxIdleConns = max(transport.MaxIdleConns, config.MaxIdleConnsPerHost)
+	}
+	if config.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = config.IdleConnTimeout
+	}
+	return client
+}
+
+// WithHTTPClient sets the HTTP client for fetching metadata (e.g. products.json and instructions.json),
+// checking for patcher updates and warming caches. Downloads use DownloadConfig.ProxyUrl instead.
+func WithHTTPClient(ctx context.Context, client *http.Client) context.Context {
+	return context.WithValue(ctx, keyHTTPClient, client)
+}
+
+// httpClient returns the HTTP client set with WithHTTPClient, http.DefaultClient if there is none.
+func httpClient(ctx context.Context) *http.Client {
+	if client, ok := ctx.Value(keyHTTPClient).(*http.Client); ok && client != nil {
+		return client
+	}
+	return http.DefaultClient
+}
+
+// WithRequestHeaders sets extra headers (e.g. for authenticating with a mirror) for fetching metadata and
+// warming caches. Downloads use DownloadConfig.Headers instead. They're not sent when checking for patcher
+// updates, that goes to a different server.
+func WithRequestHeaders(ctx context.Context, headers map[string]string) context.Context {
+	return context.WithValue(ctx, keyRequestHeaders, headers)
+}
+
+// requestHeaders returns the headers set with WithRequestHeaders, nil if there are none.
+func requestHeaders(ctx context.Context) map[string]string {
+	headers, _ := ctx.Value(keyRequestHeaders).(map[string]string)
+	return headers
+}
+
+// setRequestHeaders adds extra headers to a request, replacing any it already has.
+func setRequestHeaders(req *http.Request, headers map[string]string) {
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+}
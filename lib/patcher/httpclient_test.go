@@ -0,0 +1,175 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProxy returns a test server acting as an HTTP proxy that answers every request itself with data,
+// and the list of URLs it was asked for.
+func fakeProxy(t *testing.T, data []byte) (*url.URL, func() []string) {
+	var mu sync.Mutex
+	requested := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.String())
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	proxyUrl, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	return proxyUrl, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, requested...)
+	}
+}
+
+func TestDownloadFileProxy(t *testing.T) {
+	data := []byte("proxied patch data")
+	proxyUrl, requested := fakeProxy(t, data)
+	config := testDownloadConfig()
+	config.ProxyUrl = proxyUrl
+	d := newTestDownloader(t, config)
+	// The host doesn't exist, only the proxy can answer.
+	location, err := url.Parse("http://patches.invalid/full/abc")
+	require.NoError(t, err)
+	filename := filepath.Join(t.TempDir(), "patch")
+	err = d.DownloadFile(context.Background(), location, filename, HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, []string{"http://patches.invalid/full/abc"}, requested())
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	proxyUrl, requested := fakeProxy(t, []byte("{}"))
+	location, err := url.Parse("http://products.invalid/products.json")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data, err := fetchBytes(WithHTTPClient(ctx, NewHTTPClient(proxyUrl)), "products", location)
+	require.NoError(t, err)
+	require.Equal(t, "{}", string(data))
+	require.Equal(t, []string{"http://products.invalid/products.json"}, requested())
+	require.Equal(t, http.DefaultClient, httpClient(ctx))
+}
+
+// serveWithToken returns a test server that serves data only to requests with the right Authorization header.
+func serveWithToken(t *testing.T, data []byte, token string) *url.URL {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/file")
+	require.NoError(t, err)
+	return location
+}
+
+func TestDownloadFileHeaders(t *testing.T) {
+	data := []byte("protected patch data")
+	location := serveWithToken(t, data, "secret")
+	config := testDownloadConfig()
+	filename := filepath.Join(t.TempDir(), "patch")
+	err := newTestDownloader(t, config).DownloadFile(context.Background(), location, filename,
+		HashBytes(data), int64(len(data)))
+	require.ErrorContains(t, err, "status 401")
+
+	config.Headers = map[string]string{"Authorization": "Bearer secret"}
+	err = newTestDownloader(t, config).DownloadFile(context.Background(), location, filename,
+		HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+}
+
+func TestWithRequestHeaders(t *testing.T) {
+	location := serveWithToken(t, []byte("{}"), "secret")
+	_, err := fetchBytes(context.Background(), "products", location)
+	require.ErrorContains(t, err, "401")
+
+	ctx := WithRequestHeaders(context.Background(), map[string]string{"Authorization": "Bearer secret"})
+	data, err := fetchBytes(ctx, "products", location)
+	require.NoError(t, err)
+	require.Equal(t, "{}", string(data))
+}
+
+func TestNewDownloadClient(t *testing.T) {
+	defaults := http.DefaultTransport.(*http.Transport)
+	transport := newDownloadClient(DownloadConfig{}).Transport.(*http.Transport)
+	require.Equal(t, defaults.MaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	require.Equal(t, defaults.IdleConnTimeout, transport.IdleConnTimeout)
+
+	// Enough idle connections for every worker, and the pool as a whole isn't smaller.
+	config := DownloadConfig{MaxIdleConnsPerHost: 300, IdleConnTimeout: time.Minute}
+	transport = newDownloadClient(config).Transport.(*http.Transport)
+	require.Equal(t, 300, transport.MaxIdleConnsPerHost)
+	require.Equal(t, 300, transport.MaxIdleConns)
+	require.Equal(t, time.Minute, transport.IdleConnTimeout)
+}
+
+func TestWithTokenProvider(t *testing.T) {
+	var mu sync.Mutex
+	validToken := "token-1"
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		// Like a CDN with signed URLs, which answers 403 when they expire.
+		if r.Header.Get("Authorization") != "Bearer "+validToken {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/products.json")
+	require.NoError(t, err)
+	provided := 0
+	ctx := WithTokenProvider(context.Background(), func(ctx context.Context) (string, error) {
+		provided++
+		return fmt.Sprintf("token-%d", provided), nil
+	})
+
+	_, err = fetchBytes(ctx, "products", location)
+	require.NoError(t, err)
+
+	// Refreshed and sent again.
+	mu.Lock()
+	validToken = "token-2"
+	mu.Unlock()
+	data, err := fetchBytes(ctx, "products", location)
+	require.NoError(t, err)
+	require.Equal(t, "{}", string(data))
+	require.Equal(t, 2, provided)
+	require.Equal(t, 3, requests)
+
+	// Still denied after refreshing, even with retries.
+	mu.Lock()
+	validToken = "never"
+	mu.Unlock()
+	ctx = WithRetryPolicy(ctx, RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, DelayFactor: 1})
+	_, err = fetchBytes(ctx, "products", location)
+	require.ErrorContains(t, err, "status 403")
+	require.Equal(t, 3, provided)
+	require.Equal(t, 5, requests)
+
+	// Without a provider there's only the one attempt.
+	_, err = fetchBytes(WithRetryPolicy(context.Background(), RetryPolicy{MaxAttempts: 3}), "products", location)
+	require.ErrorContains(t, err, "status 403")
+	require.Equal(t, 6, requests)
+}
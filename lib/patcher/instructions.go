@@ -66,6 +66,10 @@ func DecodeInstructions(jsonData []byte) ([]Instruction, error) {
 		if filepath.IsAbs(path) || strings.ContainsRune(path, ':') {
 			return nil, fmt.Errorf("instructions.json contains absolute path: %s", path)
 		}
+		// Check this before IsLocal, which on Windows rejects reserved names with a less clear error.
+		if err := checkWindowsPath(path); err != nil {
+			return nil, fmt.Errorf("instructions.json contains invalid path: %w", err)
+		}
 		// Prevent escapes via stuff like '..', assuming the directory doesn't already have weird stuff like
 		// symlinked directories.
 		if !filepath.IsLocal(path) {
@@ -92,3 +96,29 @@ func DecodeInstructions(jsonData []byte) ([]Instruction, error) {
 	}
 	return instructions, nil
 }
+
+// Names of devices on Windows, with or without an extension they don't refer to a file.
+var windowsReservedNames = map[string]struct{}{
+	"CON": {}, "PRN": {}, "AUX": {}, "NUL": {},
+	"COM1": {}, "COM2": {}, "COM3": {}, "COM4": {}, "COM5": {}, "COM6": {}, "COM7": {}, "COM8": {}, "COM9": {},
+	"LPT1": {}, "LPT2": {}, "LPT3": {}, "LPT4": {}, "LPT5": {}, "LPT6": {}, "LPT7": {}, "LPT8": {}, "LPT9": {},
+}
+
+// checkWindowsPath checks that a path doesn't have components that Windows treats specially, i.e. reserved
+// device names and names ending in a dot or space (Windows strips those, so 'a.' and 'a' are the same file).
+// These are checked on every OS so an install behaves the same everywhere.
+func checkWindowsPath(path string) error {
+	for _, component := range strings.Split(path, string(filepath.Separator)) {
+		if component == "." || component == ".." {
+			continue // Handled by IsLocal.
+		}
+		if strings.HasSuffix(component, ".") || strings.HasSuffix(component, " ") {
+			return fmt.Errorf("'%s' has a name ending in a dot or space", path)
+		}
+		base, _, _ := strings.Cut(component, ".")
+		if _, found := windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))]; found {
+			return fmt.Errorf("'%s' uses reserved name '%s'", path, component)
+		}
+	}
+	return nil
+}
@@ -140,3 +140,41 @@ func TestDecodeInstructionsInconsistentNoHasDeltaPath(t *testing.T) {
 	_, err := DecodeInstructions(jsonData)
 	require.ErrorContains(t, err, "HasDelta unset but contains a DeltaHash")
 }
+
+func TestDecodeInstructionsWindowsReservedNames(t *testing.T) {
+	for _, path := range []string{"CON", "Binaries\\\\nul.txt", "Binaries\\\\Com1\\\\foo", "a.", "a ", "a.\\\\b"} {
+		jsonData := []byte(`
+		[{
+			"Path":"` + path + `",
+			"OldHash":"FA1AFFF978325F8818CE3A559D67A58297D9154674DE7FD8EB03656D93104425",
+			"NewHash":"FA1AFFF978325F8818CE3A559D67A58297D9154674DE7FD8EB03656D93104425",
+			"CompressedHash":"1854E191B7DB2537CF1F27DBC512D0FED8C661329EC6BC8A0290BFB125CC12C0",
+			"DeltaHash":null,
+			"FullReplaceSize":794539,
+			"DeltaSize":0,
+			"HasDelta":false
+		}]
+		`)
+		_, err := DecodeInstructions(jsonData)
+		require.ErrorContains(t, err, "invalid path", "path %q", path)
+	}
+}
+
+func TestDecodeInstructionsNamesResemblingReservedNames(t *testing.T) {
+	for _, path := range []string{"CONSOLE", "Binaries\\\\nul_file", "COM10", ".hidden", "a.b"} {
+		jsonData := []byte(`
+		[{
+			"Path":"` + path + `",
+			"OldHash":"FA1AFFF978325F8818CE3A559D67A58297D9154674DE7FD8EB03656D93104425",
+			"NewHash":"FA1AFFF978325F8818CE3A559D67A58297D9154674DE7FD8EB03656D93104425",
+			"CompressedHash":"1854E191B7DB2537CF1F27DBC512D0FED8C661329EC6BC8A0290BFB125CC12C0",
+			"DeltaHash":null,
+			"FullReplaceSize":794539,
+			"DeltaSize":0,
+			"HasDelta":false
+		}]
+		`)
+		_, err := DecodeInstructions(jsonData)
+		require.NoError(t, err, "path %q", path)
+	}
+}
@@ -0,0 +1,106 @@
+package patcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+type typeLockedFileRetries string
+
+const keyLockedFileRetries typeLockedFileRetries = "lockedFileRetries"
+
+// How many times a file operation that failed because the file is locked is retried, unless changed with
+// WithLockedFileRetries.
+const DefaultLockedFileRetries = 3
+
+// How long to wait before retrying a file operation that failed because the file is locked, doubled for every
+// next retry. Antivirus scanning a new file usually lets go of it within a second.
+var lockedFileRetryDelay = 250 * time.Millisecond
+
+// WithLockedFileRetries sets how many times a file operation (e.g. moving a patched file into place) that
+// failed because another process briefly has the file locked is retried, 0 to not retry. Only sharing and
+// lock violations on Windows are retried, see IsLockedFileError.
+func WithLockedFileRetries(ctx context.Context, retries int) context.Context {
+	return context.WithValue(ctx, keyLockedFileRetries, retries)
+}
+
+// lockedFileRetryPolicy returns how to retry file operations that failed because the file is locked.
+func lockedFileRetryPolicy(ctx context.Context) RetryPolicy {
+	retries, found := ctx.Value(keyLockedFileRetries).(int)
+	if !found {
+		retries = DefaultLockedFileRetries
+	}
+	return RetryPolicy{MaxAttempts: retries, BaseDelay: lockedFileRetryDelay, DelayFactor: 2}
+}
+
+// A LockedFileError is the error for a file operation that kept failing because another process has the file
+// open, see IsLockedFileError.
+type LockedFileError struct {
+	// The file that's locked.
+	Path string
+
+	// The error of the last attempt.
+	Err error
+}
+
+func (e *LockedFileError) Error() string {
+	return fmt.Sprintf("'%s' is locked by another process, possibly antivirus or the running game (close the "+
+		"game or exclude the install dir from scanning, then try again): %s", e.Path, e.Err)
+}
+
+func (e *LockedFileError) Unwrap() error {
+	return e.Err
+}
+
+// IsLockedFileError returns whether an error means a file couldn't be used because another process has it
+// open or locked. Only recognized on Windows, as sharing violations, lock violations and access denied (which
+// is also what deleting a file another process has open gives).
+func IsLockedFileError(err error) bool {
+	return hasErrno(err, lockedFileErrnos)
+}
+
+// isTransientLock returns whether an error means a file is locked in a way that's likely to go away soon, so
+// the operation is worth retrying.
+func isTransientLock(err error) bool {
+	return hasErrno(err, transientLockErrnos)
+}
+
+// hasErrno returns whether an error is one of the errnos.
+func hasErrno(err error, errnos []syscall.Errno) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	for _, e := range errnos {
+		if errno == e {
+			return true
+		}
+	}
+	return false
+}
+
+// retryLockedFile runs a file operation (e.g. a rename) on path, retrying it a few times (see
+// WithLockedFileRetries) if it fails because the file is briefly locked. If the file is locked in the end the
+// error is a *LockedFileError.
+func retryLockedFile(ctx context.Context, path string, op func() error) error {
+	err := retry(ctx, lockedFileRetryPolicy(ctx), fmt.Sprintf("Using locked file '%s'", path), func() error {
+		err := op()
+		if err != nil && !isTransientLock(err) {
+			return permanent(err)
+		}
+		return err
+	})
+	if IsLockedFileError(err) {
+		return &LockedFileError{Path: path, Err: err}
+	}
+	return err
+}
+
+// removeLockedFile removes a file, retrying if it's briefly locked like retryLockedFile.
+func removeLockedFile(ctx context.Context, path string) error {
+	return retryLockedFile(ctx, path, func() error { return os.Remove(path) })
+}
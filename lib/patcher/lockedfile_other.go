@@ -0,0 +1,11 @@
+//go:build !windows
+
+package patcher
+
+import "syscall"
+
+// Other systems don't stop a file from being renamed or removed because another process has it open.
+var lockedFileErrnos []syscall.Errno
+
+// So there's nothing to retry either, file operations are only done once.
+var transientLockErrnos []syscall.Errno
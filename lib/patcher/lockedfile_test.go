@@ -0,0 +1,112 @@
+package patcher
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// pretendLockedErrno makes IsLockedFileError recognize errno for the rest of the test, on any system, and
+// makes retrying quick. If transient is set retryLockedFile retries errno.
+func pretendLockedErrno(t *testing.T, errno syscall.Errno, transient bool) {
+	oldErrnos, oldTransient, oldDelay := lockedFileErrnos, transientLockErrnos, lockedFileRetryDelay
+	t.Cleanup(func() {
+		lockedFileErrnos, transientLockErrnos, lockedFileRetryDelay = oldErrnos, oldTransient, oldDelay
+	})
+	lockedFileErrnos = []syscall.Errno{errno}
+	transientLockErrnos = nil
+	if transient {
+		transientLockErrnos = []syscall.Errno{errno}
+	}
+	lockedFileRetryDelay = time.Millisecond
+}
+
+func TestIsLockedFileError(t *testing.T) {
+	pretendLockedErrno(t, syscall.EBUSY, true)
+	require.True(t, IsLockedFileError(&os.PathError{Op: "remove", Path: "file", Err: syscall.EBUSY}))
+	require.True(t, IsLockedFileError(&LockedFileError{Path: "file", Err: syscall.EBUSY}))
+	require.False(t, IsLockedFileError(&os.PathError{Op: "remove", Path: "file", Err: syscall.ENOENT}))
+	require.False(t, IsLockedFileError(errors.New("busy")))
+	require.False(t, IsLockedFileError(nil))
+}
+
+func TestRetryLockedFile(t *testing.T) {
+	pretendLockedErrno(t, syscall.EBUSY, true)
+	lockedErr := &os.PathError{Op: "rename", Path: "file", Err: syscall.EBUSY}
+
+	// Unlocked after a moment.
+	calls := 0
+	err := retryLockedFile(context.Background(), "file", func() error {
+		calls++
+		if calls < 2 {
+			return lockedErr
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+
+	// Locked for good.
+	calls = 0
+	err = retryLockedFile(context.Background(), "file", func() error {
+		calls++
+		return lockedErr
+	})
+	var lockedFileErr *LockedFileError
+	require.ErrorAs(t, err, &lockedFileErr)
+	require.Equal(t, "file", lockedFileErr.Path)
+	require.ErrorContains(t, err, "possibly antivirus or the running game")
+	require.Equal(t, 1+DefaultLockedFileRetries, calls)
+
+	// The number of retries can be changed.
+	calls = 0
+	err = retryLockedFile(WithLockedFileRetries(context.Background(), 0), "file", func() error {
+		calls++
+		return lockedErr
+	})
+	require.ErrorAs(t, err, &lockedFileErr)
+	require.Equal(t, 1, calls)
+
+	// Other errors aren't retried.
+	calls = 0
+	err = retryLockedFile(context.Background(), "file", func() error {
+		calls++
+		return os.ErrNotExist
+	})
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.Equal(t, 1, calls)
+}
+
+func TestRetryLockedFileNotTransient(t *testing.T) {
+	// Like access denied on Windows: reported as locked, but not retried.
+	pretendLockedErrno(t, syscall.EACCES, false)
+	calls := 0
+	err := retryLockedFile(context.Background(), "file", func() error {
+		calls++
+		return &os.PathError{Op: "remove", Path: "file", Err: syscall.EACCES}
+	})
+	var lockedFileErr *LockedFileError
+	require.ErrorAs(t, err, &lockedFileErr)
+	require.Equal(t, 1, calls)
+}
+
+func TestRunPatchPhaseLockedObsoleteFile(t *testing.T) {
+	pretendLockedErrno(t, syscall.ENOTEMPTY, true)
+	installDir := t.TempDir()
+	require.NoError(t, createPatchDirs(installDir))
+	// Removing a non-empty directory fails with ENOTEMPTY, which stands in for a locked file here.
+	obsolete := filepath.Join(installDir, "obsolete")
+	require.NoError(t, os.MkdirAll(filepath.Join(obsolete, "sub"), 0755))
+	err := runPatchPhase(context.Background(), nil, []string{"obsolete"}, NewManifest("foo"), installDir,
+		copyingBackend{}, NewProgress(), 1, nil, false, false, newVerifiedPatches(), 0, false)
+	var lockedFileErr *LockedFileError
+	require.ErrorAs(t, err, &lockedFileErr)
+	require.Equal(t, obsolete, lockedFileErr.Path)
+}
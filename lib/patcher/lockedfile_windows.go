@@ -0,0 +1,23 @@
+//go:build windows
+
+package patcher
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// Errors that mean another process has a file open or locked, see IsLockedFileError.
+var lockedFileErrnos = []syscall.Errno{
+	windows.ERROR_SHARING_VIOLATION,
+	windows.ERROR_LOCK_VIOLATION,
+	windows.ERROR_ACCESS_DENIED,
+}
+
+// Errors that are retried by retryLockedFile. Sharing and lock violations usually go away once the other
+// process (e.g. antivirus) is done with the file, access denied is more often a real permission problem.
+var transientLockErrnos = []syscall.Errno{
+	windows.ERROR_SHARING_VIOLATION,
+	windows.ERROR_LOCK_VIOLATION,
+}
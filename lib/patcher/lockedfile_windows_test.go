@@ -0,0 +1,21 @@
+//go:build windows
+
+package patcher
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/windows"
+)
+
+func TestIsLockedFileErrorWindows(t *testing.T) {
+	require.True(t, IsLockedFileError(&os.LinkError{Op: "rename", Old: "a", New: "b",
+		Err: windows.ERROR_SHARING_VIOLATION}))
+	require.True(t, IsLockedFileError(&os.PathError{Op: "remove", Path: "a", Err: windows.ERROR_LOCK_VIOLATION}))
+	require.True(t, IsLockedFileError(&os.PathError{Op: "open", Path: "a", Err: windows.ERROR_ACCESS_DENIED}))
+	require.False(t, IsLockedFileError(&os.PathError{Op: "open", Path: "a", Err: windows.ERROR_FILE_NOT_FOUND}))
+	require.True(t, isTransientLock(&os.PathError{Op: "open", Path: "a", Err: windows.ERROR_SHARING_VIOLATION}))
+	require.False(t, isTransientLock(&os.PathError{Op: "open", Path: "a", Err: windows.ERROR_ACCESS_DENIED}))
+}
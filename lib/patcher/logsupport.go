@@ -2,6 +2,7 @@ package patcher
 
 import (
 	"context"
+	"fmt"
 	"log"
 )
 
@@ -10,15 +11,35 @@ type typeVerbose string
 
 const keyVerbose typeVerbose = "verbose"
 
+type typeRunID string
+
+const keyRunID typeRunID = "runID"
+
 // SetVerbose sets the verbose flag for logging.
 func SetVerbose(ctx context.Context, verbose bool) context.Context {
 	return context.WithValue(ctx, keyVerbose, verbose)
 }
 
-// LogVerbose logs a message only if the verbose flag is set.
+// WithRunID sets an identifier for the run, e.g. given by a launcher running the patcher.
+// It's included in verbose log messages so they can be correlated.
+func WithRunID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, keyRunID, id)
+}
+
+// RunID returns the identifier set with WithRunID, or an empty string if there is none.
+func RunID(ctx context.Context) string {
+	id, _ := ctx.Value(keyRunID).(string)
+	return id
+}
+
+// LogVerbose logs a message only if the verbose flag is set. The message is prefixed with the run ID if set.
 func LogVerbose(ctx context.Context, format string, args ...any) {
 	verbose, ok := ctx.Value(keyVerbose).(bool)
 	if ok && verbose {
-		log.Printf(format, args...)
+		if id := RunID(ctx); id != "" {
+			log.Printf("[%s] %s", id, fmt.Sprintf(format, args...))
+		} else {
+			log.Printf(format, args...)
+		}
 	}
 }
@@ -0,0 +1,30 @@
+package patcher
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogVerboseRunID(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+
+	ctx := SetVerbose(context.Background(), true)
+	require.Equal(t, "", RunID(ctx))
+	LogVerbose(ctx, "no id %d", 1)
+	ctx = WithRunID(ctx, "abc")
+	require.Equal(t, "abc", RunID(ctx))
+	LogVerbose(ctx, "with id %d", 2)
+	LogVerbose(SetVerbose(ctx, false), "not verbose")
+	require.Equal(t, "no id 1\n[abc] with id 2\n", buf.String())
+}
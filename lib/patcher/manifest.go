@@ -5,19 +5,29 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 )
 
 // Filename for the manifest under the root dir.
 const ManifestFilename = "ta-manifest.json"
 
+// Version of the manifest file format written by this patcher.
+// Version 0 (no version field) had a single product, version 1 supports multiple products.
+const ManifestVersion = 1
+
 // A ManifestEntry records the last recorded checksum and change time for a file.
 type ManifestEntry struct {
 	LastChange   time.Time `json:"last_change"`
 	LastChecksum string    `json:"last_checksum"`
+	// Region checksum (see HashFileRegions) of the same contents as LastChecksum, only recorded for large
+	// files when parallel hashing is enabled.
+	RegionChecksum string `json:"region_checksum,omitempty"`
 }
 
 // A Manifest records the last recorded checksum and change time for files.
@@ -28,7 +38,26 @@ type ManifestEntry struct {
 type Manifest struct {
 	// Identifier for whatever game is installed, something like "renx_alpha".
 	Product string
+	// Entries keyed by filename. Change them with Add, otherwise a ManifestStore that only writes
+	// changes won't notice.
 	Entries map[string]ManifestEntry
+
+	// Entries of other products installed in the same directory. Not used, but
+	// written back so they don't get lost.
+	otherProducts map[string]map[string]ManifestEntry
+
+	// Filenames of entries added since the manifest was last read or written.
+	changed map[string]struct{}
+}
+
+// manifestFile is the format of the manifest file on disk.
+type manifestFile struct {
+	Version  int                                 `json:"version"`
+	Products map[string]map[string]ManifestEntry `json:"products,omitempty"`
+
+	// Fields of version 0, only used for reading.
+	Product string                   `json:"Product,omitempty"`
+	Entries map[string]ManifestEntry `json:"Entries,omitempty"`
 }
 
 // NewManifest creates a new empty manifest for the product.
@@ -36,54 +65,203 @@ func NewManifest(product string) *Manifest {
 	return &Manifest{
 		Product: product,
 		Entries: make(map[string]ManifestEntry),
+		changed: make(map[string]struct{}),
 	}
 }
 
 // ReadManifest reads a manifest from the standard location in the installation dir.
-// Verifies that the manifest has the correct product field set. Returns an empty manifest
-// if there's no manifest file.
+// The manifest can contain multiple products (e.g. a base game and a mod pack), the entries of
+// the product are returned. If the product isn't in the manifest yet (or there's no manifest file)
+// its entries are empty, the entries of other products are kept when writing the manifest.
+// Refuses manifests written by a newer version of the patcher (see ManifestVersion), as they may
+// mean something different.
 func ReadManifest(installDir string, product string) (*Manifest, error) {
-	filename := filepath.Join(installDir, ManifestFilename)
-	data, err := os.ReadFile(filename)
+	return readManifest(installDir, product, true, false)
+}
+
+// readManifest reads the manifest, see ReadManifest. If shared is false a manifest that only contains other
+// products is an error, see PatcherConfig.SharedInstallDir. If ignoreVersion is true manifests of a newer
+// version are read anyway, as far as they can be understood.
+func readManifest(installDir string, product string, shared bool, ignoreVersion bool) (*Manifest, error) {
+	mf, err := readManifestFile(installDir, ignoreVersion)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			return NewManifest(product), nil
 		}
+		return nil, err
+	}
+
+	manifest := NewManifest(product)
+	manifest.otherProducts = make(map[string]map[string]ManifestEntry)
+	found := false
+	for p, entries := range mf.Products {
+		if entries == nil {
+			entries = make(map[string]ManifestEntry)
+		}
+		if p == product {
+			manifest.Entries = entries
+			found = true
+		} else {
+			manifest.otherProducts[p] = entries
+		}
+	}
+	if !found && !shared {
+		others := make([]string, 0, len(mf.Products))
+		for p := range mf.Products {
+			others = append(others, p)
+		}
+		return nil, wrongProductError(product, others)
+	}
+	return manifest, nil
+}
+
+// wrongProductError returns the error for a manifest that doesn't contain the product.
+func wrongProductError(product string, others []string) error {
+	quoted := make([]string, 0, len(others))
+	for _, p := range others {
+		quoted = append(quoted, fmt.Sprintf("'%s'", p))
+	}
+	sort.Strings(quoted)
+	return fmt.Errorf(
+		"manifest contains wrong product (are you updating the wrong game?), expected '%s' got %s",
+		product, strings.Join(quoted, ", "),
+	)
+}
+
+// readManifestFile reads and decodes the manifest file in the installation dir, migrating it to the
+// current format. If there's no manifest file the error wraps fs.ErrNotExist. Unless ignoreVersion is true
+// a manifest of a newer version than ManifestVersion is an error.
+func readManifestFile(installDir string, ignoreVersion bool) (*manifestFile, error) {
+	filename := filepath.Join(installDir, ManifestFilename)
+	data, err := os.ReadFile(filename)
+	if err != nil {
 		return nil, fmt.Errorf("couldn't read manifest at '%s': %w", filename, err)
 	}
-	var manifest Manifest
-	if err := json.Unmarshal(data, &manifest); err != nil {
+	var mf manifestFile
+	if err := json.Unmarshal(data, &mf); err != nil {
 		return nil, fmt.Errorf("couldn't decode manifest at '%s': %w", filename, err)
 	}
-	if manifest.Product != product {
-		return nil, fmt.Errorf(
-			"manifest contains wrong product (are you updating the wrong game?), expected '%s' got '%s'",
-			product, manifest.Product,
-		)
+	if mf.Version > ManifestVersion {
+		if !ignoreVersion {
+			return nil, fmt.Errorf("manifest at '%s' was written by a newer patcher (manifest version %d, "+
+				"this patcher supports up to version %d), please update the patcher", filename, mf.Version,
+				ManifestVersion)
+		}
+		log.Printf("WARNING: manifest at '%s' was written by a newer patcher (manifest version %d), "+
+			"reading it anyway.", filename, mf.Version)
+	}
+	if mf.Version == 0 {
+		// Migrate from the single product format.
+		mf.Products = map[string]map[string]ManifestEntry{mf.Product: mf.Entries}
+	}
+	if err := replayManifestJournal(installDir, &mf); err != nil {
+		return nil, err
+	}
+	return &mf, nil
+}
+
+// A ManifestStore reads and writes manifests in an installation dir.
+// JSONManifestStore is the default, BoltManifestStore is meant for installs with a huge number of files.
+type ManifestStore interface {
+	// Read reads the manifest for a product, see ReadManifest. If shared is false a manifest that only
+	// contains other products is an error, see PatcherConfig.SharedInstallDir. If ignoreVersion is true a
+	// manifest written by a newer version of the patcher is read anyway.
+	Read(installDir string, product string, shared bool, ignoreVersion bool) (*Manifest, error)
+
+	// Write writes the manifest.
+	Write(installDir string, m *Manifest) error
+}
+
+// JSONManifestStore stores the manifest as a JSON file (ManifestFilename). Changes are appended to a journal
+// (ManifestJournalFilename) which is merged into the JSON file once it gets as big as that file, so writing
+// a few changes doesn't require rewriting the whole manifest.
+type JSONManifestStore struct{}
+
+// Read implements (ManifestStore).Read
+func (JSONManifestStore) Read(installDir string, product string, shared bool, ignoreVersion bool) (*Manifest, error) {
+	return readManifest(installDir, product, shared, ignoreVersion)
+}
+
+// Write implements (ManifestStore).Write
+func (JSONManifestStore) Write(installDir string, m *Manifest) error {
+	filename := filepath.Join(installDir, ManifestFilename)
+	info, err := os.Stat(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return m.WriteManifest(installDir)
+		}
+		return fmt.Errorf("couldn't get basic metadata of manifest '%s': %w", filename, err)
+	}
+	journalSize, err := appendManifestJournal(installDir, m)
+	if err != nil {
+		return err
+	}
+	if journalSize >= info.Size() {
+		return m.WriteManifest(installDir)
 	}
-	return &manifest, nil
+	return nil
 }
 
-// WriteManifest writes a manifest to the standard location in the installation dir.
+// WriteManifest writes a manifest to the standard location in the installation dir, replacing the file
+// atomically so a crash can't leave a half written manifest. Any journal (see JSONManifestStore) is merged.
 func (m *Manifest) WriteManifest(installDir string) error {
 	filename := filepath.Join(installDir, ManifestFilename)
 
-	encoded, err := json.MarshalIndent(m, "", " ")
+	mf := manifestFile{
+		Version:  ManifestVersion,
+		Products: make(map[string]map[string]ManifestEntry, len(m.otherProducts)+1),
+	}
+	for p, entries := range m.otherProducts {
+		mf.Products[p] = entries
+	}
+	mf.Products[m.Product] = m.Entries
+
+	encoded, err := json.MarshalIndent(mf, "", " ")
 	if err != nil {
 		return fmt.Errorf("couldn't encode manifest: %w", err)
 	}
 
-	if err := os.WriteFile(filename, encoded, 0644); err != nil {
+	if err := writeFileAtomic(filename, encoded); err != nil {
 		return fmt.Errorf("couldn't write manifest to '%s': %w", filename, err)
 	}
+	// Everything in the journal is in the manifest now.
+	journalFilename := filepath.Join(installDir, ManifestJournalFilename)
+	if err := os.Remove(journalFilename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("couldn't remove manifest journal '%s': %w", journalFilename, err)
+	}
 
+	m.changed = make(map[string]struct{})
 	return nil
 }
 
 // Add adds a file along with last change info and known checksum to the manifest.
 // Overwrites an existing entry for the file.
 func (m *Manifest) Add(filename string, lastChange time.Time, checksum string) {
-	m.Entries[path.Clean(filename)] = ManifestEntry{LastChange: lastChange, LastChecksum: checksum}
+	filename = path.Clean(filename)
+	m.Entries[filename] = ManifestEntry{LastChange: lastChange, LastChecksum: checksum}
+	m.changed[filename] = struct{}{}
+}
+
+// SetRegionChecksum records the region checksum (see HashFileRegions) of a file that was added with Add.
+func (m *Manifest) SetRegionChecksum(filename string, regionChecksum string) {
+	filename = path.Clean(filename)
+	entry, found := m.Entries[filename]
+	if !found {
+		return
+	}
+	entry.RegionChecksum = regionChecksum
+	m.Entries[filename] = entry
+	m.changed[filename] = struct{}{}
+}
+
+// GetByRegionChecksum returns the checksum of a file if its region checksum matches the one in the manifest,
+// regardless of the last change time.
+func (m *Manifest) GetByRegionChecksum(filename string, regionChecksum string) (string, bool) {
+	entry, found := m.Entries[path.Clean(filename)]
+	if !found || entry.RegionChecksum == "" || !HashEqual(entry.RegionChecksum, regionChecksum) {
+		return "", false
+	}
+	return entry.LastChecksum, true
 }
 
 // Check returns true iff a file with the given name, last change time and checksum exists
@@ -104,3 +282,12 @@ func (m *Manifest) Get(filename string, lastChange time.Time) (string, bool) {
 	}
 	return entry.LastChecksum, true
 }
+
+// GetAnyChange returns the checksum of a file if the manifest knows it, regardless of the last change time.
+func (m *Manifest) GetAnyChange(filename string) (string, bool) {
+	entry, found := m.Entries[path.Clean(filename)]
+	if !found {
+		return "", false
+	}
+	return entry.LastChecksum, true
+}
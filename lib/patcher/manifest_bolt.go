@@ -0,0 +1,199 @@
+package patcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Filename for the manifest database of BoltManifestStore under the root dir.
+const BoltManifestFilename = "ta-manifest.db"
+
+// Bucket and key names in the manifest database. The products bucket contains a bucket per product,
+// mapping filename to a JSON encoded ManifestEntry.
+var (
+	boltMetaBucket     = []byte("meta")
+	boltVersionKey     = []byte("version")
+	boltProductsBucket = []byte("products")
+)
+
+// BoltManifestStore stores the manifest in an embedded key-value database (BoltManifestFilename).
+// Only entries that changed are written, so writing is cheap even for installs with a huge number of files.
+//
+// If there's no database yet but there is a JSON manifest that manifest is converted, after which the
+// JSON manifest is removed.
+type BoltManifestStore struct{}
+
+// Read implements (ManifestStore).Read
+func (BoltManifestStore) Read(installDir string, product string, shared bool, ignoreVersion bool) (*Manifest, error) {
+	filename := filepath.Join(installDir, BoltManifestFilename)
+	if _, err := os.Stat(filename); errors.Is(err, fs.ErrNotExist) {
+		manifest, err := readManifest(installDir, product, shared, ignoreVersion)
+		if err != nil {
+			return nil, err
+		}
+		// Nothing was written to the database yet, so everything has to be.
+		for filename := range manifest.Entries {
+			manifest.changed[filename] = struct{}{}
+		}
+		return manifest, nil
+	}
+
+	db, err := openBoltManifest(filename, true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	manifest := NewManifest(product)
+	err = db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(boltMetaBucket); meta != nil {
+			version, _ := strconv.Atoi(string(meta.Get(boltVersionKey)))
+			if version > ManifestVersion {
+				if !ignoreVersion {
+					return fmt.Errorf("manifest at '%s' was written by a newer patcher (manifest version %d, "+
+						"this patcher supports up to version %d), please update the patcher", filename, version,
+						ManifestVersion)
+				}
+				log.Printf("WARNING: manifest at '%s' was written by a newer patcher (manifest version %d), "+
+					"reading it anyway.", filename, version)
+			}
+		}
+		products := tx.Bucket(boltProductsBucket)
+		if products == nil {
+			return nil
+		}
+		entries := products.Bucket([]byte(product))
+		if entries == nil {
+			if shared {
+				return nil
+			}
+			others := make([]string, 0)
+			err := products.ForEach(func(k, _ []byte) error {
+				others = append(others, string(k))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(others) == 0 {
+				return nil
+			}
+			return wrongProductError(product, others)
+		}
+		return entries.ForEach(func(k, v []byte) error {
+			var entry ManifestEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("couldn't decode entry for '%s' in manifest at '%s': %w", k, filename, err)
+			}
+			manifest.Entries[string(k)] = entry
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Write implements (ManifestStore).Write
+func (BoltManifestStore) Write(installDir string, m *Manifest) error {
+	filename := filepath.Join(installDir, BoltManifestFilename)
+	db, err := openBoltManifest(filename, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		if err := meta.Put(boltVersionKey, []byte(strconv.Itoa(ManifestVersion))); err != nil {
+			return err
+		}
+		products, err := tx.CreateBucketIfNotExists(boltProductsBucket)
+		if err != nil {
+			return err
+		}
+		// Only set if the manifest was converted from JSON, otherwise the other products are already stored.
+		for p, entries := range m.otherProducts {
+			if err := putBoltEntries(products, p, entries, nil); err != nil {
+				return err
+			}
+		}
+		return putBoltEntries(products, m.Product, m.Entries, m.changed)
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't write manifest to '%s': %w", filename, err)
+	}
+	m.changed = make(map[string]struct{})
+
+	if m.otherProducts != nil {
+		m.otherProducts = nil
+		jsonFilename := filepath.Join(installDir, ManifestFilename)
+		if err := os.Remove(jsonFilename); err == nil {
+			log.Printf("Converted manifest '%s' to '%s'.", jsonFilename, filename)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("couldn't remove converted manifest '%s': %w", jsonFilename, err)
+		}
+		journalFilename := filepath.Join(installDir, ManifestJournalFilename)
+		if err := os.Remove(journalFilename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("couldn't remove converted manifest journal '%s': %w", journalFilename, err)
+		}
+	}
+	return nil
+}
+
+// openBoltManifest opens the manifest database. Another process using it is waited on for a bit,
+// after that it's an error.
+func openBoltManifest(filename string, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open manifest at '%s': %w", filename, err)
+	}
+	return db, nil
+}
+
+// putBoltEntries stores the entries of a product. If only is not nil only those entries are stored.
+func putBoltEntries(
+	products *bolt.Bucket,
+	product string,
+	entries map[string]ManifestEntry,
+	only map[string]struct{},
+) error {
+	bucket, err := products.CreateBucketIfNotExists([]byte(product))
+	if err != nil {
+		return err
+	}
+	put := func(filename string, entry ManifestEntry) error {
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("couldn't encode manifest entry for '%s': %w", filename, err)
+		}
+		return bucket.Put([]byte(filename), encoded)
+	}
+	if only == nil {
+		for filename, entry := range entries {
+			if err := put(filename, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for filename := range only {
+		if err := put(filename, entries[filename]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
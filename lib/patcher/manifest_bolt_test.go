@@ -0,0 +1,72 @@
+package patcher
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltManifestStoreRoundTrip(t *testing.T) {
+	tempDir := t.TempDir()
+	store := BoltManifestStore{}
+	man1, err := store.Read(tempDir, "foo", false, false)
+	require.NoError(t, err)
+	require.Empty(t, man1.Entries)
+	man1.Add(filepath.Join("a", "b"), manDate1, "abcde")
+	require.NoError(t, store.Write(tempDir, man1))
+
+	man2, err := store.Read(tempDir, "foo", false, false)
+	require.NoError(t, err)
+	require.True(t, man2.Check(filepath.Join("a", "b"), manDate1, "abcde"))
+	man2.Add("c", manDate2, "fghij")
+	require.NoError(t, store.Write(tempDir, man2))
+
+	man3, err := store.Read(tempDir, "foo", false, false)
+	require.NoError(t, err)
+	require.Len(t, man3.Entries, 2)
+	require.True(t, man3.Check("c", manDate2, "fghij"))
+
+	_, err = store.Read(tempDir, "bar", false, false)
+	require.ErrorContains(t, err, "wrong product")
+	man4, err := store.Read(tempDir, "bar", true, false)
+	require.NoError(t, err)
+	require.Empty(t, man4.Entries)
+}
+
+func TestBoltManifestStoreConvertsJSON(t *testing.T) {
+	tempDir := t.TempDir()
+	man1 := NewManifest("foo")
+	man1.Add("a", manDate1, "abcde")
+	require.NoError(t, man1.WriteManifest(tempDir))
+	store := BoltManifestStore{}
+	man2, err := store.Read(tempDir, "bar", true, false)
+	require.NoError(t, err)
+	man2.Add("b", manDate1, "fghij")
+	require.NoError(t, store.Write(tempDir, man2))
+	require.NoFileExists(t, filepath.Join(tempDir, ManifestFilename))
+
+	// The other product was converted as well.
+	man3, err := store.Read(tempDir, "foo", false, false)
+	require.NoError(t, err)
+	require.True(t, man3.Check("a", manDate1, "abcde"))
+}
+
+func TestBoltManifestStoreNewerVersion(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := bolt.Open(filepath.Join(tempDir, BoltManifestFilename), 0644, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucket(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		return meta.Put(boltVersionKey, []byte("99"))
+	}))
+	require.NoError(t, db.Close())
+	_, err = BoltManifestStore{}.Read(tempDir, "foo", false, false)
+	require.ErrorContains(t, err, "written by a newer patcher")
+	_, err = BoltManifestStore{}.Read(tempDir, "foo", false, true)
+	require.NoError(t, err)
+}
@@ -0,0 +1,77 @@
+package patcher
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A ManifestExportEntry is a file listed in the manifest, see ExportManifest.
+type ManifestExportEntry struct {
+	// Product the file belongs to.
+	Product string `json:"product"`
+
+	// Path relative to the install dir, with forward slashes.
+	Path string `json:"path"`
+
+	// SHA256 checksum recorded in the manifest, in lowercase.
+	Checksum string `json:"sha256"`
+
+	// Last modification time of the file when the checksum was recorded.
+	LastChange time.Time `json:"lastChange"`
+}
+
+// ExportManifest returns the files listed in the manifest in the install dir with their checksums, sorted by
+// path and product. If product isn't empty only the files of that product are returned. Like SelfCheck
+// this reads the JSON manifest, not a BoltManifestStore.
+func ExportManifest(installDir string, product string) ([]ManifestExportEntry, error) {
+	mf, err := readManifestFile(installDir, false)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("no manifest in '%s' (has the game been installed?)", installDir)
+		}
+		return nil, err
+	}
+	if product != "" {
+		if _, found := mf.Products[product]; !found {
+			return nil, fmt.Errorf("manifest in '%s' has no files of product '%s'", installDir, product)
+		}
+	}
+	exported := make([]ManifestExportEntry, 0)
+	for p, entries := range mf.Products {
+		if product != "" && p != product {
+			continue
+		}
+		for filename, entry := range entries {
+			exported = append(exported, ManifestExportEntry{
+				Product:    p,
+				Path:       filepath.ToSlash(filename),
+				Checksum:   strings.ToLower(entry.LastChecksum),
+				LastChange: entry.LastChange,
+			})
+		}
+	}
+	sort.Slice(exported, func(i, j int) bool {
+		if exported[i].Path != exported[j].Path {
+			return exported[i].Path < exported[j].Path
+		}
+		return exported[i].Product < exported[j].Product
+	})
+	return exported, nil
+}
+
+// WriteSha256sumList writes exported manifest entries in the format of sha256sum, so an install can be
+// checked with "sha256sum -c" from the install dir.
+func WriteSha256sumList(w io.Writer, entries []ManifestExportEntry) error {
+	for _, e := range entries {
+		if _, err := fmt.Fprintf(w, "%s  %s\n", e.Checksum, e.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package patcher
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportManifest(t *testing.T) {
+	installDir := t.TempDir()
+	_, err := ExportManifest(installDir, "")
+	require.ErrorContains(t, err, "no manifest")
+
+	changed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	game := NewManifest("game")
+	game.Add(filepath.Join("b", "file"), changed, "ABC")
+	game.Add("a", changed, "def")
+	require.NoError(t, game.WriteManifest(installDir))
+	mod, err := ReadManifest(installDir, "mod")
+	require.NoError(t, err)
+	mod.Add("a", changed, "123")
+	require.NoError(t, mod.WriteManifest(installDir))
+
+	exported, err := ExportManifest(installDir, "")
+	require.NoError(t, err)
+	require.Equal(t, []ManifestExportEntry{
+		{Product: "game", Path: "a", Checksum: "def", LastChange: changed},
+		{Product: "mod", Path: "a", Checksum: "123", LastChange: changed},
+		{Product: "game", Path: "b/file", Checksum: "abc", LastChange: changed},
+	}, exported)
+
+	exported, err = ExportManifest(installDir, "game")
+	require.NoError(t, err)
+	require.Len(t, exported, 2)
+	var buf bytes.Buffer
+	require.NoError(t, WriteSha256sumList(&buf, exported))
+	require.Equal(t, "def  a\nabc  b/file\n", buf.String())
+
+	_, err = ExportManifest(installDir, "other")
+	require.ErrorContains(t, err, "no files of product 'other'")
+}
@@ -0,0 +1,81 @@
+package patcher
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadSha256sumList reads a checksum list in the format of sha256sum, as written by WriteSha256sumList.
+// A "*" before the path (sha256sum's binary mode) is accepted. Empty lines and lines starting with "#" are
+// skipped. The returned entries have no product and no last change time.
+func ReadSha256sumList(r io.Reader) ([]ManifestExportEntry, error) {
+	entries := make([]ManifestExportEntry, 0)
+	scanner := bufio.NewScanner(r)
+	lineNr := 0
+	for scanner.Scan() {
+		lineNr++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		checksum, filename, found := strings.Cut(line, " ")
+		if !found || len(filename) < 2 || (filename[0] != ' ' && filename[0] != '*') {
+			return nil, fmt.Errorf("line %d of checksum list isn't '<checksum>  <path>'", lineNr)
+		}
+		if decoded, err := hex.DecodeString(checksum); err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("line %d of checksum list has invalid SHA256 checksum '%s'", lineNr, checksum)
+		}
+		entries = append(entries, ManifestExportEntry{
+			Path:     filename[1:],
+			Checksum: strings.ToLower(checksum),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read checksum list: %w", err)
+	}
+	return entries, nil
+}
+
+// ImportChecksums adds the files in a trusted checksum list (e.g. from ExportManifest on a known-good install)
+// to the manifest, without computing checksums. Every listed file that exists in the install dir is added with
+// the listed checksum and its current modification time, so the next verify phase trusts it. Entries of
+// another product are ignored, entries without a product are taken to be of the manifest's product. Returns
+// the number of files added and the paths of the listed files that don't exist.
+//
+// Nothing is checked, if a file doesn't actually have the listed checksum the patcher won't notice until the
+// file is modified. Use only lists of installs of the same version that are known to be good.
+func ImportChecksums(installDir string, manifest *Manifest, entries []ManifestExportEntry) (int, []string, error) {
+	imported := 0
+	missing := make([]string, 0)
+	for _, e := range entries {
+		if e.Product != "" && e.Product != manifest.Product {
+			continue
+		}
+		filename := filepath.FromSlash(e.Path)
+		if !filepath.IsLocal(filename) {
+			return 0, nil, fmt.Errorf("checksum list contains path '%s' outside the install dir", e.Path)
+		}
+		realPath := filepath.Join(installDir, filename)
+		info, err := os.Stat(realPath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				missing = append(missing, e.Path)
+				continue
+			}
+			return 0, nil, fmt.Errorf("failed to get basic metadata of '%s': %w", realPath, err)
+		}
+		if info.IsDir() {
+			return 0, nil, fmt.Errorf("checksum list contains '%s' which is a directory", e.Path)
+		}
+		manifest.Add(filename, info.ModTime(), e.Checksum)
+		imported++
+	}
+	return imported, missing, nil
+}
@@ -0,0 +1,52 @@
+package patcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSha256sumList(t *testing.T) {
+	a := HashBytes([]byte("a"))
+	b := HashBytes([]byte("b"))
+	list := "# comment\n" + strings.ToUpper(a) + "  dir/a\r\n\n" + b + " *b with spaces\n"
+	entries, err := ReadSha256sumList(strings.NewReader(list))
+	require.NoError(t, err)
+	require.Equal(t, []ManifestExportEntry{
+		{Path: "dir/a", Checksum: a},
+		{Path: "b with spaces", Checksum: b},
+	}, entries)
+
+	_, err = ReadSha256sumList(strings.NewReader("abc  file\n"))
+	require.ErrorContains(t, err, "line 1 of checksum list has invalid SHA256 checksum")
+	_, err = ReadSha256sumList(strings.NewReader(a + "\n"))
+	require.ErrorContains(t, err, "isn't '<checksum>  <path>'")
+}
+
+func TestImportChecksums(t *testing.T) {
+	installDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(installDir, "dir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "dir", "a"), []byte("a"), 0644))
+	manifest := NewManifest("game")
+	imported, missing, err := ImportChecksums(installDir, manifest, []ManifestExportEntry{
+		{Path: "dir/a", Checksum: "aaa"},
+		{Path: "b", Checksum: "bbb"},
+		{Product: "other", Path: "c", Checksum: "ccc"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, imported)
+	require.Equal(t, []string{"b"}, missing)
+	require.Len(t, manifest.Entries, 1)
+	info, err := os.Stat(filepath.Join(installDir, "dir", "a"))
+	require.NoError(t, err)
+	// The listed checksum is trusted, not computed.
+	require.True(t, manifest.Check(filepath.Join("dir", "a"), info.ModTime(), "aaa"))
+
+	_, _, err = ImportChecksums(installDir, manifest, []ManifestExportEntry{{Path: "../escape", Checksum: "aaa"}})
+	require.ErrorContains(t, err, "outside the install dir")
+	_, _, err = ImportChecksums(installDir, manifest, []ManifestExportEntry{{Path: "dir", Checksum: "aaa"}})
+	require.ErrorContains(t, err, "is a directory")
+}
@@ -0,0 +1,148 @@
+package patcher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Filename for the journal of manifest changes under the root dir, see JSONManifestStore.
+const ManifestJournalFilename = "ta-manifest.journal"
+
+// A manifestJournalRecord is a line in the manifest journal.
+type manifestJournalRecord struct {
+	Product  string        `json:"product"`
+	Filename string        `json:"filename"`
+	Entry    ManifestEntry `json:"entry"`
+}
+
+// appendManifestJournal appends the changed entries of the manifest to the journal and returns the size
+// of the journal afterwards.
+func appendManifestJournal(installDir string, m *Manifest) (int64, error) {
+	filename := filepath.Join(installDir, ManifestJournalFilename)
+	// Sorted so the journal doesn't depend on map order, which makes it easier to inspect.
+	changed := make([]string, 0, len(m.changed))
+	for f := range m.changed {
+		changed = append(changed, f)
+	}
+	sort.Strings(changed)
+	var buf bytes.Buffer
+	for _, f := range changed {
+		encoded, err := json.Marshal(manifestJournalRecord{Product: m.Product, Filename: f, Entry: m.Entries[f]})
+		if err != nil {
+			return 0, fmt.Errorf("couldn't encode manifest journal record for '%s': %w", f, err)
+		}
+		buf.Write(encoded)
+		buf.WriteByte('\n')
+	}
+
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't open manifest journal '%s': %w", filename, err)
+	}
+	defer file.Close()
+	offset, err := completeManifestJournalSize(file)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't read manifest journal '%s': %w", filename, err)
+	}
+	// A single write, so a crash at worst leaves an incomplete last line.
+	if _, err := file.WriteAt(buf.Bytes(), offset); err != nil {
+		return 0, fmt.Errorf("couldn't write to manifest journal '%s': %w", filename, err)
+	}
+	if err := file.Sync(); err != nil {
+		return 0, fmt.Errorf("couldn't sync manifest journal '%s': %w", filename, err)
+	}
+	m.changed = make(map[string]struct{})
+	return offset + int64(buf.Len()), nil
+}
+
+// completeManifestJournalSize returns the size of the journal up to and including the last complete line.
+// An incomplete last line left by an interrupted write is cut off so new lines don't get appended to it.
+func completeManifestJournalSize(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return 0, nil
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, size-1); err != nil {
+		return 0, err
+	}
+	if last[0] == '\n' {
+		return size, nil
+	}
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, 0); err != nil {
+		return 0, err
+	}
+	complete := int64(bytes.LastIndexByte(data, '\n') + 1)
+	return complete, file.Truncate(complete)
+}
+
+// replayManifestJournal applies the changes in the journal (if any) to a manifest file.
+func replayManifestJournal(installDir string, mf *manifestFile) error {
+	filename := filepath.Join(installDir, ManifestJournalFilename)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("couldn't read manifest journal '%s': %w", filename, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNr := 0
+	for scanner.Scan() {
+		lineNr++
+		var record manifestJournalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			if !bytes.HasSuffix(data, []byte("\n")) && lineNr == bytes.Count(data, []byte("\n"))+1 {
+				// Incomplete last line, the patcher was interrupted while writing it.
+				log.Printf("Ignoring incomplete last line of manifest journal '%s'.", filename)
+				break
+			}
+			return fmt.Errorf("couldn't decode line %d of manifest journal '%s': %w", lineNr, filename, err)
+		}
+		entries := mf.Products[record.Product]
+		if entries == nil {
+			entries = make(map[string]ManifestEntry)
+			if mf.Products == nil {
+				mf.Products = make(map[string]map[string]ManifestEntry)
+			}
+			mf.Products[record.Product] = entries
+		}
+		entries[record.Filename] = record.Entry
+	}
+	return scanner.Err()
+}
+
+// writeFileAtomic writes a file by writing a temporary file next to it and renaming that over the file.
+// Either the old or the new contents survive a crash.
+func writeFileAtomic(filename string, data []byte) error {
+	tempFilename := filename + ".tmp"
+	file, err := os.Create(tempFilename)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFilename)
+		return err
+	}
+	return os.Rename(tempFilename, filename)
+}
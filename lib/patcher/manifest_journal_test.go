@@ -0,0 +1,156 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONManifestStoreJournal(t *testing.T) {
+	tempDir := t.TempDir()
+	store := JSONManifestStore{}
+	man1 := NewManifest("foo")
+	for i := 0; i < 10; i++ {
+		man1.Add(fmt.Sprintf("file%d", i), manDate1, "abcde")
+	}
+	require.NoError(t, store.Write(tempDir, man1))
+	require.NoFileExists(t, filepath.Join(tempDir, ManifestJournalFilename))
+	fullData, err := os.ReadFile(filepath.Join(tempDir, ManifestFilename))
+	require.NoError(t, err)
+
+	// A small change only goes to the journal.
+	man1.Add("file3", manDate2, "fghij")
+	require.NoError(t, store.Write(tempDir, man1))
+	require.FileExists(t, filepath.Join(tempDir, ManifestJournalFilename))
+	data, err := os.ReadFile(filepath.Join(tempDir, ManifestFilename))
+	require.NoError(t, err)
+	require.Equal(t, fullData, data)
+
+	man2, err := store.Read(tempDir, "foo", false, false)
+	require.NoError(t, err)
+	require.True(t, man2.Check("file3", manDate2, "fghij"))
+	require.True(t, man2.Check("file4", manDate1, "abcde"))
+
+	// Once the journal gets too big it's merged into the manifest.
+	compacted := false
+	for i := 0; i < 10 && !compacted; i++ {
+		man2.Add(fmt.Sprintf("file%d", i), manDate2, "klmno")
+		require.NoError(t, store.Write(tempDir, man2))
+		_, err := os.Stat(filepath.Join(tempDir, ManifestJournalFilename))
+		compacted = os.IsNotExist(err)
+	}
+	require.True(t, compacted)
+	for i := 0; i < 10; i++ {
+		man2.Add(fmt.Sprintf("file%d", i), manDate2, "klmno")
+	}
+	require.NoError(t, store.Write(tempDir, man2))
+	man3, err := ReadManifest(tempDir, "foo")
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.True(t, man3.Check(fmt.Sprintf("file%d", i), manDate2, "klmno"))
+	}
+}
+
+func TestManifestJournalIncompleteLine(t *testing.T) {
+	tempDir := t.TempDir()
+	store := JSONManifestStore{}
+	man1 := NewManifest("foo")
+	man1.Add("a", manDate1, "abcde")
+	man1.Add("b", manDate1, "abcde")
+	require.NoError(t, store.Write(tempDir, man1))
+	man1.Add("a", manDate2, "fghij")
+	require.NoError(t, store.Write(tempDir, man1))
+
+	// Simulate a crash while appending to the journal.
+	journalFilename := filepath.Join(tempDir, ManifestJournalFilename)
+	file, err := os.OpenFile(journalFilename, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"product":"foo","filename":"b","en`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	man2, err := ReadManifest(tempDir, "foo")
+	require.NoError(t, err)
+	require.True(t, man2.Check("a", manDate2, "fghij"))
+	require.True(t, man2.Check("b", manDate1, "abcde"))
+
+	// The incomplete line is dropped when appending.
+	man2.Add("b", manDate2, "klmno")
+	require.NoError(t, appendJournalOnly(tempDir, man2))
+	man3, err := ReadManifest(tempDir, "foo")
+	require.NoError(t, err)
+	require.True(t, man3.Check("a", manDate2, "fghij"))
+	require.True(t, man3.Check("b", manDate2, "klmno"))
+}
+
+func TestManifestJournalCorrupt(t *testing.T) {
+	tempDir := t.TempDir()
+	man1 := NewManifest("foo")
+	man1.Add("a", manDate1, "abcde")
+	require.NoError(t, man1.WriteManifest(tempDir))
+	journal := "garbage\n" + `{"product":"foo","filename":"a","entry":{}}` + "\n"
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, ManifestJournalFilename), []byte(journal), 0644))
+	_, err := ReadManifest(tempDir, "foo")
+	require.ErrorContains(t, err, "couldn't decode line 1 of manifest journal")
+}
+
+func TestSelfCheckSeesJournal(t *testing.T) {
+	tempDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "a"), []byte("foo"), 0644))
+	man := NewManifest("foo")
+	man.Add("a", manDate1, "wrong")
+	require.NoError(t, man.WriteManifest(tempDir))
+	man.Add("a", manDate1, HashBytes([]byte("foo")))
+	require.NoError(t, appendJournalOnly(tempDir, man))
+	mismatches, err := SelfCheck(context.Background(), tempDir, 1)
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+}
+
+// appendJournalOnly writes the changes of the manifest to the journal without compacting.
+func appendJournalOnly(installDir string, m *Manifest) error {
+	_, err := appendManifestJournal(installDir, m)
+	return err
+}
+
+// benchmarkManifest returns a manifest with n entries.
+func benchmarkManifest(n int) *Manifest {
+	man := NewManifest("foo")
+	for i := 0; i < n; i++ {
+		man.Add(filepath.Join("Some", "Directory", fmt.Sprintf("file%06d.upk", i)), manDate1,
+			"0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF")
+	}
+	return man
+}
+
+func BenchmarkManifestFullWrite(b *testing.B) {
+	tempDir := b.TempDir()
+	man := benchmarkManifest(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		man.Add(filepath.Join("Some", "Directory", fmt.Sprintf("file%06d.upk", i%100000)), manDate2, "abcde")
+		if err := man.WriteManifest(tempDir); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkManifestIncrementalWrite(b *testing.B) {
+	tempDir := b.TempDir()
+	store := JSONManifestStore{}
+	man := benchmarkManifest(100000)
+	if err := store.Write(tempDir, man); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		man.Add(filepath.Join("Some", "Directory", fmt.Sprintf("file%06d.upk", i%100000)), manDate2, "abcde")
+		if err := store.Write(tempDir, man); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package patcher
 
 import (
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -37,7 +38,8 @@ func TestReadManifestInvalidProduct(t *testing.T) {
 	man1.Add(filepath.Join("a", "b"), manDate1, "abcde")
 	require.True(t, man1.Check(filepath.Join("a", "b"), manDate1, "abcde"))
 	require.NoError(t, man1.WriteManifest(tempDir))
-	_, err := ReadManifest(tempDir, "bar")
+	// Only RunPatcher (without SharedInstallDir) rejects a manifest of other products.
+	_, err := readManifest(tempDir, "bar", false, false)
 	require.ErrorContains(t, err, "wrong product")
 }
 
@@ -48,3 +50,47 @@ func TestReadManifestNotFound(t *testing.T) {
 	require.Equal(t, "foo", man.Product)
 	require.Empty(t, man.Entries)
 }
+
+func TestReadManifestMigratesSingleProduct(t *testing.T) {
+	tempDir := t.TempDir()
+	oldData := `{"Product": "foo", "Entries": {"a": {"last_change": "2023-12-15T14:46:23.000000325Z", "last_checksum": "abcde"}}}`
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, ManifestFilename), []byte(oldData), 0644))
+	man, err := ReadManifest(tempDir, "foo")
+	require.NoError(t, err)
+	require.True(t, man.Check("a", manDate1, "abcde"))
+}
+
+func TestReadManifestMultipleProducts(t *testing.T) {
+	tempDir := t.TempDir()
+	man1 := NewManifest("foo")
+	man1.Add("a", manDate1, "abcde")
+	require.NoError(t, man1.WriteManifest(tempDir))
+
+	// A different product gets its own empty set of entries.
+	man2, err := ReadManifest(tempDir, "bar")
+	require.NoError(t, err)
+	require.Empty(t, man2.Entries)
+	man2.Add("b", manDate1, "fghij")
+	require.NoError(t, man2.WriteManifest(tempDir))
+
+	// Writing the second product doesn't lose the entries of the first.
+	man3, err := ReadManifest(tempDir, "foo")
+	require.NoError(t, err)
+	require.True(t, man3.Check("a", manDate1, "abcde"))
+	require.False(t, man3.Check("b", manDate1, "fghij"))
+	man4, err := ReadManifest(tempDir, "bar")
+	require.NoError(t, err)
+	require.True(t, man4.Check("b", manDate1, "fghij"))
+}
+
+func TestReadManifestNewerVersion(t *testing.T) {
+	tempDir := t.TempDir()
+	newData := `{"version": 99, "products": {"foo": {"a": {"last_change": "2023-12-15T14:46:23.000000325Z", "last_checksum": "abcde"}}}}`
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, ManifestFilename), []byte(newData), 0644))
+	_, err := ReadManifest(tempDir, "foo")
+	require.ErrorContains(t, err, "written by a newer patcher (manifest version 99")
+
+	man, err := readManifest(tempDir, "foo", false, true)
+	require.NoError(t, err)
+	require.True(t, man.Check("a", manDate1, "abcde"))
+}
@@ -0,0 +1,114 @@
+package patcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+type typeMetadataCache string
+
+const keyMetadataCache typeMetadataCache = "metadataCache"
+
+// A MetadataCache stores responses for products.json, release.json and instructions.json on disk,
+// so that they can be requested conditionally (with If-None-Match/If-Modified-Since). If the server
+// says the file hasn't changed the cached data is used. This saves a lot of traffic for launchers that
+// frequently check for updates.
+type MetadataCache struct {
+	dir string
+}
+
+// A cachedResponse is what's stored in the cache for a single URL.
+type cachedResponse struct {
+	Url          string `json:"url"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+	Body         []byte `json:"body"`
+}
+
+// NewMetadataCache creates a cache storing files in dir. The directory is created when needed.
+func NewMetadataCache(dir string) *MetadataCache {
+	return &MetadataCache{dir: dir}
+}
+
+// WithMetadataCache makes resolving instructions (see ResolveInstructionsContext) cache the fetched files in
+// cache, so they're only downloaded again if they changed. Without it nothing is cached.
+func WithMetadataCache(ctx context.Context, cache *MetadataCache) context.Context {
+	return context.WithValue(ctx, keyMetadataCache, cache)
+}
+
+// metadataCache returns the cache set with WithMetadataCache, nil if there is none.
+func metadataCache(ctx context.Context) *MetadataCache {
+	cache, _ := ctx.Value(keyMetadataCache).(*MetadataCache)
+	return cache
+}
+
+// filename returns the name of the cache file for a URL.
+func (c *MetadataCache) filename(location *url.URL) string {
+	return filepath.Join(c.dir, HashBytes([]byte(location.String()))+".json")
+}
+
+// get returns the cached response for a URL, or nil if there's no (usable) cached response.
+func (c *MetadataCache) get(location *url.URL) *cachedResponse {
+	filename := c.filename(location)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Couldn't read cached metadata '%s', ignoring cache: %s", filename, err)
+		}
+		return nil
+	}
+	var cached cachedResponse
+	if err := json.Unmarshal(data, &cached); err != nil {
+		log.Printf("Couldn't decode cached metadata '%s', ignoring cache: %s", filename, err)
+		return nil
+	}
+	// Should be impossible short of hash collisions but cheap to check.
+	if cached.Url != location.String() {
+		return nil
+	}
+	return &cached
+}
+
+// setConditionalHeaders adds the headers to request the URL only if it changed compared to the cached response.
+func (cached *cachedResponse) setConditionalHeaders(req *http.Request) {
+	if cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+	if cached.LastModified != "" {
+		req.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+}
+
+// put stores a response in the cache. Responses without ETag or Last-Modified are not stored
+// as there's no way to request them conditionally.
+func (c *MetadataCache) put(location *url.URL, header http.Header, body []byte) error {
+	cached := cachedResponse{
+		Url:          location.String(),
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+		Body:         body,
+	}
+	if cached.ETag == "" && cached.LastModified == "" {
+		return nil
+	}
+	encoded, err := json.Marshal(cached)
+	if err != nil {
+		return fmt.Errorf("couldn't encode cached metadata for '%s': %w", location, err)
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return fmt.Errorf("couldn't create metadata cache dir '%s': %w", c.dir, err)
+	}
+	filename := c.filename(location)
+	if err := os.WriteFile(filename, encoded, 0644); err != nil {
+		return fmt.Errorf("couldn't write cached metadata to '%s': %w", filename, err)
+	}
+	return nil
+}
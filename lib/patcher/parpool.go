@@ -2,10 +2,78 @@ package patcher
 
 import (
 	"context"
+	"sync"
 
 	"golang.org/x/sync/errgroup"
 )
 
+// A Limiter limits how many workers can run at the same time. Unlike errgroup's SetLimit
+// the limit can be changed while workers are running. Lowering the limit doesn't stop
+// running workers, it just prevents new ones from starting until enough have finished.
+type Limiter struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	// Closed (and replaced) whenever limit or running changes, to wake up anything waiting in Acquire.
+	changed chan struct{}
+}
+
+// NewLimiter creates a limiter allowing limit workers to run at the same time.
+func NewLimiter(limit int) *Limiter {
+	return &Limiter{
+		limit:   limit,
+		changed: make(chan struct{}),
+	}
+}
+
+// SetLimit changes the number of workers that can run at the same time.
+func (l *Limiter) SetLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.notifyLocked()
+}
+
+// Limit returns the current limit.
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// Acquire blocks until a worker is allowed to run or the context is canceled.
+// Every successful Acquire must be followed by a Release.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.running < l.limit {
+			l.running++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release marks a worker as finished.
+func (l *Limiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	l.notifyLocked()
+}
+
+func (l *Limiter) notifyLocked() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
 // DoInParallelWithResult runs the execute function for each element in the input slice,
 // processing at most numWorkers at a time. If one of the workers errors the context
 // passed to the others is cancelled.
@@ -20,15 +88,32 @@ func DoInParallelWithResult[TIn any, TOut any](
 	execute func(context.Context, TIn) (TOut, error),
 	input []TIn,
 	numWorkers int,
+) ([]TOut, error) {
+	return DoInParallelWithLimiter(ctx, execute, input, NewLimiter(numWorkers))
+}
+
+// DoInParallelWithLimiter is like DoInParallelWithResult but takes the number of workers from
+// a limiter, so it can be changed while running.
+func DoInParallelWithLimiter[TIn any, TOut any](
+	ctx context.Context,
+	execute func(context.Context, TIn) (TOut, error),
+	input []TIn,
+	limiter *Limiter,
 ) ([]TOut, error) {
 	// See https://pkg.go.dev/golang.org/x/sync/errgroup#example-Group-Parallel
-	g, ctx := errgroup.WithContext(ctx)
-	g.SetLimit(numWorkers)
+	// The limiting is done by hand instead of with SetLimit so that the limit can change.
+	g, gctx := errgroup.WithContext(ctx)
 	output := make([]TOut, len(input))
+	var acquireErr error
 	for i, val := range input {
 		i, val := i, val // Prevent loop variable closure problem
+		if acquireErr = limiter.Acquire(gctx); acquireErr != nil {
+			// Either a worker failed (Wait will return that error) or ctx got canceled.
+			break
+		}
 		g.Go(func() error {
-			result, err := execute(ctx, val)
+			defer limiter.Release()
+			result, err := execute(gctx, val)
 			if err == nil {
 				output[i] = result
 			}
@@ -38,6 +123,9 @@ func DoInParallelWithResult[TIn any, TOut any](
 	if err := g.Wait(); err != nil {
 		return nil, err
 	}
+	if acquireErr != nil {
+		return nil, acquireErr
+	}
 	return output, nil
 }
 
@@ -48,8 +136,55 @@ func DoInParallel[TIn any](
 	input []TIn,
 	numWorkers int,
 ) error {
-	_, err := DoInParallelWithResult[TIn, struct{}](ctx, func(ctx context.Context, v TIn) (struct{}, error) {
+	return DoInParallelLimited(ctx, execute, input, NewLimiter(numWorkers))
+}
+
+// DoInParallelLimited is like DoInParallelWithLimiter but without collecting results.
+func DoInParallelLimited[TIn any](
+	ctx context.Context,
+	execute func(context.Context, TIn) error,
+	input []TIn,
+	limiter *Limiter,
+) error {
+	_, err := DoInParallelWithLimiter[TIn, struct{}](ctx, func(ctx context.Context, v TIn) (struct{}, error) {
 		return struct{}{}, execute(ctx, v)
-	}, input, numWorkers)
+	}, input, limiter)
 	return err
 }
+
+// DoInParallelChan is like DoInParallelLimited but takes the input from a channel, so work can start before
+// all input is known. It returns once the channel is closed and all workers are done, or when a worker fails
+// or ctx is cancelled. The sender should stop sending when ctx is cancelled, as nothing is received then.
+func DoInParallelChan[TIn any](
+	ctx context.Context,
+	execute func(context.Context, TIn) error,
+	input <-chan TIn,
+	limiter *Limiter,
+) error {
+	g, gctx := errgroup.WithContext(ctx)
+	var recvErr error
+	for {
+		var val TIn
+		var ok bool
+		select {
+		case val, ok = <-input:
+		case <-gctx.Done():
+			// Either a worker failed (Wait will return that error) or ctx got canceled.
+			recvErr = gctx.Err()
+		}
+		if !ok || recvErr != nil {
+			break
+		}
+		if recvErr = limiter.Acquire(gctx); recvErr != nil {
+			break
+		}
+		g.Go(func() error {
+			defer limiter.Release()
+			return execute(gctx, val)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	return recvErr
+}
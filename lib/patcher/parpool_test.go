@@ -5,6 +5,7 @@ import (
 	"errors"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -64,3 +65,101 @@ func TestParpoolNoResult(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 15, res)
 }
+
+func TestParpoolLimiterChange(t *testing.T) {
+	var running, started atomic.Int32
+	// Every worker runs until it gets a value from release.
+	release := make(chan struct{})
+	execute := func(ctx context.Context, a int) error {
+		running.Add(1)
+		started.Add(1)
+		defer running.Add(-1)
+		<-release
+		return nil
+	}
+	limiter := NewLimiter(3)
+	done := make(chan error)
+	go func() {
+		done <- DoInParallelLimited[int](context.Background(), execute, []int{1, 2, 3, 4, 5, 6, 7, 8}, limiter)
+	}()
+	waitFor := func(expectedRunning int32, expectedStarted int32) {
+		require.Eventually(t, func() bool {
+			return running.Load() == expectedRunning && started.Load() == expectedStarted
+		}, 5*time.Second, time.Millisecond)
+	}
+	waitFor(3, 3)
+
+	// Lowering the limit doesn't stop running workers, but no new ones start until fewer are running.
+	limiter.SetLimit(1)
+	release <- struct{}{}
+	release <- struct{}{}
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, int32(1), running.Load())
+	require.Equal(t, int32(3), started.Load())
+	release <- struct{}{}
+	waitFor(1, 4)
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, int32(4), started.Load())
+
+	// Raising it starts more right away.
+	limiter.SetLimit(2)
+	waitFor(2, 5)
+
+	close(release)
+	require.NoError(t, <-done)
+	require.Equal(t, int32(8), started.Load())
+}
+
+func TestParpoolLimiterZeroCancelled(t *testing.T) {
+	// A limit of 0 means nothing can start, only canceling gets it unstuck.
+	execute := func(ctx context.Context, a int) error { return nil }
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := DoInParallelLimited[int](ctx, execute, []int{1, 2, 3}, NewLimiter(0))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestParpoolChan(t *testing.T) {
+	m := sync.Mutex{}
+	res := 0
+	execute := func(ctx context.Context, a int) error {
+		m.Lock()
+		defer m.Unlock()
+		res += a
+		return nil
+	}
+	input := make(chan int)
+	go func() {
+		defer close(input)
+		for i := 1; i <= 5; i++ {
+			input <- i
+		}
+	}()
+	err := DoInParallelChan[int](context.Background(), execute, input, NewLimiter(2))
+	require.NoError(t, err)
+	require.Equal(t, 15, res)
+}
+
+func TestParpoolChanError(t *testing.T) {
+	execute := func(ctx context.Context, a int) error {
+		if a == 3 {
+			return errors.New("no three")
+		}
+		return nil
+	}
+	// Never closed, a failing worker stops receiving anyway.
+	input := make(chan int)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i := 1; ; i++ {
+			select {
+			case input <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	err := DoInParallelChan[int](context.Background(), execute, input, NewLimiter(2))
+	require.ErrorContains(t, err, "no three")
+}
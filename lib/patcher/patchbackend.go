@@ -0,0 +1,112 @@
+package patcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// A PatchBackend applies patch files, e.g. XDelta or BsDiff.
+type PatchBackend interface {
+	// ApplyPatch applies a patch, writing the result to newPath. If oldPath is not nil it's a delta patch
+	// against that file, otherwise it's a full patch. Returns an error if the result doesn't have the
+	// expected checksum. On failure newPath should not be left behind (unless configured for debugging).
+	ApplyPatch(
+		ctx context.Context,
+		oldPath *string,
+		patchPath string,
+		newPath string,
+		expectedChecksum string,
+		expectedSize int64,
+	) error
+}
+
+// A StreamingPatchBackend can also apply full patches while they're being downloaded, without storing the
+// patch file. See PatcherConfig.StreamFullPatches.
+type StreamingPatchBackend interface {
+	PatchBackend
+
+	// ApplyFullPatchStream applies a full patch read from patch, like ApplyPatch. The patchName is only
+	// used in messages.
+	ApplyFullPatchStream(
+		ctx context.Context,
+		patch io.Reader,
+		patchName string,
+		newPath string,
+		expectedChecksum string,
+		expectedSize int64,
+	) error
+}
+
+// findBinary finds a program. If the binPath is just a basename without directory it will be looked up in PATH.
+func findBinary(binPath string) (string, error) {
+	if dir, _ := filepath.Split(binPath); dir == "" {
+		realPath, err := exec.LookPath(binPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to find '%s' in PATH: %w", binPath, err)
+		}
+		return realPath, nil
+	}
+	if _, err := os.Stat(binPath); err != nil {
+		return "", fmt.Errorf("failed to find '%s': %w", binPath, err)
+	}
+	return binPath, nil
+}
+
+// removePartialOutput removes the output of a failed patch application.
+func removePartialOutput(newPath string) {
+	// Best effort, the original error is more interesting than a failure to clean up.
+	if err := os.Remove(newPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Failed to remove partial output '%s' after failed patch: %s", newPath, err)
+	}
+}
+
+// checksumMismatchError is the error for a patch application producing the wrong file.
+func checksumMismatchError(what string, expectedChecksum string, checksum string) error {
+	return fmt.Errorf("%s failed: expected it to produce file with checksum %s but got %s",
+		what, strings.ToUpper(expectedChecksum), strings.ToUpper(checksum))
+}
+
+// checkOutputChecksum verifies the checksum of the output of a patch application, for backends that
+// can't compute it while writing.
+func checkOutputChecksum(ctx context.Context, what string, newPath string, expectedChecksum string) error {
+	checksum, err := hasher(ctx).HashFile(ctx, newPath, nil)
+	if err != nil {
+		return fmt.Errorf("%s failed (verify checksum of output): %w", what, err)
+	}
+	if !HashEqual(checksum, expectedChecksum) {
+		return checksumMismatchError(what, expectedChecksum, checksum)
+	}
+	return nil
+}
+
+// createOutputFile creates the output file for a patch application, preallocating it if the size is known.
+func createOutputFile(ctx context.Context, newPath string, expectedSize int64) (*os.File, error) {
+	if expectedSize > 0 {
+		file, err := CreateWithSizeHint(newPath, expectedSize)
+		if err == nil {
+			return file, nil
+		}
+		log.Printf(
+			"Creating '%s' for writing with preallocation for size %d failed, falling back to plain open: %s",
+			newPath, expectedSize, err)
+		// There's one weird edge case here, if the fallback implementation (OS is not Windows and not Linux)
+		// is used os.Create is already the entire fallback so it boils down to os.Create then try os.Create.
+		// Because both the Windows and Linux preallocation implementation open a file for writing it's possible
+		// for those that there are two errors from os.Create (or windows.CreateFile) as well.
+	}
+	var file *os.File
+	err := retryLockedFile(ctx, newPath, func() error {
+		var err error
+		file, err = os.Create(newPath)
+		return err
+	})
+	return file, err
+}
@@ -2,47 +2,215 @@ package patcher
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/fs"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"log"
+
+	"golang.org/x/sync/errgroup"
 )
 
 type PatcherConfig struct {
 	// URL containing instructions.json
 	BaseUrl *url.URL
 
+	// Same as BaseUrl on other mirrors, tried in order when downloading a patch file from BaseUrl fails.
+	FallbackBaseUrls []*url.URL
+
 	// Directory where the game should be installed.
 	InstallDir string
 
 	// Product name that should be stored in the manifest.
 	Product string
 
+	// Whether a missing install dir is an error. By default it's created, which allows fresh installs but
+	// also means a typo in the install dir creates a stray directory.
+	NoCreateInstallDir bool
+
+	// Whether the install dir can contain other products as well (e.g. a base game and a mod pack).
+	// If false RunPatcher refuses to touch an install dir whose manifest only has other products, as that's
+	// more likely the wrong install dir than a second product. ReadManifest doesn't do this check.
+	SharedInstallDir bool
+
+	// Whether instruction paths that only differ in case refer to the same file. By default this is
+	// detected from the filesystem of the install dir.
+	PathCase PathCaseMode
+
 	// How many concurrent workers in verify phase.
 	VerifyWorkers int
 
+	// If set only files changed after this time are verified. For older files whose last change time doesn't
+	// match the manifest the checksum in the manifest is trusted anyway, so this is a quick check whether
+	// anything changed since e.g. the last known good run. Files the manifest doesn't know are always verified.
+	ChangedSince time.Time
+
+	// Whether to compute the checksum of every existing file in the instructions, as if the manifest were
+	// empty, for when files were changed without changing their last change time. ChangedSince and region
+	// checksums are ignored as well. The manifest is still updated with the computed checksums.
+	ForceRehash bool
+
+	// Experimental: files of at least this many bytes also get a region checksum (see HashFileRegions),
+	// computed by VerifyWorkers workers and stored in the manifest. If the change time of such a file changed
+	// but the region checksum matches the manifest, the full checksum doesn't need to be computed, which for
+	// a huge file is a lot faster on a machine with many cores. 0 disables this.
+	ParallelHashThreshold int64
+
 	// How many concurrent workers in download phase.
 	DownloadWorkers int
 
+	// If set the download phase starts with 2 workers and adds one every DownloadRampUp until there are
+	// DownloadWorkers, so not all connections are opened at the same moment (which can trip connection rate
+	// limits or overwhelm a home router). 0 starts all workers right away.
+	DownloadRampUp time.Duration
+
 	// How many concurrent workers in apply phase.
 	ApplyWorkers int
 
+	// Maximum number of bytes the buffers of concurrent checksum computations may use together, 0 for no limit.
+	// Each computation uses a buffer of CopyBufferSize (but no more than this), so with many VerifyWorkers (or
+	// ParallelHashThreshold) this effectively lowers the number of files hashed at the same time.
+	MaxHashMemory int64
+
+	// Size in bytes of the buffers for computing checksums and writing files (downloads and xdelta output),
+	// DefaultCopyBufferSize if 0. Larger buffers help on hard disks and network shares. With MaxHashMemory set
+	// checksum computations use at most that much.
+	CopyBufferSize int
+
+	// Function creating the hash the checksums in the instructions (and the manifest) are computed with. If nil
+	// SHA256 is used, like the instructions of the launcher do. Every checksum is computed with one Hasher made
+	// from it. Also used for downloads, unless DownloadConfig.NewHash is set.
+	NewHash func() hash.Hash
+
+	// Maximum time to apply a single patch, 0 for no limit. A patch that takes longer fails, which bounds
+	// how long a pathological patch can stall the apply phase.
+	ApplyTimeout time.Duration
+
 	// Configuration of the download system.
 	DownloadConfig DownloadConfig
 
+	// Maximum number of bytes to download in total, 0 for no limit.
+	MaxTotalDownloadSize int64
+
+	// Whether to skip checking that the volume of the install dir has enough free space for the patches and
+	// the patched files before downloading. Without enough space the update would fail halfway through the
+	// apply phase, leaving a partially updated game.
+	SkipSpaceCheck bool
+
 	// Where to find the xdelta binary. If just a basename without directory
 	// will look in PATH and also in the current directory.
 	XDeltaBinPath string
 
+	// Optional backend for applying patches. If nil xdelta (see XDeltaBinPath) is used.
+	PatchBackend PatchBackend
+
 	// A function that gets called every few seconds with the current progress
 	// until the context passed to RunPatcher is canceled.
 	ProgressFunc func(Progress)
 
 	// How often to call ProgressFunc.
 	ProgressInterval time.Duration
+
+	// Whether to keep partial output files of failed patch applications, for debugging.
+	KeepTemp bool
+
+	// Whether to keep the directory with downloaded patches after a successful run, e.g. for inspecting them.
+	// Everything in it is kept, including what's left in patch/apply, and its path is logged. Patches left in it
+	// are reused by the next run if they're still needed, after checking their checksum.
+	KeepPatches bool
+
+	// Whether to verify the checksums of patch files before applying them. Patch files downloaded
+	// in the same run are not verified again as the downloader already checked them, this mainly
+	// catches patch files left over from a previous run getting corrupted.
+	VerifyPatches bool
+
+	// Whether to compute the checksum of every patched file again after moving it into place, before adding
+	// it to the manifest. The checksum is already checked while applying the patch, this catches files
+	// getting corrupted in between (e.g. by faulty hardware). Slow, as every patched file is read again.
+	VerifyAfterMove bool
+
+	// Whether RunPatcher computes the checksums of all files in the instructions again after a successful
+	// update, without trusting the manifest, and fails with a VerifyAfterError if any of them doesn't match.
+	// Unlike VerifyAfterMove this covers files that weren't patched as well. Slow, as the whole game is read.
+	VerifyAfter bool
+
+	// Whether files replaced or deleted by the apply phase are kept in the patch dir until the phase is done, so
+	// if it fails partway (e.g. a file can't be moved into place) the files changed so far are restored and the
+	// install dir is left as it was. The next run has to apply the patches of those files again. This needs
+	// disk space for the old versions of the patched files.
+	AtomicApply bool
+
+	// Whether RunPatcher waits for the verify phase to finish before starting the download phase. By default
+	// patch files are downloaded as soon as the verify phase knows they're needed, so the network isn't idle
+	// while files are being measured. Running the phases one after another is mainly useful for debugging.
+	// Dry runs and StreamFullPatches (which needs to know all downloads up front) always do this.
+	SequentialPhases bool
+
+	// Whether to apply full patches while downloading them, instead of storing the patch file first. This
+	// saves writing and reading the patch file, but an interrupted download can't be resumed: it starts over
+	// on the next run. If applying while downloading fails the patch file is downloaded as usual. Only used
+	// by RunPatcher, with a backend that implements StreamingPatchBackend and without KeepPatches.
+	StreamFullPatches bool
+
+	// If the install dir contains more than this many times as many files as there are instructions
+	// the install dir is probably wrong (e.g. someone's home directory). 0 disables the check.
+	MaxScanRatio float64
+
+	// Called when MaxScanRatio is exceeded, with the number of files found and the number of instructions.
+	// If it returns false the patcher stops. If nil a warning is logged and the patcher continues.
+	ConfirmManyFiles func(found int, expected int) bool
+
+	// If the instructions would delete more than this fraction (e.g. 0.5) of the game files in the install dir
+	// they're probably broken or malicious, a real update rarely deletes most of a game. The patcher then stops
+	// with a MassDeleteError before changing anything. 0 disables the check.
+	MaxDeleteRatio float64
+
+	// Whether to continue anyway (with a warning) when MaxDeleteRatio is exceeded. Implied by DryRun, as
+	// nothing is deleted then.
+	AllowMassDelete bool
+
+	// If set RunPatcher only runs the verify phase and then reports what it would download, patch and delete
+	// (see DeterminedActions.WriteReport) instead of doing it. The manifest is still written with the measured
+	// checksums, but nothing else in the install dir is changed. An install dir that doesn't exist is treated as
+	// empty and isn't created. With PathCaseAuto the default of the OS is assumed, detecting it would write
+	// a file.
+	DryRun bool
+
+	// Where RunPatcher writes the report of a dry run, the log if nil.
+	DryRunOutput io.Writer
+
+	// Whether files and directories in the install dir that can't be read while scanning (e.g. folders
+	// protected by the OS) are skipped with a warning. By default they fail the verify phase. The skipped
+	// paths are listed in DeterminedActions.SkippedScanPaths.
+	SkipScanErrors bool
+
+	// Where the manifest is stored. If nil JSONManifestStore is used.
+	ManifestStore ManifestStore
+
+	// Whether to read a manifest written by a newer version of the patcher anyway. Normally that's refused
+	// as the manifest may mean something this patcher doesn't understand.
+	IgnoreManifestVersion bool
+
+	// Optional throttle for changing the number of download and apply workers while running,
+	// or pausing the patcher.
+	Throttle *Throttle
+
+	// Optional function that gets called for each state transition of a file (e.g. verified, downloaded),
+	// for UIs that show more than ProgressFunc. It's called on a separate goroutine, one event at a time in
+	// the order the events happened, so a file's started event comes before its done or failed event. Events
+	// of different files interleave. If the function can't keep up events are dropped rather than slowing
+	// down the patcher. All events have been delivered when the Run function returns. Files whose checksum
+	// is known from the manifest don't get verify events.
+	OnFileEvent func(FileEvent)
 }
 
 // Helper tuple for measuring a file.
@@ -50,39 +218,317 @@ type measuredFile struct {
 	filename string
 	checksum string
 	modTime  time.Time
+	// Only set if the region checksum was computed, see PatcherConfig.ParallelHashThreshold.
+	regionChecksum string
+}
+
+// withSettings adds the settings that are passed to the phases through the context to ctx.
+func (c PatcherConfig) withSettings(ctx context.Context) context.Context {
+	ctx = withCopyBufferSize(ctx, c.CopyBufferSize)
+	// Uses the buffer size.
+	ctx = withHashBudget(ctx, c.MaxHashMemory)
+	return WithHasher(ctx, NewHasher(c.NewHash))
+}
+
+// A PhaseError is returned by RunPatcher when one of the phases fails.
+type PhaseError struct {
+	// The phase that failed.
+	Phase Phase
+	// The underlying error.
+	Err error
+}
+
+// Error implements (error).Error
+func (e *PhaseError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *PhaseError) Unwrap() error {
+	return e.Err
+}
+
+// A FileError is the error for a single file that failed in one of the phases, e.g. a patch that couldn't be
+// downloaded. Failures that aren't about one file (e.g. the install dir can't be scanned) aren't FileErrors.
+type FileError struct {
+	// The file relative to the install dir, with forward slashes. For the download phase that's the patch
+	// file (e.g. "patch/<hash>"), otherwise the game file.
+	Path string
+	// The phase the file failed in.
+	Phase Phase
+	// The underlying error.
+	Err error
+}
+
+// Error implements (error).Error
+func (e *FileError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// fileError returns a FileError for a file that failed, nil if err is nil.
+func fileError(phase Phase, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &FileError{Path: path, Phase: phase, Err: err}
+}
+
+// verifiedPatches keeps track of patch files whose checksum was verified during this run.
+type verifiedPatches struct {
+	mu sync.Mutex
+	// Checksum of the patch file, keyed by patch path relative to the install dir.
+	checksums map[string]string
+}
+
+func newVerifiedPatches() *verifiedPatches {
+	return &verifiedPatches{checksums: make(map[string]string)}
+}
+
+// add records that a patch file has the given checksum.
+func (vp *verifiedPatches) add(patchPath string, checksum string) {
+	vp.mu.Lock()
+	defer vp.mu.Unlock()
+	vp.checksums[patchPath] = checksum
+}
+
+// has returns true iff the patch file is known to have the given checksum.
+func (vp *verifiedPatches) has(patchPath string, checksum string) bool {
+	vp.mu.Lock()
+	defer vp.mu.Unlock()
+	known, found := vp.checksums[patchPath]
+	return found && HashEqual(known, checksum)
+}
+
+// verifyPatchFile checks that the patch file for an update has the expected checksum,
+// unless it was already verified during this run.
+func verifyPatchFile(ctx context.Context, installDir string, ui UpdateInstr, verified *verifiedPatches) error {
+	if verified.has(ui.PatchPath, ui.PatchChecksum) {
+		return nil
+	}
+	patchPath := filepath.Join(installDir, ui.PatchPath)
+	LogVerbose(ctx, "Verifying checksum of patch file '%s'.", patchPath)
+	file, err := os.Open(patchPath)
+	if err != nil {
+		return fmt.Errorf("failed to open patch file '%s' to verify checksum: %w", patchPath, err)
+	}
+	defer file.Close()
+	checksum, err := hasher(ctx).HashReader(ctx, file)
+	if err != nil {
+		return fmt.Errorf("failed to compute checksum of patch file '%s': %w", patchPath, err)
+	}
+	if !HashEqual(checksum, ui.PatchChecksum) {
+		return fmt.Errorf("patch file '%s' is corrupt, expected checksum %s but got %s",
+			patchPath, strings.ToUpper(ui.PatchChecksum), strings.ToUpper(checksum))
+	}
+	// Multiple files can use the same patch, no need to check it again.
+	verified.add(ui.PatchPath, ui.PatchChecksum)
+	return nil
+}
+
+// applyPatch applies the patch of an update to get the temporary file.
+func applyPatch(
+	ctx context.Context,
+	installDir string,
+	ui UpdateInstr,
+	manifest *Manifest,
+	backend PatchBackend,
+	progress *ProgressTracker,
+	verifyPatches bool,
+	verified *verifiedPatches,
+	timeout time.Duration,
+) (retErr error) {
+	patchPath := filepath.Join(installDir, ui.PatchPath)
+	newPath := filepath.Join(installDir, ui.TempFilename)
+	LogVerbose(ctx, "Applying patch '%s' to get '%s'.", patchPath, newPath)
+	progress.PhaseItemStarted(PhaseApply)
+	progress.fileEvent(FileApplyStarted, PhaseApply, ui.FilePath)
+	defer func() {
+		progress.PhaseItemDone(PhaseApply, retErr)
+		// Success is reported once the file is moved into place.
+		if retErr != nil {
+			progress.fileFailed(PhaseApply, ui.FilePath, retErr)
+		}
+	}()
+	if verifyPatches {
+		if err := verifyPatchFile(ctx, installDir, ui, verified); err != nil {
+			return err
+		}
+	}
+	if ui.IsDelta {
+		if err := checkDeltaSource(ctx, installDir, ui, manifest); err != nil {
+			return err
+		}
+	}
+
+	applyCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		applyCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var err error
+	if ui.IsDelta {
+		oldPath := filepath.Join(installDir, ui.FilePath)
+		err = backend.ApplyPatch(applyCtx, &oldPath, patchPath, newPath, ui.Checksum, ui.Size)
+	} else {
+		err = backend.ApplyPatch(applyCtx, nil, patchPath, newPath, ui.Checksum, ui.Size)
+	}
+	if err != nil && ctx.Err() == nil && errors.Is(applyCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("applying patch '%s' to get '%s' took longer than %s, giving up: %w",
+			patchPath, newPath, timeout, err)
+	}
+	return err
+}
+
+// patchTargetMatches returns whether the file to be patched already has the checksum it should have after
+// patching, e.g. because it was patched by an earlier run that was interrupted before writing the manifest.
+func patchTargetMatches(ctx context.Context, installDir string, ui UpdateInstr, manifest *Manifest) (bool, error) {
+	return installedFileHasChecksum(ctx, installDir, ui.FilePath, ui.Checksum, ui.Size, manifest)
+}
+
+// checkDeltaSource checks that the file a delta patch is applied to has the checksum the patch was made for.
+// Otherwise (e.g. an interrupted run left a different version in place) xdelta would fail cryptically.
+func checkDeltaSource(ctx context.Context, installDir string, ui UpdateInstr, manifest *Manifest) error {
+	if ui.OldHash == "" {
+		return nil // Unknown, let the patch backend find out.
+	}
+	matches, err := installedFileHasChecksum(ctx, installDir, ui.FilePath, ui.OldHash, 0, manifest)
+	if err != nil {
+		return err
+	}
+	if !matches {
+		return fmt.Errorf("'%s' doesn't have checksum %s needed for delta patch '%s', it probably changed "+
+			"since it was verified, running the patcher again will use a full patch instead",
+			filepath.Join(installDir, ui.FilePath), strings.ToUpper(ui.OldHash), ui.PatchPath)
+	}
+	return nil
+}
+
+// installedFileHasChecksum returns whether a file in the install dir exists and has the checksum.
+// The manifest is trusted if it knows the file, otherwise the checksum is computed.
+func installedFileHasChecksum(
+	ctx context.Context,
+	installDir string,
+	filename string,
+	checksum string,
+	size int64,
+	manifest *Manifest,
+) (bool, error) {
+	realPath := filepath.Join(installDir, filename)
+	fileInfo, err := os.Stat(realPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get basic metadata of '%s': %w", realPath, err)
+	}
+	if known, found := manifest.Get(filename, fileInfo.ModTime()); found {
+		return HashEqual(known, checksum), nil
+	}
+	return fileHasChecksum(ctx, realPath, checksum, size)
+}
+
+// fileHasChecksum returns whether a file exists and has the checksum. If size isn't 0 files of a different
+// size are rejected without computing the checksum.
+func fileHasChecksum(ctx context.Context, filename string, checksum string, size int64) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to open '%s' to compute checksum: %w", filename, err)
+	}
+	defer file.Close()
+	if size != 0 {
+		fileInfo, err := file.Stat()
+		if err != nil {
+			return false, fmt.Errorf("failed to get basic metadata of '%s': %w", filename, err)
+		}
+		if fileInfo.Size() != size {
+			return false, nil
+		}
+	}
+	LogVerbose(ctx, "Computing checksum of '%s'.", filename)
+	actual, err := hasher(ctx).HashReader(ctx, file)
+	if err != nil {
+		return false, fmt.Errorf("failed to compute checksum of '%s': %w", filename, err)
+	}
+	return HashEqual(actual, checksum), nil
 }
 
 // runVerifyPhase runs the entire verification phase.
-// It returns the actions to be taken in later phases.
+// It returns the actions to be taken in later phases. If downloads isn't nil the patch files to download are
+// also sent on it as soon as they're known, so the download phase can start before all files are measured. It
+// should have room for a patch file per instruction, so measuring never waits for the download phase.
+// The delete count is checked before anything is measured or sent. Then onPlanned (if not nil) gets the
+// actions for the worst case, see worstCaseActions.
 func runVerifyPhase(
 	ctx context.Context,
 	instructions []Instruction,
 	manifest *Manifest,
 	installDir string,
+	foldCase bool,
+	checkScanCount func(found int, expected int) error,
+	checkDeleteCount func(toDelete int, managed int) error,
+	skipScanErrors bool,
+	forceRehash bool,
+	changedSince time.Time,
 	numWorkers int,
+	parallelHashThreshold int64,
+	throttle *Throttle,
 	progress *ProgressTracker,
 	emitProgress func(),
+	downloads chan<- DownloadInstr,
+	onPlanned func(worstCase *DeterminedActions),
 ) (*DeterminedActions, error) {
 	progress.PhaseStarted(PhaseVerify)
 	log.Printf("Scanning files in installation directory '%s'.", installDir)
 
-	// Unlikely, but I've observed some funky flip flopping when I accidentally triggered this.
-	// Granted, it was with a slightly messy manually edited instructions file but if it happens
-	// on a player's computer it'll be very annoying to debug and the check is cheap enough.
-	filesSeen := make(map[string]struct{})
-	for _, instr := range instructions {
-		if _, found := filesSeen[instr.Path]; found {
-			return nil, fmt.Errorf("got multiple entries for '%s' in instructions.json", instr.Path)
-		}
-		filesSeen[instr.Path] = struct{}{}
+	if err := checkDuplicatePaths(instructions, foldCase); err != nil {
+		return nil, err
 	}
 
-	existingFiles, err := ScanFiles(installDir)
-	if err != nil {
-		return nil, err // ScanFiles adds enough context, no need for fmt.Errorf
+	progress.ScanProgress(0)
+	var existingFiles map[string]BasicFileInfo
+	var skippedPaths []string
+	if installDirMissing(installDir) {
+		// A real run creates the install dir first, a dry run doesn't. Either way it's an empty install.
+		existingFiles, skippedPaths = make(map[string]BasicFileInfo), make([]string, 0)
+	} else {
+		var err error
+		existingFiles, skippedPaths, err = scanFiles(os.DirFS(installDir), installDir, progress.ScanProgress,
+			skipScanErrors)
+		if err != nil {
+			return nil, err // scanFiles adds enough context, no need for fmt.Errorf
+		}
+	}
+	progress.ScanDone()
+	if err := checkScanCount(len(existingFiles), len(instructions)); err != nil {
+		return nil, err
 	}
 
-	toMeasure, manifestChecksums := DetermineFilesToMeasure(instructions, manifest, existingFiles)
+	measureManifest := manifest
+	if forceRehash {
+		log.Printf("Not trusting the manifest, computing checksums of all files.")
+		measureManifest = NewManifest(manifest.Product)
+		changedSince = time.Time{}
+		parallelHashThreshold = 0
+	}
+	toMeasure, manifestChecksums := DetermineFilesToMeasure(instructions, measureManifest, existingFiles)
+	if !changedSince.IsZero() {
+		var trusted map[string]string
+		toMeasure, trusted = filterChangedSince(toMeasure, manifest, existingFiles, changedSince)
+		log.Printf("Only verifying files changed since %s, trusting the manifest for %d older files.",
+			changedSince.Format(time.RFC3339), len(trusted))
+		for k, v := range trusted {
+			manifestChecksums[k] = v
+		}
+	}
 	log.Printf("Computing checksums of %d files, %d checksums already known from manifest.",
 		len(toMeasure), len(manifestChecksums))
 
@@ -90,28 +536,69 @@ func runVerifyPhase(
 	// Force out progres at this point. It looks a lot nicer UI wise.
 	emitProgress()
 	progress.PhaseItemsSkipped(PhaseVerify, len(manifestChecksums))
+
+	// The actions for files that don't have to be measured are known right away, those for the other files
+	// as soon as they're measured.
+	builder := newActionsBuilder()
+	var builderMu sync.Mutex
+	toMeasureInstrs := make(map[string][]int, len(toMeasure)) // Indices in instructions by path.
+	for _, filename := range toMeasure {
+		toMeasureInstrs[filename] = nil
+	}
+	var newDownloads []DownloadInstr
+	for instrIdx, instr := range instructions {
+		if _, found := toMeasureInstrs[instr.Path]; found {
+			toMeasureInstrs[instr.Path] = append(toMeasureInstrs[instr.Path], instrIdx)
+			continue
+		}
+		_, found := existingFiles[instr.Path]
+		if di, isNew := builder.add(instrIdx, instr, found, manifestChecksums[instr.Path]); isNew {
+			newDownloads = append(newDownloads, di)
+		}
+	}
+	// Delete instructions don't need measuring, so what gets deleted is known at this point.
+	managed := 0
+	for _, instr := range instructions {
+		if _, found := existingFiles[instr.Path]; found {
+			managed++
+		}
+	}
+	if err := checkDeleteCount(len(builder.toDelete), managed); err != nil {
+		return nil, err
+	}
+	if onPlanned != nil {
+		worstCase := worstCaseActions(instructions, existingFiles, manifestChecksums, toMeasureInstrs)
+		onPlanned(&worstCase)
+	}
+	if err := sendDownloads(ctx, downloads, newDownloads); err != nil {
+		return nil, err
+	}
+
 	measuredFiles, err := DoInParallelWithResult[string, measuredFile](
 		ctx,
 		func(ctx context.Context, filename string) (mf measuredFile, retErr error) {
-			realFilename := filepath.Join(installDir, filename)
-			LogVerbose(ctx, "Computing checksum of '%s'.", realFilename)
-			progress.PhaseItemStarted(PhaseVerify)
-			defer progress.PhaseItemDone(PhaseVerify, retErr)
-			file, err := os.Open(realFilename)
-			if err != nil {
-				return measuredFile{}, fmt.Errorf("failed to open '%s' to compute checksum: %w", realFilename, err)
+			if err := throttle.waitWhilePaused(ctx); err != nil {
+				return measuredFile{}, err
 			}
-			defer file.Close()
-			fileInfo, err := file.Stat()
+			progress.PhaseItemStarted(PhaseVerify)
+			progress.fileEvent(FileVerifyStarted, PhaseVerify, filename)
+			defer func() {
+				progress.PhaseItemDone(PhaseVerify, retErr)
+				progress.fileDone(FileVerified, PhaseVerify, filename, retErr)
+			}()
+			mf, err := measureFile(ctx, installDir, filename, manifest, parallelHashThreshold, numWorkers)
 			if err != nil {
-				return measuredFile{}, fmt.Errorf("failed to get basic metadata of '%s': %w", realFilename, err)
+				return mf, fileError(PhaseVerify, filename, err)
 			}
-			checksum, err := HashReader(ctx, file)
-			if err != nil {
-				return measuredFile{}, fmt.Errorf("failed to compute checksum of '%s': %w", realFilename, err)
+			var newDownloads []DownloadInstr
+			builderMu.Lock()
+			for _, instrIdx := range toMeasureInstrs[filename] {
+				if di, isNew := builder.add(instrIdx, instructions[instrIdx], true, mf.checksum); isNew {
+					newDownloads = append(newDownloads, di)
+				}
 			}
-
-			return measuredFile{filename, checksum, fileInfo.ModTime()}, nil
+			builderMu.Unlock()
+			return mf, sendDownloads(ctx, downloads, newDownloads)
 		},
 		toMeasure,
 		numWorkers,
@@ -119,16 +606,19 @@ func runVerifyPhase(
 	if err != nil {
 		return nil, err
 	}
-	checksums := make(map[string]string, len(toMeasure))
-	// Checksums we know from the manifest count as well.
-	for k, v := range manifestChecksums {
-		checksums[k] = v
-	}
 	for _, mf := range measuredFiles {
-		checksums[mf.filename] = mf.checksum
 		manifest.Add(mf.filename, mf.modTime, mf.checksum)
+		if mf.regionChecksum != "" {
+			manifest.SetRegionChecksum(mf.filename, mf.regionChecksum)
+		}
+	}
+	actions := builder.actions()
+	actions.SkippedScanPaths = skippedPaths
+	if actions.FullDownloadSize > 0 {
+		log.Printf("Need to download %d bytes of patches, %d bytes without delta patches (%.1f%% saved).",
+			actions.DownloadSize, actions.FullDownloadSize, actions.DeltaSavings())
 	}
-	actions := DetermineActions(instructions, manifest, existingFiles, checksums)
+	progress.SetDownloadSizes(actions.DownloadSize, actions.FullDownloadSize)
 	progress.PhaseDone(PhaseVerify)
 	// At this point we can report how many download and apply actions will be needed.
 	progress.PhaseSetNeeded(PhaseDownload, len(actions.ToDownload))
@@ -136,42 +626,206 @@ func runVerifyPhase(
 	return &actions, nil
 }
 
+// worstCaseActions returns actions that need at least as much as the real ones, whatever the files that still have
+// to be measured (the keys of toMeasure) turn out to contain: those files are updated and both their full and their
+// delta patch (if any) are downloaded. A delta patch isn't necessarily smaller than the full patch and files
+// sharing a full patch can each need their own delta patch, so counting only one of them isn't enough.
+func worstCaseActions(
+	instructions []Instruction,
+	existingFiles map[string]BasicFileInfo,
+	manifestChecksums map[string]string,
+	toMeasure map[string][]int,
+) DeterminedActions {
+	builder := newActionsBuilder()
+	for instrIdx, instr := range instructions {
+		if _, found := toMeasure[instr.Path]; found {
+			builder.add(instrIdx, instr, false, "")
+			if instr.DeltaHash != nil {
+				builder.add(instrIdx, instr, true, instr.OldHash)
+			}
+			continue
+		}
+		_, found := existingFiles[instr.Path]
+		builder.add(instrIdx, instr, found, manifestChecksums[instr.Path])
+	}
+	return builder.actions()
+}
+
+// sendDownloads sends patch files to download on downloads, unless that's nil.
+func sendDownloads(ctx context.Context, downloads chan<- DownloadInstr, toSend []DownloadInstr) error {
+	if downloads == nil {
+		return nil
+	}
+	for _, di := range toSend {
+		select {
+		case downloads <- di:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// measureFile computes the checksum of a file in the install dir. For files of at least parallelHashThreshold
+// bytes (unless that's 0) the region checksum is computed first by numWorkers workers. If it matches the
+// manifest the checksum from the manifest is used, as the contents didn't change.
+func measureFile(
+	ctx context.Context,
+	installDir string,
+	filename string,
+	manifest *Manifest,
+	parallelHashThreshold int64,
+	numWorkers int,
+) (measuredFile, error) {
+	realFilename := filepath.Join(installDir, filename)
+	LogVerbose(ctx, "Computing checksum of '%s'.", realFilename)
+	file, err := os.Open(realFilename)
+	if err != nil {
+		return measuredFile{}, fmt.Errorf("failed to open '%s' to compute checksum: %w", realFilename, err)
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return measuredFile{}, fmt.Errorf("failed to get basic metadata of '%s': %w", realFilename, err)
+	}
+
+	regionChecksum := ""
+	if parallelHashThreshold > 0 && fileInfo.Size() >= parallelHashThreshold {
+		regionChecksum, err = hasher(ctx).HashFileRegions(ctx, file, fileInfo.Size(), numWorkers)
+		if err != nil {
+			return measuredFile{}, fmt.Errorf("failed to compute region checksum of '%s': %w", realFilename, err)
+		}
+		if checksum, found := manifest.GetByRegionChecksum(filename, regionChecksum); found {
+			LogVerbose(ctx, "Region checksum of '%s' matches the manifest, not computing full checksum.",
+				realFilename)
+			return measuredFile{filename, checksum, fileInfo.ModTime(), regionChecksum}, nil
+		}
+	}
+
+	checksum, err := hasher(ctx).HashReader(ctx, file)
+	if err != nil {
+		return measuredFile{}, fmt.Errorf("failed to compute checksum of '%s': %w", realFilename, err)
+	}
+	return measuredFile{filename, checksum, fileInfo.ModTime(), regionChecksum}, nil
+}
+
 func runDownloadPhase(
 	ctx context.Context,
 	toDownload []DownloadInstr,
 	installDir string,
-	baseUrl *url.URL,
+	baseUrls []*url.URL,
 	downloadConfig DownloadConfig,
 	progress *ProgressTracker,
 	numWorkers int,
+	rampUp time.Duration,
+	throttle *Throttle,
+	verified *verifiedPatches,
+	maxTotalSize int64,
+	streamer *fullPatchStreamer,
+) error {
+	if err := checkTotalDownloadSize(toDownload, maxTotalSize); err != nil {
+		return err
+	}
+
+	log.Printf("Downloading %d patch files.", len(toDownload))
+	downloads := make(chan DownloadInstr, len(toDownload))
+	for _, di := range toDownload {
+		downloads <- di
+	}
+	close(downloads)
+	return downloadPatches(ctx, downloads, installDir, baseUrls, downloadConfig, progress, numWorkers, rampUp,
+		throttle, verified, maxTotalSize, streamer)
+}
+
+// checkTotalDownloadSize returns an error if the patch files add up to more than maxTotalSize bytes (unless that's 0).
+func checkTotalDownloadSize(toDownload []DownloadInstr, maxTotalSize int64) error {
+	var totalSize int64
+	for _, di := range toDownload {
+		totalSize += di.Size
+	}
+	if maxTotalSize > 0 && totalSize > maxTotalSize {
+		return fmt.Errorf("refusing to download %d bytes of patches, that's more than the maximum of %d bytes",
+			totalSize, maxTotalSize)
+	}
+	return nil
+}
+
+// downloadPatches downloads the patch files received on downloads until it's closed, as the download phase.
+// Like runDownloadPhase it refuses to download more than maxTotalSize bytes in total (unless that's 0), but
+// as the patch files aren't known up front that's only noticed once the total gets over it.
+func downloadPatches(
+	ctx context.Context,
+	downloads <-chan DownloadInstr,
+	installDir string,
+	baseUrls []*url.URL,
+	downloadConfig DownloadConfig,
+	progress *ProgressTracker,
+	numWorkers int,
+	rampUp time.Duration,
+	throttle *Throttle,
+	verified *verifiedPatches,
+	maxTotalSize int64,
+	streamer *fullPatchStreamer,
 ) error {
 	// Stop the downloader automatically.
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	if downloadConfig.NewHash == nil {
+		downloadConfig.NewHash = hasher(ctx).newHash
+	}
+	if downloadConfig.CopyBufferSize == 0 {
+		downloadConfig.CopyBufferSize = copyBufferSize(ctx)
+	}
+	if downloadConfig.MaxIdleConnsPerHost == 0 {
+		downloadConfig.MaxIdleConnsPerHost = numWorkers * max(downloadConfig.ConnectionsPerFile, 1)
+	}
 	downloader := NewDownloader(downloadConfig, func(stats DownloadStats) {
 		progress.UpdateDownloadStats(stats)
 	}, ctx)
+	downloader.throttle = throttle
 
-	log.Printf("Downloading %d patch files.", len(toDownload))
 	progress.PhaseStarted(PhaseDownload)
-	err := DoInParallel(
+	limiter := throttle.newLimiter(numWorkers)
+	defer throttle.forget(limiter)
+	stopRampUp := throttle.rampUp(limiter, numWorkers, rampUp)
+	defer stopRampUp()
+	var totalSize atomic.Int64
+	err := DoInParallelChan(
 		ctx,
 		func(ctx context.Context, di DownloadInstr) (retErr error) {
-			remoteUrl := baseUrl.JoinPath(di.RemotePath)
+			if total := totalSize.Add(di.Size); maxTotalSize > 0 && total > maxTotalSize {
+				return fmt.Errorf("refusing to download more than %d bytes of patches", maxTotalSize)
+			}
+			remoteUrls := make([]*url.URL, len(baseUrls))
+			for i, baseUrl := range baseUrls {
+				remoteUrls[i] = baseUrl.JoinPath(di.RemotePath)
+			}
+			remoteUrl := remoteUrls[0]
 			LogVerbose(ctx, "Downloading '%s'.", remoteUrl)
 			progress.PhaseItemStarted(PhaseDownload)
-			defer progress.PhaseItemDone(PhaseDownload, retErr)
-			return downloader.DownloadFile(
+			progress.fileEvent(FileDownloadStarted, PhaseDownload, di.LocalPath)
+			defer func() {
+				progress.PhaseItemDone(PhaseDownload, retErr)
+				progress.fileDone(FileDownloaded, PhaseDownload, di.LocalPath, retErr)
+			}()
+			if streamer.stream(ctx, downloader, remoteUrl, di) {
+				return nil
+			}
+			err := downloader.DownloadFileMirrors(
 				ctx,
-				remoteUrl,
+				remoteUrls,
 				filepath.Join(installDir, di.LocalPath),
 				di.Checksum,
 				di.Size,
 			)
+			if err == nil {
+				verified.add(di.LocalPath, di.Checksum)
+			}
+			return fileError(PhaseDownload, di.LocalPath, err)
 		},
-		toDownload,
-		numWorkers,
+		downloads,
+		limiter,
 	)
 	if err != nil {
 		return err
@@ -186,87 +840,536 @@ func runPatchPhase(
 	toDelete []string,
 	manifest *Manifest,
 	installDir string,
-	xdelta *XDelta,
+	backend PatchBackend,
 	progress *ProgressTracker,
 	numWorkers int,
+	throttle *Throttle,
+	verifyPatches bool,
+	verifyAfterMove bool,
+	verified *verifiedPatches,
+	applyTimeout time.Duration,
+	atomic bool,
 ) error {
 	log.Printf("Patching %d files.", len(toUpdate))
 	progress.PhaseStarted(PhaseApply)
-	err := DoInParallel(
+	limiter := throttle.newLimiter(numWorkers)
+	defer throttle.forget(limiter)
+	applied := readApplyProgress(installDir)
+	defer applied.close()
+	recordApplied := func(ui UpdateInstr) {
+		if err := applied.record(installDir, ui); err != nil {
+			log.Printf("Warning: %s, an interrupted run will have to check '%s' again.", err, ui.TempFilename)
+		}
+	}
+	inPlace, err := DoInParallelWithLimiter(
 		ctx,
-		func(ctx context.Context, ui UpdateInstr) (retErr error) {
+		func(ctx context.Context, ui UpdateInstr) (bool, error) {
 			patchPath := filepath.Join(installDir, ui.PatchPath)
 			newPath := filepath.Join(installDir, ui.TempFilename)
-			LogVerbose(ctx, "Applying patch '%s' to get '%s'.", patchPath, newPath)
-			progress.PhaseItemStarted(PhaseApply)
-			defer progress.PhaseItemDone(PhaseApply, retErr)
-			if ui.IsDelta {
-				oldPath := filepath.Join(installDir, ui.FilePath)
-				return xdelta.ApplyPatch(ctx, &oldPath, patchPath, newPath, ui.Checksum, ui.Size)
-			} else {
-				return xdelta.ApplyPatch(ctx, nil, patchPath, newPath, ui.Checksum, ui.Size)
+			// An earlier interrupted run may have done the work already, or the download phase (see
+			// StreamFullPatches).
+			if applied.isApplied(installDir, ui) {
+				LogVerbose(ctx, "Skipping patch '%s', it was already applied.", patchPath)
+				progress.PhaseItemsSkipped(PhaseApply, 1)
+				return false, nil
+			}
+			if matches, err := patchTargetMatches(ctx, installDir, ui, manifest); err != nil || matches {
+				if matches {
+					LogVerbose(ctx, "Skipping patch '%s', '%s' is already up to date.", patchPath, ui.FilePath)
+					progress.PhaseItemsSkipped(PhaseApply, 1)
+				}
+				return matches, fileError(PhaseApply, ui.FilePath, err)
+			}
+			if matches, err := fileHasChecksum(ctx, newPath, ui.Checksum, ui.Size); err != nil || matches {
+				if matches {
+					LogVerbose(ctx, "Skipping patch '%s', '%s' already exists.", patchPath, newPath)
+					progress.PhaseItemsSkipped(PhaseApply, 1)
+					recordApplied(ui)
+				}
+				return false, fileError(PhaseApply, ui.FilePath, err)
 			}
+			if err := applyPatch(ctx, installDir, ui, manifest, backend, progress, verifyPatches, verified,
+				applyTimeout); err != nil {
+				return false, fileError(PhaseApply, ui.FilePath, err)
+			}
+			recordApplied(ui)
+			return false, nil
 		},
 		toUpdate,
-		numWorkers,
+		limiter,
 	)
 	if err != nil {
 		return err
 	}
 
 	log.Printf("Moving %d patched files into place.", len(toUpdate))
-	for _, ui := range toUpdate {
-		tempPath := filepath.Join(installDir, ui.TempFilename)
-		realPath := filepath.Join(installDir, ui.FilePath)
+	rollback := newApplyRollback(installDir, manifest, atomic)
+	for i, ui := range toUpdate {
+		if err := moveIntoPlace(ctx, installDir, ui, inPlace[i], verifyAfterMove, manifest, rollback); err != nil {
+			progress.fileFailed(PhaseApply, ui.FilePath, err)
+			rollback.rollback()
+			return fileError(PhaseApply, ui.FilePath, err)
+		}
+		progress.fileEvent(FileApplied, PhaseApply, ui.FilePath)
+	}
+
+	if len(toDelete) > 0 {
+		log.Printf("Deleting %d obsolete files.", len(toDelete))
+	}
+	for _, path := range toDelete {
+		realPath := filepath.Join(installDir, path)
+		LogVerbose(ctx, "Removing obsolete file '%s'.", realPath)
+		var err error
+		if rollback != nil {
+			err = rollback.backup(ctx, path)
+		} else if err = removeLockedFile(ctx, realPath); err != nil {
+			err = fmt.Errorf("failed to remove file '%s': %w", realPath, err)
+		}
+		if err != nil {
+			progress.fileFailed(PhaseApply, path, err)
+			rollback.rollback()
+			return fileError(PhaseApply, path, err)
+		}
+		progress.fileEvent(FileDeleted, PhaseApply, path)
+	}
+	if err := rollback.discard(); err != nil {
+		// The update itself succeeded, the backups are removed with the patch dir at the latest.
+		log.Printf("Warning: %s.", err)
+	}
+
+	progress.PhaseDone(PhaseApply)
+	return nil
+}
+
+// moveIntoPlace moves a patched file into place (unless it's already in place) and adds it to the manifest.
+// With verify set the checksum of a moved file is checked again first. The original file is backed up with
+// rollback, which may be nil.
+func moveIntoPlace(
+	ctx context.Context,
+	installDir string,
+	ui UpdateInstr,
+	inPlace bool,
+	verify bool,
+	manifest *Manifest,
+	rollback *applyRollback,
+) error {
+	tempPath := filepath.Join(installDir, ui.TempFilename)
+	realPath := filepath.Join(installDir, ui.FilePath)
+	if !inPlace {
 		LogVerbose(ctx, "Moving '%s' to '%s'.", tempPath, realPath)
 		realDir := filepath.Dir(realPath)
 		if err := os.MkdirAll(realDir, 0755); err != nil {
 			return fmt.Errorf("failed to ensure directories for patched file '%s' exist: %w", realPath, err)
 		}
-		if err := os.Rename(tempPath, realPath); err != nil {
+		if err := rollback.backup(ctx, ui.FilePath); err != nil {
+			return err
+		}
+		if err := retryLockedFile(ctx, realPath, func() error { return os.Rename(tempPath, realPath) }); err != nil {
 			return fmt.Errorf("failed to move patched file '%s' to '%s': %w", tempPath, realPath, err)
 		}
-		fileInfo, err := os.Stat(realPath)
+		rollback.moved()
+	}
+	if verify && !inPlace {
+		matches, err := fileHasChecksum(ctx, realPath, ui.Checksum, ui.Size)
 		if err != nil {
-			return fmt.Errorf("failed to get basic metadata of '%s': %w", realPath, err)
+			return err
 		}
+		if !matches {
+			// Not added to the manifest, so the next run computes the checksum and patches it again.
+			return fmt.Errorf("patched file '%s' no longer has checksum %s after moving it into place",
+				realPath, strings.ToUpper(ui.Checksum))
+		}
+	}
+	fileInfo, err := os.Stat(realPath)
+	if err != nil {
+		return fmt.Errorf("failed to get basic metadata of '%s': %w", realPath, err)
+	}
 
-		// File hash is checked during xdelta operations, so it should be safe to add this to the manifest.
-		manifest.Add(ui.FilePath, fileInfo.ModTime(), ui.Checksum)
+	// File hash is checked when applying patches, so it should be safe to add this to the manifest.
+	manifest.Add(ui.FilePath, fileInfo.ModTime(), ui.Checksum)
+	return nil
+}
+
+// RunVerify runs only the verify phase: it scans the install dir and computes checksums where the manifest
+// doesn't have them. Returns the actions needed to bring the install dir up to date, to be passed to
+// RunDownload and RunApply. The manifest (see ReadManifest) is updated with the computed checksums and
+// must be passed to RunApply as well.
+//
+// The progress tracker may be nil. The ProgressFunc in the config is not used, call progress.Current when
+// progress is needed.
+func RunVerify(
+	ctx context.Context,
+	instructions []Instruction,
+	manifest *Manifest,
+	config PatcherConfig,
+	progress *ProgressTracker,
+) (*DeterminedActions, error) {
+	if err := checkNumWorkers("VerifyWorkers", config.VerifyWorkers); err != nil {
+		return nil, err
+	}
+	ctx = config.withSettings(ctx)
+	if progress == nil {
+		progress = NewProgress()
+	}
+	defer progress.startFileEvents(config.OnFileEvent)()
+	foldCase, err := config.PathCase.foldsCase(config.InstallDir)
+	if err != nil {
+		return nil, err
 	}
+	return runVerifyPhase(ctx, instructions, manifest, config.InstallDir, foldCase, config.checkScanCount,
+		config.checkDeleteCount, config.SkipScanErrors, config.ForceRehash, config.ChangedSince,
+		config.VerifyWorkers, config.ParallelHashThreshold, config.Throttle, progress, func() {}, nil, nil)
+}
 
-	if len(toDelete) > 0 {
-		log.Printf("Deleting %d obsolete files.", len(toDelete))
+// RunDownload runs only the download phase, downloading the patch files needed for actions
+// (as returned by RunVerify). First it checks there's enough free disk space for the download and apply
+// phases (see SkipSpaceCheck). The progress tracker may be nil.
+func RunDownload(
+	ctx context.Context,
+	actions *DeterminedActions,
+	config PatcherConfig,
+	progress *ProgressTracker,
+) error {
+	if err := checkNumWorkers("DownloadWorkers", config.DownloadWorkers); err != nil {
+		return err
 	}
-	for _, path := range toDelete {
-		realPath := filepath.Join(installDir, path)
-		LogVerbose(ctx, "Removing obsolete file '%s'.", realPath)
-		if err := os.Remove(realPath); err != nil {
-			return fmt.Errorf("failed to remove file '%s': %w", realPath, err)
+	ctx = config.withSettings(ctx)
+	if progress == nil {
+		progress = NewProgress()
+	}
+	defer progress.startFileEvents(config.OnFileEvent)()
+	if err := createPatchDirs(config.InstallDir); err != nil {
+		return err
+	}
+	if err := config.checkDiskSpace(actions); err != nil {
+		return err
+	}
+	return runDownloadPhase(ctx, actions.ToDownload, config.InstallDir, config.baseUrls(), config.DownloadConfig,
+		progress, config.DownloadWorkers, config.DownloadRampUp, config.Throttle, newVerifiedPatches(),
+		config.MaxTotalDownloadSize, nil)
+}
+
+// RunApply runs only the apply phase: it applies the downloaded patches, deletes obsolete files and writes
+// the manifest. When done the patch dir is removed (unless KeepPatches is set). The actions and manifest should be
+// the ones used with RunVerify, the patches must have been downloaded with RunDownload. The progress tracker may
+// be nil.
+//
+// With VerifyPatches set all patch files are verified, as they may have been on disk for a while.
+func RunApply(
+	ctx context.Context,
+	actions *DeterminedActions,
+	manifest *Manifest,
+	config PatcherConfig,
+	progress *ProgressTracker,
+) error {
+	if err := checkNumWorkers("ApplyWorkers", config.ApplyWorkers); err != nil {
+		return err
+	}
+	ctx = config.withSettings(ctx)
+	if progress == nil {
+		progress = NewProgress()
+	}
+	defer progress.startFileEvents(config.OnFileEvent)()
+	backend, err := newPatchBackend(config)
+	if err != nil {
+		return err
+	}
+	if err := createPatchDirs(config.InstallDir); err != nil {
+		return err
+	}
+	return runApply(ctx, actions, manifest, config, backend, progress, newVerifiedPatches())
+}
+
+// runApply runs the apply phase and finishes up.
+func runApply(
+	ctx context.Context,
+	actions *DeterminedActions,
+	manifest *Manifest,
+	config PatcherConfig,
+	backend PatchBackend,
+	progress *ProgressTracker,
+	verified *verifiedPatches,
+) error {
+	err := runPatchPhase(
+		ctx,
+		actions.ToUpdate,
+		actions.ToDelete,
+		manifest,
+		config.InstallDir,
+		backend,
+		progress,
+		config.ApplyWorkers,
+		config.Throttle,
+		config.VerifyPatches,
+		config.VerifyAfterMove,
+		verified,
+		config.ApplyTimeout,
+		config.AtomicApply,
+	)
+	if err != nil {
+		return err
+	}
+
+	// This path is also hardcoded in the determination logic.
+	patchDir := filepath.Join(config.InstallDir, "patch")
+	if config.KeepPatches {
+		log.Printf("Operation successful, keeping directory with downloaded patches '%s'.", patchDir)
+	} else {
+		log.Printf("Operation successful, removing directory with downloaded patches '%s'.", patchDir)
+		if err := removePatchDir(config.InstallDir); err != nil {
+			return err
 		}
 	}
 
-	progress.PhaseDone(PhaseApply)
+	if err := config.manifestStore().Write(config.InstallDir, manifest); err != nil {
+		return err
+	}
+	return removeApplyProgress(config.InstallDir)
+}
+
+// finishDryRun writes the manifest with the checksums measured in the verify phase and reports the actions a real
+// run would take, see PatcherConfig.DryRun.
+func finishDryRun(config PatcherConfig, actions *DeterminedActions, manifest *Manifest) error {
+	// Nothing was measured in an install dir that doesn't exist, and it isn't created.
+	if !installDirMissing(config.InstallDir) {
+		if err := config.manifestStore().Write(config.InstallDir, manifest); err != nil {
+			return err
+		}
+	}
+	if err := config.checkDiskSpace(actions); err != nil {
+		log.Printf("WARNING: %s.", err)
+	}
+	if config.DryRunOutput != nil {
+		return actions.WriteReport(config.DryRunOutput)
+	}
+	var report strings.Builder
+	if err := actions.WriteReport(&report); err != nil {
+		return err
+	}
+	log.Printf("Dry run, nothing was downloaded, patched or deleted. A real run would:\n%s", report.String())
 	return nil
 }
 
-func RunPatcher(ctx context.Context, instructions []Instruction, config PatcherConfig) error {
+// removePatchDir removes the patch dir, except for quarantined downloads (see QuarantineDirname) which are
+// there to be inspected.
+func removePatchDir(installDir string) error {
+	patchDir := filepath.Join(installDir, "patch")
+	quarantineDir := filepath.Join(installDir, QuarantineDirname)
+	if quarantined, err := os.ReadDir(quarantineDir); err != nil || len(quarantined) == 0 {
+		if err := os.RemoveAll(patchDir); err != nil {
+			return fmt.Errorf("failed to remove patch dir '%s': %w", patchDir, err)
+		}
+		return nil
+	}
+	log.Printf("Keeping quarantined downloads in '%s'.", quarantineDir)
+	entries, err := os.ReadDir(patchDir)
+	if err != nil {
+		return fmt.Errorf("failed to read patch dir '%s': %w", patchDir, err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(patchDir, entry.Name())
+		if path == quarantineDir {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove '%s' from patch dir: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Below this many files more than expected the scan count is never considered suspicious,
+// small installs can have a few extra files (logs, settings) that would otherwise trip the ratio.
+const minSuspiciousExtraFiles = 1000
+
+// checkScanCount checks whether the install dir contains suspiciously many files compared to
+// the instructions, see MaxScanRatio.
+func (c PatcherConfig) checkScanCount(found int, expected int) error {
+	if c.MaxScanRatio <= 0 || found-expected < minSuspiciousExtraFiles ||
+		float64(found) <= c.MaxScanRatio*float64(expected) {
+		return nil
+	}
+	log.Printf("WARNING: install dir '%s' contains %d files but the instructions only contain %d files, "+
+		"is this really the right directory?", c.InstallDir, found, expected)
+	if c.ConfirmManyFiles != nil && !c.ConfirmManyFiles(found, expected) {
+		return fmt.Errorf("install dir '%s' contains %d files while only %d were expected, not continuing",
+			c.InstallDir, found, expected)
+	}
+	return nil
+}
+
+// Below this many deleted files the deletions are never considered suspicious, a small product can
+// legitimately replace most of its files.
+const minSuspiciousDeletes = 10
+
+// A MassDeleteError is returned when the instructions would delete a suspiciously large part of the game,
+// see PatcherConfig.MaxDeleteRatio.
+type MassDeleteError struct {
+	// The install dir.
+	Dir string
+	// Number of files the instructions would delete.
+	ToDelete int
+	// Number of files in the install dir the instructions mention.
+	Managed int
+}
+
+// Error implements (error).Error
+func (e *MassDeleteError) Error() string {
+	return fmt.Sprintf("the instructions would delete %d of the %d game files in '%s', not continuing",
+		e.ToDelete, e.Managed, e.Dir)
+}
+
+// checkDeleteCount checks whether the instructions would delete suspiciously many of the game files in the
+// install dir (managed), see MaxDeleteRatio.
+func (c PatcherConfig) checkDeleteCount(toDelete int, managed int) error {
+	if c.MaxDeleteRatio <= 0 || toDelete < minSuspiciousDeletes ||
+		float64(toDelete) <= c.MaxDeleteRatio*float64(managed) {
+		return nil
+	}
+	log.Printf("WARNING: the instructions would delete %d of the %d game files in install dir '%s', "+
+		"they may be broken or malicious.", toDelete, managed, c.InstallDir)
+	if !c.AllowMassDelete && !c.DryRun {
+		return &MassDeleteError{Dir: c.InstallDir, ToDelete: toDelete, Managed: managed}
+	}
+	return nil
+}
+
+// validate returns an error for settings RunPatcher can't work with. With 0 workers nothing would ever run,
+// so the patcher would hang. A progress interval that's not positive would make the progress ticker panic.
+func (c PatcherConfig) validate() error {
+	if err := checkNumWorkers("VerifyWorkers", c.VerifyWorkers); err != nil {
+		return err
+	}
+	if err := checkNumWorkers("DownloadWorkers", c.DownloadWorkers); err != nil {
+		return err
+	}
+	if err := checkNumWorkers("ApplyWorkers", c.ApplyWorkers); err != nil {
+		return err
+	}
+	if c.ProgressInterval <= 0 {
+		return fmt.Errorf("ProgressInterval must be positive, got %s", c.ProgressInterval)
+	}
+	return nil
+}
+
+// baseUrls returns BaseUrl followed by FallbackBaseUrls.
+func (c PatcherConfig) baseUrls() []*url.URL {
+	return append([]*url.URL{c.BaseUrl}, c.FallbackBaseUrls...)
+}
+
+// checkNumWorkers returns an error if a number of workers is less than 1.
+func checkNumWorkers(what string, numWorkers int) error {
+	if numWorkers < 1 {
+		return fmt.Errorf("%s must be at least 1, got %d", what, numWorkers)
+	}
+	return nil
+}
+
+// newPatchBackend returns the configured patch backend, xdelta if none is configured.
+func newPatchBackend(config PatcherConfig) (PatchBackend, error) {
+	if config.PatchBackend != nil {
+		return config.PatchBackend, nil
+	}
 	xdelta, err := NewXDelta(config.XDeltaBinPath)
 	if err != nil {
+		return nil, err
+	}
+	xdelta.KeepTemp = config.KeepTemp
+	return xdelta, nil
+}
+
+// createPatchDirs creates the directories for downloaded patches and patch output.
+func createPatchDirs(installDir string) error {
+	// These paths are also hardcoded in the determination logic.
+	patchApplyDir := filepath.Join(installDir, "patch/apply")
+	if err := os.MkdirAll(patchApplyDir, 0755); err != nil {
+		return fmt.Errorf("couldn't create patch and patch apply directories '%s': %w", patchApplyDir, err)
+	}
+	return nil
+}
+
+// ensureInstallDir checks that the install dir is a directory. If it doesn't exist yet it's created if create is
+// true, otherwise that's an error.
+func ensureInstallDir(installDir string, create bool) error {
+	info, err := os.Stat(installDir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("couldn't get basic metadata of install dir '%s': %w", installDir, err)
+		}
+		if !create {
+			return fmt.Errorf("install dir '%s' doesn't exist and creating it is disabled", installDir)
+		}
+		log.Printf("Creating install dir '%s'.", installDir)
+		if err := os.MkdirAll(installDir, 0755); err != nil {
+			return fmt.Errorf("couldn't create install dir '%s': %w", installDir, err)
+		}
+		return nil
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("install dir '%s' exists but is not a directory", installDir)
+	}
+	return nil
+}
+
+// installDirMissing returns whether the install dir doesn't exist (yet).
+func installDirMissing(installDir string) bool {
+	_, err := os.Stat(installDir)
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// manifestStore returns the configured manifest store, JSONManifestStore if none is configured.
+func (c PatcherConfig) manifestStore() ManifestStore {
+	if c.ManifestStore != nil {
+		return c.ManifestStore
+	}
+	return JSONManifestStore{}
+}
+
+// readConfigManifest reads the manifest for the product in the config.
+func readConfigManifest(config PatcherConfig) (*Manifest, error) {
+	return config.manifestStore().Read(config.InstallDir, config.Product, config.SharedInstallDir,
+		config.IgnoreManifestVersion)
+}
+
+// RunPatcher runs all phases, see RunVerify, RunDownload and RunApply. The install dir is created if it
+// doesn't exist yet, unless NoCreateInstallDir is set.
+func RunPatcher(ctx context.Context, instructions []Instruction, config PatcherConfig) error {
+	if err := config.validate(); err != nil {
 		return err
 	}
+	ctx = config.withSettings(ctx)
+	// A dry run on an install dir that doesn't exist yet reports a fresh install, without creating it.
+	if !config.DryRun || !installDirMissing(config.InstallDir) {
+		if err := ensureInstallDir(config.InstallDir, !config.NoCreateInstallDir && !config.DryRun); err != nil {
+			return err
+		}
+	}
 
-	manifest, err := ReadManifest(config.InstallDir, config.Product)
+	backend, err := newPatchBackend(config)
 	if err != nil {
 		return err
 	}
 
-	// These paths are also hardcoded in the determination logic.
-	patchDir := filepath.Join(config.InstallDir, "patch")
-	patchApplyDir := filepath.Join(config.InstallDir, "patch/apply")
+	manifest, err := readConfigManifest(config)
+	if err != nil {
+		return err
+	}
 
-	if err = os.MkdirAll(patchApplyDir, 0755); err != nil {
-		return fmt.Errorf("couldn't create patch and patch apply directories '%s': %w", patchApplyDir, err)
+	if !config.DryRun {
+		if err := createPatchDirs(config.InstallDir); err != nil {
+			return err
+		}
+	}
+
+	var foldCase bool
+	if config.DryRun {
+		// Probing writes a file, a dry run doesn't touch the install dir (which may not even exist).
+		foldCase = config.PathCase.foldsCaseWithoutProbe()
+	} else {
+		foldCase, err = config.PathCase.foldsCase(config.InstallDir)
+		if err != nil {
+			return err
+		}
 	}
 
 	// This dance ensures one progress message is sent out in the program even if it's immediately done.
@@ -281,74 +1384,220 @@ func RunPatcher(ctx context.Context, instructions []Instruction, config PatcherC
 	emitProgress := func() { emitProgresChan <- struct{}{} }
 
 	progress := NewProgress()
+	defer progress.startFileEvents(config.OnFileEvent)()
+	currentProgress := func() Progress {
+		p := progress.Current()
+		p.Paused = config.Throttle.Paused()
+		return p
+	}
 	go func() {
 		ticker := time.NewTicker(config.ProgressInterval)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				config.ProgressFunc(progress.Current())
+				config.ProgressFunc(currentProgress())
 			case <-emitProgresChan:
-				config.ProgressFunc(progress.Current())
+				config.ProgressFunc(currentProgress())
 			case <-ctx.Done():
 				// Report progress one last time, usually that's the "all completed" progress.
-				config.ProgressFunc(progress.Current())
+				config.ProgressFunc(currentProgress())
 				close(progressDone)
 				return
 			}
 		}
 	}()
 
-	actions, err := runVerifyPhase(
-		ctx,
-		instructions,
-		manifest,
-		config.InstallDir,
-		config.VerifyWorkers,
-		progress,
-		emitProgress,
-	)
-	if err != nil {
-		return err
-	}
-	emitProgress()
+	verified := newVerifiedPatches()
 
-	err = runDownloadPhase(
-		ctx,
-		actions.ToDownload,
-		config.InstallDir,
-		config.BaseUrl,
-		config.DownloadConfig,
-		progress,
-		config.DownloadWorkers,
-	)
-	if err != nil {
-		return err
+	var actions *DeterminedActions
+	if config.concurrentPhases() {
+		actions, err = runVerifyAndDownloadPhases(ctx, instructions, manifest, foldCase, config, progress,
+			emitProgress, verified)
+		if err != nil {
+			return err
+		}
+	} else {
+		actions, err = runVerifyPhase(
+			ctx,
+			instructions,
+			manifest,
+			config.InstallDir,
+			foldCase,
+			config.checkScanCount,
+			config.checkDeleteCount,
+			config.SkipScanErrors,
+			config.ForceRehash,
+			config.ChangedSince,
+			config.VerifyWorkers,
+			config.ParallelHashThreshold,
+			config.Throttle,
+			progress,
+			emitProgress,
+			nil,
+			nil,
+		)
+		if err != nil {
+			return &PhaseError{Phase: PhaseVerify, Err: err}
+		}
+		emitProgress()
+
+		if config.DryRun {
+			return finishDryRun(config, actions, manifest)
+		}
+		if err := config.checkDiskSpace(actions); err != nil {
+			return &PhaseError{Phase: PhaseDownload, Err: err}
+		}
+		streamer := newFullPatchStreamer(config, backend, actions)
+		err = runDownloadPhase(
+			ctx,
+			actions.ToDownload,
+			config.InstallDir,
+			config.baseUrls(),
+			config.DownloadConfig,
+			progress,
+			config.DownloadWorkers,
+			config.DownloadRampUp,
+			config.Throttle,
+			verified,
+			config.MaxTotalDownloadSize,
+			streamer,
+		)
+		streamer.close()
+		if err != nil {
+			return &PhaseError{Phase: PhaseDownload, Err: err}
+		}
 	}
 	emitProgress()
 
-	err = runPatchPhase(
-		ctx,
-		actions.ToUpdate,
-		actions.ToDelete,
-		manifest,
-		config.InstallDir,
-		xdelta,
-		progress,
-		config.ApplyWorkers,
-	)
-	if err != nil {
-		return err
+	if err := runApply(ctx, actions, manifest, config, backend, progress, verified); err != nil {
+		return &PhaseError{Phase: PhaseApply, Err: err}
 	}
-
-	log.Printf("Operation successful, removing directory with downloaded patches '%s'.", patchDir)
-	if err := os.RemoveAll(patchDir); err != nil {
-		return fmt.Errorf("failed to remove patch dir '%s': %w", patchDir, err)
+	if config.VerifyAfter {
+		if err := verifyAfter(ctx, instructions, manifest, config); err != nil {
+			return err
+		}
 	}
+	log.Printf("Time spent per phase: %s.", progress.Current().PhaseDurationSummary())
+	if len(actions.SkippedScanPaths) > 0 {
+		log.Printf("Skipped %d paths that couldn't be scanned: %s.", len(actions.SkippedScanPaths),
+			strings.Join(actions.SkippedScanPaths, ", "))
+	}
+	return nil
+}
 
-	if err := manifest.WriteManifest(config.InstallDir); err != nil {
-		return err
+// concurrentPhases returns whether RunPatcher starts the download phase while the verify phase is still
+// running, see SequentialPhases.
+func (c PatcherConfig) concurrentPhases() bool {
+	if c.SequentialPhases || c.DryRun {
+		return false
+	}
+	if c.StreamFullPatches && !c.KeepPatches {
+		log.Printf("Applying full patches while downloading them needs all downloads to be known, " +
+			"not downloading while verifying.")
+		return false
 	}
+	return true
+}
 
-	return nil
+// runVerifyAndDownloadPhases runs the verify and download phases at the same time: patch files are downloaded
+// as soon as the verify phase determines they're needed. Nothing is downloaded before the delete count, disk space
+// and total download size checks passed. The last two are first done for the worst case (see worstCaseActions),
+// if that fails the downloads wait until they've passed for the real actions, once the verify phase is finished.
+// The errors are PhaseErrors.
+func runVerifyAndDownloadPhases(
+	ctx context.Context,
+	instructions []Instruction,
+	manifest *Manifest,
+	foldCase bool,
+	config PatcherConfig,
+	progress *ProgressTracker,
+	emitProgress func(),
+	verified *verifiedPatches,
+) (*DeterminedActions, error) {
+	g, gctx := errgroup.WithContext(ctx)
+	// Every instruction needs at most one patch file, so the verify phase never waits for the download phase.
+	downloads := make(chan DownloadInstr, len(instructions))
+	// Closed once the checks passed, nothing is downloaded before that.
+	checksPassed := make(chan struct{})
+	checkActions := func(actions *DeterminedActions) error {
+		if err := config.checkDiskSpace(actions); err != nil {
+			return err
+		}
+		return checkTotalDownloadSize(actions.ToDownload, config.MaxTotalDownloadSize)
+	}
+	var actions *DeterminedActions
+	g.Go(func() error {
+		defer close(downloads)
+		// If the worst case passes the downloads can start right away, otherwise they wait for the real actions.
+		checked := false
+		onPlanned := func(worstCase *DeterminedActions) {
+			if checkActions(worstCase) == nil {
+				checked = true
+				close(checksPassed)
+			}
+		}
+		var err error
+		actions, err = runVerifyPhase(
+			gctx,
+			instructions,
+			manifest,
+			config.InstallDir,
+			foldCase,
+			config.checkScanCount,
+			config.checkDeleteCount,
+			config.SkipScanErrors,
+			config.ForceRehash,
+			config.ChangedSince,
+			config.VerifyWorkers,
+			config.ParallelHashThreshold,
+			config.Throttle,
+			progress,
+			emitProgress,
+			downloads,
+			onPlanned,
+		)
+		if err != nil {
+			return &PhaseError{Phase: PhaseVerify, Err: err}
+		}
+		emitProgress()
+		if !checked {
+			if err := checkActions(actions); err != nil {
+				return &PhaseError{Phase: PhaseDownload, Err: err}
+			}
+			close(checksPassed)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		select {
+		case <-checksPassed:
+		case <-gctx.Done():
+			// The verify phase failed, its error is the one returned.
+			return nil
+		}
+		log.Printf("Downloading patch files while verifying.")
+		err := downloadPatches(
+			gctx,
+			downloads,
+			config.InstallDir,
+			config.baseUrls(),
+			config.DownloadConfig,
+			progress,
+			config.DownloadWorkers,
+			config.DownloadRampUp,
+			config.Throttle,
+			verified,
+			config.MaxTotalDownloadSize,
+			nil,
+		)
+		if err != nil {
+			return &PhaseError{Phase: PhaseDownload, Err: err}
+		}
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return actions, nil
 }
@@ -0,0 +1,782 @@
+package patcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyPatchFile(t *testing.T) {
+	tempDir := t.TempDir()
+	data := []byte("patch data")
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "p1"), data, 0644))
+	verified := newVerifiedPatches()
+	ui := UpdateInstr{PatchPath: "p1", PatchChecksum: HashBytes(data)}
+	require.NoError(t, verifyPatchFile(context.Background(), tempDir, ui, verified))
+	require.True(t, verified.has("p1", HashBytes(data)))
+
+	ui.PatchChecksum = "abc"
+	require.ErrorContains(t, verifyPatchFile(context.Background(), tempDir, ui, verified), "is corrupt")
+}
+
+func TestVerifyPatchFileSkipsVerified(t *testing.T) {
+	// The file doesn't exist, so if it would be opened that would fail.
+	verified := newVerifiedPatches()
+	verified.add("p1", "abc")
+	ui := UpdateInstr{PatchPath: "p1", PatchChecksum: "ABC"}
+	require.NoError(t, verifyPatchFile(context.Background(), t.TempDir(), ui, verified))
+}
+
+func TestRunVerify(t *testing.T) {
+	installDir := t.TempDir()
+	data := []byte("file data")
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "up_to_date"), data, 0644))
+	instructions := []Instruction{
+		{Path: "up_to_date", NewHash: someStr(HashBytes(data)), CompressedHash: someStr("abc")},
+		{Path: "missing", NewHash: someStr("def"), CompressedHash: someStr("ghi"), FullReplaceSize: 3},
+	}
+	manifest := NewManifest("foo")
+	config := PatcherConfig{InstallDir: installDir, VerifyWorkers: 2}
+	actions, err := RunVerify(context.Background(), instructions, manifest, config, nil)
+	require.NoError(t, err)
+	require.Len(t, actions.ToDownload, 1)
+	require.Equal(t, "full/def", actions.ToDownload[0].RemotePath)
+	require.Len(t, actions.ToUpdate, 1)
+	require.Equal(t, "missing", actions.ToUpdate[0].FilePath)
+	require.Empty(t, actions.ToDelete)
+	// The measured file was added to the manifest.
+	info, err := os.Stat(filepath.Join(installDir, "up_to_date"))
+	require.NoError(t, err)
+	require.True(t, manifest.Check("up_to_date", info.ModTime(), HashBytes(data)))
+}
+
+func TestRunVerifyChangedSince(t *testing.T) {
+	installDir := t.TempDir()
+	data := []byte("file data")
+	since := time.Now().Add(-time.Hour)
+	manifest := NewManifest("foo")
+	for _, tc := range []struct {
+		filename string
+		modTime  time.Time
+	}{
+		{"old", since.Add(-time.Hour)},
+		{"new", since.Add(time.Minute)},
+	} {
+		filename := filepath.Join(installDir, tc.filename)
+		require.NoError(t, os.WriteFile(filename, data, 0644))
+		require.NoError(t, os.Chtimes(filename, tc.modTime, tc.modTime))
+		// The manifest is out of date for both, and has the wrong checksum.
+		manifest.Add(tc.filename, tc.modTime.Add(-time.Minute), HashBytes([]byte("old data")))
+	}
+	// Not in the manifest, so verified however old it is.
+	unknown := filepath.Join(installDir, "unknown")
+	require.NoError(t, os.WriteFile(unknown, data, 0644))
+	require.NoError(t, os.Chtimes(unknown, since.Add(-time.Hour), since.Add(-time.Hour)))
+	instructions := []Instruction{
+		{Path: "old", NewHash: someStr(HashBytes(data)), CompressedHash: someStr("abc"), FullReplaceSize: 3},
+		{Path: "new", NewHash: someStr(HashBytes(data)), CompressedHash: someStr("abc"), FullReplaceSize: 3},
+		{Path: "unknown", NewHash: someStr(HashBytes(data)), CompressedHash: someStr("abc"), FullReplaceSize: 3},
+	}
+	var verified []string
+	config := PatcherConfig{InstallDir: installDir, VerifyWorkers: 1, ChangedSince: since,
+		OnFileEvent: func(ev FileEvent) {
+			if ev.Kind == FileVerified {
+				verified = append(verified, ev.Path)
+			}
+		}}
+	actions, err := RunVerify(context.Background(), instructions, manifest, config, nil)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"new", "unknown"}, verified)
+	// Only the old file wasn't measured, so the wrong checksum from the manifest was used.
+	require.Len(t, actions.ToUpdate, 1)
+	require.Equal(t, "old", actions.ToUpdate[0].FilePath)
+}
+
+func TestCheckScanCount(t *testing.T) {
+	config := PatcherConfig{InstallDir: "foo", MaxScanRatio: 10}
+	// Small installs never trigger the check.
+	require.NoError(t, config.checkScanCount(50, 2))
+	// Without confirmation function only a warning is logged.
+	require.NoError(t, config.checkScanCount(5000, 100))
+
+	var asked []int
+	config.ConfirmManyFiles = func(found int, expected int) bool {
+		asked = append(asked, found, expected)
+		return false
+	}
+	require.NoError(t, config.checkScanCount(1500, 200))
+	require.ErrorContains(t, config.checkScanCount(5000, 100), "not continuing")
+	require.Equal(t, []int{5000, 100}, asked)
+
+	config.MaxScanRatio = 0
+	require.NoError(t, config.checkScanCount(5000, 100))
+}
+
+func TestCheckDeleteCount(t *testing.T) {
+	config := PatcherConfig{InstallDir: "foo", MaxDeleteRatio: 0.5}
+	// Deleting a few files never triggers the check.
+	require.NoError(t, config.checkDeleteCount(5, 5))
+	require.NoError(t, config.checkDeleteCount(50, 100))
+	var massErr *MassDeleteError
+	require.ErrorAs(t, config.checkDeleteCount(51, 100), &massErr)
+	require.Equal(t, MassDeleteError{Dir: "foo", ToDelete: 51, Managed: 100}, *massErr)
+
+	config.AllowMassDelete = true
+	require.NoError(t, config.checkDeleteCount(51, 100))
+	config.AllowMassDelete = false
+	config.MaxDeleteRatio = 0
+	require.NoError(t, config.checkDeleteCount(100, 100))
+}
+
+func TestRunVerifyForceRehash(t *testing.T) {
+	installDir := t.TempDir()
+	data := []byte("file data")
+	filename := filepath.Join(installDir, "edited")
+	require.NoError(t, os.WriteFile(filename, []byte("edited data"), 0644))
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	instructions := []Instruction{
+		{Path: "edited", NewHash: someStr(HashBytes(data)), CompressedHash: someStr("abc"), FullReplaceSize: 3},
+	}
+	// The file was edited without changing its last change time, so the manifest thinks it's fine.
+	newManifest := func() *Manifest {
+		manifest := NewManifest("foo")
+		manifest.Add("edited", info.ModTime(), HashBytes(data))
+		return manifest
+	}
+
+	config := PatcherConfig{InstallDir: installDir, VerifyWorkers: 2}
+	actions, err := RunVerify(context.Background(), instructions, newManifest(), config, nil)
+	require.NoError(t, err)
+	require.Empty(t, actions.ToUpdate)
+
+	config.ForceRehash = true
+	config.ChangedSince = time.Now()
+	manifest := newManifest()
+	progress := NewProgress()
+	actions, err = RunVerify(context.Background(), instructions, manifest, config, progress)
+	require.NoError(t, err)
+	require.Len(t, actions.ToUpdate, 1)
+	require.Equal(t, "edited", actions.ToUpdate[0].FilePath)
+	require.True(t, manifest.Check("edited", info.ModTime(), HashBytes([]byte("edited data"))))
+	verify := progress.Current().Verify
+	require.Equal(t, 1, verify.Needed)
+	require.Equal(t, 1, verify.Completed)
+}
+
+func TestRunVerifyAllDeleted(t *testing.T) {
+	installDir := t.TempDir()
+	var instructions []Instruction
+	for i := 0; i < 20; i++ {
+		filename := fmt.Sprintf("file%02d", i)
+		require.NoError(t, os.WriteFile(filepath.Join(installDir, filename), []byte(filename), 0644))
+		instructions = append(instructions, Instruction{Path: filename})
+	}
+	config := PatcherConfig{InstallDir: installDir, VerifyWorkers: 2, MaxDeleteRatio: 0.5}
+	_, err := RunVerify(context.Background(), instructions, NewManifest("foo"), config, nil)
+	var massErr *MassDeleteError
+	require.ErrorAs(t, err, &massErr)
+	require.Equal(t, 20, massErr.ToDelete)
+	require.Equal(t, 20, massErr.Managed)
+
+	// Nothing was deleted.
+	entries, err := os.ReadDir(installDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 20)
+
+	config.AllowMassDelete = true
+	actions, err := RunVerify(context.Background(), instructions, NewManifest("foo"), config, nil)
+	require.NoError(t, err)
+	require.Len(t, actions.ToDelete, 20)
+}
+
+// failingBackend fails every patch application.
+type failingBackend struct{}
+
+func (failingBackend) ApplyPatch(context.Context, *string, string, string, string, int64) error {
+	return errors.New("patch applied")
+}
+
+func TestRunPatchPhaseSkipsDoneFiles(t *testing.T) {
+	installDir := t.TempDir()
+	data := []byte("new data")
+	require.NoError(t, os.MkdirAll(filepath.Join(installDir, "patch", "apply"), 0755))
+	// Patched and moved into place by an earlier run.
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "in_place"), data, 0644))
+	// Patched by an earlier run, but not moved into place yet.
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "patch", "apply", "00001_new"), data, 0644))
+	toUpdate := []UpdateInstr{
+		{PatchPath: "patch/new", FilePath: "in_place", TempFilename: "patch/apply/00000_new",
+			Checksum: HashBytes(data), Size: int64(len(data))},
+		{PatchPath: "patch/new", FilePath: "not_moved", TempFilename: "patch/apply/00001_new",
+			Checksum: HashBytes(data), Size: int64(len(data))},
+	}
+	manifest := NewManifest("foo")
+	progress := NewProgress()
+	err := runPatchPhase(context.Background(), toUpdate, nil, manifest, installDir, failingBackend{}, progress,
+		2, nil, false, false, newVerifiedPatches(), 0, false)
+	require.NoError(t, err)
+	for _, filename := range []string{"in_place", "not_moved"} {
+		info, err := os.Stat(filepath.Join(installDir, filename))
+		require.NoError(t, err)
+		require.True(t, manifest.Check(filename, info.ModTime(), HashBytes(data)))
+	}
+	require.Equal(t, 2, progress.Current().Apply.Completed)
+
+	// A file that doesn't match is still patched.
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "in_place"), []byte("old data"), 0644))
+	err = runPatchPhase(context.Background(), toUpdate[:1], nil, NewManifest("foo"), installDir, failingBackend{},
+		progress, 2, nil, false, false, newVerifiedPatches(), 0, false)
+	require.ErrorContains(t, err, "patch applied")
+}
+
+func TestRunPatchPhaseChecksDeltaSource(t *testing.T) {
+	installDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "file"), []byte("unexpected"), 0644))
+	toUpdate := []UpdateInstr{
+		{PatchPath: "patch/new_from_old", FilePath: "file", TempFilename: "patch/apply/00000_new",
+			IsDelta: true, OldHash: HashBytes([]byte("old")), Checksum: HashBytes([]byte("new"))},
+	}
+	err := runPatchPhase(context.Background(), toUpdate, nil, NewManifest("foo"), installDir, failingBackend{},
+		NewProgress(), 2, nil, false, false, newVerifiedPatches(), 0, false)
+	require.ErrorContains(t, err, "needed for delta patch")
+	var fileErr *FileError
+	require.ErrorAs(t, err, &fileErr)
+	require.Equal(t, FileError{Path: "file", Phase: PhaseApply, Err: fileErr.Err}, *fileErr)
+
+	// With the right source the backend is used.
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "file"), []byte("old"), 0644))
+	err = runPatchPhase(context.Background(), toUpdate, nil, NewManifest("foo"), installDir, failingBackend{},
+		NewProgress(), 2, nil, false, false, newVerifiedPatches(), 0, false)
+	require.ErrorContains(t, err, "patch applied")
+}
+
+// slowBackend takes until the context is canceled to apply a patch.
+type slowBackend struct{}
+
+func (slowBackend) ApplyPatch(ctx context.Context, _ *string, _ string, _ string, _ string, _ int64) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestRunPatchPhaseApplyTimeout(t *testing.T) {
+	installDir := t.TempDir()
+	toUpdate := []UpdateInstr{
+		{PatchPath: "patch/new", FilePath: "file", TempFilename: "patch/apply/00000_new",
+			Checksum: HashBytes([]byte("new"))},
+	}
+	err := runPatchPhase(context.Background(), toUpdate, nil, NewManifest("foo"), installDir, slowBackend{},
+		NewProgress(), 1, nil, false, false, newVerifiedPatches(), 50*time.Millisecond, false)
+	require.ErrorContains(t, err, "took longer than 50ms")
+
+	// Canceling the whole run isn't reported as a timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = runPatchPhase(ctx, toUpdate, nil, NewManifest("foo"), installDir, slowBackend{},
+		NewProgress(), 1, nil, false, false, newVerifiedPatches(), time.Hour, false)
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "took longer")
+}
+
+func TestRunPatchPhaseVerifyAfterMove(t *testing.T) {
+	installDir := t.TempDir()
+	require.NoError(t, createPatchDirs(installDir))
+	// The copying backend doesn't check the checksum, like a file that got corrupted after patching.
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "patch", "new"), []byte("corrupt"), 0644))
+	toUpdate := []UpdateInstr{
+		{PatchPath: "patch/new", FilePath: "file", TempFilename: "patch/apply/00000_new",
+			Checksum: HashBytes([]byte("new"))},
+	}
+	manifest := NewManifest("foo")
+	err := runPatchPhase(context.Background(), toUpdate, nil, manifest, installDir, copyingBackend{},
+		NewProgress(), 1, nil, false, true, newVerifiedPatches(), 0, false)
+	require.ErrorContains(t, err, "no longer has checksum")
+	require.Empty(t, manifest.Entries)
+
+	// Without the check the file is trusted.
+	require.NoError(t, removeApplyProgress(installDir))
+	err = runPatchPhase(context.Background(), toUpdate, nil, manifest, installDir, copyingBackend{},
+		NewProgress(), 1, nil, false, false, newVerifiedPatches(), 0, false)
+	require.NoError(t, err)
+	require.Len(t, manifest.Entries, 1)
+}
+
+func TestRunApplyKeepPatches(t *testing.T) {
+	installDir := t.TempDir()
+	config := PatcherConfig{InstallDir: installDir, ApplyWorkers: 1, KeepPatches: true}
+	require.NoError(t, createPatchDirs(installDir))
+	kept := []string{filepath.Join("patch", "abc"), filepath.Join("patch", "apply", "00000_abc")}
+	for _, filename := range kept {
+		require.NoError(t, os.WriteFile(filepath.Join(installDir, filename), []byte("abc"), 0644))
+	}
+	err := runApply(context.Background(), &DeterminedActions{}, NewManifest("foo"), config, failingBackend{},
+		NewProgress(), newVerifiedPatches())
+	require.NoError(t, err)
+	for _, filename := range kept {
+		require.FileExists(t, filepath.Join(installDir, filename))
+	}
+
+	config.KeepPatches = false
+	err = runApply(context.Background(), &DeterminedActions{}, NewManifest("foo"), config, failingBackend{},
+		NewProgress(), newVerifiedPatches())
+	require.NoError(t, err)
+	require.NoDirExists(t, filepath.Join(installDir, "patch"))
+}
+
+func TestRunPatcherInstallDirIsFile(t *testing.T) {
+	installDir := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(installDir, []byte("not a dir"), 0644))
+	config := PatcherConfig{InstallDir: installDir, Product: "foo", PatchBackend: failingBackend{},
+		VerifyWorkers: 1, DownloadWorkers: 1, ApplyWorkers: 1, ProgressInterval: time.Hour}
+	err := RunPatcher(context.Background(), nil, config)
+	require.ErrorContains(t, err, "exists but is not a directory")
+}
+
+func TestRunPatcherCreatesInstallDir(t *testing.T) {
+	installDir := filepath.Join(t.TempDir(), "new", "game")
+	config := PatcherConfig{InstallDir: installDir, Product: "foo", PatchBackend: failingBackend{},
+		NoCreateInstallDir: true, VerifyWorkers: 1, DownloadWorkers: 1, ApplyWorkers: 1,
+		ProgressInterval: time.Hour}
+	err := RunPatcher(context.Background(), nil, config)
+	require.ErrorContains(t, err, "doesn't exist and creating it is disabled")
+	require.NoDirExists(t, installDir)
+
+	config.NoCreateInstallDir = false
+	config.ProgressFunc = func(Progress) {}
+	require.NoError(t, RunPatcher(context.Background(), nil, config))
+	require.FileExists(t, filepath.Join(installDir, ManifestFilename))
+}
+
+func TestRunPatcherDryRun(t *testing.T) {
+	installDir := t.TempDir()
+	data := []byte("file data")
+	for _, filename := range []string{"up_to_date", "outdated", "obsolete"} {
+		require.NoError(t, os.WriteFile(filepath.Join(installDir, filename), data, 0644))
+	}
+	instructions := []Instruction{
+		{Path: "up_to_date", NewHash: someStr(HashBytes(data)), CompressedHash: someStr("abc")},
+		{Path: "outdated", NewHash: someStr("def"), CompressedHash: someStr("ghi"), FullReplaceSize: 3},
+		{Path: "missing", NewHash: someStr("jkl"), CompressedHash: someStr("mno"), FullReplaceSize: 4},
+		{Path: "obsolete"},
+	}
+	var report bytes.Buffer
+	// No base URL, downloading anything would fail.
+	config := PatcherConfig{InstallDir: installDir, Product: "foo", PatchBackend: failingBackend{},
+		VerifyWorkers: 1, DownloadWorkers: 1, ApplyWorkers: 1, ProgressInterval: time.Hour,
+		ProgressFunc: func(Progress) {}, DryRun: true, DryRunOutput: &report}
+	require.NoError(t, RunPatcher(context.Background(), instructions, config))
+	require.Equal(t, `Download 2 patch files, 7 bytes (7 bytes without delta patches):
+  full/def (3 bytes)
+  full/jkl (4 bytes)
+Update 2 files:
+  missing (full patch)
+  outdated (full patch)
+Delete 1 files:
+  obsolete
+`, report.String())
+
+	// Only the manifest was written, with the measured checksums.
+	require.NoDirExists(t, filepath.Join(installDir, "patch"))
+	require.FileExists(t, filepath.Join(installDir, "obsolete"))
+	manifest, err := ReadManifest(installDir, "foo")
+	require.NoError(t, err)
+	info, err := os.Stat(filepath.Join(installDir, "outdated"))
+	require.NoError(t, err)
+	require.True(t, manifest.Check("outdated", info.ModTime(), HashBytes(data)))
+}
+
+func TestRunPatcherDryRunMissingInstallDir(t *testing.T) {
+	instructions := []Instruction{
+		{Path: "file", NewHash: someStr("abc"), CompressedHash: someStr("def"), FullReplaceSize: 3},
+		{Path: "obsolete"},
+	}
+	var report bytes.Buffer
+	// The probe for case sensitivity would fail (or create the dir), so it mustn't run.
+	config := PatcherConfig{InstallDir: filepath.Join(t.TempDir(), "new"), Product: "foo",
+		PatchBackend: failingBackend{}, VerifyWorkers: 1, DownloadWorkers: 1, ApplyWorkers: 1,
+		ProgressInterval: time.Hour, ProgressFunc: func(Progress) {}, DryRun: true, DryRunOutput: &report}
+	require.NoError(t, RunPatcher(context.Background(), instructions, config))
+	require.Equal(t, `Download 1 patch files, 3 bytes (3 bytes without delta patches):
+  full/abc (3 bytes)
+Update 1 files:
+  file (full patch)
+Delete 0 files:
+`, report.String())
+	// The install dir isn't created.
+	require.NoDirExists(t, config.InstallDir)
+
+	// Something else in the way is still an error.
+	require.NoError(t, os.WriteFile(config.InstallDir, nil, 0644))
+	require.ErrorContains(t, RunPatcher(context.Background(), instructions, config), "not a directory")
+}
+
+func TestRunPatcherInvalidWorkers(t *testing.T) {
+	installDir := filepath.Join(t.TempDir(), "game")
+	for _, workers := range []int{0, -1} {
+		config := PatcherConfig{InstallDir: installDir, Product: "foo", PatchBackend: failingBackend{},
+			VerifyWorkers: 1, DownloadWorkers: workers, ApplyWorkers: 1, ProgressInterval: time.Hour}
+		err := RunPatcher(context.Background(), nil, config)
+		require.ErrorContains(t, err, fmt.Sprintf("DownloadWorkers must be at least 1, got %d", workers))
+		// Nothing is touched before the check.
+		require.NoDirExists(t, installDir)
+
+		config.DownloadWorkers, config.ApplyWorkers = 1, workers
+		err = RunApply(context.Background(), &DeterminedActions{}, NewManifest("foo"), config, nil)
+		require.ErrorContains(t, err, fmt.Sprintf("ApplyWorkers must be at least 1, got %d", workers))
+	}
+}
+
+func TestRunPatcherInvalidProgressInterval(t *testing.T) {
+	installDir := filepath.Join(t.TempDir(), "game")
+	for _, interval := range []time.Duration{0, -time.Second} {
+		config := PatcherConfig{InstallDir: installDir, Product: "foo", PatchBackend: failingBackend{},
+			VerifyWorkers: 1, DownloadWorkers: 1, ApplyWorkers: 1, ProgressInterval: interval,
+			ProgressFunc: func(Progress) {}}
+		err := RunPatcher(context.Background(), nil, config)
+		require.ErrorContains(t, err, "ProgressInterval must be positive")
+	}
+}
+
+func TestMeasureFileRegionChecksum(t *testing.T) {
+	installDir := t.TempDir()
+	data := []byte("huge file")
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "file"), data, 0644))
+	file, err := os.Open(filepath.Join(installDir, "file"))
+	require.NoError(t, err)
+	regionChecksum, err := HashFileRegions(context.Background(), file, int64(len(data)), 2)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	// Without a region checksum in the manifest the checksum is computed.
+	manifest := NewManifest("foo")
+	mf, err := measureFile(context.Background(), installDir, "file", manifest, 5, 2)
+	require.NoError(t, err)
+	require.Equal(t, HashBytes(data), mf.checksum)
+	require.Equal(t, regionChecksum, mf.regionChecksum)
+
+	// With a matching region checksum the manifest is trusted, even though the change time differs.
+	manifest.Add("file", manDate1, "abcde")
+	manifest.SetRegionChecksum("file", regionChecksum)
+	mf, err = measureFile(context.Background(), installDir, "file", manifest, 5, 2)
+	require.NoError(t, err)
+	require.Equal(t, "abcde", mf.checksum)
+
+	// Small files and a disabled threshold always get their checksum computed.
+	for _, threshold := range []int64{0, 100} {
+		mf, err = measureFile(context.Background(), installDir, "file", manifest, threshold, 2)
+		require.NoError(t, err)
+		require.Equal(t, HashBytes(data), mf.checksum)
+		require.Empty(t, mf.regionChecksum)
+	}
+}
+
+func TestRemovePatchDirKeepsQuarantine(t *testing.T) {
+	installDir := t.TempDir()
+	require.NoError(t, createPatchDirs(installDir))
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "patch", "new"), []byte("patch"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(installDir, QuarantineDirname), 0755))
+	// An empty quarantine dir isn't worth keeping.
+	require.NoError(t, removePatchDir(installDir))
+	require.NoDirExists(t, filepath.Join(installDir, "patch"))
+
+	require.NoError(t, createPatchDirs(installDir))
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "patch", "new"), []byte("patch"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(installDir, QuarantineDirname), 0755))
+	quarantined := filepath.Join(installDir, QuarantineDirname, "new_ABC")
+	require.NoError(t, os.WriteFile(quarantined, []byte("bad"), 0644))
+	require.NoError(t, removePatchDir(installDir))
+	require.FileExists(t, quarantined)
+	require.NoFileExists(t, filepath.Join(installDir, "patch", "new"))
+	require.NoDirExists(t, filepath.Join(installDir, "patch", "apply"))
+}
+
+// patchServer serves patch files from a map of remote paths to data, under any first path element (e.g.
+// "/run1/full/file"). With interrupt set every response stops halfway, like a connection dropping. The Range
+// header of every request is recorded, by the full path.
+type patchServer struct {
+	files     map[string][]byte
+	interrupt atomic.Bool
+
+	mu     sync.Mutex
+	ranges map[string][]string
+}
+
+func (s *patchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, remotePath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	data, found := s.files[remotePath]
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	s.ranges[r.URL.Path] = append(s.ranges[r.URL.Path], r.Header.Get("Range"))
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if s.interrupt.Load() {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, _ = w.Write(data[:len(data)/2])
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// requestRanges returns the Range headers of the requests for a path.
+func (s *patchServer) requestRanges(path string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ranges[path]
+}
+
+func TestRunDownloadResumeWithOtherWorkers(t *testing.T) {
+	for _, tc := range []struct{ before, after int }{{4, 1}, {1, 4}, {2, 3}} {
+		t.Run(fmt.Sprintf("%d_to_%d", tc.before, tc.after), func(t *testing.T) {
+			server := &patchServer{files: make(map[string][]byte), ranges: make(map[string][]string)}
+			var toDownload []DownloadInstr
+			for i := 0; i < 8; i++ {
+				data := bytes.Repeat([]byte{byte('a' + i)}, 1000+100*i)
+				remotePath := fmt.Sprintf("full/file%d", i)
+				server.files[remotePath] = data
+				toDownload = append(toDownload, DownloadInstr{
+					RemotePath: remotePath,
+					LocalPath:  fmt.Sprintf("patch/file%d", i),
+					Checksum:   HashBytes(data),
+					Size:       int64(len(data)),
+				})
+			}
+			httpServer := httptest.NewServer(server)
+			t.Cleanup(httpServer.Close)
+			// Each run has its own base URL, so late requests of the first run aren't counted for the second.
+			firstUrl, err := url.Parse(httpServer.URL + "/run1")
+			require.NoError(t, err)
+			secondUrl, err := url.Parse(httpServer.URL + "/run2")
+			require.NoError(t, err)
+			installDir := t.TempDir()
+			require.NoError(t, createPatchDirs(installDir))
+
+			// The first run is interrupted by the first download that fails.
+			config := testDownloadConfig()
+			config.MaxAttempts = 0
+			server.interrupt.Store(true)
+			err = runDownloadPhase(context.Background(), toDownload, installDir, []*url.URL{firstUrl}, config,
+				NewProgress(), tc.before, 0, nil, newVerifiedPatches(), 0, nil)
+			require.Error(t, err)
+
+			partial := make(map[string]int64)
+			for _, di := range toDownload {
+				if size, found := existingDownloadSize(filepath.Join(installDir, di.LocalPath)); found {
+					partial[di.RemotePath] = size
+				}
+			}
+			require.NotEmpty(t, partial)
+
+			server.interrupt.Store(false)
+			verified := newVerifiedPatches()
+			err = runDownloadPhase(context.Background(), toDownload, installDir, []*url.URL{secondUrl},
+				testDownloadConfig(), NewProgress(), tc.after, 0, nil, verified, 0, nil)
+			require.NoError(t, err)
+
+			// Every file is requested once, a partial one only for what's missing.
+			for _, di := range toDownload {
+				expectedRange := ""
+				if done := partial[di.RemotePath]; done > 0 {
+					expectedRange = fmt.Sprintf("bytes=%d-%d", done, di.Size-1)
+				}
+				require.Equal(t, []string{expectedRange}, server.requestRanges("/run2/"+di.RemotePath), di.RemotePath)
+				actual, err := os.ReadFile(filepath.Join(installDir, di.LocalPath))
+				require.NoError(t, err)
+				require.Equal(t, server.files[di.RemotePath], actual)
+				require.True(t, verified.has(di.LocalPath, di.Checksum))
+			}
+		})
+	}
+}
+
+func TestRunDownloadPhaseFileError(t *testing.T) {
+	server := &patchServer{files: make(map[string][]byte), ranges: make(map[string][]string)}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	baseUrl, err := url.Parse(httpServer.URL + "/run")
+	require.NoError(t, err)
+	installDir := t.TempDir()
+	require.NoError(t, createPatchDirs(installDir))
+	toDownload := []DownloadInstr{{RemotePath: "full/missing", LocalPath: "patch/missing", Checksum: "abc", Size: 3}}
+
+	config := testDownloadConfig()
+	config.MaxAttempts = 0
+	err = runDownloadPhase(context.Background(), toDownload, installDir, []*url.URL{baseUrl}, config,
+		NewProgress(), 1, 0, nil, newVerifiedPatches(), 0, nil)
+	require.ErrorContains(t, err, "status 404")
+	var fileErr *FileError
+	require.ErrorAs(t, err, &fileErr)
+	require.Equal(t, "patch/missing", fileErr.Path)
+	require.Equal(t, PhaseDownload, fileErr.Phase)
+}
+
+func TestRunVerifySendsDownloads(t *testing.T) {
+	installDir := t.TempDir()
+	data := []byte("file data")
+	for _, filename := range []string{"up_to_date", "outdated"} {
+		require.NoError(t, os.WriteFile(filepath.Join(installDir, filename), data, 0644))
+	}
+	instructions := []Instruction{
+		{Path: "up_to_date", NewHash: someStr(HashBytes(data)), CompressedHash: someStr("abc")},
+		{Path: "outdated", NewHash: someStr("def"), CompressedHash: someStr("ghi"), FullReplaceSize: 3},
+		// Two files with the same contents share a patch file, which is sent once.
+		{Path: "missing1", NewHash: someStr("jkl"), CompressedHash: someStr("mno"), FullReplaceSize: 4},
+		{Path: "missing2", NewHash: someStr("jkl"), CompressedHash: someStr("mno"), FullReplaceSize: 4},
+	}
+	downloads := make(chan DownloadInstr, len(instructions))
+	var worstCase *DeterminedActions
+	onPlanned := func(actions *DeterminedActions) {
+		// Nothing is sent before the worst case is known.
+		require.Empty(t, downloads)
+		worstCase = actions
+	}
+	actions, err := runVerifyPhase(context.Background(), instructions, NewManifest("foo"), installDir, false,
+		func(int, int) error { return nil }, func(int, int) error { return nil }, false, false, time.Time{}, 2, 0,
+		nil, NewProgress(), func() {}, downloads, onPlanned)
+	require.NoError(t, err)
+	close(downloads)
+	var sent []DownloadInstr
+	for di := range downloads {
+		sent = append(sent, di)
+	}
+	require.Len(t, actions.ToDownload, 2)
+	require.ElementsMatch(t, actions.ToDownload, sent)
+	// Without a manifest both existing files could need a full patch.
+	require.NotNil(t, worstCase)
+	require.Len(t, worstCase.ToDownload, 3)
+	require.Len(t, worstCase.ToUpdate, 4)
+}
+
+func TestWorstCaseActions(t *testing.T) {
+	existingFiles := map[string]BasicFileInfo{"a": {}, "b": {}, "known": {}}
+	// Delta patches can be bigger than the full patch, and files sharing a full patch can need different ones.
+	instructions := []Instruction{
+		{Path: "a", NewHash: someStr("new"), CompressedHash: someStr("full"), FullReplaceSize: 10, FileSize: 20,
+			OldHash: "old_a", DeltaHash: someStr("delta_a"), DeltaSize: 30},
+		{Path: "b", NewHash: someStr("new"), CompressedHash: someStr("full"), FullReplaceSize: 10, FileSize: 20,
+			OldHash: "old_b", DeltaHash: someStr("delta_b"), DeltaSize: 40},
+		{Path: "known", NewHash: someStr("known"), CompressedHash: someStr("known_full"), FullReplaceSize: 50},
+		{Path: "missing", NewHash: someStr("missing"), CompressedHash: someStr("missing_full"), FullReplaceSize: 60},
+	}
+	manifestChecksums := map[string]string{"known": "known"}
+	toMeasure := map[string][]int{"a": {0}, "b": {1}}
+	worstCase := worstCaseActions(instructions, existingFiles, manifestChecksums, toMeasure)
+	require.Equal(t, int64(10+30+40+60), worstCase.DownloadSize)
+	require.Len(t, worstCase.ToUpdate, 3)
+
+	// Every outcome of measuring needs at most that much.
+	for _, checksums := range []map[string]string{
+		{"a": "old_a", "b": "old_b"}, {"a": "other", "b": "old_b"}, {"a": "new", "b": "new"},
+	} {
+		checksums["known"] = "known"
+		actions := DetermineActions(instructions, NewManifest("foo"), existingFiles, checksums)
+		require.LessOrEqual(t, spaceNeeded(t.TempDir(), &actions), spaceNeeded(t.TempDir(), &worstCase))
+	}
+}
+
+func TestRunPatcherChecksBeforeDownloading(t *testing.T) {
+	for _, sequential := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sequential_%t", sequential), func(t *testing.T) {
+			server := &patchServer{files: make(map[string][]byte), ranges: make(map[string][]string)}
+			httpServer := httptest.NewServer(server)
+			t.Cleanup(httpServer.Close)
+			baseUrl, err := url.Parse(httpServer.URL + "/run")
+			require.NoError(t, err)
+			installDir := t.TempDir()
+			data := []byte("patch data")
+			server.files["full/abc"] = data
+			instructions := []Instruction{
+				{Path: "small", NewHash: someStr("abc"), CompressedHash: someStr("abc"),
+					FullReplaceSize: int64(len(data)), FileSize: int64(len(data))},
+				// No disk has room for this.
+				{Path: "huge", NewHash: someStr("def"), CompressedHash: someStr("def"), FullReplaceSize: 1 << 60,
+					FileSize: 1 << 60},
+			}
+			// Slow progress reports hold up the end of the verify phase, giving downloads time to start if
+			// they weren't held back.
+			config := PatcherConfig{InstallDir: installDir, Product: "foo", BaseUrl: baseUrl,
+				PatchBackend: copyingBackend{}, DownloadConfig: testDownloadConfig(), VerifyWorkers: 2,
+				DownloadWorkers: 2, ApplyWorkers: 2, ProgressInterval: time.Hour,
+				ProgressFunc: func(Progress) { time.Sleep(50 * time.Millisecond) }, SequentialPhases: sequential}
+			if _, err := AvailableDiskSpace(installDir); err != nil {
+				t.Skipf("Can't determine free disk space: %s", err)
+			}
+			var spaceErr *NotEnoughSpaceError
+			require.ErrorAs(t, RunPatcher(context.Background(), instructions, config), &spaceErr)
+			require.Empty(t, server.requestRanges("/run/full/abc"))
+
+			// Same for the total download size.
+			instructions[1].FullReplaceSize, instructions[1].FileSize = 100, 100
+			config.MaxTotalDownloadSize = int64(len(data)) + 50
+			require.ErrorContains(t, RunPatcher(context.Background(), instructions, config), "refusing to download")
+			require.Empty(t, server.requestRanges("/run/full/abc"))
+			config.MaxTotalDownloadSize = 0
+
+			// Same for the delete check.
+			for i := 0; i < minSuspiciousDeletes; i++ {
+				filename := fmt.Sprintf("obsolete%d", i)
+				require.NoError(t, os.WriteFile(filepath.Join(installDir, filename), data, 0644))
+				instructions = append(instructions, Instruction{Path: filename})
+			}
+			instructions[1] = Instruction{Path: "other", NewHash: someStr("abc"), CompressedHash: someStr("abc"),
+				FullReplaceSize: int64(len(data)), FileSize: int64(len(data))}
+			config.MaxDeleteRatio = 0.5
+			var deleteErr *MassDeleteError
+			require.ErrorAs(t, RunPatcher(context.Background(), instructions, config), &deleteErr)
+			require.Empty(t, server.requestRanges("/run/full/abc"))
+		})
+	}
+}
+
+func TestRunPatcherSequentialPhases(t *testing.T) {
+	for _, sequential := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sequential_%t", sequential), func(t *testing.T) {
+			server := &patchServer{files: make(map[string][]byte), ranges: make(map[string][]string)}
+			httpServer := httptest.NewServer(server)
+			t.Cleanup(httpServer.Close)
+			baseUrl, err := url.Parse(httpServer.URL + "/run")
+			require.NoError(t, err)
+			installDir := t.TempDir()
+			var instructions []Instruction
+			for i := 0; i < 8; i++ {
+				filename := fmt.Sprintf("file%d", i)
+				if i%2 == 0 {
+					require.NoError(t, os.WriteFile(filepath.Join(installDir, filename), []byte("old"), 0644))
+				}
+				data := bytes.Repeat([]byte{byte('a' + i)}, 1000+100*i)
+				checksum := HashBytes(data)
+				server.files["full/"+checksum] = data
+				instructions = append(instructions, Instruction{Path: filename, NewHash: someStr(checksum),
+					CompressedHash: someStr(checksum), FullReplaceSize: int64(len(data)), FileSize: int64(len(data))})
+			}
+
+			config := PatcherConfig{InstallDir: installDir, Product: "foo", BaseUrl: baseUrl,
+				PatchBackend: copyingBackend{}, DownloadConfig: testDownloadConfig(), VerifyWorkers: 2,
+				DownloadWorkers: 2, ApplyWorkers: 2, ProgressInterval: time.Hour, ProgressFunc: func(Progress) {},
+				SequentialPhases: sequential}
+			require.NoError(t, RunPatcher(context.Background(), instructions, config))
+			for i, instr := range instructions {
+				actual, err := os.ReadFile(filepath.Join(installDir, instr.Path))
+				require.NoError(t, err)
+				require.Equal(t, server.files["full/"+*instr.NewHash], actual, i)
+				require.Len(t, server.requestRanges("/run/full/"+*instr.NewHash), 1)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package patcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// A PathCaseMode determines whether paths that only differ in case are considered the same file.
+type PathCaseMode int
+
+const (
+	// Detect whether the install dir is on a case-insensitive filesystem.
+	PathCaseAuto PathCaseMode = 0
+	// Paths differing in case are different files.
+	PathCaseSensitive PathCaseMode = 1
+	// Paths differing in case are the same file (e.g. Windows and macOS by default).
+	PathCaseInsensitive PathCaseMode = 2
+)
+
+// foldsCase returns whether paths in dir should be compared case-insensitively.
+func (m PathCaseMode) foldsCase(dir string) (bool, error) {
+	switch m {
+	case PathCaseSensitive:
+		return false, nil
+	case PathCaseInsensitive:
+		return true, nil
+	default:
+		return isCaseInsensitiveDir(dir)
+	}
+}
+
+// foldsCaseWithoutProbe is like foldsCase, but instead of probing the filesystem (which writes a file) it
+// assumes the default of the OS. Used when nothing may be written, e.g. in a dry run.
+func (m PathCaseMode) foldsCaseWithoutProbe() bool {
+	switch m {
+	case PathCaseSensitive:
+		return false
+	case PathCaseInsensitive:
+		return true
+	default:
+		return runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+	}
+}
+
+// isCaseInsensitiveDir checks whether dir is on a case-insensitive filesystem by creating a file with a
+// lowercase name and checking whether the uppercase name refers to it.
+func isCaseInsensitiveDir(dir string) (bool, error) {
+	file, err := os.CreateTemp(dir, "tapatcher-case-probe-")
+	if err != nil {
+		return false, fmt.Errorf("failed to detect whether '%s' is case-insensitive: %w", dir, err)
+	}
+	name := file.Name()
+	file.Close()
+	defer os.Remove(name)
+	upper := filepath.Join(filepath.Dir(name), strings.ToUpper(filepath.Base(name)))
+	_, err = os.Stat(upper)
+	return err == nil, nil
+}
+
+// checkDuplicatePaths returns an error if instructions contain multiple entries for the same file.
+// With foldCase paths differing only in case are considered the same file.
+func checkDuplicatePaths(instructions []Instruction, foldCase bool) error {
+	// Unlikely, but I've observed some funky flip flopping when I accidentally triggered this.
+	// Granted, it was with a slightly messy manually edited instructions file but if it happens
+	// on a player's computer it'll be very annoying to debug and the check is cheap enough.
+	filesSeen := make(map[string]string)
+	for _, instr := range instructions {
+		key := instr.Path
+		if foldCase {
+			key = strings.ToLower(key)
+		}
+		if other, found := filesSeen[key]; found {
+			if other == instr.Path {
+				return fmt.Errorf("got multiple entries for '%s' in instructions.json", instr.Path)
+			}
+			return fmt.Errorf("got entries for '%s' and '%s' in instructions.json, which are the same file "+
+				"on a case-insensitive filesystem", other, instr.Path)
+		}
+		filesSeen[key] = instr.Path
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package patcher
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckDuplicatePathsCaseCollision(t *testing.T) {
+	instructions := []Instruction{
+		{Path: filepath.Join("Data", "File")},
+		{Path: filepath.Join("data", "file")},
+	}
+	require.NoError(t, checkDuplicatePaths(instructions, false))
+	require.ErrorContains(t, checkDuplicatePaths(instructions, true), "case-insensitive")
+}
+
+func TestCheckDuplicatePathsExact(t *testing.T) {
+	instructions := []Instruction{
+		{Path: filepath.Join("Data", "File")},
+		{Path: filepath.Join("Data", "File")},
+	}
+	require.ErrorContains(t, checkDuplicatePaths(instructions, false), "multiple entries")
+	require.ErrorContains(t, checkDuplicatePaths(instructions, true), "multiple entries")
+}
+
+func TestPathCaseModeExplicit(t *testing.T) {
+	// The directory doesn't exist, so explicit modes must not probe it.
+	dir := filepath.Join(t.TempDir(), "missing")
+	foldCase, err := PathCaseSensitive.foldsCase(dir)
+	require.NoError(t, err)
+	require.False(t, foldCase)
+	foldCase, err = PathCaseInsensitive.foldsCase(dir)
+	require.NoError(t, err)
+	require.True(t, foldCase)
+	require.False(t, PathCaseSensitive.foldsCaseWithoutProbe())
+	require.True(t, PathCaseInsensitive.foldsCaseWithoutProbe())
+}
+
+func TestIsCaseInsensitiveDirCleansUp(t *testing.T) {
+	dir := t.TempDir()
+	_, err := isCaseInsensitiveDir(dir)
+	require.NoError(t, err)
+	entries, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
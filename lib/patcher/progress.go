@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,10 +17,29 @@ const (
 	PhaseApply    Phase = 2
 )
 
+// Number of phases.
+const PhaseCount = 3
+
+// String implements (fmt.Stringer).String
+func (p Phase) String() string {
+	switch p {
+	case PhaseVerify:
+		return "verify"
+	case PhaseDownload:
+		return "download"
+	case PhaseApply:
+		return "apply"
+	default:
+		return fmt.Sprintf("Phase(%d)", int(p))
+	}
+}
+
 // ProgressTracker is used to track the progress of the patching process.
 type ProgressTracker struct {
 	mu      sync.Mutex
 	current Progress
+	// Where file events go, nil if they aren't reported.
+	events *fileEventDispatcher
 }
 
 // Progress is current progress information.
@@ -31,6 +51,20 @@ type Progress struct {
 	// Total bytes downloaded.
 	DownloadTotalBytes int64 `json:"downloadTotalBytes"`
 
+	// Total size in bytes of the patch files to download. Known once the verify phase is done.
+	DownloadSize int64 `json:"downloadSize"`
+
+	// Total size in bytes the patch files to download would have without delta patches. Known once the
+	// verify phase is done.
+	DownloadSizeWithoutDeltas int64 `json:"downloadSizeWithoutDeltas"`
+
+	// Whether the install dir is being scanned. This happens at the start of the verify phase,
+	// before the number of files to verify is known.
+	Scanning bool `json:"scanning"`
+
+	// How many files the scan found so far.
+	ScannedFiles int `json:"scannedFiles"`
+
 	// Progress in the verify phase.
 	Verify ProgressPhase `json:"verify"`
 
@@ -39,6 +73,19 @@ type Progress struct {
 
 	// Progress in the apply phase.
 	Apply ProgressPhase `json:"apply"`
+
+	// Whether the patcher is paused.
+	Paused bool `json:"paused"`
+
+	// Number (1-based) of the phase that was started last, 0 if no phase was started yet. Together with
+	// PhaseCount this allows showing something like "Downloading (2/3)".
+	PhaseIndex int `json:"phaseIndex"`
+
+	// Total number of phases.
+	PhaseCount int `json:"phaseCount"`
+
+	// Name of the phase that took the most time so far (e.g. "download"), empty if no phase was started yet.
+	LongestPhase string `json:"longestPhase"`
 }
 
 // ProgressPhase contains the progress in a particular phase.
@@ -66,7 +113,7 @@ type ProgressPhase struct {
 
 // NewProgress creates a progress tracker.
 func NewProgress() *ProgressTracker {
-	return &ProgressTracker{}
+	return &ProgressTracker{current: Progress{PhaseCount: PhaseCount}}
 }
 
 // Current returns a copy of the current progress with duration calculated correctly.
@@ -78,9 +125,65 @@ func (p *ProgressTracker) Current() Progress {
 	rv.Verify.updateDurationToNow(now)
 	rv.Download.updateDurationToNow(now)
 	rv.Apply.updateDurationToNow(now)
+	if longest, found := rv.longestPhase(); found {
+		rv.LongestPhase = longest.String()
+	}
 	return rv
 }
 
+// longestPhase returns the started phase with the longest duration. On a tie the earlier phase wins.
+func (p *Progress) longestPhase() (Phase, bool) {
+	longest, found := PhaseVerify, false
+	for phase := PhaseVerify; phase < PhaseCount; phase++ {
+		ph := p.GetPhase(phase)
+		if ph.startedAt == nil {
+			continue
+		}
+		if !found || ph.Duration > p.GetPhase(longest).Duration {
+			longest, found = phase, true
+		}
+	}
+	return longest, found
+}
+
+// PhaseDurationSummary returns a one line summary of how long each started phase took, marking the longest,
+// e.g. "verify 12s, download 3m4s (longest), apply 40s".
+func (p Progress) PhaseDurationSummary() string {
+	longest, found := p.longestPhase()
+	if !found {
+		return "no phase started"
+	}
+	parts := make([]string, 0, PhaseCount)
+	for phase := PhaseVerify; phase < PhaseCount; phase++ {
+		ph := p.GetPhase(phase)
+		if ph.startedAt == nil {
+			continue
+		}
+		part := fmt.Sprintf("%s %s", phase, time.Duration(ph.Duration)*time.Second)
+		if phase == longest {
+			part += " (longest)"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// DownloadEta estimates how long the remaining downloads take at the current download speed. Returns false
+// if that's unknown: before the verify phase has determined what to download, or while nothing is coming in.
+func (p Progress) DownloadEta() (time.Duration, bool) {
+	if !p.Download.NeededKnown {
+		return 0, false
+	}
+	remaining := p.DownloadSize - p.DownloadTotalBytes
+	if p.Download.Done || remaining <= 0 {
+		return 0, true
+	}
+	if p.DownloadSpeed <= 0 {
+		return 0, false
+	}
+	return time.Duration(remaining/p.DownloadSpeed) * time.Second, true
+}
+
 // UpdateDownloadStats updates the download related statistics.
 func (p *ProgressTracker) UpdateDownloadStats(stats DownloadStats) {
 	p.mu.Lock()
@@ -89,6 +192,29 @@ func (p *ProgressTracker) UpdateDownloadStats(stats DownloadStats) {
 	p.current.DownloadTotalBytes = stats.TotalBytes
 }
 
+// SetDownloadSizes sets the sizes of the patch files to download, with and without delta patches.
+func (p *ProgressTracker) SetDownloadSizes(size int64, withoutDeltas int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current.DownloadSize = size
+	p.current.DownloadSizeWithoutDeltas = withoutDeltas
+}
+
+// ScanProgress marks the scan as running and sets the number of files found so far.
+func (p *ProgressTracker) ScanProgress(found int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current.Scanning = true
+	p.current.ScannedFiles = found
+}
+
+// ScanDone marks the scan as finished.
+func (p *ProgressTracker) ScanDone() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current.Scanning = false
+}
+
 // PhaseSetNeeded sets the needed value for a phase.
 func (p *ProgressTracker) PhaseSetNeeded(phase Phase, needed int) {
 	p.mu.Lock()
@@ -105,6 +231,7 @@ func (p *ProgressTracker) PhaseStarted(phase Phase) {
 	ph := p.current.GetPhase(phase)
 	t := time.Now()
 	ph.startedAt = &t
+	p.current.PhaseIndex = int(phase) + 1
 }
 
 // PhaseDone marks a phase as finished.
@@ -0,0 +1,65 @@
+package patcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressPhaseIndex(t *testing.T) {
+	progress := NewProgress()
+	p := progress.Current()
+	require.Equal(t, 0, p.PhaseIndex)
+	require.Equal(t, 3, p.PhaseCount)
+	progress.PhaseStarted(PhaseVerify)
+	require.Equal(t, 1, progress.Current().PhaseIndex)
+	progress.PhaseDone(PhaseVerify)
+	progress.PhaseStarted(PhaseDownload)
+	require.Equal(t, 2, progress.Current().PhaseIndex)
+	progress.PhaseDone(PhaseDownload)
+	progress.PhaseStarted(PhaseApply)
+	progress.PhaseDone(PhaseApply)
+	p = progress.Current()
+	require.Equal(t, 3, p.PhaseIndex)
+	require.Equal(t, 3, p.PhaseCount)
+}
+
+func TestProgressLongestPhase(t *testing.T) {
+	progress := NewProgress()
+	require.Equal(t, "", progress.Current().LongestPhase)
+	require.Equal(t, "no phase started", progress.Current().PhaseDurationSummary())
+
+	for _, phase := range []Phase{PhaseVerify, PhaseDownload, PhaseApply} {
+		progress.PhaseStarted(phase)
+		progress.PhaseDone(phase)
+	}
+	progress.current.Verify.Duration = 12
+	progress.current.Download.Duration = 184
+	progress.current.Apply.Duration = 40
+	p := progress.Current()
+	require.Equal(t, "download", p.LongestPhase)
+	require.Equal(t, "verify 12s, download 3m4s (longest), apply 40s", p.PhaseDurationSummary())
+}
+
+func TestProgressDownloadEta(t *testing.T) {
+	progress := NewProgress()
+	_, known := progress.Current().DownloadEta()
+	require.False(t, known)
+
+	progress.PhaseSetNeeded(PhaseDownload, 2)
+	progress.SetDownloadSizes(1000, 2000)
+	progress.PhaseStarted(PhaseDownload)
+	_, known = progress.Current().DownloadEta()
+	require.False(t, known)
+
+	progress.UpdateDownloadStats(DownloadStats{Speed: 100, TotalBytes: 400})
+	eta, known := progress.Current().DownloadEta()
+	require.True(t, known)
+	require.Equal(t, 6*time.Second, eta)
+
+	progress.PhaseDone(PhaseDownload)
+	eta, known = progress.Current().DownloadEta()
+	require.True(t, known)
+	require.Equal(t, time.Duration(0), eta)
+}
@@ -0,0 +1,111 @@
+package patcher
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A RateSchedule is the maximum combined download speed over time, e.g. limited during business hours and
+// unlimited at night. The zero value means no limit.
+type RateSchedule struct {
+	// Maximum download speed in bytes per second outside the windows, 0 for no limit.
+	Default int64
+
+	// Times of day with a different maximum speed. If windows overlap the first one wins.
+	Windows []RateWindow
+}
+
+// A RateWindow is a time of day with its own maximum download speed, see RateSchedule.
+type RateWindow struct {
+	// Hour (0-23, local time) the window starts.
+	StartHour int
+
+	// Hour (0-23, local time) the window ends, exclusive. If it's not after StartHour the window wraps
+	// around midnight, e.g. 22 to 6.
+	EndHour int
+
+	// Maximum download speed in bytes per second during the window, 0 for no limit.
+	Rate int64
+}
+
+// RateAt returns the maximum download speed at a time, 0 if there's no limit.
+func (s RateSchedule) RateAt(t time.Time) int64 {
+	hour := t.Hour()
+	for _, w := range s.Windows {
+		if w.contains(hour) {
+			return w.Rate
+		}
+	}
+	return s.Default
+}
+
+// contains returns whether the window contains the hour.
+func (w RateWindow) contains(hour int) bool {
+	if w.StartHour < w.EndHour {
+		return hour >= w.StartHour && hour < w.EndHour
+	}
+	return hour >= w.StartHour || hour < w.EndHour
+}
+
+// A rateLimiter is a token bucket that limits the combined speed of all downloads. The rate can be changed
+// while downloading, a rate of 0 means no limit. At most a second worth of data can be read in a burst.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	// Bytes that can be read without waiting, negative if reads went over the limit.
+	tokens float64
+	// When tokens was last updated.
+	last time.Time
+}
+
+// newRateLimiter creates a rate limiter with a full bucket.
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// setRate changes the maximum rate.
+func (l *rateLimiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refillLocked(time.Now())
+	if l.rate <= 0 {
+		// Without a limit the tokens meant nothing.
+		l.tokens = float64(rate)
+	}
+	l.rate = rate
+	l.tokens = min(l.tokens, float64(rate))
+}
+
+// take takes tokens for n bytes that were read, waiting until the rate allows that much data.
+func (l *rateLimiter) take(ctx context.Context, n int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refillLocked(time.Now())
+	if l.rate <= 0 {
+		return nil
+	}
+	l.tokens -= float64(n)
+	for l.tokens < 0 && l.rate > 0 {
+		// Wait at most a second at a time so rate changes are picked up.
+		wait := min(time.Duration(-l.tokens/float64(l.rate)*float64(time.Second)), time.Second)
+		l.mu.Unlock()
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			l.mu.Lock()
+			return ctx.Err()
+		}
+		l.mu.Lock()
+		l.refillLocked(time.Now())
+	}
+	return nil
+}
+
+// refillLocked adds the tokens for the time since the last update.
+func (l *rateLimiter) refillLocked(now time.Time) {
+	if l.rate > 0 {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), float64(l.rate))
+	}
+	l.last = now
+}
@@ -0,0 +1,61 @@
+package patcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateScheduleRateAt(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2024, 3, 1, hour, 30, 0, 0, time.Local)
+	}
+	schedule := RateSchedule{
+		Default: 100,
+		Windows: []RateWindow{
+			{StartHour: 8, EndHour: 18, Rate: 10},
+			// Wraps around midnight.
+			{StartHour: 22, EndHour: 6, Rate: 0},
+		},
+	}
+	require.Equal(t, int64(100), schedule.RateAt(at(7)))
+	require.Equal(t, int64(10), schedule.RateAt(at(8)))
+	require.Equal(t, int64(10), schedule.RateAt(at(17)))
+	require.Equal(t, int64(100), schedule.RateAt(at(18)))
+	require.Equal(t, int64(0), schedule.RateAt(at(23)))
+	require.Equal(t, int64(0), schedule.RateAt(at(0)))
+	require.Equal(t, int64(0), schedule.RateAt(at(5)))
+	require.Equal(t, int64(100), schedule.RateAt(at(6)))
+
+	require.Equal(t, int64(0), RateSchedule{}.RateAt(at(12)))
+}
+
+func TestRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := newRateLimiter(10000)
+
+	// A full bucket allows a second worth of data right away.
+	start := time.Now()
+	require.NoError(t, l.take(ctx, 10000))
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+
+	// After that reads have to wait.
+	start = time.Now()
+	require.NoError(t, l.take(ctx, 5000))
+	require.Greater(t, time.Since(start), 400*time.Millisecond)
+
+	// Without a limit nothing waits.
+	l.setRate(0)
+	start = time.Now()
+	require.NoError(t, l.take(ctx, 1000000))
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+
+	// Waiting stops when the context is canceled.
+	l.setRate(1)
+	require.NoError(t, l.take(ctx, 1))
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, l.take(ctx, 1000), context.DeadlineExceeded)
+}
@@ -1,9 +1,11 @@
 package patcher
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -13,32 +15,156 @@ type ResolvedInstructions struct {
 	Instructions []Instruction
 	BaseUrl      *url.URL
 	VersionName  string
+
+	// BaseUrl on the other mirrors, in the order of release.json. See PatcherConfig.FallbackBaseUrls.
+	FallbackBaseUrls []*url.URL
 }
 
 // productsJson contains the relevant parts of the products.json file.
 type productsJson struct {
-	Games []struct {
-		ReleaseUrl string `json:"legacy_data_path"`
-		Tag        string `json:"tag"`
-	} `json:"games"`
+	Games []productsGame `json:"games"`
+}
+
+// productsGame is a game in the products.json file.
+type productsGame struct {
+	ReleaseUrl string
+	Tag        string
+
+	// Descriptions of fields that weren't found.
+	missing []string
+}
+
+// Field names of the release URL in products.json, in order of preference. The backend is moving from
+// legacy_data_path to data_path.
+var releaseUrlFieldNames = []string{"legacy_data_path", "data_path"}
+
+// UnmarshalJSON implements json.Unmarshaler, accepting the known names of renamed fields.
+func (g *productsGame) UnmarshalJSON(data []byte) error {
+	missing, err := decodeFlexibleFields(data,
+		flexibleField{releaseUrlFieldNames, &g.ReleaseUrl, false},
+		flexibleField{[]string{"tag"}, &g.Tag, false},
+	)
+	g.missing = missing
+	return err
 }
 
 // releaseJson contains the relevant parts of the release.json file.
 type releaseJson struct {
-	Game struct {
-		InstructionsHash string `json:"instructions_hash"`
-		PatchPath        string `json:"patch_path"`
-		Mirrors          []struct {
-			Url string `json:"url"`
-		} `json:"mirrors"`
-		VersionName string `json:"version_name"`
-	} `json:"game"`
+	Game releaseGame `json:"game"`
+}
+
+// releaseGame is the game section of the release.json file.
+type releaseGame struct {
+	InstructionsHash string
+	PatchPath        string
+	Mirrors          []struct {
+		Url string `json:"url"`
+	}
+	VersionName string
+
+	// Descriptions of fields that weren't found.
+	missing []string
+}
+
+// UnmarshalJSON implements json.Unmarshaler, keeping track of missing fields instead of silently
+// leaving them empty.
+func (g *releaseGame) UnmarshalJSON(data []byte) error {
+	missing, err := decodeFlexibleFields(data,
+		flexibleField{[]string{"instructions_hash"}, &g.InstructionsHash, false},
+		flexibleField{[]string{"patch_path"}, &g.PatchPath, false},
+		flexibleField{[]string{"mirrors"}, &g.Mirrors, false},
+		flexibleField{[]string{"version_name"}, &g.VersionName, true},
+	)
+	g.missing = missing
+	return err
+}
+
+// A flexibleField is a JSON object field that can go by several names.
+type flexibleField struct {
+	// Known names of the field, in order of preference.
+	names []string
+	// Pointer to where the value should be decoded.
+	dest any
+	// Whether it's fine for the field to be missing.
+	optional bool
+}
+
+// decodeFlexibleFields decodes a JSON object, taking the value of each field from the first of its names
+// present in the object. Returns descriptions of the required fields that weren't present at all, missing fields
+// are left alone.
+func decodeFlexibleFields(data []byte, fields ...flexibleField) ([]string, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, field := range fields {
+		found := false
+		for _, name := range field.names {
+			if raw, ok := object[name]; ok {
+				if err := json.Unmarshal(raw, field.dest); err != nil {
+					return nil, fmt.Errorf("invalid value for field '%s': %w", name, err)
+				}
+				found = true
+				break
+			}
+		}
+		if !found && !field.optional {
+			missing = append(missing, "'"+strings.Join(field.names, "' or '")+"'")
+		}
+	}
+	return missing, nil
+}
+
+// A ResolveStep is a step of resolving instructions, see ResolveInstructionsContext.
+type ResolveStep int
+
+const (
+	ResolveFetchingProducts      ResolveStep = 0
+	ResolveFetchingRelease       ResolveStep = 1
+	ResolveFetchingInstructions  ResolveStep = 2
+	ResolveVerifyingInstructions ResolveStep = 3
+)
+
+// String implements (fmt.Stringer).String
+func (s ResolveStep) String() string {
+	switch s {
+	case ResolveFetchingProducts:
+		return "fetching products.json"
+	case ResolveFetchingRelease:
+		return "fetching release.json"
+	case ResolveFetchingInstructions:
+		return "fetching instructions.json"
+	case ResolveVerifyingInstructions:
+		return "verifying instructions.json"
+	default:
+		return fmt.Sprintf("ResolveStep(%d)", int(s))
+	}
 }
 
 // ResolveInstructions finds the instructions and URL containing the patch files by looking up a product
 // through the root products.json file.
 func ResolveInstructions(productsUrl *url.URL, product string) (*ResolvedInstructions, error) {
-	products, err := fetchJson[productsJson]("products.json", productsUrl)
+	return ResolveInstructionsContext(context.Background(), productsUrl, product, nil)
+}
+
+// ResolveInstructionsContext is ResolveInstructions with cancellation through ctx. If onStep is not nil it's
+// called when a step starts, e.g. to show what's going on while fetching a large instructions.json.
+// The fetched files are cached if a cache is set with WithMetadataCache.
+func ResolveInstructionsContext(
+	ctx context.Context,
+	productsUrl *url.URL,
+	product string,
+	onStep func(ResolveStep),
+) (*ResolvedInstructions, error) {
+	step := func(s ResolveStep) {
+		if onStep != nil {
+			onStep(s)
+		}
+	}
+
+	step(ResolveFetchingProducts)
+	products, err := fetchJson[productsJson](ctx, "products.json", productsUrl)
 	if err != nil {
 		return nil, err
 	}
@@ -46,39 +172,67 @@ func ResolveInstructions(productsUrl *url.URL, product string) (*ResolvedInstruc
 	var releaseUrl *url.URL
 	for _, game := range products.Games {
 		if HashEqual(game.Tag, product) {
+			if len(game.missing) > 0 {
+				return nil, fmt.Errorf("game '%s' in '%s' is missing field %s", product, productsUrl,
+					strings.Join(game.missing, ", "))
+			}
+			if strings.TrimSpace(game.ReleaseUrl) == "" {
+				return nil, fmt.Errorf("game '%s' has no release URL configured in '%s'", product, productsUrl)
+			}
 			releaseUrl, err = url.Parse(game.ReleaseUrl)
 			if err != nil {
 				return nil, fmt.Errorf("can't convert %q in '%s' to URL: %w", game.ReleaseUrl, productsUrl, err)
 			}
+			if !releaseUrl.IsAbs() || releaseUrl.Host == "" {
+				return nil, fmt.Errorf("game '%s' has release URL %q in '%s', which isn't an absolute URL",
+					product, game.ReleaseUrl, productsUrl)
+			}
 		}
 	}
 	if releaseUrl == nil {
 		return nil, fmt.Errorf("couldn't find game '%s' in '%s'", product, productsUrl)
 	}
 
-	release, err := fetchJson[releaseJson]("release.json", releaseUrl)
+	step(ResolveFetchingRelease)
+	release, err := fetchJson[releaseJson](ctx, "release.json", releaseUrl)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(release.Game.missing) > 0 {
+		return nil, fmt.Errorf("game '%s' in '%s' is missing field %s", product, releaseUrl,
+			strings.Join(release.Game.missing, ", "))
+	}
 	if len(release.Game.Mirrors) == 0 {
 		return nil, fmt.Errorf("there are no mirrors for gmae '%s' in '%s'", product, releaseUrl)
 	}
 
-	// Just fetch the first, there's only one mirror nowadays.
+	// Instructions are fetched from the first, the others are only used when a download fails.
 	mirrorUrl, err := url.Parse(release.Game.Mirrors[0].Url)
 	if err != nil {
 		return nil, fmt.Errorf("can't convert %q in '%s' to URL: %w", release.Game.Mirrors[0].Url, releaseUrl, err)
 	}
 	baseUrl := mirrorUrl.JoinPath(release.Game.PatchPath)
+	fallbackBaseUrls := make([]*url.URL, 0, len(release.Game.Mirrors)-1)
+	for _, mirror := range release.Game.Mirrors[1:] {
+		fallbackUrl, err := url.Parse(mirror.Url)
+		if err != nil || !fallbackUrl.IsAbs() {
+			// Only a fallback, not worth failing over.
+			log.Printf("Ignoring mirror %q in '%s', it's not a valid URL.", mirror.Url, releaseUrl)
+			continue
+		}
+		fallbackBaseUrls = append(fallbackBaseUrls, fallbackUrl.JoinPath(release.Game.PatchPath))
+	}
 	instructionsUrl := baseUrl.JoinPath("instructions.json")
 
-	instructionsData, err := fetchBytes("instructions.json", instructionsUrl)
+	step(ResolveFetchingInstructions)
+	instructionsData, err := fetchBytes(ctx, "instructions.json", instructionsUrl)
 	if err != nil {
 		return nil, err
 	}
 
-	checksum := HashBytes(instructionsData)
+	step(ResolveVerifyingInstructions)
+	checksum := hasher(ctx).HashBytes(instructionsData)
 	if !HashEqual(release.Game.InstructionsHash, checksum) {
 		return nil, fmt.Errorf("'%s' hash mismatch, expected %s got %s", instructionsUrl,
 			strings.ToUpper(release.Game.InstructionsHash), strings.ToUpper(checksum))
@@ -90,32 +244,82 @@ func ResolveInstructions(productsUrl *url.URL, product string) (*ResolvedInstruc
 	}
 
 	return &ResolvedInstructions{
-		BaseUrl:      baseUrl,
-		Instructions: instructions,
-		VersionName:  release.Game.VersionName,
+		BaseUrl:          baseUrl,
+		Instructions:     instructions,
+		VersionName:      release.Game.VersionName,
+		FallbackBaseUrls: fallbackBaseUrls,
 	}, nil
 }
 
-func fetchBytes(what string, location *url.URL) ([]byte, error) {
-	resp, err := http.Get(location.String())
+// fetchBytes fetches a metadata file, retrying failures as set with WithRetryPolicy and caching it in the cache
+// set with WithMetadataCache.
+func fetchBytes(ctx context.Context, what string, location *url.URL) ([]byte, error) {
+	var data []byte
+	err := retry(ctx, metadataRetryPolicy(ctx), "Fetching "+what, func() error {
+		var err error
+		data, err = fetchBytesOnce(ctx, what, location)
+		return err
+	})
+	return data, err
+}
+
+// fetchBytesOnce makes a single attempt of fetchBytes. Failures that won't go away by trying again (e.g.
+// status 404) are marked as permanent.
+func fetchBytesOnce(ctx context.Context, what string, location *url.URL) ([]byte, error) {
+	cache := metadataCache(ctx)
+	var cached *cachedResponse
+	if cache != nil {
+		cached = cache.get(location)
+	}
+	resp, err := sendWithToken(ctx, requestTokens(ctx), what, func(token string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location.String(), nil)
+		if err != nil {
+			return nil, permanent(fmt.Errorf("failed to create request to fetch %s: %w", what, err))
+		}
+		setRequestHeaders(req, requestHeaders(ctx))
+		setAuthorization(req, token)
+		if cached != nil {
+			cached.setConditionalHeaders(req)
+		}
+		resp, err := httpClient(ctx).Do(req)
+		if err != nil {
+			// Error message very likely contains URL already.
+			return nil, fmt.Errorf("failed to fetch %s: %w", what, err)
+		}
+		return resp, nil
+	})
 	if err != nil {
-		// Error message very likely contains URL already.
-		return nil, fmt.Errorf("failed to fetch %s: %v", what, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		log.Printf("Using cached %s, '%s' not modified.", what, location)
+		return cached.Body, nil
 	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("failed to fetch %s (status %d)", what, resp.StatusCode)
+		err := fmt.Errorf("failed to fetch %s (status %d)", what, resp.StatusCode)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, permanent(err)
+		}
+		return nil, err
 	}
-	defer resp.Body.Close()
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response from '%s': %w", location, err)
 	}
+	if cache != nil {
+		if err := cache.put(location, resp.Header, data); err != nil {
+			// Not fatal, the next fetch just won't be able to use the cache.
+			log.Printf("Failed to cache %s: %s", what, err)
+		}
+	}
 	return data, nil
 }
 
-func fetchJson[T any](what string, location *url.URL) (T, error) {
+func fetchJson[T any](ctx context.Context, what string, location *url.URL) (T, error) {
 	var val T
-	data, err := fetchBytes(what, location)
+	data, err := fetchBytes(ctx, what, location)
 	if err != nil {
 		return val, err
 	}
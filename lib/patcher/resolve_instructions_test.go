@@ -0,0 +1,176 @@
+package patcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchBytesMetadataCache(t *testing.T) {
+	var fullResponses atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fullResponses.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("data"))
+	}))
+	defer server.Close()
+	location, err := url.Parse(server.URL + "/products.json")
+	require.NoError(t, err)
+	ctx := WithMetadataCache(context.Background(), NewMetadataCache(t.TempDir()))
+
+	data, err := fetchBytes(ctx, "products.json", location)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+	data, err = fetchBytes(ctx, "products.json", location)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+	require.EqualValues(t, 1, fullResponses.Load())
+
+	// Without cache there's no conditional request.
+	_, err = fetchBytes(context.Background(), "products.json", location)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, fullResponses.Load())
+}
+
+func TestFetchBytesRetry(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/products.json" {
+			requests.Add(1)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("data"))
+	}))
+	defer server.Close()
+	location, err := url.Parse(server.URL + "/products.json")
+	require.NoError(t, err)
+
+	// Without a policy nothing is retried.
+	_, err = fetchBytes(context.Background(), "products.json", location)
+	require.ErrorContains(t, err, "status 503")
+
+	requests.Store(0)
+	ctx := WithRetryPolicy(context.Background(), RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond})
+	data, err := fetchBytes(ctx, "products.json", location)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+	require.EqualValues(t, 2, requests.Load())
+
+	// A missing file won't appear by asking again.
+	requests.Store(0)
+	_, err = fetchBytes(ctx, "release.json", location.JoinPath("..", "release.json"))
+	require.ErrorContains(t, err, "status 404")
+	require.EqualValues(t, 1, requests.Load())
+}
+
+// newTestBackend starts a server serving a products.json with a single game "foo" (with the given JSON fields
+// besides the tag) and a release.json with the given game fields. The fields can use {{server}} for the
+// server URL. Returns the products.json URL.
+func newTestBackend(t *testing.T, productsGameFields string, releaseGameFields string) *url.URL {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body string
+		switch r.URL.Path {
+		case "/products.json":
+			body = `{"games": [{"tag": "foo", ` + productsGameFields + `}]}`
+		case "/release.json":
+			body = `{"game": {` + releaseGameFields + `}}`
+		case "/patches/instructions.json":
+			body = "[]"
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(strings.ReplaceAll(body, "{{server}}", server.URL)))
+	}))
+	t.Cleanup(server.Close)
+	location, err := url.Parse(server.URL + "/products.json")
+	require.NoError(t, err)
+	return location
+}
+
+// Release.json game fields that resolve to an empty instructions.json.
+var testReleaseGameFields = `"instructions_hash": "` + HashBytes([]byte("[]")) + `", "patch_path": "patches",` +
+	`"mirrors": [{"url": "{{server}}"}], "version_name": "1.0"`
+
+func TestResolveInstructionsReleaseUrlFieldNames(t *testing.T) {
+	for _, field := range []string{"legacy_data_path", "data_path"} {
+		t.Run(field, func(t *testing.T) {
+			productsUrl := newTestBackend(t, `"`+field+`": "{{server}}/release.json"`, testReleaseGameFields)
+			resolved, err := ResolveInstructions(productsUrl, "foo")
+			require.NoError(t, err)
+			require.Equal(t, "1.0", resolved.VersionName)
+			require.Empty(t, resolved.Instructions)
+		})
+	}
+}
+
+func TestResolveInstructionsMissingFields(t *testing.T) {
+	productsUrl := newTestBackend(t, `"release_path": "{{server}}/release.json"`, testReleaseGameFields)
+	_, err := ResolveInstructions(productsUrl, "foo")
+	require.ErrorContains(t, err, "missing field 'legacy_data_path' or 'data_path'")
+
+	productsUrl = newTestBackend(t, `"legacy_data_path": "{{server}}/release.json"`,
+		`"patch_path": "patches", "mirrors": [{"url": "{{server}}"}]`)
+	_, err = ResolveInstructions(productsUrl, "foo")
+	require.ErrorContains(t, err, "missing field 'instructions_hash'")
+}
+
+func TestResolveInstructionsEmptyReleaseUrl(t *testing.T) {
+	productsUrl := newTestBackend(t, `"legacy_data_path": ""`, testReleaseGameFields)
+	_, err := ResolveInstructions(productsUrl, "foo")
+	require.ErrorContains(t, err, "game 'foo' has no release URL configured")
+
+	productsUrl = newTestBackend(t, `"legacy_data_path": "release.json"`, testReleaseGameFields)
+	_, err = ResolveInstructions(productsUrl, "foo")
+	require.ErrorContains(t, err, "isn't an absolute URL")
+}
+
+func TestResolveInstructionsContext(t *testing.T) {
+	productsUrl := newTestBackend(t, `"legacy_data_path": "{{server}}/release.json"`, testReleaseGameFields)
+	steps := make([]ResolveStep, 0)
+	resolved, err := ResolveInstructionsContext(context.Background(), productsUrl, "foo",
+		func(s ResolveStep) { steps = append(steps, s) })
+	require.NoError(t, err)
+	require.Equal(t, "1.0", resolved.VersionName)
+	require.Equal(t, []ResolveStep{ResolveFetchingProducts, ResolveFetchingRelease, ResolveFetchingInstructions,
+		ResolveVerifyingInstructions}, steps)
+
+	// Canceling stops the resolve in the step it's in.
+	ctx, cancel := context.WithCancel(context.Background())
+	steps = steps[:0]
+	_, err = ResolveInstructionsContext(ctx, productsUrl, "foo", func(s ResolveStep) {
+		steps = append(steps, s)
+		if s == ResolveFetchingRelease {
+			cancel()
+		}
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, []ResolveStep{ResolveFetchingProducts, ResolveFetchingRelease}, steps)
+}
+
+func TestResolveInstructionsFallbackMirrors(t *testing.T) {
+	releaseFields := `"instructions_hash": "` + HashBytes([]byte("[]")) + `", "patch_path": "patches",` +
+		`"mirrors": [{"url": "{{server}}"}, {"url": "http://mirror2.invalid/"}, {"url": "::bad"}]`
+	location := newTestBackend(t, `"legacy_data_path": "{{server}}/release.json"`, releaseFields)
+	resolved, err := ResolveInstructions(location, "foo")
+	require.NoError(t, err)
+	require.Len(t, resolved.FallbackBaseUrls, 1)
+	require.Equal(t, "http://mirror2.invalid/patches", resolved.FallbackBaseUrls[0].String())
+}
@@ -0,0 +1,109 @@
+package patcher
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+)
+
+type typeRetryPolicy string
+
+const keyRetryPolicy typeRetryPolicy = "retryPolicy"
+
+// A RetryPolicy says how often and how quickly a failed operation (e.g. a download) is retried. The delay
+// between attempts grows exponentially. The zero value doesn't retry.
+type RetryPolicy struct {
+	// How many times to retry after the first attempt failed.
+	MaxAttempts int
+
+	// How long to wait before the first retry.
+	BaseDelay time.Duration
+
+	// How much to multiply the delay by after each retry (factor, so 2 = double every retry).
+	DelayFactor float64
+
+	// Fraction of each delay that is randomly added or subtracted (e.g. 0.2 for up to 20% more or less), so
+	// many patchers that failed at the same moment don't all retry at the same moment. 0 for no jitter.
+	Jitter float64
+}
+
+// delay returns how long to wait before the nth retry (counting from 1), without jitter.
+func (p RetryPolicy) delay(n int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < n; i++ {
+		// This mainly works because the durations are going to be fairly small so overflows are unlikely.
+		delay = time.Duration(float64(delay) * p.DelayFactor)
+	}
+	return delay
+}
+
+// jittered returns the delay with the policy's jitter applied.
+func (p RetryPolicy) jittered(delay time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return delay
+	}
+	return max(0, time.Duration(float64(delay)*(1+p.Jitter*(2*rand.Float64()-1))))
+}
+
+// WithRetryPolicy sets how failed fetches of metadata (products.json, release.json and instructions.json)
+// are retried. Without it they aren't. Downloads use the retry settings of DownloadConfig instead.
+func WithRetryPolicy(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, keyRetryPolicy, policy)
+}
+
+// metadataRetryPolicy returns the policy set with WithRetryPolicy, the zero policy if there is none.
+func metadataRetryPolicy(ctx context.Context) RetryPolicy {
+	policy, _ := ctx.Value(keyRetryPolicy).(RetryPolicy)
+	return policy
+}
+
+// A permanentError is a failure that retry doesn't retry, see permanent.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// permanent marks an error returned by the operation passed to retry as not worth retrying.
+func permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// retry runs op until it succeeds, waiting between attempts as the policy says. It gives up when the
+// attempts are used up, when op returns an error marked with permanent (which is returned without the mark)
+// or when the context is canceled. Failed attempts that are retried are logged as "<what> failed".
+func retry(ctx context.Context, policy RetryPolicy, what string, op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		var permErr permanentError
+		if errors.As(err, &permErr) {
+			return permErr.err
+		}
+		if attempt > policy.MaxAttempts {
+			return err
+		}
+		if errors.Is(err, context.Canceled) {
+			// Don't log cancelations, those likely aren't errors.
+			return err
+		}
+		wait := policy.jittered(policy.delay(attempt))
+		log.Printf("%s failed [attempt %d/%d, waiting %s until next attempt]: %s",
+			what, attempt, policy.MaxAttempts, wait.Round(time.Millisecond), err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package patcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testRetryPolicy retries quickly.
+var testRetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, DelayFactor: 2}
+
+func TestRetrySucceedsAfterFailures(t *testing.T) {
+	calls := 0
+	err := retry(context.Background(), testRetryPolicy, "Test", func() error {
+		calls++
+		if calls < 3 {
+			return fmt.Errorf("failure %d", calls)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+}
+
+func TestRetryExhausted(t *testing.T) {
+	calls := 0
+	err := retry(context.Background(), testRetryPolicy, "Test", func() error {
+		calls++
+		return fmt.Errorf("failure %d", calls)
+	})
+	// MaxAttempts retries after the first attempt, the last error is returned.
+	require.EqualError(t, err, "failure 4")
+	require.Equal(t, 4, calls)
+
+	calls = 0
+	err = retry(context.Background(), RetryPolicy{}, "Test", func() error {
+		calls++
+		return errors.New("failure")
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestRetryPermanent(t *testing.T) {
+	failure := errors.New("failure")
+	calls := 0
+	err := retry(context.Background(), testRetryPolicy, "Test", func() error {
+		calls++
+		return permanent(failure)
+	})
+	require.Same(t, failure, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestRetryCanceled(t *testing.T) {
+	// Canceled while waiting for the next attempt.
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour}
+	calls := 0
+	start := time.Now()
+	err := retry(ctx, policy, "Test", func() error {
+		calls++
+		cancel()
+		return errors.New("failure")
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 1, calls)
+	require.Less(t, time.Since(start), time.Minute)
+
+	// A canceled operation isn't retried.
+	calls = 0
+	err = retry(context.Background(), testRetryPolicy, "Test", func() error {
+		calls++
+		return fmt.Errorf("stopped: %w", context.Canceled)
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 1, calls)
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Second, DelayFactor: 1.5}
+	// The first retry waits the base delay.
+	require.Equal(t, time.Second, policy.delay(1))
+	require.Equal(t, 1500*time.Millisecond, policy.delay(2))
+	require.Equal(t, 2250*time.Millisecond, policy.delay(3))
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	require.Equal(t, time.Second, RetryPolicy{}.jittered(time.Second))
+	policy := RetryPolicy{Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		delay := policy.jittered(time.Second)
+		require.GreaterOrEqual(t, delay, 800*time.Millisecond)
+		require.LessOrEqual(t, delay, 1200*time.Millisecond)
+	}
+	// Even a silly amount of jitter doesn't make the delay negative.
+	policy.Jitter = 5
+	for i := 0; i < 100; i++ {
+		require.GreaterOrEqual(t, policy.jittered(time.Second), time.Duration(0))
+	}
+}
@@ -3,6 +3,7 @@ package patcher
 import (
 	"fmt"
 	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
 	"time"
@@ -16,25 +17,64 @@ type BasicFileInfo struct {
 
 // ScanFiles recursively determines all files in the directory
 // and gets limited information such as modification time.
-func ScanFiles(rootDir string) (map[string]BasicFileInfo, error) {
+//
+// If onFile is not nil it's called after each file with the number of files found so far,
+// as scanning a big directory can take a while.
+func ScanFiles(rootDir string, onFile func(found int)) (map[string]BasicFileInfo, error) {
+	infos, _, err := scanFiles(os.DirFS(rootDir), rootDir, onFile, false)
+	return infos, err
+}
+
+// ScanFilesSkippingErrors is like ScanFiles, but files and directories that can't be read (e.g. folders
+// protected by the OS) are skipped with a warning instead of failing the scan. Returns the skipped paths.
+// An error reading the directory itself still fails the scan.
+func ScanFilesSkippingErrors(rootDir string, onFile func(found int)) (map[string]BasicFileInfo, []string, error) {
+	return scanFiles(os.DirFS(rootDir), rootDir, onFile, true)
+}
+
+// scanFiles scans like ScanFiles, optionally skipping what can't be read. The filesystem is the root dir,
+// which is only used for messages.
+func scanFiles(
+	filesystem fs.FS,
+	rootDir string,
+	onFile func(found int),
+	skipErrors bool,
+) (map[string]BasicFileInfo, []string, error) {
 	infos := make(map[string]BasicFileInfo)
-	filesystem := os.DirFS(rootDir)
-	err := fs.WalkDir(filesystem, ".", func(path string, d fs.DirEntry, err error) error {
+	skipped := make([]string, 0)
+	skip := func(path string, d fs.DirEntry, err error) error {
+		if !skipErrors || path == "." {
+			return err
+		}
+		log.Printf("Warning: skipping '%s' while scanning: %s", filepath.Join(rootDir, path), err)
+		skipped = append(skipped, filepath.Clean(path))
 		if d.IsDir() {
-			return nil
+			// Don't walk the entries that could be read before the error.
+			return fs.SkipDir
 		}
+		return nil
+	}
+	err := fs.WalkDir(filesystem, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			return fmt.Errorf("error while scanning file '%s': %w", path, err)
+			// For a directory that can't be read this is the second call, after the one for the directory
+			// itself succeeded.
+			return skip(path, d, fmt.Errorf("error while scanning file '%s': %w", path, err))
+		}
+		if d.IsDir() {
+			return nil
 		}
 		info, err := d.Info()
 		if err != nil {
-			return fmt.Errorf("error while statting file '%s': %w", path, err)
+			return skip(path, d, fmt.Errorf("error while statting file '%s': %w", path, err))
 		}
 		infos[filepath.Clean(path)] = BasicFileInfo{ModTime: info.ModTime()}
+		if onFile != nil {
+			onFile(len(infos))
+		}
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return infos, nil
+	return infos, skipped, nil
 }
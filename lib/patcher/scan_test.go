@@ -0,0 +1,61 @@
+package patcher
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanFilesReportsProgress(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a", "b"), nil, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "c"), nil, 0644))
+	var reported []int
+	infos, err := ScanFiles(dir, func(found int) { reported = append(reported, found) })
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Contains(t, infos, filepath.Join("a", "b"))
+	require.Equal(t, []int{1, 2}, reported)
+}
+
+// lockedFS is a filesystem where one directory can't be read, like a folder protected by the OS.
+type lockedFS struct {
+	fstest.MapFS
+	locked string
+}
+
+func (l lockedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == l.locked {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrPermission}
+	}
+	return l.MapFS.ReadDir(name)
+}
+
+func TestScanFilesSkipErrors(t *testing.T) {
+	filesystem := lockedFS{
+		MapFS: fstest.MapFS{
+			"game/file":        {},
+			"locked/file":      {},
+			"zzz/another_file": {},
+		},
+		locked: "locked",
+	}
+	_, _, err := scanFiles(filesystem, "root", nil, false)
+	require.ErrorIs(t, err, fs.ErrPermission)
+
+	infos, skipped, err := scanFiles(filesystem, "root", nil, true)
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Contains(t, infos, filepath.Join("zzz", "another_file"))
+	require.Equal(t, []string{"locked"}, skipped)
+
+	// The root dir itself can't be skipped.
+	filesystem.locked = "."
+	_, _, err = scanFiles(filesystem, "root", nil, true)
+	require.ErrorIs(t, err, fs.ErrPermission)
+}
@@ -0,0 +1,139 @@
+package patcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A SelfCheckMismatch is a file whose contents don't match the checksum recorded in the manifest.
+type SelfCheckMismatch struct {
+	// Product the file belongs to.
+	Product string
+
+	// Filename relative to the install dir.
+	Filename string
+
+	// Checksum recorded in the manifest.
+	Expected string
+
+	// Checksum of the file on disk, empty if the file is missing or couldn't be read.
+	Actual string
+
+	// Why the file couldn't be read (e.g. a permission problem), nil if it could be read or is missing.
+	Err error
+}
+
+// Unreadable returns whether the file exists but couldn't be read, so it's not known whether it matches.
+func (m SelfCheckMismatch) Unreadable() bool {
+	return m.Err != nil
+}
+
+// selfCheckFile is a file to check in SelfCheck.
+type selfCheckFile struct {
+	product  string
+	filename string
+	checksum string
+}
+
+// SelfCheck computes the checksums of all files listed in the manifest in the install dir and returns
+// those that no longer match the manifest (e.g. because of disk corruption), sorted by product and filename.
+// Unlike the verify phase it doesn't need instructions, the manifest is the reference. Files of all
+// products in the manifest are checked.
+//
+// A file that can't be read doesn't stop the check, it's returned as a mismatch with Err set so a report
+// covers all files. Returns an error if there's no manifest or the check is canceled.
+func SelfCheck(ctx context.Context, installDir string, numWorkers int) ([]SelfCheckMismatch, error) {
+	if err := checkNumWorkers("number of workers", numWorkers); err != nil {
+		return nil, err
+	}
+	mf, err := readManifestFile(installDir, false)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("no manifest in '%s', nothing to check against (has the game been installed?)",
+				installDir)
+		}
+		return nil, err
+	}
+	toCheck := make([]selfCheckFile, 0)
+	for product, entries := range mf.Products {
+		for filename, entry := range entries {
+			toCheck = append(toCheck, selfCheckFile{product, filename, entry.LastChecksum})
+		}
+	}
+	sort.Slice(toCheck, func(i, j int) bool {
+		if toCheck[i].product != toCheck[j].product {
+			return toCheck[i].product < toCheck[j].product
+		}
+		return toCheck[i].filename < toCheck[j].filename
+	})
+
+	log.Printf("Computing checksums of %d files in '%s'.", len(toCheck), installDir)
+	return checkFiles(ctx, installDir, toCheck, numWorkers)
+}
+
+// checkFiles computes the checksums of files in the install dir with numWorkers workers and returns those that
+// don't match, in the order of toCheck.
+func checkFiles(
+	ctx context.Context,
+	installDir string,
+	toCheck []selfCheckFile,
+	numWorkers int,
+) ([]SelfCheckMismatch, error) {
+	results, err := DoInParallelWithResult[selfCheckFile, *SelfCheckMismatch](
+		ctx,
+		func(ctx context.Context, scf selfCheckFile) (*SelfCheckMismatch, error) {
+			return checkFile(ctx, installDir, scf)
+		},
+		toCheck,
+		numWorkers,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	mismatches := make([]SelfCheckMismatch, 0)
+	for _, m := range results {
+		if m != nil {
+			mismatches = append(mismatches, *m)
+		}
+	}
+	return mismatches, nil
+}
+
+// checkFile computes the checksum of a file in the install dir, returning a mismatch if it's missing, can't be
+// read or doesn't have the expected checksum. Only fails if the context is canceled.
+func checkFile(ctx context.Context, installDir string, scf selfCheckFile) (*SelfCheckMismatch, error) {
+	realFilename := filepath.Join(installDir, scf.filename)
+	LogVerbose(ctx, "Computing checksum of '%s'.", realFilename)
+	mismatch := &SelfCheckMismatch{Product: scf.product, Filename: scf.filename, Expected: scf.checksum}
+	file, err := os.Open(realFilename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return mismatch, nil
+		}
+		LogVerbose(ctx, "Failed to open '%s': %s", realFilename, err)
+		mismatch.Err = fmt.Errorf("failed to open '%s' to compute checksum: %w", realFilename, err)
+		return mismatch, nil
+	}
+	defer file.Close()
+	checksum, err := hasher(ctx).HashReader(ctx, file)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		LogVerbose(ctx, "Failed to read '%s': %s", realFilename, err)
+		mismatch.Err = fmt.Errorf("failed to compute checksum of '%s': %w", realFilename, err)
+		return mismatch, nil
+	}
+	if HashEqual(checksum, scf.checksum) {
+		return nil, nil
+	}
+	mismatch.Actual = checksum
+	return mismatch, nil
+}
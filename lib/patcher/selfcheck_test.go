@@ -0,0 +1,56 @@
+package patcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfCheck(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a", "good"), []byte("good"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bad"), []byte("corrupted"), 0644))
+	manifest := NewManifest("foo")
+	manifest.Add(filepath.Join("a", "good"), time.Now(), HashBytes([]byte("good")))
+	manifest.Add("bad", time.Now(), HashBytes([]byte("bad")))
+	manifest.Add("missing", time.Now(), HashBytes([]byte("missing")))
+	require.NoError(t, manifest.WriteManifest(dir))
+
+	mismatches, err := SelfCheck(context.Background(), dir, 2)
+	require.NoError(t, err)
+	require.Equal(t, []SelfCheckMismatch{
+		{Product: "foo", Filename: "bad", Expected: HashBytes([]byte("bad")), Actual: HashBytes([]byte("corrupted"))},
+		{Product: "foo", Filename: "missing", Expected: HashBytes([]byte("missing"))},
+	}, mismatches)
+}
+
+func TestSelfCheckNoManifest(t *testing.T) {
+	_, err := SelfCheck(context.Background(), t.TempDir(), 2)
+	require.ErrorContains(t, err, "no manifest")
+}
+
+func TestSelfCheckUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	// A directory where the file should be can be opened but not read.
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "unreadable"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "zbad"), []byte("corrupted"), 0644))
+	manifest := NewManifest("foo")
+	manifest.Add("unreadable", time.Now(), HashBytes([]byte("unreadable")))
+	manifest.Add("zbad", time.Now(), HashBytes([]byte("bad")))
+	require.NoError(t, manifest.WriteManifest(dir))
+
+	// The unreadable file doesn't stop the check of the other files.
+	mismatches, err := SelfCheck(context.Background(), dir, 1)
+	require.NoError(t, err)
+	require.Len(t, mismatches, 2)
+	require.True(t, mismatches[0].Unreadable())
+	require.ErrorContains(t, mismatches[0].Err, "failed to compute checksum")
+	require.Equal(t, "", mismatches[0].Actual)
+	require.False(t, mismatches[1].Unreadable())
+	require.Equal(t, HashBytes([]byte("corrupted")), mismatches[1].Actual)
+}
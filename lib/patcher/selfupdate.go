@@ -0,0 +1,128 @@
+package patcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Where to check for a newer version of the patcher by default.
+const DefaultSelfUpdateUrl = "https://api.github.com/repos/pminten/totemarts-patcher-cli/releases/latest"
+
+// SelfUpdateInfo describes the latest available version of the patcher.
+type SelfUpdateInfo struct {
+	// Latest version.
+	Version string
+	// Where to get it, may be empty.
+	Url string
+	// Whether Version is newer than the running version.
+	Newer bool
+}
+
+// selfUpdateJson contains the relevant parts of the response of the self update URL.
+// Both a simple {"version": ..., "url": ...} document and the GitHub latest release API are understood.
+type selfUpdateJson struct {
+	Version string `json:"version"`
+	Url     string `json:"url"`
+	TagName string `json:"tag_name"`
+	HtmlUrl string `json:"html_url"`
+}
+
+// CheckSelfUpdate fetches the latest patcher version from updateUrl and compares it to currentVersion.
+// It never downloads anything else, it's up to the caller to tell the user.
+func CheckSelfUpdate(ctx context.Context, updateUrl *url.URL, currentVersion string) (*SelfUpdateInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, updateUrl.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request to check for patcher update: %w", err)
+	}
+	resp, err := httpClient(ctx).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for patcher update: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to check for patcher update at '%s' (status %d)", updateUrl, resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from '%s': %w", updateUrl, err)
+	}
+	var raw selfUpdateJson
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to decode response from '%s': %w", updateUrl, err)
+	}
+	info := SelfUpdateInfo{Version: raw.Version, Url: raw.Url}
+	if info.Version == "" {
+		info.Version = raw.TagName
+	}
+	if info.Url == "" {
+		info.Url = raw.HtmlUrl
+	}
+	if info.Version == "" {
+		return nil, fmt.Errorf("response from '%s' doesn't contain a version", updateUrl)
+	}
+	cmp, err := CompareVersions(currentVersion, info.Version)
+	if err != nil {
+		return nil, err
+	}
+	info.Newer = cmp < 0
+	return &info, nil
+}
+
+// CompareVersions compares two semantic versions (optionally prefixed with 'v'). Returns -1 if a is older
+// than b, 0 if they're equal and 1 if a is newer. Build metadata (after '+') is ignored and prerelease
+// versions are considered older than the corresponding release, but prereleases aren't compared among
+// each other beyond equality.
+func CompareVersions(a string, b string) (int, error) {
+	aParts, aPre, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	bParts, bPre, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := range aParts {
+		if aParts[i] != bParts[i] {
+			if aParts[i] < bParts[i] {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	switch {
+	case aPre == bPre:
+		return 0, nil
+	case aPre == "":
+		return 1, nil
+	case bPre == "":
+		return -1, nil
+	default:
+		return strings.Compare(aPre, bPre), nil
+	}
+}
+
+// parseVersion splits a version like v1.2.3-rc.1 into numeric parts and a prerelease string.
+func parseVersion(version string) ([3]int, string, error) {
+	var parts [3]int
+	s := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, pre, _ := strings.Cut(s, "-")
+	fields := strings.Split(s, ".")
+	if len(fields) > 3 {
+		return parts, "", fmt.Errorf("invalid version %q", version)
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return parts, "", fmt.Errorf("invalid version %q", version)
+		}
+		parts[i] = n
+	}
+	return parts, pre, nil
+}
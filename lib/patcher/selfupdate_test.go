@@ -0,0 +1,53 @@
+package patcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"v1.0.0", "1.0.0", 0},
+		{"1.0.0", "1.0.1", -1},
+		{"1.2.0", "1.10.0", -1},
+		{"2.0", "1.9.9", 1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0", "1.0.0-rc.1", 1},
+		{"1.0.0+abc", "1.0.0", 0},
+	}
+	for _, c := range cases {
+		actual, err := CompareVersions(c.a, c.b)
+		require.NoError(t, err)
+		require.Equal(t, c.expected, actual, "%s vs %s", c.a, c.b)
+	}
+	_, err := CompareVersions("<unknown version>", "1.0.0")
+	require.Error(t, err)
+}
+
+func TestCheckSelfUpdate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"tag_name": "v1.2.0", "html_url": "https://example.com/release"}`))
+	}))
+	defer server.Close()
+	updateUrl, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	info, err := CheckSelfUpdate(context.Background(), updateUrl, "v1.1.0")
+	require.NoError(t, err)
+	require.True(t, info.Newer)
+	require.Equal(t, "v1.2.0", info.Version)
+	require.Equal(t, "https://example.com/release", info.Url)
+
+	info, err = CheckSelfUpdate(context.Background(), updateUrl, "v1.2.0")
+	require.NoError(t, err)
+	require.False(t, info.Newer)
+}
@@ -0,0 +1,107 @@
+package patcher
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/url"
+	"path/filepath"
+)
+
+// A fullPatchStreamer applies full patches while they're being downloaded, see PatcherConfig.StreamFullPatches.
+// The patched files are recorded in the apply progress file, so the apply phase only moves them into place.
+type fullPatchStreamer struct {
+	backend    StreamingPatchBackend
+	installDir string
+
+	// Updates to stream, by the patch file that would otherwise be downloaded for them.
+	updates map[string]UpdateInstr
+
+	applied *applyProgress
+}
+
+// newFullPatchStreamer returns a streamer for the full patches in the actions that can be streamed, nil if
+// streaming is disabled or there's nothing to stream. Full patches used for more than one file aren't
+// streamed, neither are patch files that are already (partially) downloaded as those can be resumed.
+func newFullPatchStreamer(config PatcherConfig, backend PatchBackend, actions *DeterminedActions) *fullPatchStreamer {
+	if !config.StreamFullPatches || config.KeepPatches {
+		return nil
+	}
+	streamingBackend, ok := backend.(StreamingPatchBackend)
+	if !ok {
+		log.Printf("The patch backend can't apply patches while downloading them, downloading them first.")
+		return nil
+	}
+	uses := make(map[string]int)
+	for _, ui := range actions.ToUpdate {
+		uses[ui.PatchPath]++
+	}
+	candidates := make(map[string]UpdateInstr)
+	for _, ui := range actions.ToUpdate {
+		if !ui.IsDelta && uses[ui.PatchPath] == 1 {
+			candidates[ui.PatchPath] = ui
+		}
+	}
+	updates := make(map[string]UpdateInstr)
+	for _, di := range actions.ToDownload {
+		ui, found := candidates[di.LocalPath]
+		if !found {
+			continue
+		}
+		if _, found := existingDownloadSize(filepath.Join(config.InstallDir, di.LocalPath)); found {
+			continue
+		}
+		updates[di.LocalPath] = ui
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	log.Printf("Applying %d full patches while downloading them.", len(updates))
+	return &fullPatchStreamer{
+		backend:    streamingBackend,
+		installDir: config.InstallDir,
+		updates:    updates,
+		applied:    readApplyProgress(config.InstallDir),
+	}
+}
+
+// stream applies the patch of a download while downloading it, if it's one to stream. Returns whether that
+// succeeded, if not the patch file should be downloaded as usual.
+func (s *fullPatchStreamer) stream(
+	ctx context.Context,
+	downloader *Downloader,
+	remoteUrl *url.URL,
+	di DownloadInstr,
+) bool {
+	if s == nil {
+		return false
+	}
+	ui, found := s.updates[di.LocalPath]
+	if !found {
+		return false
+	}
+	newPath := filepath.Join(s.installDir, ui.TempFilename)
+	// Named after the output, the patch file itself is used if this fails.
+	err := downloader.StreamFile(ctx, remoteUrl, newPath, di.Checksum, di.Size, func(r io.Reader) error {
+		return s.backend.ApplyFullPatchStream(ctx, r, remoteUrl.String(), newPath, ui.Checksum, ui.Size)
+	})
+	if err != nil {
+		removePartialOutput(newPath)
+		if ctx.Err() == nil {
+			log.Printf("Applying '%s' while downloading it failed, downloading it first: %s", remoteUrl, err)
+		}
+		return false
+	}
+	if err := s.applied.record(s.installDir, ui); err != nil {
+		// The apply phase recognizes the file by its checksum instead.
+		log.Printf("Warning: %s, the apply phase will have to check '%s' again.", err, ui.TempFilename)
+	}
+	return true
+}
+
+// close closes the apply progress file.
+func (s *fullPatchStreamer) close() {
+	if s != nil {
+		s.applied.close()
+	}
+}
@@ -0,0 +1,79 @@
+package patcher
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// streamingCopyBackend applies a patch by copying it, also when streaming.
+type streamingCopyBackend struct {
+	copyingBackend
+	fail bool
+}
+
+func (b streamingCopyBackend) ApplyFullPatchStream(
+	_ context.Context, patch io.Reader, _ string, newPath string, _ string, _ int64,
+) error {
+	if b.fail {
+		return errors.New("can't stream")
+	}
+	data, err := io.ReadAll(patch)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(newPath, data, 0644)
+}
+
+func TestStreamFullPatches(t *testing.T) {
+	data := []byte("new data")
+	location := serveBytes(t, data)
+	actions := &DeterminedActions{
+		ToDownload: []DownloadInstr{
+			{RemotePath: "full/new", LocalPath: "patch/new", Checksum: HashBytes(data), Size: int64(len(data))},
+		},
+		ToUpdate: []UpdateInstr{
+			{PatchPath: "patch/new", PatchChecksum: HashBytes(data), FilePath: "file",
+				TempFilename: "patch/apply/00000_new", Checksum: HashBytes(data), Size: int64(len(data))},
+		},
+	}
+	for _, fail := range []bool{false, true} {
+		installDir := t.TempDir()
+		require.NoError(t, createPatchDirs(installDir))
+		config := PatcherConfig{InstallDir: installDir, StreamFullPatches: true}
+		streamer := newFullPatchStreamer(config, streamingCopyBackend{fail: fail}, actions)
+		require.NotNil(t, streamer)
+		err := runDownloadPhase(context.Background(), actions.ToDownload, installDir, []*url.URL{location},
+			testDownloadConfig(), NewProgress(), 1, 0, nil, newVerifiedPatches(), 0, streamer)
+		streamer.close()
+		require.NoError(t, err)
+		if fail {
+			// Downloaded as usual instead.
+			require.FileExists(t, filepath.Join(installDir, "patch", "new"))
+			require.NoFileExists(t, filepath.Join(installDir, "patch", "apply", "00000_new"))
+		} else {
+			require.NoFileExists(t, filepath.Join(installDir, "patch", "new"))
+			require.True(t, readApplyProgress(installDir).isApplied(installDir, actions.ToUpdate[0]))
+		}
+	}
+
+	// Patches that are already being downloaded, used for several files or applied by a backend that can't
+	// stream aren't streamed.
+	installDir := t.TempDir()
+	config := PatcherConfig{InstallDir: installDir, StreamFullPatches: true}
+	require.Nil(t, newFullPatchStreamer(config, copyingBackend{}, actions))
+	require.NoError(t, createPatchDirs(installDir))
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "patch", "new"), data[:3], 0644))
+	require.Nil(t, newFullPatchStreamer(config, streamingCopyBackend{}, actions))
+	twice := *actions
+	twice.ToUpdate = append(twice.ToUpdate, UpdateInstr{PatchPath: "patch/new", FilePath: "other",
+		TempFilename: "patch/apply/00001_new", Checksum: HashBytes(data)})
+	require.Nil(t, newFullPatchStreamer(PatcherConfig{InstallDir: t.TempDir(), StreamFullPatches: true},
+		streamingCopyBackend{}, &twice))
+}
@@ -0,0 +1,244 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How many workers a phase that ramps up (see PatcherConfig.DownloadRampUp) starts with.
+const rampUpStartWorkers = 2
+
+// A ThrottleLevel indicates how aggressively the patcher should use the machine.
+type ThrottleLevel int
+
+const (
+	// Use the configured number of workers.
+	ThrottleNormal ThrottleLevel = 0
+	// Use a single worker per phase, for when the user wants to use the machine for something else.
+	ThrottleLow ThrottleLevel = 1
+)
+
+// String implements (fmt.Stringer).String
+func (l ThrottleLevel) String() string {
+	switch l {
+	case ThrottleNormal:
+		return "normal"
+	case ThrottleLow:
+		return "low"
+	default:
+		return fmt.Sprintf("ThrottleLevel(%d)", int(l))
+	}
+}
+
+// A Throttle allows changing the number of concurrent download and apply workers while the
+// patcher is running. It can also pause the patcher entirely. A nil *Throttle is valid and
+// simply never changes anything.
+//
+// Pausing is cooperative. No new files are started while paused, running downloads are suspended
+// between reads and the hashing in the verify phase waits before starting the next file. A running
+// xdelta process can't be suspended, so applying a patch only pauses between files.
+type Throttle struct {
+	mu    sync.Mutex
+	level ThrottleLevel
+	// Limiters of running phases.
+	limiters map[*Limiter]int // Value is the number of workers at normal level.
+	// Closed on resume. Nil when not paused.
+	resumed chan struct{}
+}
+
+// NewThrottle creates a throttle at normal level.
+func NewThrottle() *Throttle {
+	return &Throttle{
+		level:    ThrottleNormal,
+		limiters: make(map[*Limiter]int),
+	}
+}
+
+// Level returns the current throttle level.
+func (t *Throttle) Level() ThrottleLevel {
+	if t == nil {
+		return ThrottleNormal
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.level
+}
+
+// SetLevel changes the throttle level, adjusting the limits of running phases.
+func (t *Throttle) SetLevel(level ThrottleLevel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.level = level
+	t.updateLimitsLocked()
+}
+
+// Paused returns whether the throttle is paused.
+func (t *Throttle) Paused() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.resumed != nil
+}
+
+// Pause stops new work from being started and suspends running downloads until Resume is called.
+func (t *Throttle) Pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pauseLocked()
+}
+
+// Resume undoes Pause.
+func (t *Throttle) Resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resumeLocked()
+}
+
+// TogglePause pauses if not paused and resumes otherwise. Returns whether the throttle is now paused.
+func (t *Throttle) TogglePause() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.resumed != nil {
+		t.resumeLocked()
+		return false
+	}
+	t.pauseLocked()
+	return true
+}
+
+// pauseLocked is Pause, with the mutex held.
+func (t *Throttle) pauseLocked() {
+	if t.resumed == nil {
+		t.resumed = make(chan struct{})
+		t.updateLimitsLocked()
+	}
+}
+
+// resumeLocked is Resume, with the mutex held.
+func (t *Throttle) resumeLocked() {
+	if t.resumed != nil {
+		close(t.resumed)
+		t.resumed = nil
+		t.updateLimitsLocked()
+	}
+}
+
+// waitWhilePaused blocks until the throttle is not paused or the context is canceled.
+func (t *Throttle) waitWhilePaused(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	resumed := t.resumed
+	t.mu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Cycle switches to the next throttle level (wrapping around) and returns the new level.
+func (t *Throttle) Cycle() ThrottleLevel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.level == ThrottleNormal {
+		t.level = ThrottleLow
+	} else {
+		t.level = ThrottleNormal
+	}
+	t.updateLimitsLocked()
+	return t.level
+}
+
+// newLimiter creates a limiter for a phase which would use normal workers when not throttled.
+// The limiter should be passed to forget when the phase is done.
+func (t *Throttle) newLimiter(normal int) *Limiter {
+	if t == nil {
+		return NewLimiter(normal)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	limiter := NewLimiter(t.limitLocked(normal))
+	t.limiters[limiter] = normal
+	return limiter
+}
+
+// forget stops adjusting a limiter created by newLimiter.
+func (t *Throttle) forget(limiter *Limiter) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.limiters, limiter)
+}
+
+// setNormal changes the number of workers a limiter created by newLimiter would use when not throttled.
+func (t *Throttle) setNormal(limiter *Limiter, normal int) {
+	if t == nil {
+		limiter.SetLimit(normal)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, found := t.limiters[limiter]; found {
+		t.limiters[limiter] = normal
+		limiter.SetLimit(t.limitLocked(normal))
+	}
+}
+
+// rampUp makes a limiter created by newLimiter start with rampUpStartWorkers workers and allow one more every
+// interval until it reaches normal, so not all connections are opened at the same moment. Returns a function
+// that stops the ramp-up, which must be called before forget.
+func (t *Throttle) rampUp(limiter *Limiter, normal int, interval time.Duration) func() {
+	if interval <= 0 || normal <= rampUpStartWorkers {
+		return func() {}
+	}
+	current := rampUpStartWorkers
+	t.setNormal(limiter, current)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for current < normal {
+			select {
+			case <-ticker.C:
+				current++
+				t.setNormal(limiter, current)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func (t *Throttle) updateLimitsLocked() {
+	for limiter, normal := range t.limiters {
+		limiter.SetLimit(t.limitLocked(normal))
+	}
+}
+
+func (t *Throttle) limitLocked(normal int) int {
+	if t.resumed != nil {
+		return 0
+	}
+	if t.level == ThrottleLow {
+		return min(1, normal)
+	}
+	return normal
+}
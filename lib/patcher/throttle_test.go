@@ -0,0 +1,114 @@
+package patcher
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottleCycle(t *testing.T) {
+	throttle := NewThrottle()
+	limiter := throttle.newLimiter(4)
+	require.Equal(t, 4, limiter.Limit())
+	require.Equal(t, ThrottleLow, throttle.Cycle())
+	require.Equal(t, 1, limiter.Limit())
+	require.Equal(t, ThrottleNormal, throttle.Cycle())
+	require.Equal(t, 4, limiter.Limit())
+	throttle.forget(limiter)
+	throttle.Cycle()
+	require.Equal(t, 4, limiter.Limit())
+}
+
+func TestThrottleNil(t *testing.T) {
+	var throttle *Throttle
+	limiter := throttle.newLimiter(4)
+	require.Equal(t, 4, limiter.Limit())
+	require.Equal(t, ThrottleNormal, throttle.Level())
+	throttle.forget(limiter)
+}
+
+func TestThrottlePause(t *testing.T) {
+	throttle := NewThrottle()
+	limiter := throttle.newLimiter(4)
+	throttle.Pause()
+	require.True(t, throttle.Paused())
+	require.Equal(t, 0, limiter.Limit())
+
+	waitDone := make(chan error)
+	go func() { waitDone <- throttle.waitWhilePaused(context.Background()) }()
+	select {
+	case <-waitDone:
+		require.Fail(t, "waitWhilePaused returned while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.False(t, throttle.TogglePause())
+	require.NoError(t, <-waitDone)
+	require.Equal(t, 4, limiter.Limit())
+}
+
+func TestThrottleToggleConcurrently(t *testing.T) {
+	throttle := NewThrottle()
+	limiter := throttle.newLimiter(4)
+	// Every call flips the state, so half of them see each outcome.
+	var paused, low atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if throttle.TogglePause() {
+				paused.Add(1)
+			}
+			if throttle.Cycle() == ThrottleLow {
+				low.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(50), paused.Load())
+	require.Equal(t, int32(50), low.Load())
+	require.False(t, throttle.Paused())
+	require.Equal(t, ThrottleNormal, throttle.Level())
+	require.Equal(t, 4, limiter.Limit())
+}
+
+func TestThrottleRampUp(t *testing.T) {
+	var nilThrottle *Throttle
+	limiter := nilThrottle.newLimiter(4)
+	stop := nilThrottle.rampUp(limiter, 4, 10*time.Millisecond)
+	require.Equal(t, 2, limiter.Limit())
+	require.Eventually(t, func() bool { return limiter.Limit() == 4 }, time.Second, 5*time.Millisecond)
+	stop()
+
+	// Throttling still applies while ramping up, the ramp-up continues underneath.
+	throttle := NewThrottle()
+	limiter = throttle.newLimiter(4)
+	throttle.SetLevel(ThrottleLow)
+	stop = throttle.rampUp(limiter, 4, 10*time.Millisecond)
+	require.Equal(t, 1, limiter.Limit())
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 1, limiter.Limit())
+	throttle.SetLevel(ThrottleNormal)
+	require.Eventually(t, func() bool { return limiter.Limit() == 4 }, time.Second, 5*time.Millisecond)
+	stop()
+	throttle.forget(limiter)
+
+	// Stopping early keeps the limit where it was.
+	limiter = nilThrottle.newLimiter(4)
+	stop = nilThrottle.rampUp(limiter, 4, time.Hour)
+	stop()
+	require.Equal(t, 2, limiter.Limit())
+
+	// Few workers or no interval start right away.
+	limiter = nilThrottle.newLimiter(2)
+	nilThrottle.rampUp(limiter, 2, time.Millisecond)()
+	require.Equal(t, 2, limiter.Limit())
+	limiter = nilThrottle.newLimiter(4)
+	nilThrottle.rampUp(limiter, 4, 0)()
+	require.Equal(t, 4, limiter.Limit())
+}
@@ -0,0 +1,424 @@
+package patcher
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+)
+
+// A decoder for VCDIFF (RFC 3284), the format produced by xdelta3. Supports the xdelta3 extension of
+// per-window Adler-32 checksums. Secondary compression, custom code tables and windows copying from
+// earlier target data (VCD_TARGET) are not supported, decoding such patches fails with
+// errVCDiffUnsupported.
+
+var errVCDiffUnsupported = errors.New("patch uses a VCDIFF feature that the built-in decoder doesn't support")
+
+const (
+	// Header indicator bits.
+	vcdDecompress = 0x01
+	vcdCodeTable  = 0x02
+	vcdAppHeader  = 0x04
+
+	// Window indicator bits.
+	vcdSource  = 0x01
+	vcdTarget  = 0x02
+	vcdAdler32 = 0x04 // xdelta3 extension.
+
+	// Instruction types.
+	vcdNoop = 0
+	vcdAdd  = 1
+	vcdRun  = 2
+	vcdCopy = 3
+
+	// Address cache sizes of the default code table.
+	vcdNearSize = 4
+	vcdSameSize = 3
+
+	// Refuse windows with a bigger delta encoding than this, xdelta3 windows are much smaller
+	// and a corrupt length shouldn't make us allocate absurd amounts of memory.
+	vcdMaxWindowSize = 1 << 28
+)
+
+// A vcdInstruction is half of a code table entry.
+type vcdInstruction struct {
+	typ  byte
+	size int
+	mode byte
+}
+
+// vcdCodeTableEntries is the default code table (RFC 3284 section 5.6).
+var vcdCodeTableEntries = func() [256][2]vcdInstruction {
+	var table [256][2]vcdInstruction
+	table[0][0] = vcdInstruction{typ: vcdRun}
+	idx := 1
+	for size := 0; size <= 17; size++ {
+		table[idx][0] = vcdInstruction{typ: vcdAdd, size: size}
+		idx++
+	}
+	for mode := byte(0); mode <= 8; mode++ {
+		table[idx][0] = vcdInstruction{typ: vcdCopy, mode: mode}
+		idx++
+		for size := 4; size <= 18; size++ {
+			table[idx][0] = vcdInstruction{typ: vcdCopy, size: size, mode: mode}
+			idx++
+		}
+	}
+	for mode := byte(0); mode <= 5; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			for copySize := 4; copySize <= 6; copySize++ {
+				table[idx] = [2]vcdInstruction{
+					{typ: vcdAdd, size: addSize},
+					{typ: vcdCopy, size: copySize, mode: mode},
+				}
+				idx++
+			}
+		}
+	}
+	for mode := byte(6); mode <= 8; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			table[idx] = [2]vcdInstruction{
+				{typ: vcdAdd, size: addSize},
+				{typ: vcdCopy, size: 4, mode: mode},
+			}
+			idx++
+		}
+	}
+	for mode := byte(0); mode <= 8; mode++ {
+		table[idx] = [2]vcdInstruction{
+			{typ: vcdCopy, size: 4, mode: mode},
+			{typ: vcdAdd, size: 1},
+		}
+		idx++
+	}
+	return table
+}()
+
+// vcdAddressCache decodes COPY addresses (RFC 3284 section 5.3).
+type vcdAddressCache struct {
+	near     [vcdNearSize]int
+	nextSlot int
+	same     [vcdSameSize * 256]int
+}
+
+func (c *vcdAddressCache) update(addr int) {
+	c.near[c.nextSlot] = addr
+	c.nextSlot = (c.nextSlot + 1) % vcdNearSize
+	c.same[addr%(vcdSameSize*256)] = addr
+}
+
+func (c *vcdAddressCache) decode(addrs *vcdBuffer, here int, mode byte) (int, error) {
+	var addr int
+	switch {
+	case mode == 0: // VCD_SELF
+		n, err := addrs.int()
+		if err != nil {
+			return 0, err
+		}
+		addr = n
+	case mode == 1: // VCD_HERE
+		n, err := addrs.int()
+		if err != nil {
+			return 0, err
+		}
+		addr = here - n
+	case int(mode) < 2+vcdNearSize:
+		n, err := addrs.int()
+		if err != nil {
+			return 0, err
+		}
+		addr = c.near[mode-2] + n
+	case int(mode) < 2+vcdNearSize+vcdSameSize:
+		b, err := addrs.byte()
+		if err != nil {
+			return 0, err
+		}
+		addr = c.same[(int(mode)-2-vcdNearSize)*256+int(b)]
+	default:
+		return 0, fmt.Errorf("invalid VCDIFF address mode %d", mode)
+	}
+	if addr < 0 || addr >= here {
+		return 0, fmt.Errorf("invalid VCDIFF copy address %d", addr)
+	}
+	c.update(addr)
+	return addr, nil
+}
+
+// A vcdBuffer reads VCDIFF values from a section of a window.
+type vcdBuffer struct {
+	b   []byte
+	pos int
+}
+
+func (b *vcdBuffer) byte() (byte, error) {
+	if b.pos >= len(b.b) {
+		return 0, errors.New("truncated VCDIFF window")
+	}
+	v := b.b[b.pos]
+	b.pos++
+	return v, nil
+}
+
+func (b *vcdBuffer) int() (int, error) {
+	return readVCDInt(b.byte)
+}
+
+func (b *vcdBuffer) bytes(n int) ([]byte, error) {
+	if n < 0 || n > len(b.b)-b.pos {
+		return nil, errors.New("truncated VCDIFF window")
+	}
+	v := b.b[b.pos : b.pos+n]
+	b.pos += n
+	return v, nil
+}
+
+func (b *vcdBuffer) done() bool {
+	return b.pos == len(b.b)
+}
+
+// readVCDInt reads a variable length integer (base 128, most significant digit first).
+func readVCDInt(next func() (byte, error)) (int, error) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		b, err := next()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			if v > 1<<62 {
+				break
+			}
+			return int(v), nil
+		}
+	}
+	return 0, errors.New("VCDIFF integer too large")
+}
+
+// decodeVCDiff decodes a VCDIFF patch, writing the result to out. The source may be nil if the
+// patch doesn't need one (a full patch).
+func decodeVCDiff(patch io.Reader, source io.ReaderAt, out io.Writer) error {
+	r := bufio.NewReader(patch)
+	readByte := func() (byte, error) {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return b, err
+	}
+
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return fmt.Errorf("failed to read VCDIFF header: %w", err)
+	}
+	if magic[0] != 0xd6 || magic[1] != 0xc3 || magic[2] != 0xc4 {
+		return errors.New("not a VCDIFF (xdelta3) patch")
+	}
+	if magic[3] != 0 {
+		return fmt.Errorf("unknown VCDIFF version %d: %w", magic[3], errVCDiffUnsupported)
+	}
+	hdrIndicator, err := readByte()
+	if err != nil {
+		return fmt.Errorf("failed to read VCDIFF header: %w", err)
+	}
+	if hdrIndicator&^(vcdDecompress|vcdCodeTable|vcdAppHeader) != 0 {
+		return fmt.Errorf("invalid VCDIFF header indicator %#x", hdrIndicator)
+	}
+	if hdrIndicator&vcdDecompress != 0 {
+		// Which secondary compressor is used. Only a problem if a window actually uses it.
+		if _, err := readByte(); err != nil {
+			return fmt.Errorf("failed to read VCDIFF header: %w", err)
+		}
+	}
+	if hdrIndicator&vcdCodeTable != 0 {
+		return fmt.Errorf("custom code table: %w", errVCDiffUnsupported)
+	}
+	if hdrIndicator&vcdAppHeader != 0 {
+		n, err := readVCDInt(readByte)
+		if err != nil {
+			return fmt.Errorf("failed to read VCDIFF header: %w", err)
+		}
+		if _, err := r.Discard(n); err != nil {
+			return fmt.Errorf("failed to read VCDIFF header: %w", err)
+		}
+	}
+
+	for {
+		winIndicator, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read VCDIFF window: %w", err)
+		}
+		if err := decodeVCDWindow(winIndicator, readByte, r, source, out); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeVCDWindow decodes a single window, after the window indicator has been read.
+func decodeVCDWindow(
+	winIndicator byte,
+	readByte func() (byte, error),
+	r io.Reader,
+	source io.ReaderAt,
+	out io.Writer,
+) error {
+	if winIndicator&^(vcdSource|vcdTarget|vcdAdler32) != 0 {
+		return fmt.Errorf("invalid VCDIFF window indicator %#x", winIndicator)
+	}
+	if winIndicator&vcdTarget != 0 {
+		return fmt.Errorf("window copying from target: %w", errVCDiffUnsupported)
+	}
+	segLen, segPos := 0, 0
+	if winIndicator&vcdSource != 0 {
+		var err error
+		if segLen, err = readVCDInt(readByte); err != nil {
+			return fmt.Errorf("failed to read VCDIFF window: %w", err)
+		}
+		if segPos, err = readVCDInt(readByte); err != nil {
+			return fmt.Errorf("failed to read VCDIFF window: %w", err)
+		}
+		if source == nil {
+			return errors.New("VCDIFF patch needs a source file but none was given")
+		}
+	}
+	deltaLen, err := readVCDInt(readByte)
+	if err != nil {
+		return fmt.Errorf("failed to read VCDIFF window: %w", err)
+	}
+	if deltaLen > vcdMaxWindowSize {
+		return fmt.Errorf("VCDIFF window too large (%d bytes)", deltaLen)
+	}
+	delta := vcdBuffer{b: make([]byte, deltaLen)}
+	if _, err := io.ReadFull(r, delta.b); err != nil {
+		return fmt.Errorf("failed to read VCDIFF window: %w", err)
+	}
+
+	targetLen, err := delta.int()
+	if err != nil {
+		return err
+	}
+	if targetLen > vcdMaxWindowSize {
+		return fmt.Errorf("VCDIFF target window too large (%d bytes)", targetLen)
+	}
+	deltaIndicator, err := delta.byte()
+	if err != nil {
+		return err
+	}
+	if deltaIndicator != 0 {
+		return fmt.Errorf("secondary compression: %w", errVCDiffUnsupported)
+	}
+	dataLen, err := delta.int()
+	if err != nil {
+		return err
+	}
+	instLen, err := delta.int()
+	if err != nil {
+		return err
+	}
+	addrLen, err := delta.int()
+	if err != nil {
+		return err
+	}
+	var expectedAdler []byte
+	if winIndicator&vcdAdler32 != 0 {
+		if expectedAdler, err = delta.bytes(4); err != nil {
+			return err
+		}
+	}
+	dataBytes, err := delta.bytes(dataLen)
+	if err != nil {
+		return err
+	}
+	instBytes, err := delta.bytes(instLen)
+	if err != nil {
+		return err
+	}
+	addrBytes, err := delta.bytes(addrLen)
+	if err != nil {
+		return err
+	}
+	if !delta.done() {
+		return errors.New("VCDIFF window has trailing data")
+	}
+	data := vcdBuffer{b: dataBytes}
+	inst := vcdBuffer{b: instBytes}
+	addrs := vcdBuffer{b: addrBytes}
+
+	target := make([]byte, 0, targetLen)
+	var cache vcdAddressCache
+	for !inst.done() {
+		idx, err := inst.byte()
+		if err != nil {
+			return err
+		}
+		for _, in := range vcdCodeTableEntries[idx] {
+			if in.typ == vcdNoop {
+				continue
+			}
+			size := in.size
+			if size == 0 {
+				if size, err = inst.int(); err != nil {
+					return err
+				}
+			}
+			if size > targetLen-len(target) {
+				return errors.New("VCDIFF instructions exceed target window size")
+			}
+			switch in.typ {
+			case vcdAdd:
+				added, err := data.bytes(size)
+				if err != nil {
+					return err
+				}
+				target = append(target, added...)
+			case vcdRun:
+				b, err := data.byte()
+				if err != nil {
+					return err
+				}
+				for i := 0; i < size; i++ {
+					target = append(target, b)
+				}
+			case vcdCopy:
+				addr, err := cache.decode(&addrs, segLen+len(target), in.mode)
+				if err != nil {
+					return err
+				}
+				if addr < segLen {
+					// Copy from source, possibly continuing in the target.
+					fromSource := min(size, segLen-addr)
+					start := len(target)
+					target = target[:start+fromSource]
+					if _, err := source.ReadAt(target[start:], int64(segPos+addr)); err != nil {
+						return fmt.Errorf("failed to read source for VCDIFF copy: %w", err)
+					}
+					size -= fromSource
+					addr = segLen
+				}
+				// Byte by byte because the ranges can overlap, that's how runs of patterns are encoded.
+				for i := addr - segLen; size > 0; i, size = i+1, size-1 {
+					target = append(target, target[i])
+				}
+			}
+		}
+	}
+	if len(target) != targetLen || !data.done() || !addrs.done() {
+		return errors.New("VCDIFF window doesn't match its declared sizes")
+	}
+	if expectedAdler != nil {
+		actual := adler32.Checksum(target)
+		expected := uint32(expectedAdler[0])<<24 | uint32(expectedAdler[1])<<16 |
+			uint32(expectedAdler[2])<<8 | uint32(expectedAdler[3])
+		if actual != expected {
+			return fmt.Errorf("VCDIFF window checksum mismatch (expected %08x, got %08x)", expected, actual)
+		}
+	}
+	if _, err := out.Write(target); err != nil {
+		return fmt.Errorf("failed to write patch output: %w", err)
+	}
+	return nil
+}
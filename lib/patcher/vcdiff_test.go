@@ -0,0 +1,161 @@
+package patcher
+
+import (
+	"bytes"
+	"hash/adler32"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// appendVCDInt appends a VCDIFF variable length integer.
+func appendVCDInt(b []byte, v int) []byte {
+	digits := []byte{byte(v & 0x7f)}
+	for v >>= 7; v > 0; v >>= 7 {
+		digits = append([]byte{byte(v&0x7f) | 0x80}, digits...)
+	}
+	return append(b, digits...)
+}
+
+// Instructions using the default code table, with explicit sizes.
+func vcdAddInst(size int) []byte { return appendVCDInt([]byte{1}, size) }
+func vcdRunInst(size int) []byte { return appendVCDInt([]byte{0}, size) }
+func vcdCopyInst(size int, mode int) []byte {
+	return appendVCDInt([]byte{byte(19 + 16*mode)}, size)
+}
+
+// A testVCDWindow describes a window for encodeTestVCDiff.
+type testVCDWindow struct {
+	source         []int // Segment length and position, nil for no source.
+	targetLen      int
+	data           []byte
+	inst           []byte
+	addr           []byte
+	adler          *uint32
+	deltaIndicator byte
+}
+
+// encodeTestVCDiff builds a VCDIFF patch from handcrafted windows.
+func encodeTestVCDiff(windows ...testVCDWindow) []byte {
+	out := []byte{0xd6, 0xc3, 0xc4, 0, 0}
+	for _, w := range windows {
+		var indicator byte
+		if w.source != nil {
+			indicator |= vcdSource
+		}
+		if w.adler != nil {
+			indicator |= vcdAdler32
+		}
+		out = append(out, indicator)
+		if w.source != nil {
+			out = appendVCDInt(out, w.source[0])
+			out = appendVCDInt(out, w.source[1])
+		}
+		delta := appendVCDInt(nil, w.targetLen)
+		delta = append(delta, w.deltaIndicator)
+		delta = appendVCDInt(delta, len(w.data))
+		delta = appendVCDInt(delta, len(w.inst))
+		delta = appendVCDInt(delta, len(w.addr))
+		if w.adler != nil {
+			a := *w.adler
+			delta = append(delta, byte(a>>24), byte(a>>16), byte(a>>8), byte(a))
+		}
+		delta = append(delta, w.data...)
+		delta = append(delta, w.inst...)
+		delta = append(delta, w.addr...)
+		out = appendVCDInt(out, len(delta))
+		out = append(out, delta...)
+	}
+	return out
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestVCDCodeTable(t *testing.T) {
+	require.Equal(t, [2]vcdInstruction{{typ: vcdRun}, {}}, vcdCodeTableEntries[0])
+	require.Equal(t, vcdInstruction{typ: vcdAdd, size: 17}, vcdCodeTableEntries[18][0])
+	require.Equal(t, vcdInstruction{typ: vcdCopy, size: 18, mode: 8}, vcdCodeTableEntries[162][0])
+	require.Equal(t, [2]vcdInstruction{{typ: vcdAdd, size: 1}, {typ: vcdCopy, size: 4}},
+		vcdCodeTableEntries[163])
+	require.Equal(t, [2]vcdInstruction{{typ: vcdAdd, size: 4}, {typ: vcdCopy, size: 6, mode: 5}},
+		vcdCodeTableEntries[234])
+	require.Equal(t, [2]vcdInstruction{{typ: vcdAdd, size: 1}, {typ: vcdCopy, size: 4, mode: 6}},
+		vcdCodeTableEntries[235])
+	require.Equal(t, [2]vcdInstruction{{typ: vcdCopy, size: 4, mode: 8}, {typ: vcdAdd, size: 1}},
+		vcdCodeTableEntries[255])
+}
+
+func TestDecodeVCDiffWithoutSource(t *testing.T) {
+	patch := encodeTestVCDiff(testVCDWindow{
+		targetLen: 14,
+		data:      []byte("hello x"),
+		// Copy from the target itself at address 0, there's no source segment.
+		inst: concat(vcdAddInst(6), vcdRunInst(3), vcdCopyInst(5, 0)),
+		addr: appendVCDInt(nil, 0),
+	})
+	var out bytes.Buffer
+	require.NoError(t, decodeVCDiff(bytes.NewReader(patch), nil, &out))
+	require.Equal(t, "hello xxxhello", out.String())
+}
+
+func TestDecodeVCDiffWithSource(t *testing.T) {
+	source := []byte("0123abcdef")
+	patch := encodeTestVCDiff(
+		testVCDWindow{
+			source:    []int{6, 4}, // "abcdef"
+			targetLen: 9,
+			data:      []byte("!"),
+			// Copy "def" from the source, continuing with "def" just written to the target.
+			// Then a copy relative to the previous address (near cache mode 2) of "de".
+			inst: concat(vcdCopyInst(6, 0), vcdAddInst(1), vcdCopyInst(2, 2)),
+			addr: concat(appendVCDInt(nil, 3), appendVCDInt(nil, 0)),
+		},
+		testVCDWindow{
+			targetLen: 2,
+			data:      []byte("ok"),
+			inst:      vcdAddInst(2),
+		},
+	)
+	var out bytes.Buffer
+	require.NoError(t, decodeVCDiff(bytes.NewReader(patch), bytes.NewReader(source), &out))
+	require.Equal(t, "defdef!deok", out.String())
+}
+
+func TestDecodeVCDiffAdler32(t *testing.T) {
+	good := adler32.Checksum([]byte("abc"))
+	bad := good + 1
+	window := testVCDWindow{targetLen: 3, data: []byte("abc"), inst: vcdAddInst(3), adler: &good}
+	var out bytes.Buffer
+	require.NoError(t, decodeVCDiff(bytes.NewReader(encodeTestVCDiff(window)), nil, &out))
+	require.Equal(t, "abc", out.String())
+
+	window.adler = &bad
+	err := decodeVCDiff(bytes.NewReader(encodeTestVCDiff(window)), nil, &out)
+	require.ErrorContains(t, err, "checksum mismatch")
+}
+
+func TestDecodeVCDiffErrors(t *testing.T) {
+	var out bytes.Buffer
+	err := decodeVCDiff(bytes.NewReader([]byte("PK\x03\x04")), nil, &out)
+	require.ErrorContains(t, err, "not a VCDIFF")
+
+	compressed := encodeTestVCDiff(testVCDWindow{targetLen: 3, data: []byte("abc"), inst: vcdAddInst(3),
+		deltaIndicator: 1})
+	err = decodeVCDiff(bytes.NewReader(compressed), nil, &out)
+	require.ErrorIs(t, err, errVCDiffUnsupported)
+
+	needsSource := encodeTestVCDiff(testVCDWindow{source: []int{3, 0}, targetLen: 3,
+		inst: vcdCopyInst(3, 0), addr: appendVCDInt(nil, 0)})
+	err = decodeVCDiff(bytes.NewReader(needsSource), nil, &out)
+	require.ErrorContains(t, err, "needs a source")
+
+	tooLong := encodeTestVCDiff(testVCDWindow{targetLen: 2, data: []byte("abc"), inst: vcdAddInst(3)})
+	err = decodeVCDiff(bytes.NewReader(tooLong), nil, &out)
+	require.ErrorContains(t, err, "exceed target window size")
+
+	truncated := encodeTestVCDiff(testVCDWindow{targetLen: 3, data: []byte("abc"), inst: vcdAddInst(3)})
+	err = decodeVCDiff(bytes.NewReader(truncated[:len(truncated)-2]), nil, &out)
+	require.Error(t, err)
+}
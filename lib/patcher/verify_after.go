@@ -0,0 +1,79 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// How many mismatching files a VerifyAfterError lists in its message, the rest is only counted.
+const maxListedMismatches = 10
+
+// A VerifyAfterError is returned by RunPatcher when files don't match the instructions after the update, see
+// PatcherConfig.VerifyAfter.
+type VerifyAfterError struct {
+	// The install dir.
+	Dir string
+	// The files that don't match, sorted by filename. Expected is the checksum from the instructions.
+	Mismatches []SelfCheckMismatch
+}
+
+// Error implements (error).Error
+func (e *VerifyAfterError) Error() string {
+	names := make([]string, 0, maxListedMismatches)
+	for _, m := range e.Mismatches[:min(len(e.Mismatches), maxListedMismatches)] {
+		names = append(names, m.Filename)
+	}
+	more := ""
+	if len(e.Mismatches) > maxListedMismatches {
+		more = fmt.Sprintf(" and %d more", len(e.Mismatches)-maxListedMismatches)
+	}
+	return fmt.Sprintf("%d files in '%s' don't match the instructions after the update: %s%s",
+		len(e.Mismatches), e.Dir, strings.Join(names, ", "), more)
+}
+
+// verifyAfter computes the checksums of all files in the instructions again, without trusting the manifest, and
+// returns a VerifyAfterError if any of them doesn't match. The checksums found for those files are written to the
+// manifest, so the next run repairs them.
+func verifyAfter(ctx context.Context, instructions []Instruction, manifest *Manifest, config PatcherConfig) error {
+	toCheck := make([]selfCheckFile, 0, len(instructions))
+	for _, instr := range instructions {
+		if instr.NewHash != nil {
+			toCheck = append(toCheck, selfCheckFile{config.Product, instr.Path, *instr.NewHash})
+		}
+	}
+	sort.Slice(toCheck, func(i, j int) bool { return toCheck[i].filename < toCheck[j].filename })
+
+	log.Printf("Verifying all %d files in '%s' again.", len(toCheck), config.InstallDir)
+	mismatches, err := checkFiles(ctx, config.InstallDir, toCheck, config.VerifyWorkers)
+	if err != nil {
+		return err
+	}
+	if len(mismatches) == 0 {
+		log.Printf("All files match the instructions.")
+		return nil
+	}
+	for _, m := range mismatches {
+		realFilename := filepath.Join(config.InstallDir, m.Filename)
+		switch {
+		case m.Unreadable():
+			log.Printf("Verification after update: %s.", m.Err)
+		case m.Actual == "":
+			log.Printf("Verification after update: '%s' is missing.", realFilename)
+		default:
+			log.Printf("Verification after update: '%s' has checksum %s, expected %s.", realFilename,
+				strings.ToUpper(m.Actual), strings.ToUpper(m.Expected))
+			if fileInfo, err := os.Stat(realFilename); err == nil {
+				manifest.Add(m.Filename, fileInfo.ModTime(), m.Actual)
+			}
+		}
+	}
+	if err := config.manifestStore().Write(config.InstallDir, manifest); err != nil {
+		return err
+	}
+	return &VerifyAfterError{Dir: config.InstallDir, Mismatches: mismatches}
+}
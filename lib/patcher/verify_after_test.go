@@ -0,0 +1,57 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyAfter(t *testing.T) {
+	installDir := t.TempDir()
+	good := []byte("good")
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "good"), good, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "bad"), []byte("corrupted"), 0644))
+	instructions := []Instruction{
+		{Path: "good", NewHash: someStr(HashBytes(good)), CompressedHash: someStr("abc")},
+		{Path: "bad", NewHash: someStr(HashBytes([]byte("bad"))), CompressedHash: someStr("abc")},
+		{Path: "missing", NewHash: someStr(HashBytes([]byte("missing"))), CompressedHash: someStr("abc")},
+		{Path: "deleted"},
+	}
+	// The manifest thinks everything is fine, that's ignored.
+	manifest := NewManifest("foo")
+	info, err := os.Stat(filepath.Join(installDir, "bad"))
+	require.NoError(t, err)
+	manifest.Add("bad", info.ModTime(), HashBytes([]byte("bad")))
+	config := PatcherConfig{InstallDir: installDir, Product: "foo", VerifyWorkers: 2}
+
+	err = verifyAfter(context.Background(), instructions, manifest, config)
+	var verifyErr *VerifyAfterError
+	require.ErrorAs(t, err, &verifyErr)
+	require.Equal(t, []SelfCheckMismatch{
+		{Product: "foo", Filename: "bad", Expected: HashBytes([]byte("bad")), Actual: HashBytes([]byte("corrupted"))},
+		{Product: "foo", Filename: "missing", Expected: HashBytes([]byte("missing"))},
+	}, verifyErr.Mismatches)
+	require.ErrorContains(t, err, "2 files in")
+	require.ErrorContains(t, err, "don't match the instructions after the update: bad, missing")
+
+	// The manifest now has the real checksum, so the next run patches the file.
+	written, err := ReadManifest(installDir, "foo")
+	require.NoError(t, err)
+	require.True(t, written.Check("bad", info.ModTime(), HashBytes([]byte("corrupted"))))
+
+	// Without mismatches nothing happens.
+	require.NoError(t, verifyAfter(context.Background(), instructions[:1], manifest, config))
+}
+
+func TestVerifyAfterErrorMessage(t *testing.T) {
+	err := &VerifyAfterError{Dir: "game"}
+	for i := 0; i < 12; i++ {
+		err.Mismatches = append(err.Mismatches, SelfCheckMismatch{Filename: fmt.Sprintf("f%02d", i)})
+	}
+	require.Equal(t, "12 files in 'game' don't match the instructions after the update: "+
+		"f00, f01, f02, f03, f04, f05, f06, f07, f08, f09 and 2 more", err.Error())
+}
@@ -0,0 +1,134 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A PatchMismatch is a staged patch file whose checksum doesn't match the instructions.
+type PatchMismatch struct {
+	// Path of the patch file relative to the install dir, e.g. "patch/<hash>".
+	Path string
+
+	// Checksum according to the instructions.
+	Expected string
+
+	// Checksum of the patch file.
+	Actual string
+
+	// Whether the patch file is smaller than it should be, e.g. because its download was interrupted.
+	Incomplete bool
+}
+
+// stagedPatch is a patch file to check in VerifyStagedPatches.
+type stagedPatch struct {
+	path     string
+	checksum string
+	size     int64
+	// Whether this is the .part file of an unfinished download, which RunApply can't use even if complete.
+	unfinished bool
+}
+
+// VerifyStagedPatches computes the checksums of the patch files staged in the patch dir of the install dir
+// (e.g. by RunDownload, to be applied later with RunApply) and returns the ones that don't match the
+// instructions, sorted by path, along with the number of patch files checked. Patch files are checked by
+// numWorkers workers at the same time. Unfinished downloads (.part files) are always reported as incomplete.
+// Files in the patch dir that aren't patches for the instructions are ignored.
+func VerifyStagedPatches(
+	ctx context.Context,
+	installDir string,
+	instructions []Instruction,
+	numWorkers int,
+) ([]PatchMismatch, int, error) {
+	if err := checkNumWorkers("number of workers", numWorkers); err != nil {
+		return nil, 0, err
+	}
+	// Same naming scheme as in DetermineActions.
+	expected := make(map[string]stagedPatch)
+	for _, instr := range instructions {
+		if instr.NewHash == nil || instr.CompressedHash == nil {
+			continue
+		}
+		fullPath := path.Join("patch", *instr.NewHash)
+		expected[fullPath] = stagedPatch{path: fullPath, checksum: *instr.CompressedHash, size: instr.FullReplaceSize}
+		if instr.DeltaHash != nil {
+			deltaPath := path.Join("patch", fmt.Sprintf("%s_from_%s", *instr.NewHash, instr.OldHash))
+			expected[deltaPath] = stagedPatch{path: deltaPath, checksum: *instr.DeltaHash, size: instr.DeltaSize}
+		}
+	}
+
+	patchDir := filepath.Join(installDir, "patch")
+	entries, err := os.ReadDir(patchDir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("couldn't list patch dir '%s': %w", patchDir, err)
+	}
+	toCheck := make([]stagedPatch, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name, unfinished := strings.CutSuffix(entry.Name(), ".part")
+		sp, found := expected[path.Join("patch", name)]
+		if unfinished {
+			sp.path = partFilename(sp.path)
+			sp.unfinished = true
+		}
+		if !found {
+			LogVerbose(ctx, "Ignoring '%s', it's not a patch for these instructions.",
+				filepath.Join(patchDir, entry.Name()))
+			continue
+		}
+		toCheck = append(toCheck, sp)
+	}
+	sort.Slice(toCheck, func(i, j int) bool { return toCheck[i].path < toCheck[j].path })
+
+	log.Printf("Computing checksums of %d patch files in '%s'.", len(toCheck), patchDir)
+	results, err := DoInParallelWithResult[stagedPatch, *PatchMismatch](
+		ctx,
+		func(ctx context.Context, sp stagedPatch) (*PatchMismatch, error) {
+			patchPath := filepath.Join(installDir, sp.path)
+			LogVerbose(ctx, "Verifying checksum of patch file '%s'.", patchPath)
+			file, err := os.Open(patchPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open patch file '%s' to verify checksum: %w", patchPath, err)
+			}
+			defer file.Close()
+			info, err := file.Stat()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get basic metadata of patch file '%s': %w", patchPath, err)
+			}
+			checksum, err := hasher(ctx).HashReader(ctx, file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compute checksum of patch file '%s': %w", patchPath, err)
+			}
+			if !sp.unfinished && HashEqual(checksum, sp.checksum) {
+				return nil, nil
+			}
+			return &PatchMismatch{
+				Path:       sp.path,
+				Expected:   sp.checksum,
+				Actual:     checksum,
+				Incomplete: sp.unfinished || info.Size() < sp.size,
+			}, nil
+		},
+		toCheck,
+		numWorkers,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	mismatches := make([]PatchMismatch, 0)
+	for _, m := range results {
+		if m != nil {
+			mismatches = append(mismatches, *m)
+		}
+	}
+	return mismatches, len(toCheck), nil
+}
@@ -0,0 +1,50 @@
+package patcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyStagedPatches(t *testing.T) {
+	installDir := t.TempDir()
+	patchDir := filepath.Join(installDir, "patch")
+	require.NoError(t, os.MkdirAll(filepath.Join(patchDir, "apply"), 0755))
+	full := []byte("full patch")
+	delta := []byte("delta patch")
+	instructions := []Instruction{
+		{Path: "a", NewHash: someStr("n1"), CompressedHash: someStr(HashBytes(full)),
+			FullReplaceSize: int64(len(full))},
+		{Path: "b", NewHash: someStr("n2"), OldHash: "o2", CompressedHash: someStr("c2"), FullReplaceSize: 100,
+			DeltaHash: someStr(HashBytes(delta)), DeltaSize: int64(len(delta))},
+		{Path: "c", NewHash: someStr("n3"), CompressedHash: someStr(HashBytes(full)),
+			FullReplaceSize: int64(len(full))},
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(patchDir, "n1"), full, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(patchDir, "n2_from_o2"), delta, 0644))
+	// Interrupted download.
+	require.NoError(t, os.WriteFile(filepath.Join(patchDir, "n2"), []byte("partial"), 0644))
+	// Unfinished download, even though it happens to be complete.
+	require.NoError(t, os.WriteFile(filepath.Join(patchDir, "n1.part"), full, 0644))
+	// Corrupted.
+	require.NoError(t, os.WriteFile(filepath.Join(patchDir, "n3"), []byte("corrupted!"), 0644))
+	// Not a patch for these instructions.
+	require.NoError(t, os.WriteFile(filepath.Join(patchDir, "other"), []byte("other"), 0644))
+
+	mismatches, checked, err := VerifyStagedPatches(context.Background(), installDir, instructions, 2)
+	require.NoError(t, err)
+	require.Equal(t, 5, checked)
+	require.Equal(t, []PatchMismatch{
+		{Path: "patch/n1.part", Expected: HashBytes(full), Actual: HashBytes(full), Incomplete: true},
+		{Path: "patch/n2", Expected: "c2", Actual: HashBytes([]byte("partial")), Incomplete: true},
+		{Path: "patch/n3", Expected: HashBytes(full), Actual: HashBytes([]byte("corrupted!"))},
+	}, mismatches)
+}
+
+func TestVerifyStagedPatchesNoPatchDir(t *testing.T) {
+	_, _, err := VerifyStagedPatches(context.Background(), t.TempDir(), nil, 2)
+	require.ErrorContains(t, err, "couldn't list patch dir")
+}
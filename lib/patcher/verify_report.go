@@ -0,0 +1,92 @@
+package patcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A VerifyReport is the state of every file of a game in an install dir, see VerifyInstall. All lists are
+// sorted and contain paths relative to the install dir.
+type VerifyReport struct {
+	// Files that match the instructions.
+	UpToDate []string
+	// Files that exist but don't match the instructions.
+	Mismatched []string
+	// Files in the instructions that don't exist.
+	Missing []string
+	// Files the instructions say should be deleted but still exist.
+	Obsolete []string
+	// Paths that couldn't be read while scanning, see PatcherConfig.SkipScanErrors.
+	SkippedScanPaths []string
+}
+
+// OutOfDate returns whether an update would change anything.
+func (r *VerifyReport) OutOfDate() bool {
+	return len(r.Mismatched) > 0 || len(r.Missing) > 0 || len(r.Obsolete) > 0
+}
+
+// VerifyInstall runs the verify phase (see RunVerify) and reports which files are up to date, which need to be
+// updated and which need to be deleted, without downloading or changing anything. Checksums are computed
+// where the manifest doesn't have them, pass a new manifest (see NewManifest) to compute all of them. The
+// manifest isn't written.
+//
+// Unlike an update this doesn't fail when most of the install dir would be deleted, those files are reported as
+// obsolete.
+func VerifyInstall(
+	ctx context.Context,
+	instructions []Instruction,
+	manifest *Manifest,
+	config PatcherConfig,
+	progress *ProgressTracker,
+) (*VerifyReport, error) {
+	config.AllowMassDelete = true
+	actions, err := RunVerify(ctx, instructions, manifest, config, progress)
+	if err != nil {
+		return nil, err
+	}
+	return newVerifyReport(config.InstallDir, instructions, actions)
+}
+
+// newVerifyReport sorts the files in the instructions by the actions determined for them.
+func newVerifyReport(installDir string, instructions []Instruction, actions *DeterminedActions) (*VerifyReport, error) {
+	toUpdate := make(map[string]bool, len(actions.ToUpdate))
+	for _, ui := range actions.ToUpdate {
+		toUpdate[ui.FilePath] = true
+	}
+	report := &VerifyReport{
+		UpToDate:         []string{},
+		Mismatched:       []string{},
+		Missing:          []string{},
+		Obsolete:         append([]string{}, actions.ToDelete...),
+		SkippedScanPaths: append([]string{}, actions.SkippedScanPaths...),
+	}
+	for _, instr := range instructions {
+		if instr.NewHash == nil {
+			continue
+		}
+		if !toUpdate[instr.Path] {
+			report.UpToDate = append(report.UpToDate, instr.Path)
+			continue
+		}
+		realPath := filepath.Join(installDir, instr.Path)
+		_, err := os.Lstat(realPath)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			report.Missing = append(report.Missing, instr.Path)
+		case err != nil:
+			return nil, fmt.Errorf("failed to get basic metadata of '%s': %w", realPath, err)
+		default:
+			report.Mismatched = append(report.Mismatched, instr.Path)
+		}
+	}
+	for _, list := range [][]string{report.UpToDate, report.Mismatched, report.Missing, report.Obsolete,
+		report.SkippedScanPaths} {
+		sort.Strings(list)
+	}
+	return report, nil
+}
@@ -0,0 +1,47 @@
+package patcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyInstall(t *testing.T) {
+	installDir := t.TempDir()
+	good := []byte("good")
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "good"), good, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "bad"), []byte("corrupted"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(installDir, "deleted"), []byte("old"), 0644))
+	instructions := []Instruction{
+		{Path: "good", NewHash: someStr(HashBytes(good)), CompressedHash: someStr("abc"), FullReplaceSize: 3},
+		{Path: "bad", NewHash: someStr(HashBytes([]byte("bad"))), CompressedHash: someStr("abc"), FullReplaceSize: 3},
+		{Path: "missing", NewHash: someStr(HashBytes([]byte("missing"))), CompressedHash: someStr("abc"),
+			FullReplaceSize: 3},
+		{Path: "deleted"},
+		{Path: "already_deleted"},
+	}
+	// Every file would be deleted or updated, that's reported rather than refused.
+	config := PatcherConfig{InstallDir: installDir, VerifyWorkers: 2, MaxDeleteRatio: 0.1}
+	report, err := VerifyInstall(context.Background(), instructions, NewManifest("foo"), config, nil)
+	require.NoError(t, err)
+	require.Equal(t, &VerifyReport{
+		UpToDate:         []string{"good"},
+		Mismatched:       []string{"bad"},
+		Missing:          []string{"missing"},
+		Obsolete:         []string{"deleted"},
+		SkippedScanPaths: []string{},
+	}, report)
+	require.True(t, report.OutOfDate())
+	// Nothing was changed.
+	_, err = os.Stat(filepath.Join(installDir, "deleted"))
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(installDir, "patch"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	report, err = VerifyInstall(context.Background(), instructions[:1], NewManifest("foo"), config, nil)
+	require.NoError(t, err)
+	require.False(t, report.OutOfDate())
+}
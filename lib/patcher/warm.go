@@ -0,0 +1,145 @@
+package patcher
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A WarmConfig is the configuration for WarmPatchUrls.
+type WarmConfig struct {
+	// How many requests to send at the same time.
+	Workers int
+
+	// How long to wait for a response to a single request.
+	RequestTimeout time.Duration
+
+	// If true a GET of the first byte is sent instead of a HEAD request, for caches that don't fetch a file
+	// on a HEAD request.
+	RangeGet bool
+}
+
+// A WarmResult is the outcome of probing the URL of a patch file, see WarmPatchUrls.
+type WarmResult struct {
+	// The probed URL.
+	Url *url.URL
+
+	// HTTP status code of the response, 0 if there was no response.
+	StatusCode int
+
+	// Size of the patch file according to the instructions.
+	ExpectedSize int64
+
+	// Size of the patch file according to the response, -1 if the response didn't say.
+	Size int64
+
+	// Why there was no response, nil if there was one.
+	Err error
+}
+
+// Ok returns whether the server had the patch file.
+func (r WarmResult) Ok() bool {
+	return r.Err == nil && r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// WrongSize returns whether the server had the patch file but with a different size than expected. If the
+// server didn't report a size (or the instructions don't have one) the size isn't considered wrong.
+func (r WarmResult) WrongSize() bool {
+	return r.Ok() && r.Size >= 0 && r.ExpectedSize > 0 && r.Size != r.ExpectedSize
+}
+
+// WarmPatchUrls requests the patch files of toDownload (as returned by DetermineActions or RunVerify) from
+// baseUrl without downloading them, so caches between the server and the patcher (e.g. a CDN) fetch them
+// ahead of an update. Returns a result for every patch file, in the order of toDownload. A failed request
+// doesn't stop the others, it's reported in its result; only cancellation is returned as an error.
+func WarmPatchUrls(
+	ctx context.Context,
+	baseUrl *url.URL,
+	toDownload []DownloadInstr,
+	config WarmConfig,
+) ([]WarmResult, error) {
+	if err := checkNumWorkers("number of workers", config.Workers); err != nil {
+		return nil, err
+	}
+	return DoInParallelWithResult[DownloadInstr, WarmResult](
+		ctx,
+		func(ctx context.Context, di DownloadInstr) (WarmResult, error) {
+			remoteUrl := baseUrl.JoinPath(di.RemotePath)
+			LogVerbose(ctx, "Warming '%s'.", remoteUrl)
+			statusCode, size, err := warmUrl(ctx, remoteUrl, config)
+			if ctx.Err() != nil {
+				return WarmResult{}, ctx.Err()
+			}
+			return WarmResult{
+				Url:          remoteUrl,
+				StatusCode:   statusCode,
+				ExpectedSize: di.Size,
+				Size:         size,
+				Err:          err,
+			}, nil
+		},
+		toDownload,
+		config.Workers,
+	)
+}
+
+// warmUrl sends a single warming request and returns the status code of the response and the size of the
+// file according to the response (-1 if unknown).
+func warmUrl(ctx context.Context, remoteUrl *url.URL, config WarmConfig) (int, int64, error) {
+	if config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.RequestTimeout)
+		defer cancel()
+	}
+	method := http.MethodHead
+	if config.RangeGet {
+		method = http.MethodGet
+	}
+	what := fmt.Sprintf("'%s'", remoteUrl)
+	resp, err := sendWithToken(ctx, requestTokens(ctx), what, func(token string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, remoteUrl.String(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create request for '%s': %w", remoteUrl, err)
+		}
+		setRequestHeaders(req, requestHeaders(ctx))
+		setAuthorization(req, token)
+		if config.RangeGet {
+			req.Header.Set("Range", "bytes=0-0")
+		}
+		resp, err := httpClient(ctx).Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("request for '%s' failed: %w", remoteUrl, err)
+		}
+		return resp, nil
+	})
+	if err != nil {
+		return 0, -1, err
+	}
+	defer resp.Body.Close()
+	// Only read the requested byte, a server ignoring the range would send the whole file.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1))
+	return resp.StatusCode, responseFileSize(resp), nil
+}
+
+// responseFileSize returns the size of the whole file a response is for, -1 if the response doesn't say.
+// For a range response that's the total in Content-Range ("bytes 0-0/1234"), otherwise the content length.
+func responseFileSize(resp *http.Response) int64 {
+	if resp.StatusCode == http.StatusPartialContent {
+		contentRange := resp.Header.Get("Content-Range")
+		_, total, found := strings.Cut(contentRange, "/")
+		if !found {
+			return -1
+		}
+		size, err := strconv.ParseInt(total, 10, 64)
+		if err != nil {
+			return -1 // E.g. "*" for an unknown size.
+		}
+		return size
+	}
+	return resp.ContentLength
+}
@@ -0,0 +1,67 @@
+package patcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarmPatchUrls(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path] = r.Method + " " + r.Header.Get("Range")
+		mu.Unlock()
+		if r.URL.Path == "/game/full/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			w.Header().Set("Content-Range", "bytes 0-0/1")
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		_, _ = w.Write([]byte("x"))
+	}))
+	defer server.Close()
+	baseUrl, err := url.Parse(server.URL + "/game")
+	require.NoError(t, err)
+	toDownload := []DownloadInstr{
+		{RemotePath: "full/a", LocalPath: "patch/a", Size: 1},
+		{RemotePath: "full/missing", LocalPath: "patch/missing"},
+		{RemotePath: "delta/b_from_c", LocalPath: "patch/b_from_c", Size: 2},
+	}
+
+	results, err := WarmPatchUrls(context.Background(), baseUrl, toDownload, WarmConfig{Workers: 2})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	require.Equal(t, server.URL+"/game/full/a", results[0].Url.String())
+	require.True(t, results[0].Ok())
+	require.Equal(t, int64(1), results[0].Size)
+	require.False(t, results[0].WrongSize())
+	require.False(t, results[1].Ok())
+	require.Equal(t, http.StatusNotFound, results[1].StatusCode)
+	require.False(t, results[1].WrongSize())
+	require.True(t, results[2].Ok())
+	require.True(t, results[2].WrongSize())
+	require.Equal(t, "HEAD ", requests["/game/full/a"])
+
+	results, err = WarmPatchUrls(context.Background(), baseUrl, toDownload[:1], WarmConfig{Workers: 1, RangeGet: true})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusPartialContent, results[0].StatusCode)
+	require.Equal(t, int64(1), results[0].Size)
+	require.False(t, results[0].WrongSize())
+	require.Equal(t, "GET bytes=0-0", requests["/game/full/a"])
+
+	// No server at all is reported per URL.
+	server.Close()
+	results, err = WarmPatchUrls(context.Background(), baseUrl, toDownload[:1], WarmConfig{Workers: 1})
+	require.NoError(t, err)
+	require.Error(t, results[0].Err)
+	require.False(t, results[0].Ok())
+}
@@ -2,45 +2,190 @@ package patcher
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"os/exec"
-	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+)
+
+// minXDeltaVersion is the oldest xdelta version known to apply the patches correctly.
+var minXDeltaVersion = []int{3, 0, 11}
+
+// How long 'xdelta3 -V' may take. If it takes longer the binary can't be checked.
+const xdeltaCheckTimeout = 10 * time.Second
+
+// xdeltaVersionRe matches the version in the output of 'xdelta3 -V'.
+var xdeltaVersionRe = regexp.MustCompile(`(?i)xdelta version (\d+(?:\.\d+)*)`)
+
+// Source window sizes for XDelta.SourceWindow. xdelta caches up to this much of the old file in memory while
+// applying a delta patch, reading blocks from disk again when they've been evicted from the cache. A smaller
+// window uses less memory but can make applying patches of large files much slower, as the same parts of the
+// old file may be read many times. Each concurrent patch application uses its own window.
+const (
+	// The window used by the Vue/Electron launcher, fastest for large files.
+	DefaultXDeltaSourceWindow int64 = 512 * 1024 * 1024
+
+	// For machines with a few GiB of memory.
+	LowMemoryXDeltaSourceWindow int64 = 64 * 1024 * 1024
+
+	// For machines with barely any memory to spare, expect applying large delta patches to be slow.
+	MinimalXDeltaSourceWindow int64 = 16 * 1024 * 1024
 )
 
 // An XDelta instance provides helpers for invoking the xdelta program.
 type XDelta struct {
 	// Path to the binary.
 	binPath string
+
+	// Version reported by the binary, empty if it couldn't be determined.
+	version string
+
+	// If true ApplyPatch leaves the (partial) output file in place when it fails. Useful for debugging.
+	KeepTemp bool
+
+	// Size in bytes of xdelta's source window (its '-B' option), 0 for DefaultXDeltaSourceWindow.
+	SourceWindow int64
 }
 
 // Create an XDelta instance.
 //
 // If the binPath is just a basename without directory it will be looked up in PATH.
 // To use binary in the current directory use something like './xdelta3'.
+//
+// The version of the binary is logged, with a warning if it's older than the minimum known to work.
+// If the binary is clearly some other program (its '-V' output doesn't mention xdelta) that's an error,
+// otherwise failing to determine the version is not an error.
 func NewXDelta(binPath string) (*XDelta, error) {
-	if dir, _ := filepath.Split(binPath); dir == "" {
-		realPath, err := exec.LookPath(binPath)
+	realPath, err := findBinary(binPath)
+	if err != nil {
+		return nil, err
+	}
+	version, err := detectXDeltaVersion(realPath)
+	var notXDelta *notXDeltaError
+	if errors.As(err, &notXDelta) {
+		return nil, err
+	} else if err != nil {
+		log.Printf("Failed to determine version of xdelta '%s': %s", realPath, err)
+	} else if !xdeltaVersionOk(version) {
+		log.Printf("Warning: xdelta '%s' has version %s, older than %s which is the minimum known to work",
+			realPath, version, formatVersion(minXDeltaVersion))
+	} else {
+		log.Printf("Using xdelta '%s' version %s", realPath, version)
+	}
+	return &XDelta{binPath: realPath, version: version}, nil
+}
+
+// Version returns the version reported by the xdelta binary, or an empty string if unknown.
+func (x XDelta) Version() string {
+	return x.version
+}
+
+// A notXDeltaError means the configured xdelta binary is some other program, e.g. a different tool or a
+// script. Applying patches with it would fail with baffling errors.
+type notXDeltaError struct {
+	binPath string
+	reason  string
+}
+
+// Error implements (error).Error
+func (e *notXDeltaError) Error() string {
+	return fmt.Sprintf("configured xdelta binary '%s' doesn't appear to be xdelta3: %s", e.binPath, e.reason)
+}
+
+// detectXDeltaVersion runs 'xdelta3 -V' and extracts the version. Returns a *notXDeltaError if the binary
+// can't be run or its output doesn't mention xdelta.
+func detectXDeltaVersion(binPath string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), xdeltaCheckTimeout)
+	defer cancel()
+	// Depending on the version it prints to stdout or stderr.
+	output, err := exec.CommandContext(ctx, binPath, "-V").CombinedOutput()
+	if ctx.Err() != nil {
+		// Slow, but that doesn't say what it is.
+		return "", fmt.Errorf("running '%s -V' took longer than %s", binPath, xdeltaCheckTimeout)
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return "", &notXDeltaError{binPath: binPath, reason: fmt.Sprintf("couldn't run it: %s", err)}
+	}
+	if !strings.Contains(strings.ToLower(string(output)), "xdelta") {
+		printed := strings.TrimSpace(string(output))
+		if len(printed) > 200 {
+			printed = printed[:200] + "..."
+		}
+		return "", &notXDeltaError{binPath: binPath, reason: fmt.Sprintf("'-V' printed %q", printed)}
+	}
+	if err != nil {
+		return "", fmt.Errorf("running '%s -V' failed: %w", binPath, err)
+	}
+	return parseXDeltaVersion(string(output))
+}
+
+// parseXDeltaVersion extracts the version from the output of 'xdelta3 -V'.
+func parseXDeltaVersion(output string) (string, error) {
+	match := xdeltaVersionRe.FindStringSubmatch(output)
+	if match == nil {
+		return "", fmt.Errorf("no version found in output: %s", strings.TrimSpace(output))
+	}
+	return match[1], nil
+}
+
+// xdeltaVersionOk checks whether a version (as returned by parseXDeltaVersion) is at least minXDeltaVersion.
+func xdeltaVersionOk(version string) bool {
+	for i, part := range strings.Split(version, ".") {
+		if i >= len(minXDeltaVersion) {
+			break
+		}
+		n, err := strconv.Atoi(part)
 		if err != nil {
-			return nil, fmt.Errorf("failed to find '%s' in PATH: %w", binPath, err)
+			return false
 		}
-		return &XDelta{binPath: realPath}, nil
+		if n != minXDeltaVersion[i] {
+			return n > minXDeltaVersion[i]
+		}
+	}
+	// Shorter versions like "3.0" count as 3.0.0.
+	return len(strings.Split(version, ".")) >= len(minXDeltaVersion)
+}
+
+func formatVersion(version []int) string {
+	parts := make([]string, len(version))
+	for i, n := range version {
+		parts[i] = strconv.Itoa(n)
 	}
-	if _, err := os.Stat(binPath); err != nil {
-		return nil, fmt.Errorf("failed to find '%s': %w", binPath, err)
+	return strings.Join(parts, ".")
+}
+
+// versionNote describes the xdelta version, for adding to error messages.
+func (x XDelta) versionNote() string {
+	if x.version == "" {
+		return "xdelta version unknown"
+	}
+	if !xdeltaVersionOk(x.version) {
+		return fmt.Sprintf("xdelta version %s is older than %s, the minimum known to work; try a newer xdelta",
+			x.version, formatVersion(minXDeltaVersion))
+	}
+	return fmt.Sprintf("xdelta version %s", x.version)
+}
+
+// sourceWindow returns the source window size to pass to xdelta.
+func (x XDelta) sourceWindow() int64 {
+	if x.SourceWindow <= 0 {
+		return DefaultXDeltaSourceWindow
 	}
-	return &XDelta{
-		binPath: binPath,
-	}, nil
+	return x.SourceWindow
 }
 
 // ApplyPatch runs the xdelta binary, outputting to newPath, validating the checksum at the same time.
 // If oldPath is not nil it's a delta patch, otherwise it's a full patch.
+//
+// On failure the output file is removed (unless KeepTemp is set), so that an xdelta that got killed
+// or produced garbage doesn't leave a partial file behind.
 func (x XDelta) ApplyPatch(
 	ctx context.Context,
 	oldPath *string,
@@ -53,66 +198,88 @@ func (x XDelta) ApplyPatch(
 	// we don't have to read the file later.
 	var cmd *exec.Cmd
 	var what string
+	sourceWindow := strconv.FormatInt(x.sourceWindow(), 10)
 	if oldPath == nil {
 		// Decompress, source window <num>, force overwrite, write to stdout.
-		// Source window number is copied from Vue/Electron launcher.
-		cmd = exec.CommandContext(ctx, x.binPath, "-d", "-B", "536870912", "-f", "-c", patchPath)
+		cmd = exec.CommandContext(ctx, x.binPath, "-d", "-B", sourceWindow, "-f", "-c", patchPath)
 		what = fmt.Sprintf("applying full patch '%s' to get '%s'", patchPath, newPath)
 	} else {
 		// Decompress, source window <num>, force overwrite, write to stdout, source file to copy from (oldPath).
-		cmd = exec.CommandContext(ctx, x.binPath, "-d", "-B", "536870912", "-f", "-c", "-s", *oldPath, patchPath)
-		what = "delta patch"
+		cmd = exec.CommandContext(ctx, x.binPath, "-d", "-B", sourceWindow, "-f", "-c", "-s", *oldPath, patchPath)
 		what = fmt.Sprintf("applying delta patch '%s' to '%s' to get '%s'", patchPath, *oldPath, newPath)
 	}
+	return x.run(ctx, cmd, what, newPath, expectedChecksum, expectedSize)
+}
+
+// ApplyFullPatchStream implements (StreamingPatchBackend).ApplyFullPatchStream. The patch is passed to
+// xdelta on stdin.
+func (x XDelta) ApplyFullPatchStream(
+	ctx context.Context,
+	patch io.Reader,
+	patchName string,
+	newPath string,
+	expectedChecksum string,
+	expectedSize int64,
+) error {
+	// Decompress, source window <num>, force overwrite, write to stdout, read the patch from stdin.
+	cmd := exec.CommandContext(ctx, x.binPath, "-d", "-B", strconv.FormatInt(x.sourceWindow(), 10), "-f", "-c")
+	cmd.Stdin = patch
+	what := fmt.Sprintf("applying streamed full patch '%s' to get '%s'", patchName, newPath)
+	return x.run(ctx, cmd, what, newPath, expectedChecksum, expectedSize)
+}
+
+// run runs an xdelta command that writes the patched file to stdout, writing it to newPath and validating
+// the checksum at the same time.
+func (x XDelta) run(
+	ctx context.Context,
+	cmd *exec.Cmd,
+	what string,
+	newPath string,
+	expectedChecksum string,
+	expectedSize int64,
+) (retErr error) {
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return fmt.Errorf("%s failed (create stdout pipe): %w", what, err)
 	}
 
-	hash := sha256.New()
+	hash := hasher(ctx).New()
 	wrappedStdout := io.TeeReader(stdout, hash)
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("%s failed (start xdelta): %w", what, err)
 	}
 
-	var file *os.File
-	if expectedSize > 0 {
-		file, err = CreateWithSizeHint(newPath, expectedSize)
-		if err != nil {
-			log.Printf(
-				"Creating '%s' for writing with preallocation for size %d failed, falling back to plain open: %s",
-				newPath, expectedSize, err)
-			// There's one weird edge case here, if the fallback implementation (OS is not Windows and not Linux)
-			// is used os.Create is already the entire fallback so it boils down to os.Create then try os.Create.
-			// Because both the Windows and Linux preallocation implementation open a file for writing it's possible
-			// for those that there are two errors from os.Create (or windows.CreateFile) as well.
-			file, err = os.Create(newPath)
+	// Registered before the deferred file.Close so it runs after it, Windows can't remove open files.
+	createdFile := false
+	defer func() {
+		if retErr != nil && createdFile && !x.KeepTemp {
+			removePartialOutput(newPath)
 		}
-	} else {
-		file, err = os.Create(newPath)
-	}
+	}()
+
+	file, err := createOutputFile(ctx, newPath, expectedSize)
 	if err != nil {
 		return fmt.Errorf("%s failed (create file): %w", what, err)
 	}
+	createdFile = true
 	defer file.Close()
 
-	_, err = io.Copy(file, wrappedStdout)
+	_, err = copyBuffered(file, wrappedStdout, copyBufferSize(ctx))
 	if err != nil {
 		return fmt.Errorf("%s failed (write file): %w", what, err)
 	}
 
 	if err := cmd.Wait(); err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
-			return fmt.Errorf("%s failed: %w; xdelta said: %s",
-				what, err, string(exitErr.Stderr))
+			return fmt.Errorf("%s failed: %w; xdelta said: %s (%s)",
+				what, err, string(exitErr.Stderr), x.versionNote())
 		}
-		return fmt.Errorf("%s failed: %w", what, err)
+		return fmt.Errorf("%s failed: %w (%s)", what, err, x.versionNote())
 	}
 
 	checksum := hex.EncodeToString(hash.Sum(nil))
 	if !HashEqual(checksum, expectedChecksum) {
-		return fmt.Errorf("%s failed: expected it to produce file with checksum %s but got %s",
-			what, strings.ToUpper(expectedChecksum), strings.ToUpper(checksum))
+		return fmt.Errorf("%w (%s)", checksumMismatchError(what, expectedChecksum, checksum), x.versionNote())
 	}
 
 	return nil
@@ -0,0 +1,112 @@
+package patcher
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A GoXDelta applies xdelta3 patches in-process, without needing the xdelta binary.
+//
+// The built-in decoder doesn't support everything xdelta3 can produce (notably secondary compression).
+// Such patches are passed to Fallback if set.
+type GoXDelta struct {
+	// Used for patches the built-in decoder can't handle. May be nil.
+	Fallback PatchBackend
+
+	// If true ApplyPatch leaves the (partial) output file in place when it fails. Useful for debugging.
+	KeepTemp bool
+}
+
+// ApplyPatch decodes the patch, outputting to newPath, validating the checksum at the same time.
+// If oldPath is not nil it's a delta patch, otherwise it's a full patch.
+//
+// On failure the output file is removed (unless KeepTemp is set).
+func (g GoXDelta) ApplyPatch(
+	ctx context.Context,
+	oldPath *string,
+	patchPath string,
+	newPath string,
+	expectedChecksum string,
+	expectedSize int64,
+) error {
+	err := g.applyPatch(ctx, oldPath, patchPath, newPath, expectedChecksum, expectedSize)
+	if errors.Is(err, errVCDiffUnsupported) && g.Fallback != nil {
+		LogVerbose(ctx, "Built-in xdelta decoder can't apply '%s', using fallback: %s", patchPath, err)
+		return g.Fallback.ApplyPatch(ctx, oldPath, patchPath, newPath, expectedChecksum, expectedSize)
+	}
+	return err
+}
+
+func (g GoXDelta) applyPatch(
+	ctx context.Context,
+	oldPath *string,
+	patchPath string,
+	newPath string,
+	expectedChecksum string,
+	expectedSize int64,
+) (retErr error) {
+	var what string
+	var source io.ReaderAt
+	if oldPath == nil {
+		what = fmt.Sprintf("applying full patch '%s' to get '%s'", patchPath, newPath)
+	} else {
+		what = fmt.Sprintf("applying delta patch '%s' to '%s' to get '%s'", patchPath, *oldPath, newPath)
+		sourceFile, err := os.Open(*oldPath)
+		if err != nil {
+			return fmt.Errorf("%s failed (open source): %w", what, err)
+		}
+		defer sourceFile.Close()
+		source = sourceFile
+	}
+
+	patchFile, err := os.Open(patchPath)
+	if err != nil {
+		return fmt.Errorf("%s failed (open patch): %w", what, err)
+	}
+	defer patchFile.Close()
+
+	// Registered before the deferred file.Close so it runs after it, Windows can't remove open files.
+	createdFile := false
+	defer func() {
+		// The fallback creates the file again, so an unsupported patch is always cleaned up.
+		if retErr != nil && createdFile && (!g.KeepTemp || errors.Is(retErr, errVCDiffUnsupported)) {
+			removePartialOutput(newPath)
+		}
+	}()
+
+	file, err := createOutputFile(ctx, newPath, expectedSize)
+	if err != nil {
+		return fmt.Errorf("%s failed (create file): %w", what, err)
+	}
+	createdFile = true
+	defer file.Close()
+
+	hash := hasher(ctx).New()
+	if err := decodeVCDiff(contextReader{ctx: ctx, r: patchFile}, source, io.MultiWriter(file, hash)); err != nil {
+		return fmt.Errorf("%s failed: %w", what, err)
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if !HashEqual(checksum, expectedChecksum) {
+		return checksumMismatchError(what, expectedChecksum, checksum)
+	}
+	return nil
+}
+
+// A contextReader stops reading once the context is canceled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read implements (io.Reader).Read
+func (c contextReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
@@ -0,0 +1,69 @@
+package patcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingBackend is a PatchBackend that records whether it was called.
+type recordingBackend struct {
+	called bool
+}
+
+func (r *recordingBackend) ApplyPatch(context.Context, *string, string, string, string, int64) error {
+	r.called = true
+	return nil
+}
+
+func TestGoXDeltaApplyPatch(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old")
+	patchPath := filepath.Join(dir, "patch")
+	newPath := filepath.Join(dir, "new")
+	require.NoError(t, os.WriteFile(oldPath, []byte("old data"), 0644))
+	patch := encodeTestVCDiff(testVCDWindow{
+		source:    []int{8, 0},
+		targetLen: 8,
+		data:      []byte("new "),
+		inst:      concat(vcdAddInst(4), vcdCopyInst(4, 0)),
+		addr:      appendVCDInt(nil, 4),
+	})
+	require.NoError(t, os.WriteFile(patchPath, patch, 0644))
+
+	fallback := &recordingBackend{}
+	g := GoXDelta{Fallback: fallback}
+	err := g.ApplyPatch(context.Background(), &oldPath, patchPath, newPath, HashBytes([]byte("new data")), 8)
+	require.NoError(t, err)
+	require.False(t, fallback.called)
+	data, err := os.ReadFile(newPath)
+	require.NoError(t, err)
+	require.Equal(t, "new data", string(data))
+
+	err = g.ApplyPatch(context.Background(), &oldPath, patchPath, newPath, "abc", 8)
+	require.ErrorContains(t, err, "expected it to produce file with checksum")
+	require.NoFileExists(t, newPath)
+}
+
+func TestGoXDeltaFallback(t *testing.T) {
+	dir := t.TempDir()
+	patchPath := filepath.Join(dir, "patch")
+	newPath := filepath.Join(dir, "new")
+	patch := encodeTestVCDiff(testVCDWindow{targetLen: 3, data: []byte("abc"), inst: vcdAddInst(3),
+		deltaIndicator: 1})
+	require.NoError(t, os.WriteFile(patchPath, patch, 0644))
+
+	fallback := &recordingBackend{}
+	g := GoXDelta{Fallback: fallback, KeepTemp: true}
+	require.NoError(t, g.ApplyPatch(context.Background(), nil, patchPath, newPath, "abc", 3))
+	require.True(t, fallback.called)
+	// Left over output of the built-in decoder is removed even with KeepTemp.
+	require.NoFileExists(t, newPath)
+
+	g.Fallback = nil
+	err := g.ApplyPatch(context.Background(), nil, patchPath, newPath, "abc", 3)
+	require.ErrorIs(t, err, errVCDiffUnsupported)
+}
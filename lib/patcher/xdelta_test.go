@@ -0,0 +1,126 @@
+package patcher
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBinary creates a shell script pretending to be some program. Skips the test on Windows.
+func fakeBinary(t *testing.T, name string, script string) string {
+	if runtime.GOOS == "windows" {
+		t.Skipf("fake %s is a shell script", name)
+	}
+	binPath := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(binPath, []byte("#!/bin/sh\n"+script), 0755))
+	return binPath
+}
+
+// fakeXDelta creates a shell script pretending to be xdelta. Skips the test on Windows.
+func fakeXDelta(t *testing.T, script string) string {
+	return fakeBinary(t, "xdelta3", script)
+}
+
+// fakeXDeltaVersion makes a fake xdelta answer '-V' like xdelta does.
+const fakeXDeltaVersion = "if [ \"$1\" = -V ]; then echo 'Xdelta version 3.0.11, Copyright (C)' >&2; exit 0; fi\n"
+
+func TestApplyPatchFailureRemovesOutput(t *testing.T) {
+	xdelta, err := NewXDelta(fakeXDelta(t, fakeXDeltaVersion+"echo partial\nexit 1\n"))
+	require.NoError(t, err)
+	newPath := filepath.Join(t.TempDir(), "new")
+	err = xdelta.ApplyPatch(context.Background(), nil, "patch", newPath, "abc", 0)
+	require.Error(t, err)
+	require.NoFileExists(t, newPath)
+}
+
+func TestApplyPatchFailureKeepTemp(t *testing.T) {
+	xdelta, err := NewXDelta(fakeXDelta(t, fakeXDeltaVersion+"echo partial\nexit 1\n"))
+	require.NoError(t, err)
+	xdelta.KeepTemp = true
+	newPath := filepath.Join(t.TempDir(), "new")
+	err = xdelta.ApplyPatch(context.Background(), nil, "patch", newPath, "abc", 0)
+	require.Error(t, err)
+	require.FileExists(t, newPath)
+}
+
+func TestApplyPatchSourceWindow(t *testing.T) {
+	// Writes the arguments as output, so the checksum tells whether the right ones were passed.
+	xdelta, err := NewXDelta(fakeXDelta(t, fakeXDeltaVersion+"echo \"$@\"\n"))
+	require.NoError(t, err)
+	newPath := filepath.Join(t.TempDir(), "new")
+	oldPath := "old"
+	expected := HashBytes([]byte("-d -B 536870912 -f -c -s old patch\n"))
+	require.NoError(t, xdelta.ApplyPatch(context.Background(), &oldPath, "patch", newPath, expected, 0))
+
+	xdelta.SourceWindow = LowMemoryXDeltaSourceWindow
+	expected = HashBytes([]byte("-d -B 67108864 -f -c -s old patch\n"))
+	require.NoError(t, xdelta.ApplyPatch(context.Background(), &oldPath, "patch", newPath, expected, 0))
+}
+
+func TestApplyFullPatchStream(t *testing.T) {
+	// Outputs its input, so the patch is its own result.
+	xdelta, err := NewXDelta(fakeXDelta(t, fakeXDeltaVersion+"cat\n"))
+	require.NoError(t, err)
+	newPath := filepath.Join(t.TempDir(), "new")
+	data := []byte("patched data")
+	err = xdelta.ApplyFullPatchStream(context.Background(), bytes.NewReader(data), "patch", newPath,
+		HashBytes(data), int64(len(data)))
+	require.NoError(t, err)
+	written, err := os.ReadFile(newPath)
+	require.NoError(t, err)
+	require.Equal(t, data, written)
+
+	err = xdelta.ApplyFullPatchStream(context.Background(), bytes.NewReader(data), "patch", newPath, "abc", 0)
+	require.ErrorContains(t, err, "applying streamed full patch 'patch'")
+	require.NoFileExists(t, newPath)
+}
+
+func TestParseXDeltaVersion(t *testing.T) {
+	version, err := parseXDeltaVersion("Xdelta version 3.1.0, Copyright (C) Joshua MacDonald\n")
+	require.NoError(t, err)
+	require.Equal(t, "3.1.0", version)
+	_, err = parseXDeltaVersion("usage: something else")
+	require.Error(t, err)
+}
+
+func TestXDeltaVersionOk(t *testing.T) {
+	require.True(t, xdeltaVersionOk("3.0.11"))
+	require.True(t, xdeltaVersionOk("3.1.0"))
+	require.True(t, xdeltaVersionOk("4.0.0"))
+	require.False(t, xdeltaVersionOk("3.0.8"))
+	require.False(t, xdeltaVersionOk("3.0"))
+	require.False(t, xdeltaVersionOk("1.1.3"))
+}
+
+func TestApplyPatchFailureMentionsVersion(t *testing.T) {
+	script := "if [ \"$1\" = -V ]; then echo 'Xdelta version 3.0.8, Copyright (C)' >&2; exit 0; fi\nexit 1\n"
+	xdelta, err := NewXDelta(fakeXDelta(t, script))
+	require.NoError(t, err)
+	require.Equal(t, "3.0.8", xdelta.Version())
+	err = xdelta.ApplyPatch(context.Background(), nil, "patch", filepath.Join(t.TempDir(), "new"), "abc", 0)
+	require.ErrorContains(t, err, "xdelta version 3.0.8 is older than 3.0.11")
+}
+
+func TestNewXDeltaNotXDelta(t *testing.T) {
+	_, err := NewXDelta(fakeBinary(t, "xdelta3", "echo 'usage: bspatch oldfile newfile patchfile'\nexit 1\n"))
+	require.ErrorContains(t, err, "doesn't appear to be xdelta3")
+	require.ErrorContains(t, err, "usage: bspatch")
+
+	// Not executable at all.
+	binPath := filepath.Join(t.TempDir(), "xdelta3")
+	require.NoError(t, os.WriteFile(binPath, []byte("not a program"), 0644))
+	_, err = NewXDelta(binPath)
+	require.ErrorContains(t, err, "doesn't appear to be xdelta3")
+}
+
+func TestNewXDeltaUnknownVersion(t *testing.T) {
+	// Looks like xdelta but without a version, that's not worth failing over.
+	xdelta, err := NewXDelta(fakeXDelta(t, "echo 'xdelta3: unknown option'\nexit 1\n"))
+	require.NoError(t, err)
+	require.Equal(t, "", xdelta.Version())
+}